@@ -4,8 +4,8 @@ package main
 
 import (
 	"fmt"
+	ptpc "github.com/pharmbio/ptp-project/lib/components"
 	sp "github.com/scipipe/scipipe"
-	spc "github.com/scipipe/scipipe/components"
 	"strings"
 )
 
@@ -84,17 +84,9 @@ func main() {
 	// --------------------------------
 	unPackDB.In("xzfile").Connect(dlExcapeDB.Out("excapexz"))
 
-	unPackDBFanOut := spc.NewFanOut("unpackdb_fanout")
-	unPackDBFanOut.InFile.Connect(unPackDB.Out("unxzed"))
-	wf.AddProc(unPackDBFanOut) // Oh, this is so easy to forget!!!
-
-	tableFile := "dat/compound_counts.tsv"
-	createTableFile := wf.NewProc("create_table_file", "echo 'Gene_symbol,Compound_count' > {o:table}")
-	createTableFile.SetPathStatic("table", tableFile)
-
-	createTableFanOut := spc.NewFanOut("create_table_fanout")
-	createTableFanOut.InFile.Connect(createTableFile.Out("table"))
-	wf.AddProc(createTableFanOut)
+	// Gather the counts into one table, written once all counts are done,
+	// instead of having the count tasks append to a shared file
+	compoundCounts := ptpc.NewTableGatherer(wf, "create_table", "dat/compound_counts.tsv", []string{"gene_symbol"}, "Compound_count")
 
 	// --------------------------------
 	// Count ligands in targets
@@ -103,19 +95,15 @@ func main() {
 		geneLC := strings.ToLower(gene)
 		procName := "cnt_comp_" + geneLC
 
-		countCompoundsPerTarget := wf.NewProc(procName, fmt.Sprintf(`awk -F"\t" '$9 == "%s" { SUM += 1 } END { print SUM }' {i:tsvfile} > {o:compound_count}`, gene))
+		countCompoundsPerTarget := wf.NewProc(procName, `awk -F"\t" '$9 == "{p:gene_symbol}" { SUM += 1 } END { print SUM + 0 }' {i:tsvfile} > {o:compound_count}`)
 		countCompoundsPerTarget.SetPathStatic("compound_count", "dat/compound_count_"+geneLC+".txt")
-		countCompoundsPerTarget.In("tsvfile").Connect(unPackDBFanOut.Out("to_" + procName))
+		countCompoundsPerTarget.ParamInPort("gene_symbol").ConnectStr(gene)
+		countCompoundsPerTarget.In("tsvfile").Connect(unPackDB.Out("unxzed"))
 
 		// SLURM string
 		countCompoundsPerTarget.Prepend = "salloc -A snic2017-7-89 -n 4 -t 1:00:00 -J scipipe_cnt_comp_" + geneLC + " srun "
 
-		writeToTable := wf.NewProc("write_to_table_"+geneLC, "echo \""+gene+"\t$(head -n 1 {i:cnt})\" >> {i:create_table}; touch {o:write_done}")
-		writeToTable.SetPathStatic("write_done", tableFile+".write_done_"+geneLC)
-		writeToTable.In("create_table").Connect(createTableFanOut.Out("table_" + gene))
-		writeToTable.In("cnt").Connect(countCompoundsPerTarget.Out("compound_count"))
-
-		wf.ConnectLast(writeToTable.Out("write_done"))
+		compoundCounts.InResults().Connect(countCompoundsPerTarget.Out("compound_count"))
 	}
 
 	// --------------------------------
@@ -11,6 +11,8 @@ import (
 	"strconv"
 	str "strings"
 
+	ptpc "github.com/pharmbio/ptp-project/lib/components"
+	ptpstats "github.com/pharmbio/ptp-project/lib/stats"
 	sp "github.com/scipipe/scipipe"
 	spc "github.com/scipipe/scipipe/components"
 )
@@ -429,9 +431,10 @@ func main() {
 		}
 	}
 
-	testObsFuzzDiff := wf.NewProc("test_obsfuzz_diff", "Rscript bin/test_ofdiff.r -i {i:summary} -o {o:stats}")
-	testObsFuzzDiff.SetPathExtend("summary", "stats", ".obsfuzz_diff_stats.txt")
-	testObsFuzzDiff.In("summary").Connect(sortSummaryOnDataSize.Out("sorted"))
+	// Test if observed fuzziness is lower after filling up with assumed non-actives
+	testObsFuzzDiff := ptpc.NewRunsetComparison(wf, "test_obsfuzz_diff", "res/final_models_summary.sorted.obsfuzz_diff_stats.tsv",
+		"orig", "fill", ptpstats.AltLess, "ObsFuzzOverall", "ObsFuzzClassAvg", "Efficiency", "Accuracy")
+	testObsFuzzDiff.InSummary().Connect(sortSummaryOnDataSize.Out("sorted"))
 
 	// --------------------------------
 	// Run the pipeline!
@@ -441,7 +444,7 @@ func main() {
 	if *graph {
 		//wf.PlotGraph("workflow.dot", true, true)
 	} else {
-		wf.RunToRegex("plot_summary_.*")
+		wf.RunToRegex("plot_summary_.*", "test_obsfuzz_diff")
 	}
 }
 
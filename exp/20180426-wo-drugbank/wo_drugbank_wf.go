@@ -461,7 +461,7 @@ func main() {
 						cvStatsRecords := &[]cpSignCrossValOutput{}
 						t.InIP("cvstats").UnMarshalJSON(cvStatsRecords)
 
-						tsvWrt.Write([]string{"confidence", "accuracty"})
+						tsvWrt.Write([]string{"confidence", "accuracy"})
 						for _, crossValOut := range *cvStatsRecords {
 							confidence := fmt.Sprintf("%.3f", crossValOut.Confidence)
 							accuracy := fmt.Sprintf("%.3f", crossValOut.Accuracy)
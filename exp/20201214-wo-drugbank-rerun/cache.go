@@ -0,0 +1,402 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	str "strings"
+	"sync"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Content-addressed task cache
+// ================================================================================
+
+// cacheEntry is stored next to each output, in <output>.cache.json, with what
+// the output was made from, and the checksum of the output itself, so that
+// tasks using it as input do not need to read it again
+type cacheEntry struct {
+	Key      string            `json:"key"`
+	Command  string            `json:"command"` // Checksum of the command pattern
+	Params   map[string]string `json:"params"`
+	Inputs   map[string]string `json:"inputs"` // Checksums of the inputs, per in-port
+	Tools    map[string]string `json:"tools"`  // Checksums of tools (such as the CPSign jar) used by the command
+	Checksum string            `json:"sha256"`
+	Size     int64             `json:"size"`
+	ModTime  int64             `json:"modtime"`
+}
+
+// computeKey sets the key of the entry, from everything the output was made
+// from
+func (e *cacheEntry) computeKey() {
+	data, err := json.Marshal([]interface{}{e.Command, e.Params, e.Inputs, e.Tools}) // Maps are marshalled with sorted keys
+	sp.Check(err)
+	sum := sha256.Sum256(data)
+	e.Key = hex.EncodeToString(sum[:])
+}
+
+func cacheEntryPath(path string) string {
+	return path + ".cache.json"
+}
+
+// TaskCache makes tasks rerun when their command, parameters, inputs or tools
+// have changed since their outputs were made, instead of skipping all tasks
+// whose outputs exist. The key of each task is stored next to its outputs.
+// Outputs made before there were keys are kept. With Explain, the reason for
+// rerunning, or not rerunning, each task is logged.
+type TaskCache struct {
+	Explain   bool
+	ToolFiles []string // Tools whose checksums are part of the key of commands using them
+	mx        sync.Mutex
+	checksums map[string]*cacheEntry // Checksums of files, with the size and modification time they were computed for
+	decisions map[string]int
+}
+
+func NewTaskCache(explain bool, toolFiles ...string) *TaskCache {
+	return &TaskCache{
+		Explain:   explain,
+		ToolFiles: toolFiles,
+		checksums: map[string]*cacheEntry{},
+		decisions: map[string]int{},
+	}
+}
+
+// taskCache is used by the components that skip work when their outputs are
+// up to date
+var taskCache *TaskCache
+
+// Apply makes the tasks of all the processes of wf check their outputs
+// against their keys before they are run, and store their keys after. It
+// must be called after the executors and the FailurePolicy are applied, and
+// not before planning, as it removes outdated outputs.
+func (c *TaskCache) Apply(wf *sp.Workflow) {
+	for _, proc := range wf.Procs() {
+		p, ok := proc.(*sp.Process)
+		if !ok || len(p.PathFormatters) == 0 {
+			continue
+		}
+		pathFuncs := map[string]func(*sp.Task) string{}
+		for portName, pathFunc := range p.PathFormatters {
+			pathFuncs[portName] = pathFunc
+		}
+		// The path formatters are called when tasks are created, before
+		// SciPipe checks if their outputs exist, so the outputs are checked
+		// from one of them
+		firstPort := sortedPortNames(pathFuncs)[0]
+		p.PathFormatters[firstPort] = func(t *sp.Task) string {
+			c.checkTask(p, t, pathFuncs)
+			return pathFuncs[firstPort](t)
+		}
+		customExecute := p.CustomExecute
+		p.CustomExecute = func(t *sp.Task) {
+			if customExecute != nil {
+				customExecute(t)
+			} else {
+				if err := execLocalCommand(t); err != nil {
+					sp.Failf("| %-32s | %s\n", t.Name, err)
+				}
+			}
+			c.storeTask(p, t)
+		}
+	}
+}
+
+// checkTask removes the outputs of t if they are outdated, or incomplete, so
+// that SciPipe runs the task again
+func (c *TaskCache) checkTask(p *sp.Process, t *sp.Task, pathFuncs map[string]func(*sp.Task) string) {
+	paths := []string{}
+	for _, portName := range sortedPortNames(pathFuncs) {
+		if !p.OutPortsDoStream[portName] {
+			paths = append(paths, pathFuncs[portName](t))
+		}
+	}
+	decision, reason, existing := c.taskDecision(p, t, paths)
+	c.decide(t.Name, decision, reason)
+	if decision == "rerun" {
+		removeOutputs(existing)
+	}
+}
+
+// taskDecision tells whether t, with its outputs at paths, is to be run,
+// rerun, reused or kept, and why, together with the outputs that exist. It
+// does not remove anything, so that it can also be used for planning.
+func (c *TaskCache) taskDecision(p *sp.Process, t *sp.Task, paths []string) (decision string, reason string, existing []string) {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			existing = append(existing, path)
+		}
+	}
+	if len(existing) == 0 {
+		return "run", "no outputs yet", existing
+	}
+	if len(existing) < len(paths) {
+		return "rerun", "some outputs are missing", existing
+	}
+	current := c.taskEntry(p, t)
+	for _, path := range paths {
+		stored := readCacheEntry(path)
+		if stored == nil {
+			return "keep", "outputs were made before cache keys were stored", existing
+		}
+		if stored.Key != current.Key {
+			return "rerun", explainChange(stored, current), existing
+		}
+	}
+	return "reuse", "command, parameters, inputs and tools unchanged", existing
+}
+
+// storeTask stores the cache entries of the (still temporary) outputs of t
+func (c *TaskCache) storeTask(p *sp.Process, t *sp.Task) {
+	entry := c.taskEntry(p, t)
+	for portName, oip := range t.OutIPs {
+		if p.OutPortsDoStream[portName] || failurePolicy.IsPlaceholder(oip.Path()) {
+			continue
+		}
+		c.storeEntry(oip.Path(), oip.TempPath(), *entry)
+	}
+}
+
+// taskEntry returns the cache entry (without the output checksum) of t
+func (c *TaskCache) taskEntry(p *sp.Process, t *sp.Task) *cacheEntry {
+	// The heap size is left out, as it depends on the host, and on retries
+	cmd := javaHeapPtn.ReplaceAllString(p.CommandPattern, "-Xmx")
+	sum := sha256.Sum256([]byte(cmd))
+	entry := &cacheEntry{
+		Command: hex.EncodeToString(sum[:]),
+		Params:  t.Params,
+		Inputs:  map[string]string{},
+		Tools:   map[string]string{},
+	}
+	for portName, ip := range t.InIPs {
+		if ip.Path() != "" {
+			entry.Inputs[portName] = c.checksum(ip.Path())
+		}
+	}
+	for _, tool := range c.ToolFiles {
+		if str.Contains(p.CommandPattern, tool) {
+			entry.Tools[filepath.Base(tool)] = c.checksum(tool)
+		}
+	}
+	entry.computeKey()
+	return entry
+}
+
+// ComponentUpToDate tells whether the output at path, of a component, was made
+// from the same parameters and inputs, so that the component can skip making
+// it. Outdated outputs are removed. Without a cache, it tells whether the
+// output exists.
+func (c *TaskCache) ComponentUpToDate(procName string, path string, params map[string]string, inIPs []*sp.FileIP) bool {
+	if _, err := os.Stat(path); err != nil {
+		if c != nil {
+			c.decide(procName, "run", "no outputs yet")
+		}
+		return false
+	}
+	if c == nil {
+		return true
+	}
+	stored := readCacheEntry(path)
+	if stored == nil {
+		c.decide(procName, "keep", "outputs were made before cache keys were stored")
+		return true
+	}
+	current := c.componentEntry(procName, params, inIPs)
+	if stored.Key != current.Key {
+		c.decide(procName, "rerun", explainChange(stored, current))
+		removeOutputs([]string{path})
+		return false
+	}
+	c.decide(procName, "reuse", "parameters and inputs unchanged")
+	return true
+}
+
+// StoreComponent stores the cache entry of an output of a component, written
+// to tempPath, and to be moved to path
+func (c *TaskCache) StoreComponent(procName string, path string, tempPath string, params map[string]string, inIPs []*sp.FileIP) {
+	if c == nil {
+		return
+	}
+	c.storeEntry(path, tempPath, *c.componentEntry(procName, params, inIPs))
+}
+
+func (c *TaskCache) componentEntry(procName string, params map[string]string, inIPs []*sp.FileIP) *cacheEntry {
+	sum := sha256.Sum256([]byte(procName))
+	entry := &cacheEntry{
+		Command: hex.EncodeToString(sum[:]),
+		Params:  params,
+		Inputs:  map[string]string{},
+		Tools:   map[string]string{},
+	}
+	for _, ip := range inIPs {
+		entry.Inputs[ip.Path()] = c.checksum(ip.Path())
+	}
+	entry.computeKey()
+	return entry
+}
+
+func (c *TaskCache) storeEntry(path string, tempPath string, entry cacheEntry) {
+	fi, err := os.Stat(tempPath)
+	if err != nil {
+		return // Outputs not produced are caught by SciPipe
+	}
+	entry.Checksum = c.checksum(tempPath)
+	entry.Size = fi.Size()
+	entry.ModTime = fi.ModTime().UnixNano() // Kept when the file is moved to its final path
+	data, err := json.MarshalIndent(entry, "", "  ")
+	sp.Check(err)
+	sp.CheckWithMsg(ioutil.WriteFile(cacheEntryPath(path), data, 0644), "Could not write cache entry for: "+path)
+	c.mx.Lock()
+	c.checksums[path] = &entry
+	c.mx.Unlock()
+}
+
+// checksum returns the SHA-256 checksum of a file (or of the files in a
+// directory), reusing checksums already computed, or stored in the cache
+// entry of the file, as long as its size and modification time are the same
+func (c *TaskCache) checksum(path string) string {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "missing"
+	}
+	c.mx.Lock()
+	known, ok := c.checksums[path]
+	c.mx.Unlock()
+	if !ok {
+		known = readCacheEntry(path)
+	}
+	if known != nil && known.Checksum != "" && known.Size == fi.Size() && known.ModTime == fi.ModTime().UnixNano() {
+		return known.Checksum
+	}
+
+	h := sha256.New()
+	err = filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		io.WriteString(h, str.TrimPrefix(p, path)+"\x00")
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(h, f)
+		return err
+	})
+	sp.CheckWithMsg(err, "Could not compute checksum of: "+path)
+	sum := hex.EncodeToString(h.Sum(nil))
+	c.mx.Lock()
+	c.checksums[path] = &cacheEntry{Checksum: sum, Size: fi.Size(), ModTime: fi.ModTime().UnixNano()}
+	c.mx.Unlock()
+	return sum
+}
+
+// decide logs the decision on whether to run a task, and why. Reruns of
+// existing outputs are always logged, and the other decisions with Explain.
+func (c *TaskCache) decide(taskName string, decision string, reason string) {
+	c.mx.Lock()
+	c.decisions[decision]++
+	c.mx.Unlock()
+	if c.Explain || decision == "rerun" {
+		sp.Audit.Printf("| %-32s | Cache: %s, as %s\n", taskName, decision, reason)
+	}
+}
+
+// PrintSummary logs how many tasks were run, rerun, reused and kept
+func (c *TaskCache) PrintSummary() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	sp.Audit.Printf("Cache: %d run, %d rerun, %d reused, %d kept without cache key\n", c.decisions["run"], c.decisions["rerun"], c.decisions["reuse"], c.decisions["keep"])
+}
+
+// ================================================================================
+// Helpers
+// ================================================================================
+
+// readCacheEntry reads the cache entry of the output at path, or returns nil
+// if there is none
+func readCacheEntry(path string) *cacheEntry {
+	data, err := ioutil.ReadFile(cacheEntryPath(path))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		sp.Warning.Printf("Could not parse cache entry %s, so ignoring it: %s\n", cacheEntryPath(path), err)
+		return nil
+	}
+	return entry
+}
+
+// explainChange tells what differs between a stored and a current entry
+func explainChange(stored *cacheEntry, current *cacheEntry) string {
+	changes := []string{}
+	if stored.Command != current.Command {
+		changes = append(changes, "the command changed")
+	}
+	changes = append(changes, mapChanges("parameter", stored.Params, current.Params, true)...)
+	changes = append(changes, mapChanges("input", stored.Inputs, current.Inputs, false)...)
+	changes = append(changes, mapChanges("tool", stored.Tools, current.Tools, false)...)
+	if len(changes) == 0 {
+		return "the cache key changed"
+	}
+	return str.Join(changes, ", ")
+}
+
+// mapChanges lists the added, removed and changed values between two maps,
+// with the values themselves if showValues is true
+func mapChanges(what string, stored map[string]string, current map[string]string, showValues bool) []string {
+	changes := []string{}
+	names := []string{}
+	for name := range stored {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := stored[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		oldVal, inOld := stored[name]
+		newVal, inNew := current[name]
+		switch {
+		case !inOld:
+			changes = append(changes, fmt.Sprintf("%s %s was added", what, name))
+		case !inNew:
+			changes = append(changes, fmt.Sprintf("%s %s was removed", what, name))
+		case oldVal != newVal && showValues:
+			changes = append(changes, fmt.Sprintf("%s %s changed (%s -> %s)", what, name, oldVal, newVal))
+		case oldVal != newVal:
+			changes = append(changes, fmt.Sprintf("%s %s changed", what, name))
+		}
+	}
+	return changes
+}
+
+func sortedPortNames(pathFuncs map[string]func(*sp.Task) string) []string {
+	names := []string{}
+	for name := range pathFuncs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// removeOutputs removes outputs, with their audit logs and cache entries
+func removeOutputs(paths []string) {
+	for _, path := range paths {
+		for _, p := range []string{path, path + ".audit.json", cacheEntryPath(path)} {
+			if err := os.RemoveAll(p); err != nil {
+				sp.Warning.Printf("Could not remove outdated output %s: %s\n", p, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestCacheEntryKey(t *testing.T) {
+	entries := []*cacheEntry{
+		{Command: "cmdsum", Params: map[string]string{"gene": "DRD1", "cost": "1"}, Inputs: map[string]string{"data": "datasum"}},
+		{Command: "othersum", Params: map[string]string{"gene": "DRD1", "cost": "1"}, Inputs: map[string]string{"data": "datasum"}},
+		{Command: "cmdsum", Params: map[string]string{"gene": "DRD1", "cost": "10"}, Inputs: map[string]string{"data": "datasum"}},
+		{Command: "cmdsum", Params: map[string]string{"gene": "DRD1"}, Inputs: map[string]string{"data": "datasum"}},
+		{Command: "cmdsum", Params: map[string]string{"gene": "DRD1", "cost": "1"}, Inputs: map[string]string{"data": "othersum"}},
+		{Command: "cmdsum", Params: map[string]string{"gene": "DRD1", "cost": "1"}, Inputs: map[string]string{"data": "datasum"}, Tools: map[string]string{"cpsign.jar": "toolsum"}},
+		{Command: "cmdsum", Params: map[string]string{"gene": "DRD1", "cost": "1", "data": "datasum"}, Inputs: map[string]string{}},
+	}
+	entryOfKey := map[string]int{}
+	for i, e := range entries {
+		e.computeKey()
+		if len(e.Key) != 64 {
+			t.Errorf("Key of entry %d = %q, want a hex SHA-256 checksum", i, e.Key)
+		}
+		if j, ok := entryOfKey[e.Key]; ok {
+			t.Errorf("Entries %d and %d have the same key %s, want different keys", j, i, e.Key)
+		}
+		entryOfKey[e.Key] = i
+	}
+
+	// The key is what the output was made from, regardless of the order of
+	// the parameters, and of the output itself
+	same := &cacheEntry{Command: "cmdsum", Params: map[string]string{"cost": "1", "gene": "DRD1"}, Inputs: map[string]string{"data": "datasum"}, Checksum: "outsum", Size: 10, ModTime: 1}
+	same.computeKey()
+	if same.Key != entries[0].Key {
+		t.Errorf("Key with the output checksum = %s, want %s", same.Key, entries[0].Key)
+	}
+}
+
+func TestExplainChange(t *testing.T) {
+	stored := &cacheEntry{
+		Command: "cmdsum",
+		Params:  map[string]string{"gene": "DRD1", "cost": "1"},
+		Inputs:  map[string]string{"data": "datasum"},
+		Tools:   map[string]string{},
+	}
+	tests := []struct {
+		current *cacheEntry
+		want    string
+	}{
+		{&cacheEntry{Command: "cmdsum", Params: map[string]string{"gene": "DRD1", "cost": "1"}, Inputs: map[string]string{"data": "datasum"}},
+			"the cache key changed"},
+		{&cacheEntry{Command: "othersum", Params: map[string]string{"gene": "DRD1", "cost": "10"}, Inputs: map[string]string{"data": "othersum"}},
+			"the command changed, parameter cost changed (1 -> 10), input data changed"},
+		{&cacheEntry{Command: "cmdsum", Params: map[string]string{"gene": "DRD1", "replicate": "r1"}, Inputs: map[string]string{}, Tools: map[string]string{"cpsign.jar": "toolsum"}},
+			"parameter cost was removed, parameter replicate was added, input data was removed, tool cpsign.jar was added"},
+	}
+	for _, tt := range tests {
+		if got := explainChange(stored, tt.current); got != tt.want {
+			t.Errorf("explainChange(%+v) = %q, want %q", tt.current, got, tt.want)
+		}
+	}
+}
+
+// TestTaskEntry checks that the key of a task depends on its inputs and
+// tools, but not on the heap size of Java commands
+func TestTaskEntry(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "task_entry_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	inPath := filepath.Join(tmpDir, "in.tsv")
+	toolPath := filepath.Join(tmpDir, "cpsign.jar")
+	for _, path := range []string{inPath, toolPath} {
+		if err := ioutil.WriteFile(path, []byte("v1"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wf := sp.NewWorkflow("task_entry_test", 1)
+	nProcs := 0
+	taskKey := func(cmd string) string {
+		nProcs++
+		p := wf.NewProc(fmt.Sprintf("task_entry_%d", nProcs), cmd)
+		task := &sp.Task{Params: map[string]string{"cost": "1"}, InIPs: map[string]*sp.FileIP{"data": sp.NewFileIP(inPath)}}
+		return NewTaskCache(false, toolPath).taskEntry(p, task).Key
+	}
+	jarCmd := "java -Xmx1024m -jar " + toolPath + " train {i:data} > {o:model}"
+	key := taskKey(jarCmd)
+	if got := taskKey("java -Xmx2048m -jar " + toolPath + " train {i:data} > {o:model}"); got != key {
+		t.Errorf("Key changed with the heap size: %s, want %s", got, key)
+	}
+	if got := taskKey("java -Xmx1024m -jar " + toolPath + " predict {i:data} > {o:model}"); got == key {
+		t.Errorf("Key did not change with the command: %s", got)
+	}
+
+	catKey := taskKey("cat {i:data} > {o:model}")
+	if err := ioutil.WriteFile(toolPath, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := taskKey(jarCmd); got == key {
+		t.Errorf("Key did not change with the tool: %s", got)
+	}
+	if got := taskKey("cat {i:data} > {o:model}"); got != catKey {
+		t.Errorf("Key changed with a tool not in the command: %s, want %s", got, catKey)
+	}
+	if err := ioutil.WriteFile(inPath, []byte("v2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := taskKey("cat {i:data} > {o:model}"); got == catKey {
+		t.Errorf("Key did not change with the input: %s", got)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+
+// CalibrationAnalyzer analyzes the calibration of the crossvalidated models
+// for the cost selected for each final model. For each gene, replicate and
+// runset it writes a TSV with the calibration curve, overall and per class,
+// and the calibration error at each confidence level. It also writes a
+// summary table across targets, with the maximum and mean absolute
+// calibration error, the area between the calibration curve and the
+// diagonal, the worst calibrated class, and a flag for targets whose
+// calibration error exceeds Tolerance.
+type CalibrationAnalyzer struct {
+	sp.BaseProcess
+	OutDir          string
+	SummaryFileName string
+	Tolerance       float64
+}
+
+func NewCalibrationAnalyzer(wf *sp.Workflow, procName string, outDir string, summaryFileName string, tolerance float64) *CalibrationAnalyzer {
+	p := &CalibrationAnalyzer{
+		BaseProcess:     sp.NewBaseProcess(wf, procName),
+		OutDir:          outDir,
+		SummaryFileName: summaryFileName,
+		Tolerance:       tolerance,
+	}
+	p.InitInPort(p, "cvstats")
+	p.InitInPort(p, "model")
+	p.InitOutPort(p, "curves")
+	p.InitOutPort(p, "summary")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *CalibrationAnalyzer) InCrossValStats() *sp.InPort { return p.InPort("cvstats") }
+func (p *CalibrationAnalyzer) InModel() *sp.InPort         { return p.InPort("model") }
+func (p *CalibrationAnalyzer) OutCurves() *sp.OutPort      { return p.OutPort("curves") }
+func (p *CalibrationAnalyzer) OutSummary() *sp.OutPort     { return p.OutPort("summary") }
+
+func (p *CalibrationAnalyzer) Run() {
+	defer p.CloseAllOutPorts()
+
+	summaryRows := [][]string{{"Gene", "Replicate", "Runset", "Cost", "Points", "MaxAbsCalibError", "MeanAbsCalibError", "AreaVsDiagonal", "WorstClass", "WorstClassMaxAbsError", "Miscalibrated"}}
+	for _, cvIP := range receiveSelectedCrossValStats(p.Name(), p.InCrossValStats(), p.InModel()) {
+		metrics := parseCrossValMetrics(cvIP.Read())
+		calib := analyzeCalibration(metrics.Points)
+		uniq := str.ToLower(cvIP.Param("gene")) + "." + cvIP.Param("replicate") + "." + cvIP.Param("runset")
+
+		// Per-target calibration curve
+		header := []string{"confidence", "accuracy", "error"}
+		for _, class := range calib.classes {
+			header = append(header, "accuracy_"+class, "error_"+class)
+		}
+		rows := [][]string{header}
+		for _, pt := range metrics.Points {
+			row := []string{fmt.Sprintf("%.3f", pt.Confidence), fmt.Sprintf("%.3f", pt.Accuracy), fmt.Sprintf("%.3f", pt.Accuracy-pt.Confidence)}
+			for _, class := range calib.classes {
+				if acc, ok := pt.ClassAccuracy[class]; ok {
+					row = append(row, fmt.Sprintf("%.3f", acc), fmt.Sprintf("%.3f", acc-pt.Confidence))
+				} else {
+					row = append(row, "NA", "NA")
+				}
+			}
+			rows = append(rows, row)
+		}
+		oip := sp.NewFileIP(p.OutDir + "/" + uniq + ".calibration.tsv")
+		writeTSVRows(oip, rows)
+		p.OutCurves().Send(oip)
+
+		worstClassErr := "NA"
+		if calib.worstClass != "" {
+			worstClassErr = fmt.Sprintf("%.3f", calib.worstClassMaxAbsErr)
+		}
+		miscalibrated := calib.maxAbsErr > p.Tolerance || (calib.worstClass != "" && calib.worstClassMaxAbsErr > p.Tolerance)
+		summaryRows = append(summaryRows, []string{
+			cvIP.Param("gene"),
+			cvIP.Param("replicate"),
+			cvIP.Param("runset"),
+			cvIP.Param("cost"),
+			fmt.Sprintf("%d", len(metrics.Points)),
+			fmt.Sprintf("%.3f", calib.maxAbsErr),
+			fmt.Sprintf("%.3f", calib.meanAbsErr),
+			fmt.Sprintf("%.4f", calib.areaVsDiagonal),
+			calib.worstClass,
+			worstClassErr,
+			fmt.Sprintf("%t", miscalibrated),
+		})
+	}
+
+	oip := sp.NewFileIP(p.SummaryFileName)
+	writeTSVRows(oip, summaryRows)
+	p.OutSummary().Send(oip)
+}
+
+// calibrationStats summarizes how far a calibration curve is from the
+// diagonal, where accuracy equals confidence
+type calibrationStats struct {
+	maxAbsErr           float64
+	meanAbsErr          float64
+	areaVsDiagonal      float64 // Area between the curve and the diagonal, over the confidence range
+	classes             []string
+	worstClass          string // The class with the largest absolute calibration error
+	worstClassMaxAbsErr float64
+}
+
+// analyzeCalibration computes calibration errors from calibration points
+// sorted on confidence
+func analyzeCalibration(points []calibrationPoint) calibrationStats {
+	cs := calibrationStats{}
+	if len(points) == 0 {
+		cs.maxAbsErr, cs.meanAbsErr, cs.areaVsDiagonal = math.NaN(), math.NaN(), math.NaN()
+		return cs
+	}
+	classSet := map[string]bool{}
+	classMaxErr := map[string]float64{}
+	for i, pt := range points {
+		absErr := math.Abs(pt.Accuracy - pt.Confidence)
+		cs.maxAbsErr = math.Max(cs.maxAbsErr, absErr)
+		cs.meanAbsErr += absErr / float64(len(points))
+		if i > 0 {
+			prev := points[i-1]
+			cs.areaVsDiagonal += areaBetween(prev.Confidence, prev.Accuracy-prev.Confidence, pt.Confidence, pt.Accuracy-pt.Confidence)
+		}
+		for class, acc := range pt.ClassAccuracy {
+			classSet[class] = true
+			classMaxErr[class] = math.Max(classMaxErr[class], math.Abs(acc-pt.Confidence))
+		}
+	}
+	for class := range classSet {
+		cs.classes = append(cs.classes, class)
+	}
+	sort.Strings(cs.classes)
+	for _, class := range cs.classes {
+		if cs.worstClass == "" || classMaxErr[class] > cs.worstClassMaxAbsErr {
+			cs.worstClass = class
+			cs.worstClassMaxAbsErr = classMaxErr[class]
+		}
+	}
+	return cs
+}
+
+// areaBetween returns the area between a linear segment of the error (from e1
+// at x1 to e2 at x2) and zero, counting the parts above and below zero as
+// positive
+func areaBetween(x1, e1, x2, e2 float64) float64 {
+	if e1*e2 >= 0 {
+		return (x2 - x1) * (math.Abs(e1) + math.Abs(e2)) / 2
+	}
+	// The segment crosses zero, so sum the two triangles
+	xZero := x1 + (x2-x1)*math.Abs(e1)/(math.Abs(e1)+math.Abs(e2))
+	return (xZero-x1)*math.Abs(e1)/2 + (x2-xZero)*math.Abs(e2)/2
+}
+
+// ================================================================================
+// Helpers
+// ================================================================================
+
+// receiveSelectedCrossValStats receives crossvalidation results for all costs
+// on cvStatsPort, and final models on modelPort, and returns the
+// crossvalidation results for the cost selected for each model, sorted on
+// gene, replicate and runset. The cvstats in-port is drained before the
+// models are received, as the models depend on all the crossvalidations
+// being done.
+func receiveSelectedCrossValStats(procName string, cvStatsPort *sp.InPort, modelPort *sp.InPort) []*sp.FileIP {
+	uniqStr := func(ip *sp.FileIP) string {
+		return str.ToLower(ip.Param("gene")) + "." + ip.Param("replicate") + "." + ip.Param("runset") + ".c" + ip.Param("cost")
+	}
+	cvStats := map[string]*sp.FileIP{}
+	for ip := range cvStatsPort.Chan {
+		if failurePolicy.SkipIP(procName, ip) {
+			continue
+		}
+		cvStats[uniqStr(ip)] = ip
+	}
+	selected := []string{}
+	for ip := range modelPort.Chan {
+		if failurePolicy.SkipIP(procName, ip) {
+			continue
+		}
+		selected = append(selected, uniqStr(ip))
+	}
+	sort.Strings(selected)
+	ips := []*sp.FileIP{}
+	for _, uniq := range selected {
+		cvIP, ok := cvStats[uniq]
+		if !ok {
+			sp.Failf("| %-32s | No crossvalidation results found for selected model %s\n", procName, uniq)
+		}
+		ips = append(ips, cvIP)
+	}
+	return ips
+}
+
+// writeTSVRows writes rows as a tab-separated file, to the temporary path of
+// oip, and then atomizes it
+func writeTSVRows(oip *sp.FileIP, rows [][]string) {
+	fh := oip.OpenWriteTemp()
+	tsvWriter := csv.NewWriter(fh)
+	tsvWriter.Comma = '\t'
+	for _, row := range rows {
+		tsvWriter.Write(row)
+	}
+	tsvWriter.Flush()
+	fh.Close()
+	oip.Atomize()
+}
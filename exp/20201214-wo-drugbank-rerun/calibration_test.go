@@ -0,0 +1,71 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestAnalyzeCalibration(t *testing.T) {
+	tests := []struct {
+		desc   string
+		points []calibrationPoint
+		want   calibrationStats
+	}{
+		{
+			"calibrated",
+			[]calibrationPoint{{Confidence: 0.1, Accuracy: 0.1}, {Confidence: 0.5, Accuracy: 0.5}, {Confidence: 0.9, Accuracy: 0.9}},
+			calibrationStats{},
+		},
+		{
+			"over-confident at one end, with class accuracies",
+			[]calibrationPoint{
+				{Confidence: 0.5, Accuracy: 0.6, ClassAccuracy: map[string]float64{"A": 0.4, "N": 0.55}},
+				{Confidence: 0.9, Accuracy: 0.9, ClassAccuracy: map[string]float64{"A": 0.95, "N": 0.9}},
+			},
+			calibrationStats{maxAbsErr: 0.1, meanAbsErr: 0.05, areaVsDiagonal: 0.02, classes: []string{"A", "N"}, worstClass: "A", worstClassMaxAbsErr: 0.1},
+		},
+		{
+			"crossing the diagonal",
+			[]calibrationPoint{{Confidence: 0.2, Accuracy: 0.3}, {Confidence: 0.4, Accuracy: 0.3}},
+			calibrationStats{maxAbsErr: 0.1, meanAbsErr: 0.1, areaVsDiagonal: 0.01},
+		},
+		{
+			"tied classes",
+			[]calibrationPoint{{Confidence: 0.5, Accuracy: 0.5, ClassAccuracy: map[string]float64{"N": 0.25, "A": 0.75}}},
+			calibrationStats{classes: []string{"A", "N"}, worstClass: "A", worstClassMaxAbsErr: 0.25},
+		},
+	}
+	for _, tt := range tests {
+		got := analyzeCalibration(tt.points)
+		for _, v := range []*float64{&got.maxAbsErr, &got.meanAbsErr, &got.areaVsDiagonal, &got.worstClassMaxAbsErr} {
+			*v = math.Round(*v*1e9) / 1e9
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("analyzeCalibration(%s) = %+v, want %+v", tt.desc, got, tt.want)
+		}
+	}
+
+	got := analyzeCalibration(nil)
+	if !math.IsNaN(got.maxAbsErr) || !math.IsNaN(got.meanAbsErr) || !math.IsNaN(got.areaVsDiagonal) {
+		t.Errorf("analyzeCalibration(nil) = %+v, want NaN errors", got)
+	}
+}
+
+func TestAreaBetween(t *testing.T) {
+	tests := []struct {
+		x1, e1, x2, e2 float64
+		want           float64
+	}{
+		{0, 0.1, 1, 0.1, 0.1},
+		{0, -0.1, 1, -0.3, 0.2},
+		{0, 0.1, 1, -0.1, 0.05},  // Crossing at 0.5
+		{0, 0.3, 1, -0.1, 0.125}, // Crossing at 0.75
+		{0.5, 0, 0.9, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := areaBetween(tt.x1, tt.e1, tt.x2, tt.e2); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("areaBetween(%g, %g, %g, %g) = %g, want %g", tt.x1, tt.e1, tt.x2, tt.e2, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	str "strings"
+
+	ptpstats "github.com/pharmbio/ptp-project/lib/stats"
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// The compare command
+// ================================================================================
+
+// compareMetric is a metric compared across experiments, read from the first
+// of its columns found in a table. Summaries from different experiments, and
+// different kinds of tables, name the same metric differently.
+type compareMetric struct {
+	name string
+	cols []string
+}
+
+var compareMetrics = []compareMetric{
+	{"Cost", []string{"Cost"}},
+	{"ObsFuzzOverall", []string{"ObsFuzzOverall", "ObsFuzzOverallMean"}},
+	{"CrossValValidity", []string{"Accuracy"}}, // The accuracy of a conformal predictor is its validity
+	{"ValidationValidity", []string{"ValidityMean"}},
+	{"ValidationEfficiency", []string{"EfficiencyMean"}},
+	{"ActiveCnt", []string{"ActiveCnt"}},
+	{"NonactiveCnt", []string{"NonactiveCnt"}},
+	{"TotalCnt", []string{"TotalCnt"}},
+}
+
+// compareThresholds decide when a difference changes the conclusions about a
+// target
+type compareThresholds struct {
+	confidence  float64
+	validityTol float64
+	fuzzDelta   float64
+	countDelta  float64
+}
+
+// compareTarget holds the values of the metrics of a target (gene and
+// runset) in one experiment, over all its replicates
+type compareTarget struct {
+	gene   string
+	runSet string
+	values map[string][]float64
+	costs  []string
+}
+
+// compareExperiment holds the targets of the tables of one experiment
+type compareExperiment struct {
+	label   string
+	targets map[string]*compareTarget
+}
+
+// compareCmd aligns final models summaries and validation summaries of two or
+// more experiments by gene and runset, and writes the values of each metric
+// per experiment, with the differences to the first experiment. Targets
+// whose conclusions changed (selected cost, validity at the confidence
+// level, fuzziness or data counts beyond the thresholds, or the target
+// missing) are listed on stderr.
+func compareCmd(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	outPath := flags.String("out", "", "File to write the comparison table to (default: stdout)")
+	defaultRunSet := flags.String("defaultrunset", "fill", "Runset of the rows of tables without a Runset column, such as those of fillup-propertrain")
+	th := compareThresholds{}
+	flags.Float64Var(&th.confidence, "confidence", 0.8, "Confidence level at which models are considered valid")
+	flags.Float64Var(&th.validityTol, "validitytol", 0.02, "How far below the confidence level the validity may be, for a model to be considered valid")
+	flags.Float64Var(&th.fuzzDelta, "fuzzdelta", 0.05, "Change in observed fuzziness considered a changed conclusion")
+	flags.Float64Var(&th.countDelta, "countdelta", 0.1, "Relative change in the number of compounds considered a changed conclusion")
+	flags.Usage = func() {
+		name := filepath.Base(os.Args[0])
+		fmt.Fprintf(flags.Output(), "Usage: %s compare [flags] LABEL=TABLE[,TABLE...] LABEL=TABLE[,TABLE...] ...\n\n", name)
+		fmt.Fprintf(flags.Output(), "Compares final models summaries, and replicate (validation) summaries, of experiments, such as:\n\n")
+		fmt.Fprintf(flags.Output(), "  %s compare 2018=res.20180505/final_models_summary.tsv 2020=res/final_models_summary.tsv,res/final_models_summary.replicates.tsv\n\n", name)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() < 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	exps := []*compareExperiment{}
+	for _, arg := range flags.Args() {
+		parts := str.SplitN(arg, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			sp.Failf("Experiments must be given as LABEL=TABLE[,TABLE...], but got: %s\n", arg)
+		}
+		exps = append(exps, readCompareExperiment(parts[0], str.Split(parts[1], ","), *defaultRunSet))
+	}
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		fh, err := os.Create(*outPath)
+		sp.CheckWithMsg(err, "Could not create comparison table: "+*outPath)
+		defer fh.Close()
+		out = fh
+	}
+	changed := writeComparison(out, exps, th)
+
+	fmt.Fprintf(os.Stderr, "%d targets with changed conclusions, compared to %s:\n", len(changed), exps[0].label)
+	for _, line := range changed {
+		fmt.Fprintf(os.Stderr, "  %s\n", line)
+	}
+}
+
+// readCompareExperiment reads the targets of the tables of an experiment.
+// Values of the same target and metric in several tables (such as those of
+// replicates) are averaged. If a metric is in more than one of the tables, the
+// first table having it is used.
+func readCompareExperiment(label string, paths []string, defaultRunSet string) *compareExperiment {
+	exp := &compareExperiment{label: label, targets: map[string]*compareTarget{}}
+	metricFrom := map[string]string{}
+	for _, path := range paths {
+		rows := readTSVWithHeader(path)
+		if len(rows) == 0 {
+			sp.Warning.Printf("No rows in table %s, of experiment %s\n", path, label)
+			continue
+		}
+		if _, ok := rows[0]["Gene"]; !ok {
+			sp.Failf("Column Gene missing in table %s, of experiment %s\n", path, label)
+		}
+		// The column each metric is read from, in this table
+		cols := map[string]string{}
+		for _, metric := range compareMetrics {
+			for _, col := range metric.cols {
+				if _, ok := rows[0][col]; ok {
+					if from, ok := metricFrom[metric.name]; ok && from != path {
+						sp.Warning.Printf("%s is in both %s and %s, of experiment %s, so using the first\n", metric.name, from, path, label)
+						break
+					}
+					metricFrom[metric.name] = path
+					cols[metric.name] = col
+					break
+				}
+			}
+		}
+		for _, row := range rows {
+			runSet, ok := row["Runset"]
+			if !ok {
+				runSet = defaultRunSet
+			}
+			t := exp.target(row["Gene"], runSet)
+			for metricName, col := range cols {
+				if metricName == "Cost" {
+					t.costs = append(t.costs, row[col])
+					continue
+				}
+				if v := parseFloatOrNaN(row[col]); !math.IsNaN(v) && v != -1 { // -1 is used for metrics not computed
+					t.values[metricName] = append(t.values[metricName], v)
+				}
+			}
+		}
+	}
+	return exp
+}
+
+func (e *compareExperiment) target(gene string, runSet string) *compareTarget {
+	gene = str.ToUpper(gene)
+	key := gene + "\t" + runSet
+	if _, ok := e.targets[key]; !ok {
+		e.targets[key] = &compareTarget{gene: gene, runSet: runSet, values: map[string][]float64{}}
+	}
+	return e.targets[key]
+}
+
+// value returns the mean of a metric over the replicates of the target, or
+// NaN if the target, or the metric, is missing
+func (t *compareTarget) value(metricName string) float64 {
+	if t == nil {
+		return math.NaN()
+	}
+	if metricName == "Cost" {
+		return parseFloatOrNaN(t.cost())
+	}
+	if len(t.values[metricName]) == 0 {
+		return math.NaN()
+	}
+	return ptpstats.Mean(t.values[metricName])
+}
+
+// cost returns the cost selected for most replicates, or the lowest of the
+// most common ones
+func (t *compareTarget) cost() string {
+	counts := map[string]int{}
+	for _, cost := range t.costs {
+		counts[cost]++
+	}
+	best := ""
+	for cost, n := range counts {
+		if best == "" || n > counts[best] || (n == counts[best] && parseFloatOrNaN(cost) < parseFloatOrNaN(best)) {
+			best = cost
+		}
+	}
+	return best
+}
+
+// writeComparison writes the comparison table, and returns descriptions of
+// the targets whose conclusions changed, compared to the first experiment
+func writeComparison(w io.Writer, exps []*compareExperiment, th compareThresholds) []string {
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, exp := range exps {
+		for key := range exp.targets {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+
+	metrics := []string{}
+	for _, metric := range compareMetrics {
+		for _, exp := range exps {
+			if exp.hasMetric(metric.name) {
+				metrics = append(metrics, metric.name)
+				break
+			}
+		}
+	}
+
+	tsvWriter := csv.NewWriter(w)
+	tsvWriter.Comma = '\t'
+	header := []string{"Gene", "Runset"}
+	for _, metric := range metrics {
+		for _, exp := range exps {
+			header = append(header, metric+"."+exp.label)
+		}
+		for _, exp := range exps[1:] {
+			header = append(header, metric+".delta."+exp.label)
+		}
+	}
+	header = append(header, "ChangedConclusions")
+	tsvWriter.Write(header)
+
+	changed := []string{}
+	for _, key := range keys {
+		parts := str.Split(key, "\t")
+		row := []string{parts[0], parts[1]}
+		for _, metric := range metrics {
+			for _, exp := range exps {
+				row = append(row, formatCompareValue(metric, exp.targets[key].value(metric)))
+			}
+			base := exps[0].targets[key].value(metric)
+			for _, exp := range exps[1:] {
+				row = append(row, formatCompareValue(metric, exp.targets[key].value(metric)-base))
+			}
+		}
+		changes := []string{}
+		for _, exp := range exps[1:] {
+			for _, change := range changedConclusions(exps[0].targets[key], exp.targets[key], th) {
+				changes = append(changes, exp.label+": "+change)
+			}
+		}
+		row = append(row, str.Join(changes, "; "))
+		tsvWriter.Write(row)
+		if len(changes) > 0 {
+			changed = append(changed, fmt.Sprintf("%s %s: %s", parts[0], parts[1], str.Join(changes, "; ")))
+		}
+	}
+	tsvWriter.Flush()
+	sp.Check(tsvWriter.Error())
+	return changed
+}
+
+func (e *compareExperiment) hasMetric(metricName string) bool {
+	for _, t := range e.targets {
+		if !math.IsNaN(t.value(metricName)) {
+			return true
+		}
+	}
+	return false
+}
+
+// changedConclusions lists how the conclusions about a target differ between
+// a base experiment and another one
+func changedConclusions(base *compareTarget, other *compareTarget, th compareThresholds) []string {
+	switch {
+	case base == nil && other == nil:
+		return nil
+	case base == nil:
+		return []string{"target added"}
+	case other == nil:
+		return []string{"target missing"}
+	}
+	changes := []string{}
+	if base.cost() != "" && other.cost() != "" && base.cost() != other.cost() {
+		changes = append(changes, fmt.Sprintf("cost %s -> %s", base.cost(), other.cost()))
+	}
+	for _, metric := range []string{"CrossValValidity", "ValidationValidity"} {
+		a, b := base.value(metric), other.value(metric)
+		if math.IsNaN(a) || math.IsNaN(b) {
+			continue
+		}
+		aValid, bValid := a >= th.confidence-th.validityTol, b >= th.confidence-th.validityTol
+		if aValid != bValid {
+			changes = append(changes, fmt.Sprintf("%s %s -> %s at %.2f (%.3f -> %.3f)", metric, validStr(aValid), validStr(bValid), th.confidence, a, b))
+		}
+	}
+	if d := other.value("ObsFuzzOverall") - base.value("ObsFuzzOverall"); math.Abs(d) >= th.fuzzDelta {
+		changes = append(changes, fmt.Sprintf("ObsFuzzOverall %+.3f", d))
+	}
+	for _, metric := range []string{"ActiveCnt", "NonactiveCnt", "TotalCnt"} {
+		a, b := base.value(metric), other.value(metric)
+		if a > 0 && math.Abs(b-a)/a >= th.countDelta {
+			changes = append(changes, fmt.Sprintf("%s %+.0f%%", metric, 100*(b-a)/a))
+		}
+	}
+	return changes
+}
+
+func validStr(valid bool) string {
+	if valid {
+		return "valid"
+	}
+	return "not valid"
+}
+
+// formatCompareValue formats counts and costs without decimals, and the other
+// metrics with three, as in the summaries. Missing values are given as NA.
+func formatCompareValue(metric string, v float64) string {
+	if math.IsNaN(v) {
+		return "NA"
+	}
+	if metric == "Cost" || str.HasSuffix(metric, "Cnt") {
+		return fmt.Sprintf("%.0f", v)
+	}
+	return fmt.Sprintf("%.3f", v)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// writeCompareTables writes tables into dir, and returns their paths
+func writeCompareTables(t *testing.T, dir string, tables map[string]string) map[string]string {
+	paths := map[string]string{}
+	for name, data := range tables {
+		paths[name] = filepath.Join(dir, name)
+		if err := ioutil.WriteFile(paths[name], []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return paths
+}
+
+func TestReadCompareExperiment(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "compare_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	paths := writeCompareTables(t, tmpDir, map[string]string{
+		// An old summary, without a Runset column
+		"old.tsv": "Gene\tCost\tObsFuzzOverall\tAccuracy\tActiveCnt\n" +
+			"drd1\t10\t0.20\t0.81\t120\n" +
+			"htr2b\t1\tNA\t-1\t30\n",
+		"final.tsv": "Gene\tReplicate\tRunset\tCost\tObsFuzzOverall\tAccuracy\n" +
+			"DRD1\tr1\torig\t10\t0.20\t0.80\n" +
+			"DRD1\tr2\torig\t100\t0.30\t0.90\n" +
+			"DRD1\tr3\torig\t100\t0.25\t0.85\n",
+		"replicates.tsv": "Gene\tRunset\tObsFuzzOverallMean\tValidityMean\tEfficiencyMean\n" +
+			"DRD1\torig\t0.90\t0.79\t0.70\n",
+	})
+
+	tests := []struct {
+		paths []string
+		want  map[string]*compareTarget
+	}{
+		{
+			[]string{paths["old.tsv"]},
+			map[string]*compareTarget{
+				"DRD1\tfill":  {gene: "DRD1", runSet: "fill", costs: []string{"10"}, values: map[string][]float64{"ObsFuzzOverall": {0.2}, "CrossValValidity": {0.81}, "ActiveCnt": {120}}},
+				"HTR2B\tfill": {gene: "HTR2B", runSet: "fill", costs: []string{"1"}, values: map[string][]float64{"ActiveCnt": {30}}}, // NA and -1 are left out
+			},
+		},
+		{
+			// ObsFuzzOverall is read from the first table having it
+			[]string{paths["final.tsv"], paths["replicates.tsv"]},
+			map[string]*compareTarget{
+				"DRD1\torig": {gene: "DRD1", runSet: "orig", costs: []string{"10", "100", "100"}, values: map[string][]float64{
+					"ObsFuzzOverall":       {0.2, 0.3, 0.25},
+					"CrossValValidity":     {0.8, 0.9, 0.85},
+					"ValidationValidity":   {0.79},
+					"ValidationEfficiency": {0.7},
+				}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		if got := readCompareExperiment("exp", tt.paths, "fill"); !reflect.DeepEqual(got.targets, tt.want) {
+			t.Errorf("readCompareExperiment(%v) =\n%+v\nwant:\n%+v", tt.paths, got.targets, tt.want)
+		}
+	}
+}
+
+func TestCompareTargetValue(t *testing.T) {
+	target := &compareTarget{costs: []string{"100", "10", "10", "100", "1"}, values: map[string][]float64{"ObsFuzzOverall": {0.2, 0.3}}}
+	tests := []struct {
+		target *compareTarget
+		metric string
+		want   float64
+	}{
+		{target, "Cost", 10}, // The lowest of the most common costs
+		{target, "ObsFuzzOverall", 0.25},
+		{target, "ActiveCnt", math.NaN()},
+		{nil, "ObsFuzzOverall", math.NaN()},
+		{&compareTarget{}, "Cost", math.NaN()},
+	}
+	for _, tt := range tests {
+		got := tt.target.value(tt.metric)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("value(%q) of %+v = %v, want %v", tt.metric, tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestChangedConclusions(t *testing.T) {
+	th := compareThresholds{confidence: 0.8, validityTol: 0.02, fuzzDelta: 0.05, countDelta: 0.1}
+	newTarget := func(cost string, values map[string][]float64) *compareTarget {
+		return &compareTarget{costs: []string{cost}, values: values}
+	}
+	tests := []struct {
+		desc  string
+		base  *compareTarget
+		other *compareTarget
+		want  []string
+	}{
+		{"both missing", nil, nil, nil},
+		{"added", nil, newTarget("10", nil), []string{"target added"}},
+		{"missing", newTarget("10", nil), nil, []string{"target missing"}},
+		{
+			"unchanged within the thresholds",
+			newTarget("10", map[string][]float64{"CrossValValidity": {0.81}, "ObsFuzzOverall": {0.20}, "ActiveCnt": {100}}),
+			newTarget("10", map[string][]float64{"CrossValValidity": {0.79}, "ObsFuzzOverall": {0.24}, "ActiveCnt": {109}}),
+			[]string{},
+		},
+		{
+			"changed",
+			newTarget("10", map[string][]float64{"CrossValValidity": {0.81}, "ValidationValidity": {0.70}, "ObsFuzzOverall": {0.20}, "ActiveCnt": {100}, "TotalCnt": {200}}),
+			newTarget("100", map[string][]float64{"CrossValValidity": {0.77}, "ValidationValidity": {0.85}, "ObsFuzzOverall": {0.10}, "ActiveCnt": {80}, "TotalCnt": {250}}),
+			[]string{
+				"cost 10 -> 100",
+				"CrossValValidity valid -> not valid at 0.80 (0.810 -> 0.770)",
+				"ValidationValidity not valid -> valid at 0.80 (0.700 -> 0.850)",
+				"ObsFuzzOverall -0.100",
+				"ActiveCnt -20%",
+				"TotalCnt +25%",
+			},
+		},
+		{
+			"metrics missing in one experiment",
+			newTarget("", map[string][]float64{"CrossValValidity": {0.81}, "ObsFuzzOverall": {0.20}}),
+			newTarget("100", map[string][]float64{"ActiveCnt": {80}}),
+			[]string{},
+		},
+	}
+	for _, tt := range tests {
+		if got := changedConclusions(tt.base, tt.other, th); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("changedConclusions(%s) = %q, want %q", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCompareValue(t *testing.T) {
+	tests := []struct {
+		metric string
+		v      float64
+		want   string
+	}{
+		{"Cost", 100, "100"},
+		{"ActiveCnt", 120.4, "120"},
+		{"ObsFuzzOverall", 0.12345, "0.123"},
+		{"ObsFuzzOverall", math.NaN(), "NA"},
+	}
+	for _, tt := range tests {
+		if got := formatCompareValue(tt.metric, tt.v); got != tt.want {
+			t.Errorf("formatCompareValue(%q, %v) = %q, want %q", tt.metric, tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestWriteComparison(t *testing.T) {
+	th := compareThresholds{confidence: 0.8, validityTol: 0.02, fuzzDelta: 0.05, countDelta: 0.1}
+	exps := []*compareExperiment{
+		{label: "2018", targets: map[string]*compareTarget{
+			"DRD1\torig":  {gene: "DRD1", runSet: "orig", costs: []string{"10"}, values: map[string][]float64{"ObsFuzzOverall": {0.2}}},
+			"HTR2B\torig": {gene: "HTR2B", runSet: "orig", costs: []string{"1"}, values: map[string][]float64{"ObsFuzzOverall": {0.3}}},
+		}},
+		{label: "2020", targets: map[string]*compareTarget{
+			"DRD1\torig": {gene: "DRD1", runSet: "orig", costs: []string{"10"}, values: map[string][]float64{"ObsFuzzOverall": {0.1}}},
+		}},
+	}
+	out := &bytes.Buffer{}
+	changed := writeComparison(out, exps, th)
+
+	// Only the metrics found in some experiment are compared
+	want := "Gene\tRunset\tCost.2018\tCost.2020\tCost.delta.2020\tObsFuzzOverall.2018\tObsFuzzOverall.2020\tObsFuzzOverall.delta.2020\tChangedConclusions\n" +
+		"DRD1\torig\t10\t10\t0\t0.200\t0.100\t-0.100\t2020: ObsFuzzOverall -0.100\n" +
+		"HTR2B\torig\t1\tNA\tNA\t0.300\tNA\tNA\t2020: target missing\n"
+	if out.String() != want {
+		t.Errorf("writeComparison() =\n%s\nwant:\n%s", out.String(), want)
+	}
+	wantChanged := []string{"DRD1 orig: 2020: ObsFuzzOverall -0.100", "HTR2B orig: 2020: target missing"}
+	if !reflect.DeepEqual(changed, wantChanged) {
+		t.Errorf("writeComparison() changed = %q, want %q", changed, wantChanged)
+	}
+}
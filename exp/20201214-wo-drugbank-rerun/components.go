@@ -6,6 +6,7 @@ import (
 	"encoding/csv"
 	"fmt"
 	"path/filepath"
+	"sort"
 	"strconv"
 
 	str "strings"
@@ -55,16 +56,29 @@ func (p *SummarizeCostGammaPerf) OutStats() *sp.OutPort { return p.OutPort("out_
 func (p *SummarizeCostGammaPerf) Run() {
 	defer p.OutStats().Close()
 
+	// Receive all inputs before checking the output, as it is outdated if
+	// the inputs have changed
+	iips := []*sp.FileIP{}
+	skipped := 0
+	for iip := range p.In().Chan {
+		if failurePolicy.SkipIP(p.Name(), iip) {
+			skipped++
+			continue
+		}
+		iips = append(iips, iip)
+	}
+
 	outIp := sp.NewFileIP(p.FileName)
-	if outIp.Exists() {
-		sp.Info.Printf("Process %s: Out-target %s already exists, so skipping\n", p.Name(), outIp.Path())
+	cacheParams := map[string]string{"include_gamma": fmt.Sprintf("%t", p.IncludeGamma)}
+	if skipped == 0 && taskCache.ComponentUpToDate(p.Name(), outIp.Path(), cacheParams, iips) {
+		sp.Info.Printf("Process %s: Out-target %s is up to date, so skipping\n", p.Name(), outIp.Path())
 	} else {
 		header := []string{"Gene", "ObsFuzzOverall", "Cost"}
 		if p.IncludeGamma {
 			header = append(header, "Gamma")
 		}
 		rows := [][]string{header}
-		for iip := range p.In().Chan {
+		for _, iip := range iips {
 			gene := iip.Param("gene")
 			cost := iip.Param("cost")
 			obsFuzzOverall := iip.Key("obsfuzz_overall")
@@ -83,6 +97,12 @@ func (p *SummarizeCostGammaPerf) Run() {
 		}
 		tsvWriter.Flush()
 		ofh.Close()
+		if skipped > 0 {
+			// The cost can not be selected for a failed branch
+			failurePolicy.MarkPlaceholder(outIp.Path())
+		} else {
+			taskCache.StoreComponent(p.Name(), outIp.Path(), outIp.TempPath(), cacheParams, iips)
+		}
 		outIp.Atomize()
 	}
 	p.OutStats().Send(outIp)
@@ -136,6 +156,15 @@ func (p *BestCostGamma) Run() {
 	defer p.OutBestObsFuzzOverall().Close()
 
 	for iip := range p.InCSVFile().Chan {
+		if failurePolicy.IsPlaceholder(iip.Path()) {
+			// The tasks getting the parameters are skipped in failed branches
+			p.OutBestCost().Send("-1")
+			if p.IncludeGamma {
+				p.OutBestGamma().Send("NaN")
+			}
+			p.OutBestObsFuzzOverall().Send("NaN")
+			continue
+		}
 		csvData := iip.Read()
 
 		bytesReader := bytes.NewReader(csvData)
@@ -225,33 +254,44 @@ func (p *ParamPrinter) GetNewParamInPort(portName string) *sp.ParamInPort {
 func (p *ParamPrinter) Run() {
 	defer p.OutBestParamsFile().Close()
 
-	oip := sp.NewFileIP(p.BestParamsFileName)
-	if !oip.Exists() && !oip.TempFileExists() {
-		rows := []map[string]string{}
-		for len(p.ParamInPorts()) > 0 {
-			row := map[string]string{}
-			for pname, pport := range p.ParamInPorts() {
-				param, ok := <-pport.Chan
-				if !ok {
-					p.DeleteParamInPort(pname) // This we should implement in the BaseProcess instead!
-					continue
-				}
-				row[pname] = param
+	// Receive all parameters before checking the output, as it is outdated
+	// if the parameters have changed
+	rows := []map[string]string{}
+	for len(p.ParamInPorts()) > 0 {
+		row := map[string]string{}
+		for pname, pport := range p.ParamInPorts() {
+			param, ok := <-pport.Chan
+			if !ok {
+				p.DeleteParamInPort(pname) // This we should implement in the BaseProcess instead!
+				continue
 			}
-			rows = append(rows, row)
+			row[pname] = param
 		}
+		rows = append(rows, row)
+	}
 
-		var outContent string
+	var outContent string
 
-		for _, row := range rows {
-			for name, val := range row {
-				outContent += fmt.Sprintf("%s=%s\n", name, val)
-			}
+	for _, row := range rows {
+		// Sorted, so that the content, and its cache key, is the same across runs
+		names := []string{}
+		for name := range row {
+			names = append(names, name)
 		}
+		sort.Strings(names)
+		for _, name := range names {
+			outContent += fmt.Sprintf("%s=%s\n", name, row[name])
+		}
+	}
+
+	oip := sp.NewFileIP(p.BestParamsFileName)
+	cacheParams := map[string]string{"content": outContent}
+	if !oip.TempFileExists() && !taskCache.ComponentUpToDate(p.Name(), oip.Path(), cacheParams, nil) {
 		oip.Write([]byte(outContent))
+		taskCache.StoreComponent(p.Name(), oip.Path(), oip.TempPath(), cacheParams, nil)
 		oip.Atomize()
 	} else {
-		sp.Info.Printf("Target file (or temp file) exists for: %s, so skipping\n", oip.Path())
+		sp.Info.Printf("Target file (or temp file) exists, and is up to date, for: %s, so skipping\n", oip.Path())
 	}
 
 	p.OutBestParamsFile().Send(oip)
@@ -285,6 +325,17 @@ func (p *FinalModelSummarizer) InModel() *sp.InPort           { return p.InPort(
 func (p *FinalModelSummarizer) InTargetDataCount() *sp.InPort { return p.InPort("target_data_count") }
 func (p *FinalModelSummarizer) OutSummary() *sp.OutPort       { return p.OutPort("summary") }
 
+// InRegression takes the summary of the conformal regression models, from
+// RegressionSummarizer, to add their cost and validation results, at the
+// 0.8 confidence level, to the rows of the same gene and replicate. The
+// in-port is created on first use, as it is only connected with -regression.
+func (p *FinalModelSummarizer) InRegression() *sp.InPort {
+	if _, ok := p.InPorts()["regression"]; !ok {
+		p.InitInPort(p, "regression")
+	}
+	return p.InPort("regression")
+}
+
 func (p *FinalModelSummarizer) Run() {
 	defer p.OutSummary().Close()
 
@@ -292,6 +343,9 @@ func (p *FinalModelSummarizer) Run() {
 	nonActiveCounts := map[string]int64{}
 	totalCompounds := map[string]int64{}
 	for tdip := range p.InTargetDataCount().Chan {
+		if failurePolicy.SkipIP(p.Name(), tdip) {
+			continue
+		}
 		gene := tdip.Param("gene")
 		runSet := tdip.Param("runset")
 		uniq := gene + "_" + runSet
@@ -319,7 +373,29 @@ func (p *FinalModelSummarizer) Run() {
 		"ActiveCnt",
 		"NonactiveCnt",
 		"TotalCnt"}}
+	modelIPs := []*sp.FileIP{}
 	for iip := range p.InModel().Chan {
+		if failurePolicy.SkipIP(p.Name(), iip) {
+			continue
+		}
+		modelIPs = append(modelIPs, iip)
+	}
+
+	regressionCols := []string{"RegressionCost", "RegressionRMSE", "RegressionCoverage80", "RegressionMedianWidth80"}
+	regressionRows := map[string]map[string]string{}
+	if _, ok := p.InPorts()["regression"]; ok {
+		rows[0] = append(rows[0], regressionCols...)
+		for rip := range p.InRegression().Chan {
+			if failurePolicy.SkipIP(p.Name(), rip) {
+				continue
+			}
+			for _, row := range readTSVWithHeader(rip.Path()) {
+				regressionRows[str.ToUpper(row["Gene"])+"_"+row["Replicate"]] = row
+			}
+		}
+	}
+
+	for _, iip := range modelIPs {
 		uniq := iip.Param("gene") + "_" + iip.Param("runset")
 		row := []string{
 			iip.Param("gene"),
@@ -333,6 +409,16 @@ func (p *FinalModelSummarizer) Run() {
 			fmt.Sprintf("%d", nonActiveCounts[uniq]),
 			fmt.Sprintf("%d", totalCompounds[uniq]),
 		}
+		if _, ok := p.InPorts()["regression"]; ok {
+			regressionRow := regressionRows[str.ToUpper(iip.Param("gene"))+"_"+iip.Param("replicate")]
+			for _, col := range []string{"Cost", "ValidationRMSE", "Coverage80", "MedianWidth80"} {
+				val, ok := regressionRow[col]
+				if !ok {
+					val = "NA"
+				}
+				row = append(row, val)
+			}
+		}
 		rows = append(rows, row)
 	}
 
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"sort"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Config files
+// ================================================================================
+
+// applyConfigFile sets the flags in a JSON config file, such as
+// {"geneset": "bowes44", "maxtasks": 19}, except those given on the command
+// line, which take precedence. It must be called after flag.Parse.
+func applyConfigFile(path string) {
+	data, err := ioutil.ReadFile(path)
+	sp.CheckWithMsg(err, "Could not read config file: "+path)
+	values := map[string]interface{}{}
+	sp.CheckWithMsg(json.Unmarshal(data, &values), "Could not parse config file: "+path)
+
+	onCommandLine := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) {
+		onCommandLine[f.Name] = true
+	})
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil {
+			sp.Failf("Unknown flag %s in config file %s\n", name, path)
+		}
+		if name == "config" || onCommandLine[name] {
+			continue
+		}
+		// JSON numbers are float64, so format whole numbers without decimals
+		value := fmt.Sprint(values[name])
+		if v, ok := values[name].(float64); ok && v == float64(int64(v)) {
+			value = fmt.Sprintf("%d", int64(v))
+		}
+		sp.CheckWithMsg(flag.Set(name, value), fmt.Sprintf("Invalid value for %s in config file %s", name, path))
+	}
+}
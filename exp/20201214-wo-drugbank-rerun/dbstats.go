@@ -0,0 +1,330 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	str "strings"
+
+	ptpc "github.com/pharmbio/ptp-project/lib/components"
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// ExCAPE-DB statistics
+// ================================================================================
+
+// Columns of ExCAPE-DB (0-based)
+const (
+	excapeColInchiKey = 0
+	excapeColActivity = 3
+	excapeColPXC50    = 4
+	excapeColDB       = 5
+	excapeColGene     = 8
+	excapeColSmiles   = 11
+)
+
+// pXC50 values are binned with this width, to get their quantiles without
+// keeping all values in memory
+const (
+	pxc50BinWidth = 0.1
+	pxc50Bins     = 150
+)
+
+// geneStats holds the statistics of the rows of one gene in ExCAPE-DB.
+// Structures are kept as hashes of their InChIKeys (or SMILES, when the
+// InChIKey is missing), with flags for the activity labels seen for them, as
+// the full keys of all genes would not fit in memory.
+type geneStats struct {
+	rows        int
+	actRows     int
+	nonactRows  int
+	pubChemRows int
+	chEMBLRows  int
+	otherDBRows int
+	structs     map[uint64]uint8
+	pxc50N      int
+	pxc50Sum    float64
+	pxc50Min    float64
+	pxc50Max    float64
+	pxc50Hist   [pxc50Bins]int
+}
+
+const (
+	structActive    uint8 = 1
+	structNonactive uint8 = 2
+)
+
+// ExcapeDBStats is a SciPipe component computing statistics per gene over
+// ExCAPE-DB, in one pass over the database: the number of active and
+// non-active rows, unique structures, duplicate rows (rows of structures
+// already seen for the gene), conflicting structures (labelled both active
+// and non-active), the split of rows over the source databases, and the
+// distribution of pXC50 values. It also selects the genes eligible for
+// modelling, out of the Panel (or all genes if empty), as those having at
+// least MinPerClass unique, non-conflicting, structures in each class. This
+// is how the min100percls gene sets were selected.
+type ExcapeDBStats struct {
+	sp.BaseProcess
+	StatsFileName string
+	PanelFileName string
+	MinPerClass   int
+	Panel         []string
+}
+
+func NewExcapeDBStats(wf *sp.Workflow, procName string, statsFileName string, panelFileName string, minPerClass int, panel []string) *ExcapeDBStats {
+	p := &ExcapeDBStats{
+		BaseProcess:   sp.NewBaseProcess(wf, procName),
+		StatsFileName: statsFileName,
+		PanelFileName: panelFileName,
+		MinPerClass:   minPerClass,
+		Panel:         panel,
+	}
+	p.InitInPort(p, "excapedb")
+	p.InitOutPort(p, "stats")
+	p.InitOutPort(p, "panel")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *ExcapeDBStats) InExcapeDB() *sp.InPort { return p.InPort("excapedb") }
+func (p *ExcapeDBStats) OutStats() *sp.OutPort  { return p.OutPort("stats") }
+func (p *ExcapeDBStats) OutPanel() *sp.OutPort  { return p.OutPort("panel") }
+
+func (p *ExcapeDBStats) Run() {
+	defer p.OutStats().Close()
+	defer p.OutPanel().Close()
+
+	iips := []*sp.FileIP{}
+	for iip := range p.InExcapeDB().Chan {
+		iips = append(iips, iip)
+	}
+	if len(iips) != 1 {
+		sp.Failf("| %-32s | Expected one ExCAPE-DB file, but got %d\n", p.Name(), len(iips))
+	}
+
+	statsIP := sp.NewFileIP(p.StatsFileName)
+	panelIP := sp.NewFileIP(p.PanelFileName)
+	cacheParams := map[string]string{
+		"min_per_class": fmt.Sprintf("%d", p.MinPerClass),
+		"panel":         str.Join(p.Panel, ","),
+	}
+	if taskCache.ComponentUpToDate(p.Name(), statsIP.Path(), cacheParams, iips) && taskCache.ComponentUpToDate(p.Name(), panelIP.Path(), cacheParams, iips) {
+		sp.Info.Printf("Process %s: Out-targets %s and %s are up to date, so skipping\n", p.Name(), statsIP.Path(), panelIP.Path())
+	} else {
+		stats := readExcapeDBStats(iips[0].Path())
+		sp.Audit.Printf("| %-32s | Counted the rows of %d genes in %s\n", p.Name(), len(stats), iips[0].Path())
+
+		genes := []string{}
+		for gene := range stats {
+			genes = append(genes, gene)
+		}
+		sort.Strings(genes)
+		inPanel := map[string]bool{}
+		for _, gene := range p.Panel {
+			inPanel[str.ToUpper(gene)] = true
+		}
+
+		rows := [][]string{{"Gene", "Rows", "ActiveRows", "NonactiveRows", "UniqueStructures", "DuplicateRows",
+			"ConflictingStructures", "UniqueActives", "UniqueNonactives", "PubChemRows", "ChEMBLRows", "OtherDBRows",
+			"PXC50Count", "PXC50Min", "PXC50Q1", "PXC50Median", "PXC50Q3", "PXC50Max", "PXC50Mean", "InPanel", "Eligible"}}
+		eligible := []string{}
+		for _, gene := range genes {
+			s := stats[gene]
+			actives, nonactives, conflicts := s.structCounts()
+			isInPanel := len(p.Panel) == 0 || inPanel[gene]
+			isEligible := isInPanel && actives >= p.MinPerClass && nonactives >= p.MinPerClass
+			if isEligible {
+				eligible = append(eligible, gene)
+			}
+			if len(p.Panel) > 0 && inPanel[gene] && !isEligible {
+				sp.Audit.Printf("| %-32s | Gene %s of the panel has too few structures (%d active, %d non-active) to be modelled\n", p.Name(), gene, actives, nonactives)
+			}
+			rows = append(rows, []string{
+				gene,
+				fmt.Sprintf("%d", s.rows),
+				fmt.Sprintf("%d", s.actRows),
+				fmt.Sprintf("%d", s.nonactRows),
+				fmt.Sprintf("%d", len(s.structs)),
+				fmt.Sprintf("%d", s.rows-len(s.structs)),
+				fmt.Sprintf("%d", conflicts),
+				fmt.Sprintf("%d", actives),
+				fmt.Sprintf("%d", nonactives),
+				fmt.Sprintf("%d", s.pubChemRows),
+				fmt.Sprintf("%d", s.chEMBLRows),
+				fmt.Sprintf("%d", s.otherDBRows),
+				fmt.Sprintf("%d", s.pxc50N),
+				ptpc.FmtFloat(s.pxc50MinOrNaN()),
+				ptpc.FmtFloat(s.pxc50Quantile(0.25)),
+				ptpc.FmtFloat(s.pxc50Quantile(0.5)),
+				ptpc.FmtFloat(s.pxc50Quantile(0.75)),
+				ptpc.FmtFloat(s.pxc50MaxOrNaN()),
+				ptpc.FmtFloat(s.pxc50Mean()),
+				fmt.Sprintf("%t", isInPanel),
+				fmt.Sprintf("%t", isEligible),
+			})
+		}
+		for _, gene := range p.Panel {
+			if stats[str.ToUpper(gene)] == nil {
+				sp.Audit.Printf("| %-32s | Gene %s of the panel is not in ExCAPE-DB\n", p.Name(), gene)
+			}
+		}
+		sp.Audit.Printf("| %-32s | %d genes have at least %d unique structures per class\n", p.Name(), len(eligible), p.MinPerClass)
+
+		fh := statsIP.OpenWriteTemp()
+		tsvWriter := csv.NewWriter(fh)
+		tsvWriter.Comma = '\t'
+		tsvWriter.WriteAll(rows)
+		sp.CheckWithMsg(tsvWriter.Error(), "Could not write statistics: "+statsIP.TempPath())
+		fh.Close()
+		taskCache.StoreComponent(p.Name(), statsIP.Path(), statsIP.TempPath(), cacheParams, iips)
+		statsIP.Atomize()
+
+		panelContent := ""
+		for _, gene := range eligible {
+			panelContent += gene + "\n"
+		}
+		panelIP.Write([]byte(panelContent))
+		taskCache.StoreComponent(p.Name(), panelIP.Path(), panelIP.TempPath(), cacheParams, iips)
+		panelIP.Atomize()
+	}
+	p.OutStats().Send(statsIP)
+	p.OutPanel().Send(panelIP)
+}
+
+// readExcapeDBStats reads the statistics per gene of an ExCAPE-DB file, with
+// a header line
+func readExcapeDBStats(path string) map[string]*geneStats {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open ExCAPE-DB file: "+path)
+	defer fh.Close()
+
+	stats := map[string]*geneStats{}
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		if lineNo == 1 {
+			continue // Header
+		}
+		row := str.Split(scanner.Text(), "\t")
+		if len(row) <= excapeColSmiles {
+			continue
+		}
+		gene := str.ToUpper(row[excapeColGene])
+		s, ok := stats[gene]
+		if !ok {
+			s = &geneStats{structs: map[uint64]uint8{}, pxc50Min: math.Inf(1), pxc50Max: math.Inf(-1)}
+			stats[gene] = s
+		}
+		s.add(row)
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read ExCAPE-DB file: "+path)
+	return stats
+}
+
+func (s *geneStats) add(row []string) {
+	s.rows++
+	structKey := row[excapeColInchiKey]
+	if structKey == "" {
+		structKey = row[excapeColSmiles]
+	}
+	h := fnv.New64a()
+	h.Write([]byte(structKey))
+	flags := s.structs[h.Sum64()]
+	switch row[excapeColActivity] {
+	case "A":
+		s.actRows++
+		flags |= structActive
+	case "N":
+		s.nonactRows++
+		flags |= structNonactive
+	}
+	s.structs[h.Sum64()] = flags
+
+	db := str.ToLower(row[excapeColDB])
+	switch {
+	case str.HasPrefix(db, "pubchem"):
+		s.pubChemRows++
+	case str.HasPrefix(db, "chembl"):
+		s.chEMBLRows++
+	default:
+		s.otherDBRows++
+	}
+
+	if v, err := strconv.ParseFloat(row[excapeColPXC50], 64); err == nil && !math.IsNaN(v) {
+		s.pxc50N++
+		s.pxc50Sum += v
+		s.pxc50Min = math.Min(s.pxc50Min, v)
+		s.pxc50Max = math.Max(s.pxc50Max, v)
+		bin := int(v / pxc50BinWidth)
+		if bin < 0 {
+			bin = 0
+		} else if bin >= pxc50Bins {
+			bin = pxc50Bins - 1
+		}
+		s.pxc50Hist[bin]++
+	}
+}
+
+// structCounts returns the number of unique structures only labelled active,
+// only labelled non-active, and labelled both (conflicting)
+func (s *geneStats) structCounts() (actives int, nonactives int, conflicts int) {
+	for _, flags := range s.structs {
+		switch flags {
+		case structActive:
+			actives++
+		case structNonactive:
+			nonactives++
+		case structActive | structNonactive:
+			conflicts++
+		}
+	}
+	return actives, nonactives, conflicts
+}
+
+func (s *geneStats) pxc50Mean() float64 {
+	if s.pxc50N == 0 {
+		return math.NaN()
+	}
+	return s.pxc50Sum / float64(s.pxc50N)
+}
+
+func (s *geneStats) pxc50MinOrNaN() float64 {
+	if s.pxc50N == 0 {
+		return math.NaN()
+	}
+	return s.pxc50Min
+}
+
+func (s *geneStats) pxc50MaxOrNaN() float64 {
+	if s.pxc50N == 0 {
+		return math.NaN()
+	}
+	return s.pxc50Max
+}
+
+// pxc50Quantile returns the q quantile of the pXC50 values, as the middle of
+// the histogram bin it falls in, kept within the min and max values
+func (s *geneStats) pxc50Quantile(q float64) float64 {
+	if s.pxc50N == 0 {
+		return math.NaN()
+	}
+	target := int(math.Ceil(q * float64(s.pxc50N)))
+	if target < 1 {
+		target = 1
+	}
+	cum := 0
+	for bin, n := range s.pxc50Hist {
+		cum += n
+		if cum >= target {
+			v := (float64(bin) + 0.5) * pxc50BinWidth
+			return math.Max(s.pxc50Min, math.Min(s.pxc50Max, math.Round(v*100)/100))
+		}
+	}
+	return s.pxc50Max
+}
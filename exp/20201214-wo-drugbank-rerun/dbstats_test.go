@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestReadExcapeDBStats(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "excapedb_stats_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Inchikey, activity, pXC50, DB, gene and SMILES
+	rows := [][]string{
+		{"KEY1", "A", "7.0", "chembl20", "DRD1", "C1"},
+		{"KEY1", "A", "7.2", "pubchem", "DRD1", "C1"}, // Duplicate
+		{"KEY2", "N", "4.0", "chembl20", "DRD1", "C2"},
+		{"KEY3", "A", "6.03", "chembl20", "DRD1", "C3"},
+		{"KEY3", "N", "4.5", "other", "DRD1", "C3"}, // Conflicting
+		{"", "N", "", "pubchem", "DRD1", "CCO"},     // Identified by SMILES
+		{"KEY4", "A", "8.04", "chembl20", "drd1", "C4"},
+		{"KEY5", "N", "NaN", "pubchem", "HTR2B", "C5"},
+	}
+	lines := []string{"Ambit_InchiKey\tOriginal_Entry_ID\tEntrez_ID\tActivity_Flag\tpXC50\tDB\tOriginal_Assay_ID\tTax_ID\tGene_Symbol\tOrtholog_Group\tInChI\tSMILES"}
+	for _, r := range rows {
+		lines = append(lines, str.Join([]string{r[0], "ID", "1812", r[1], r[2], r[3], "1", "9606", r[4], "1", "InChI", r[5]}, "\t"))
+	}
+	lines = append(lines, "KEY6\tToo few columns")
+	dbPath := filepath.Join(tmpDir, "excapedb.tsv")
+	if err := ioutil.WriteFile(dbPath, []byte(str.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := readExcapeDBStats(dbPath)
+	if len(stats) != 2 {
+		t.Fatalf("Got stats of %d genes, want 2", len(stats))
+	}
+	tests := []struct {
+		gene                                 string
+		rows, actRows, nonactRows            int
+		pubChemRows, chEMBLRows, otherDBRows int
+		actives, nonactives, conflicts       int
+		pxc50N                               int
+	}{
+		{"DRD1", 7, 4, 3, 2, 4, 1, 2, 2, 1, 6},
+		{"HTR2B", 1, 0, 1, 1, 0, 0, 0, 1, 0, 0},
+	}
+	for _, tt := range tests {
+		s := stats[tt.gene]
+		if s == nil {
+			t.Errorf("No stats for %s", tt.gene)
+			continue
+		}
+		actives, nonactives, conflicts := s.structCounts()
+		got := []int{s.rows, s.actRows, s.nonactRows, s.pubChemRows, s.chEMBLRows, s.otherDBRows, actives, nonactives, conflicts, s.pxc50N}
+		want := []int{tt.rows, tt.actRows, tt.nonactRows, tt.pubChemRows, tt.chEMBLRows, tt.otherDBRows, tt.actives, tt.nonactives, tt.conflicts, tt.pxc50N}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("Counts of %s (rows, active and non-active rows, PubChem, ChEMBL and other rows, active, non-active and conflicting structures, pXC50 values) = %v, want %v", tt.gene, got, want)
+				break
+			}
+		}
+	}
+
+	drd1 := stats["DRD1"]
+	pxc50Tests := []struct {
+		desc string
+		got  float64
+		want float64
+	}{
+		{"mean", drd1.pxc50Mean(), (7.0 + 7.2 + 4.0 + 6.03 + 4.5 + 8.04) / 6},
+		{"min", drd1.pxc50MinOrNaN(), 4.0},
+		{"max", drd1.pxc50MaxOrNaN(), 8.04},
+		{"median", drd1.pxc50Quantile(0.5), 6.05}, // The middle of the bin
+		{"0 quantile", drd1.pxc50Quantile(0), 4.05},
+		{"1 quantile", drd1.pxc50Quantile(1), 8.04}, // Kept within the max
+	}
+	for _, tt := range pxc50Tests {
+		if math.Abs(tt.got-tt.want) > 1e-9 {
+			t.Errorf("pXC50 %s of DRD1 = %g, want %g", tt.desc, tt.got, tt.want)
+		}
+	}
+	htr2b := stats["HTR2B"]
+	for _, v := range []float64{htr2b.pxc50Mean(), htr2b.pxc50MinOrNaN(), htr2b.pxc50MaxOrNaN(), htr2b.pxc50Quantile(0.5)} {
+		if !math.IsNaN(v) {
+			t.Errorf("pXC50 statistic of HTR2B, without pXC50 values = %g, want NaN", v)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	ptpc "github.com/pharmbio/ptp-project/lib/components"
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Gathering results into tables
+// ================================================================================
+
+// NewTableGatherer returns a table gatherer (see lib/components) that leaves
+// out the placeholders of failed tasks, and keeps its table by the task cache
+// of the workflow
+func NewTableGatherer(wf *sp.Workflow, procName string, fileName string, keyParams []string, valueCols ...string) *ptpc.TableGatherer {
+	p := ptpc.NewTableGatherer(wf, procName, fileName, keyParams, valueCols...)
+	p.SkipIP = func(procName string, ip *sp.FileIP) bool { return failurePolicy.SkipIP(procName, ip) }
+	p.Cache = workflowTaskCache{}
+	return p
+}
+
+// workflowTaskCache lets components use the task cache of the workflow, which
+// is only created after the processes are
+type workflowTaskCache struct{}
+
+func (workflowTaskCache) ComponentUpToDate(procName string, path string, params map[string]string, inIPs []*sp.FileIP) bool {
+	return taskCache.ComponentUpToDate(procName, path, params, inIPs)
+}
+
+func (workflowTaskCache) StoreComponent(procName string, path string, tempPath string, params map[string]string, inIPs []*sp.FileIP) {
+	taskCache.StoreComponent(procName, path, tempPath, params, inIPs)
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Gene symbol resolution
+// ================================================================================
+
+// Statuses of resolved panel genes
+const (
+	geneOK        = "ok"        // In ExCAPE-DB under the panel symbol
+	geneRenamed   = "renamed"   // In ExCAPE-DB under another symbol, with the same Entrez ID
+	geneAlias     = "alias"     // The panel symbol is an alias, or previous symbol, of one gene in ExCAPE-DB
+	geneAmbiguous = "ambiguous" // The panel symbol could mean more than one gene
+	geneMissing   = "missing"   // Not in ExCAPE-DB, under any symbol
+	geneUnknown   = "unknown"   // Not in the alias table (when ExCAPE-DB can not be checked)
+	geneUnchecked = "unchecked" // Neither an alias table nor the ExCAPE-DB gene list is available
+)
+
+// geneRecord is a gene in an alias table
+type geneRecord struct {
+	symbol   string
+	entrezID string
+	aliases  []string // Aliases and previous symbols
+}
+
+// geneAliasTable holds genes with their aliases, from an NCBI gene_info file
+// (such as Homo_sapiens.gene_info.gz) or an HGNC complete set file
+// (hgnc_complete_set.txt). Symbols are looked up in upper case.
+type geneAliasTable struct {
+	bySymbol map[string]*geneRecord
+	byAlias  map[string][]*geneRecord
+}
+
+// readGeneAliasTable reads an alias table, detecting its format from the
+// header. Files ending in .gz are decompressed. From NCBI gene_info files,
+// only genes of taxID are read.
+func readGeneAliasTable(path string, taxID string) *geneAliasTable {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open gene alias table: "+path)
+	defer fh.Close()
+	var rd io.Reader = fh
+	if str.HasSuffix(path, ".gz") {
+		gzRd, err := gzip.NewReader(fh)
+		sp.CheckWithMsg(err, "Could not decompress gene alias table: "+path)
+		defer gzRd.Close()
+		rd = gzRd
+	}
+	tsvReader := csv.NewReader(bufio.NewReader(rd))
+	tsvReader.Comma = '\t'
+	tsvReader.LazyQuotes = true
+	tsvReader.FieldsPerRecord = -1
+	header, err := tsvReader.Read()
+	sp.CheckWithMsg(err, "Could not read header of gene alias table: "+path)
+	col := map[string]int{}
+	for i, name := range header {
+		col[str.TrimPrefix(name, "#")] = i
+	}
+
+	// Columns of the symbol, Entrez ID, and the alias lists, per format
+	var symbolCol, entrezCol string
+	var aliasCols []string
+	taxCol := ""
+	switch {
+	case hasCols(col, "tax_id", "GeneID", "Symbol", "Synonyms"):
+		symbolCol, entrezCol, aliasCols, taxCol = "Symbol", "GeneID", []string{"Synonyms"}, "tax_id"
+	case hasCols(col, "symbol", "entrez_id", "alias_symbol", "prev_symbol"):
+		symbolCol, entrezCol, aliasCols = "symbol", "entrez_id", []string{"alias_symbol", "prev_symbol"}
+	default:
+		sp.Failf("Unknown format of gene alias table %s, which should be an NCBI gene_info or an HGNC complete set file\n", path)
+	}
+
+	table := &geneAliasTable{bySymbol: map[string]*geneRecord{}, byAlias: map[string][]*geneRecord{}}
+	for {
+		row, err := tsvReader.Read()
+		if err == io.EOF {
+			break
+		}
+		sp.CheckWithMsg(err, "Could not read gene alias table: "+path)
+		field := func(name string) string {
+			if col[name] < len(row) {
+				return str.Trim(row[col[name]], `"`)
+			}
+			return ""
+		}
+		if taxCol != "" && field(taxCol) != taxID {
+			continue
+		}
+		rec := &geneRecord{symbol: str.ToUpper(field(symbolCol)), entrezID: field(entrezCol)}
+		for _, aliasCol := range aliasCols {
+			for _, alias := range str.Split(field(aliasCol), "|") {
+				alias = str.ToUpper(str.TrimSpace(alias))
+				if alias != "" && alias != "-" && alias != rec.symbol {
+					rec.aliases = append(rec.aliases, alias)
+				}
+			}
+		}
+		table.bySymbol[rec.symbol] = rec
+		for _, alias := range rec.aliases {
+			table.byAlias[alias] = append(table.byAlias[alias], rec)
+		}
+	}
+	return table
+}
+
+func hasCols(col map[string]int, names ...string) bool {
+	for _, name := range names {
+		if _, ok := col[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// readExcapeGenes reads the Gene_Symbol, Entrez_ID and Tax_ID of the genes in
+// ExCAPE-DB, as extracted by the workflow, into a map from symbol (in upper
+// case) to Entrez ID, preferring the human Entrez ID of symbols shared by
+// orthologs. It returns nil if the file does not exist yet.
+func readExcapeGenes(path string) map[string]string {
+	fh, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	sp.CheckWithMsg(err, "Could not open ExCAPE-DB gene list: "+path)
+	defer fh.Close()
+	genes := map[string]string{}
+	sc := bufio.NewScanner(fh)
+	for sc.Scan() {
+		fields := str.Split(sc.Text(), "\t")
+		if len(fields) < 3 || fields[0] == "" {
+			continue
+		}
+		symbol := str.ToUpper(fields[0])
+		if _, ok := genes[symbol]; !ok || fields[2] == "9606" {
+			genes[symbol] = fields[1]
+		}
+	}
+	sp.CheckWithMsg(sc.Err(), "Could not read ExCAPE-DB gene list: "+path)
+	return genes
+}
+
+// writeExcapeGenes extracts the Gene_Symbol, Entrez_ID and Tax_ID of the
+// genes in ExCAPE-DB, at dbPath, to genesPath, the same way as the
+// ext_excape_genes process, so that the genes of a panel can be resolved
+// before the workflow is run
+func writeExcapeGenes(dbPath string, genesPath string) {
+	dbFh, err := os.Open(dbPath)
+	sp.CheckWithMsg(err, "Could not open ExCAPE-DB: "+dbPath)
+	defer dbFh.Close()
+	genes := map[string]bool{}
+	sc := bufio.NewScanner(dbFh)
+	sc.Buffer(make([]byte, 1024*1024), 64*1024*1024) // InChI strings can be long
+	for i := 0; sc.Scan(); i++ {
+		fields := str.Split(sc.Text(), "\t")
+		if i == 0 || len(fields) < 9 {
+			continue
+		}
+		genes[fields[8]+"\t"+fields[2]+"\t"+fields[7]] = true
+	}
+	sp.CheckWithMsg(sc.Err(), "Could not read ExCAPE-DB: "+dbPath)
+	lines := []string{}
+	for line := range genes {
+		lines = append(lines, line+"\n")
+	}
+	sort.Strings(lines)
+
+	tmpPath := genesPath + ".tmp"
+	sp.CheckWithMsg(ioutil.WriteFile(tmpPath, []byte(str.Join(lines, "")), 0644), "Could not write ExCAPE-DB gene list: "+tmpPath)
+	sp.CheckWithMsg(os.Rename(tmpPath, genesPath), "Could not move ExCAPE-DB gene list in place: "+genesPath)
+}
+
+// GeneResolution is how a panel symbol was resolved to an ExCAPE-DB
+// Gene_Symbol and Entrez ID
+type GeneResolution struct {
+	PanelSymbol string
+	Symbol      string // Gene_Symbol in ExCAPE-DB, or the panel symbol if not resolved
+	EntrezID    string
+	Status      string
+	Note        string
+}
+
+// Resolved tells whether the gene can be used in the workflow
+func (r *GeneResolution) Resolved() bool {
+	return r.Status != geneMissing && r.Status != geneAmbiguous
+}
+
+// resolveGenePanel resolves the symbols of a panel, against the genes of
+// ExCAPE-DB, using the alias table for symbols not in ExCAPE-DB. Either of
+// aliases and excapeGenes can be nil, if not available, in which case the
+// symbols are checked as far as possible. Genes sharing an alias with a
+// missing gene (such as KCNE1 and MINK1, which share "MinK") are suggested,
+// but never used without being put in the panel, as shared aliases often name
+// unrelated genes.
+func resolveGenePanel(panel []string, aliases *geneAliasTable, excapeGenes map[string]string) []*GeneResolution {
+	resolutions := []*GeneResolution{}
+	for _, panelSymbol := range panel {
+		symbol := str.ToUpper(panelSymbol)
+		r := &GeneResolution{PanelSymbol: panelSymbol, Symbol: symbol}
+		resolutions = append(resolutions, r)
+		var rec *geneRecord
+		if aliases != nil {
+			rec = aliases.bySymbol[symbol]
+		}
+
+		if excapeGenes == nil {
+			switch {
+			case aliases == nil:
+				r.Status, r.Note = geneUnchecked, "no alias table, and no ExCAPE-DB gene list yet"
+			case rec != nil:
+				r.Status, r.EntrezID, r.Note = geneOK, rec.entrezID, "not checked against ExCAPE-DB, as the gene list does not exist yet"
+			case len(aliases.byAlias[symbol]) == 1:
+				r.Status, r.Symbol, r.EntrezID = geneAlias, aliases.byAlias[symbol][0].symbol, aliases.byAlias[symbol][0].entrezID
+				r.Note = "alias of " + r.Symbol + ", not checked against ExCAPE-DB, as the gene list does not exist yet"
+			case len(aliases.byAlias[symbol]) > 1:
+				r.Status, r.Note = geneAmbiguous, "alias of "+str.Join(recordSymbols(aliases.byAlias[symbol]), ", ")
+			default:
+				r.Status, r.Note = geneUnknown, "not in the alias table"
+			}
+			continue
+		}
+
+		if entrezID, ok := excapeGenes[symbol]; ok {
+			r.Status, r.EntrezID = geneOK, entrezID
+			continue
+		}
+		if aliases == nil {
+			r.Status, r.Note = geneMissing, "not in ExCAPE-DB (use -genealiases to look for aliases)"
+			continue
+		}
+		if rec != nil {
+			if excapeSymbol := symbolOfEntrezID(excapeGenes, rec.entrezID); excapeSymbol != "" {
+				r.Status, r.Symbol, r.EntrezID = geneRenamed, excapeSymbol, rec.entrezID
+				r.Note = "in ExCAPE-DB as " + excapeSymbol + ", with the same Entrez ID"
+				continue
+			}
+		}
+		// Genes in ExCAPE-DB having the panel symbol as an alias
+		candidates := inExcape(aliases.byAlias[symbol], excapeGenes)
+		if len(candidates) == 1 {
+			r.Status, r.Symbol, r.EntrezID = geneAlias, candidates[0], excapeGenes[candidates[0]]
+			r.Note = "alias of " + candidates[0]
+			continue
+		}
+		if len(candidates) > 1 {
+			r.Status, r.Note = geneAmbiguous, "alias of "+str.Join(candidates, ", ")+" in ExCAPE-DB"
+			continue
+		}
+		r.Status, r.Note = geneMissing, "not in ExCAPE-DB"
+		if rec != nil {
+			r.EntrezID = rec.entrezID
+			sharing := []string{}
+			for _, alias := range rec.aliases {
+				for _, other := range inExcape(aliases.byAlias[alias], excapeGenes) {
+					sharing = append(sharing, other+" (shares the alias "+alias+")")
+				}
+			}
+			sort.Strings(sharing)
+			if len(sharing) > 0 {
+				r.Note += ", consider " + str.Join(sharing, ", ")
+			}
+		}
+	}
+	return resolutions
+}
+
+func recordSymbols(recs []*geneRecord) []string {
+	symbols := []string{}
+	for _, rec := range recs {
+		symbols = append(symbols, rec.symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// inExcape returns the sorted symbols of the records in ExCAPE-DB
+func inExcape(recs []*geneRecord, excapeGenes map[string]string) []string {
+	symbols := []string{}
+	for _, rec := range recs {
+		if _, ok := excapeGenes[rec.symbol]; ok {
+			symbols = append(symbols, rec.symbol)
+		}
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+func symbolOfEntrezID(excapeGenes map[string]string, entrezID string) string {
+	if entrezID == "" || entrezID == "-" {
+		return ""
+	}
+	symbols := []string{}
+	for symbol, id := range excapeGenes {
+		if id == entrezID {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.Strings(symbols)
+	if len(symbols) == 0 {
+		return ""
+	}
+	return symbols[0]
+}
+
+// resolveGenePanelOrFail resolves the symbols of a panel, logs the genes not
+// found under their panel symbol, and fails if any gene is missing or
+// ambiguous, unless skipUnresolved is set, in which case they are left out.
+// The genes are resolved against the ExCAPE-DB gene list, which is extracted
+// from ExCAPE-DB, at excapeDBPath, if it does not exist yet. It returns the
+// ExCAPE-DB symbols of the resolved genes, all the resolutions, and whether
+// they were checked against ExCAPE-DB, which they can not be before
+// ExCAPE-DB is downloaded.
+func resolveGenePanelOrFail(panel []string, aliasPath string, taxID string, excapeDBPath string, excapeGenesPath string, skipUnresolved bool) ([]string, []*GeneResolution, bool) {
+	var aliases *geneAliasTable
+	if aliasPath != "" {
+		aliases = readGeneAliasTable(aliasPath, taxID)
+	}
+	excapeGenes := readExcapeGenes(excapeGenesPath)
+	if _, err := os.Stat(excapeDBPath); excapeGenes == nil && err == nil {
+		sp.Audit.Printf("Extracting the ExCAPE-DB gene list (%s) from %s, to resolve the genes against\n", excapeGenesPath, excapeDBPath)
+		writeExcapeGenes(excapeDBPath, excapeGenesPath)
+		excapeGenes = readExcapeGenes(excapeGenesPath)
+	}
+	resolutions := resolveGenePanel(panel, aliases, excapeGenes)
+	symbols := []string{}
+	unresolved := []string{}
+	seen := map[string]string{}
+	for _, r := range resolutions {
+		if prev, ok := seen[r.Symbol]; ok && r.Resolved() {
+			r.Status, r.Note = geneAmbiguous, "resolves to "+r.Symbol+", as does "+prev
+		}
+		switch {
+		case !r.Resolved():
+			sp.Error.Printf("| %-32s | Gene is %s: %s\n", r.PanelSymbol, r.Status, r.Note)
+			unresolved = append(unresolved, r.PanelSymbol)
+		case r.Status != geneOK && r.Status != geneUnchecked:
+			sp.Warning.Printf("| %-32s | Gene is %s, using %s: %s\n", r.PanelSymbol, r.Status, r.Symbol, r.Note)
+		}
+		if r.Resolved() {
+			seen[r.Symbol] = r.PanelSymbol
+			symbols = append(symbols, r.Symbol)
+		}
+	}
+	if len(unresolved) > 0 && !skipUnresolved {
+		sp.Failf("Could not resolve the genes %s, so not running the workflow (use -skipunresolved to leave them out)\n", str.Join(unresolved, ", "))
+	}
+	if len(unresolved) > 0 {
+		sp.Warning.Printf("Leaving out the genes %s, which could not be resolved\n", str.Join(unresolved, ", "))
+	}
+	return symbols, resolutions, excapeGenes != nil
+}
+
+// writeGeneResolutions writes the resolutions to a tab-separated file
+func writeGeneResolutions(path string, resolutions []*GeneResolution) {
+	fh, err := os.Create(path)
+	sp.CheckWithMsg(err, "Could not create gene resolution file: "+path)
+	defer fh.Close()
+	tsvWriter := csv.NewWriter(fh)
+	tsvWriter.Comma = '\t'
+	tsvWriter.Write([]string{"PanelSymbol", "Gene_Symbol", "Entrez_ID", "Status", "Note"})
+	for _, r := range resolutions {
+		tsvWriter.Write([]string{r.PanelSymbol, r.Symbol, r.EntrezID, r.Status, r.Note})
+	}
+	tsvWriter.Flush()
+	sp.CheckWithMsg(tsvWriter.Error(), "Could not write gene resolution file: "+path)
+}
+
+// readGeneSetFile reads a gene set from a file with one gene symbol per line
+// (lines starting with # are comments), adds it to the gene sets, named after
+// the file, and returns its name
+func readGeneSetFile(path string) string {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open gene set file: "+path)
+	defer fh.Close()
+	genes := []string{}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := str.TrimSpace(scanner.Text())
+		if line == "" || str.HasPrefix(line, "#") {
+			continue
+		}
+		genes = append(genes, str.ToUpper(line))
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read gene set file: "+path)
+	if len(genes) == 0 {
+		sp.Failf("No genes in gene set file: %s\n", path)
+	}
+	name := str.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	geneSets[name] = genes
+	return name
+}
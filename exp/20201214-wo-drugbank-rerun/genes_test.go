@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// TestResolveGenePanelFromExcapeDB resolves a panel before the ExCAPE-DB gene
+// list is made by the workflow, from ExCAPE-DB itself
+func TestResolveGenePanelFromExcapeDB(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "resolve_gene_panel_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	dbPath := filepath.Join(tmpDir, "excapedb.tsv")
+	genesPath := filepath.Join(tmpDir, "excapedb.genes.tsv")
+
+	symbols, _, checked := resolveGenePanelOrFail([]string{"DRD1"}, "", "9606", dbPath, genesPath, true)
+	if checked || len(symbols) != 1 {
+		t.Errorf("Resolved %v (checked: %t) without ExCAPE-DB, want [DRD1] unchecked", symbols, checked)
+	}
+
+	header := "Ambit_InchiKey\tOriginal_Entry_ID\tEntrez_ID\tActivity_Flag\tpXC50\tDB\tOriginal_Assay_ID\tTax_ID\tGene_Symbol\tOrtholog_Group\tInChI\tSMILES"
+	rows := []string{
+		"KEY1\tCHEMBL1\t1812\tA\t7.1\tchembl20\t1\t9606\tDRD1\t1\tInChI=1\tCCO",
+		"KEY2\tCHEMBL2\t24316\tN\t4.2\tchembl20\t2\t10116\tDRD1\t1\tInChI=2\tCCN",
+		"KEY3\tCHEMBL3\t1812\tN\t4.9\tchembl20\t3\t9606\tDRD1\t1\tInChI=3\tCCC",
+	}
+	data := header + "\n"
+	for _, row := range rows {
+		data += row + "\n"
+	}
+	if err := ioutil.WriteFile(dbPath, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	symbols, resolutions, checked := resolveGenePanelOrFail([]string{"DRD1", "HTR2B"}, "", "9606", dbPath, genesPath, true)
+	if !checked || len(symbols) != 1 || symbols[0] != "DRD1" {
+		t.Errorf("Resolved %v (checked: %t), want [DRD1] checked", symbols, checked)
+	}
+	wantStatuses := []string{geneOK, geneMissing}
+	for i, r := range resolutions {
+		if r.Status != wantStatuses[i] {
+			t.Errorf("Status of %s = %q, want %q", r.PanelSymbol, r.Status, wantStatuses[i])
+		}
+	}
+
+	genesData, err := ioutil.ReadFile(genesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGenes := "DRD1\t1812\t9606\nDRD1\t24316\t10116\n"
+	if string(genesData) != wantGenes {
+		t.Errorf("ExCAPE-DB gene list = %q, want %q", genesData, wantGenes)
+	}
+}
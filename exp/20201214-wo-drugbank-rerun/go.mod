@@ -1,3 +1,9 @@
 module github.com/pharmbio/ptp-project/exp/20180426-wo-drugbank
 
 go 1.15
+
+require github.com/pharmbio/ptp-project/lib v0.0.0
+
+// Components shared with the other experiments, vendored like the rest of
+// the dependencies (copy the packages in lib into vendor/ after changing them)
+replace github.com/pharmbio/ptp-project/lib => ../../lib
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Workflow graph export
+// ================================================================================
+
+const (
+	graphFormatDOT     = "dot"
+	graphFormatMermaid = "mermaid"
+)
+
+// Node states, based on the output files on disk
+const (
+	nodeStateDone    = "done"
+	nodeStateMissing = "missing"
+	nodeStateFailed  = "failed"
+	nodeStateUnknown = "unknown" // For components, whose outputs are only known at run time
+)
+
+var nodeStateColors = map[string]string{
+	nodeStateDone:    "#a6dba0",
+	nodeStateMissing: "#f7f7f7",
+	nodeStateFailed:  "#f4a582",
+	nodeStateUnknown: "#d9d9d9",
+}
+
+// graphNode is a process, or in a collapsed graph, the same process in all
+// the per-gene branches
+type graphNode struct {
+	id          string
+	label       string
+	component   bool
+	state       string
+	highlighted bool
+}
+
+type graphEdge struct {
+	from  string
+	to    string
+	label string
+	param bool
+}
+
+// workflowGraph is a graph of the processes of a workflow, with the state of
+// each process, based on which of its outputs exist on disk
+type workflowGraph struct {
+	nodes []*graphNode
+	edges []*graphEdge
+}
+
+// newWorkflowGraph creates a graph of the processes upstream of, and
+// including, those matching procNamePattern. If collapse is true, the
+// per-gene branches of the genes in genes are collapsed into one template
+// branch, with the gene replaced by "{gene}" in the process names. Processes
+// in the branch of highlightGene (if not empty) are highlighted, and in a
+// collapsed graph, the template branch shows the state of that gene. Tasks in
+// failedTasks (see readFailedTasks) are shown as failed, unless their outputs
+// have been made since.
+func newWorkflowGraph(wf *sp.Workflow, procNamePattern string, genes []string, collapse bool, highlightGene string, failedTasks map[string]bool) *workflowGraph {
+	wp := newWorkflowPlanner(wf, nil) // The state is decided by which outputs exist
+	tasks := wp.PlanToRegex(procNamePattern)
+
+	geneOf := map[string]string{} // Lower case gene per process name, for processes in a per-gene branch
+	for procName := range wp.planned {
+		for _, tok := range str.Split(procName, "_") {
+			for _, gene := range genes {
+				if tok == str.ToLower(gene) {
+					geneOf[procName] = tok
+				}
+			}
+		}
+	}
+	highlightGene = str.ToLower(highlightGene)
+	nodeName := func(procName string) string {
+		gene, ok := geneOf[procName]
+		if !collapse || !ok {
+			return procName
+		}
+		toks := str.Split(procName, "_")
+		for i, tok := range toks {
+			if tok == gene {
+				toks[i] = "{gene}"
+			}
+		}
+		return str.Join(toks, "_")
+	}
+
+	statesPerNode := map[string][]string{}
+	components := map[string]bool{}
+	for _, t := range tasks {
+		if collapse && highlightGene != "" && geneOf[t.procName] != "" && geneOf[t.procName] != highlightGene {
+			continue // The template branch shows the state of the highlighted gene only
+		}
+		name := nodeName(t.procName)
+		components[name] = t.component
+		statesPerNode[name] = append(statesPerNode[name], taskState(t, failedTasks))
+	}
+
+	g := &workflowGraph{}
+	ids := map[string]string{}
+	procNames := []string{}
+	for procName := range wp.planned {
+		procNames = append(procNames, procName)
+	}
+	sort.Strings(procNames)
+	nodes := map[string]*graphNode{}
+	nodeNums := map[string]int{} // Per node id, to sort the edges in node order
+	for _, procName := range procNames {
+		name := nodeName(procName)
+		if _, ok := nodes[name]; !ok {
+			nodeNums[fmt.Sprintf("n%d", len(ids))] = len(ids)
+			ids[name] = fmt.Sprintf("n%d", len(ids))
+			nodes[name] = &graphNode{
+				id:        ids[name],
+				label:     name,
+				component: components[name],
+				state:     mergeNodeStates(statesPerNode[name]),
+			}
+			g.nodes = append(g.nodes, nodes[name])
+		}
+		if highlightGene != "" && geneOf[procName] == highlightGene {
+			nodes[name].highlighted = true
+		}
+	}
+
+	seenEdges := map[graphEdge]bool{}
+	addEdge := func(e graphEdge) {
+		if !seenEdges[e] {
+			seenEdges[e] = true
+			g.edges = append(g.edges, &graphEdge{from: e.from, to: e.to, label: e.label, param: e.param})
+		}
+	}
+	for _, procName := range procNames {
+		proc := wf.Proc(procName)
+		for _, inPort := range sortedInPorts(proc) {
+			for _, rpt := range sortedRemoteOutPorts(inPort) {
+				if !wp.planned[rpt.Process().Name()] {
+					continue
+				}
+				addEdge(graphEdge{from: ids[nodeName(rpt.Process().Name())], to: ids[nodeName(procName)], label: portLabel(rpt.Name(), inPort.Name())})
+			}
+		}
+		for _, pip := range proc.ParamInPorts() {
+			for _, rpp := range pip.RemotePorts {
+				if rpp.Process() == proc || !wp.planned[rpp.Process().Name()] {
+					continue // Skip the feeders of ConnectStr
+				}
+				addEdge(graphEdge{from: ids[nodeName(rpp.Process().Name())], to: ids[nodeName(procName)], label: portLabel(rpp.Name(), pip.Name()), param: true})
+			}
+		}
+	}
+	sort.SliceStable(g.edges, func(i, j int) bool {
+		if g.edges[i].from != g.edges[j].from {
+			return nodeNums[g.edges[i].from] < nodeNums[g.edges[j].from]
+		}
+		return nodeNums[g.edges[i].to] < nodeNums[g.edges[j].to]
+	})
+	return g
+}
+
+// taskState tells whether all outputs of a planned task exist (done), whether
+// the task failed, or else that it is still to be run (missing), or if its
+// outputs are only known at run time (unknown). A task failed if any of its
+// outputs is a placeholder written by the FailurePolicy, or if it is in
+// failedTasks and its outputs are not all there.
+func taskState(t *plannedTask, failedTasks map[string]bool) string {
+	if t.component {
+		return nodeStateUnknown
+	}
+	state := nodeStateDone
+	for _, path := range t.outPaths {
+		if str.HasPrefix(path, "<") {
+			// Paths starting with a placeholder could match just about anything
+			if state == nodeStateDone {
+				state = nodeStateUnknown
+			}
+			continue
+		}
+		if isPlaceholderFile(path) {
+			return nodeStateFailed
+		}
+		if !pathsExist(path) {
+			state = nodeStateMissing
+		}
+	}
+	if state != nodeStateDone && failedTasks[t.procName] {
+		return nodeStateFailed
+	}
+	return state
+}
+
+// readFailedTasks returns the names of the tasks that failed in earlier runs,
+// from the failure report written with -continue, and from the errors of
+// failed attempts that the FailurePolicy keeps in logDir. Missing files are
+// fine, as they mean that nothing has failed.
+func readFailedTasks(reportPath string, logDir string) map[string]bool {
+	failed := map[string]bool{}
+	if data, err := ioutil.ReadFile(reportPath); err == nil {
+		for _, m := range failureReportTaskPtn.FindAllStringSubmatch(string(data), -1) {
+			failed[m[1]] = true
+		}
+	}
+	logPaths, err := filepath.Glob(logDir + "/*.attempt*.log")
+	sp.CheckWithMsg(err, "Could not list failure logs in: "+logDir)
+	for _, logPath := range logPaths {
+		if m := failureLogPtn.FindStringSubmatch(filepath.Base(logPath)); m != nil {
+			failed[m[1]] = true
+		}
+	}
+	return failed
+}
+
+var (
+	failureReportTaskPtn = regexp.MustCompile(`(?m)^  Task (\S+) failed after`)
+	failureLogPtn        = regexp.MustCompile(`^(.+)\.attempt\d+\.log$`)
+)
+
+// isPlaceholderFile tells whether path is a placeholder output, which the
+// FailurePolicy writes for the tasks of a failed branch, and removes at the
+// end of the run
+func isPlaceholderFile(path string) bool {
+	if planPlaceholderPtn.MatchString(path) {
+		return false
+	}
+	fh, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer fh.Close()
+	buf := make([]byte, len(placeholderPrefix))
+	n, _ := io.ReadFull(fh, buf)
+	return string(buf[:n]) == placeholderPrefix
+}
+
+// pathsExist tells whether path exists, or for paths with placeholders for
+// values only known at run time, whether any file matches it
+func pathsExist(path string) bool {
+	if !planPlaceholderPtn.MatchString(path) {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	matches, err := filepath.Glob(planPlaceholderPtn.ReplaceAllString(path, "*"))
+	return err == nil && len(matches) > 0
+}
+
+// mergeNodeStates returns the state of a node from the states of its tasks:
+// failed if any task failed, missing if any is missing, and done only if all
+// are done
+func mergeNodeStates(states []string) string {
+	merged := nodeStateUnknown
+	for _, state := range states {
+		switch {
+		case state == nodeStateFailed:
+			return nodeStateFailed
+		case state == nodeStateMissing:
+			merged = nodeStateMissing
+		case state == nodeStateDone && merged == nodeStateUnknown:
+			merged = nodeStateDone
+		}
+	}
+	return merged
+}
+
+// portLabel returns an edge label from the full names (process.port) of the
+// connected ports
+func portLabel(fromPortName string, toPortName string) string {
+	shortName := func(portName string) string {
+		return portName[str.LastIndex(portName, ".")+1:]
+	}
+	from, to := shortName(fromPortName), shortName(toPortName)
+	if from == to {
+		return from
+	}
+	return from + " → " + to
+}
+
+// ================================================================================
+// Rendering
+// ================================================================================
+
+// DOT renders the graph in the Graphviz DOT format
+func (g *workflowGraph) DOT() []byte {
+	out := &bytes.Buffer{}
+	out.WriteString("digraph workflow {\n")
+	out.WriteString("  rankdir=LR;\n")
+	out.WriteString("  node [shape=box, style=filled, fontname=Helvetica, fontsize=10];\n")
+	out.WriteString("  edge [fontname=Helvetica, fontsize=8];\n")
+	for _, n := range g.nodes {
+		style := "filled"
+		if n.component {
+			style = "\"filled,rounded\""
+		}
+		penWidth := 1
+		if n.highlighted {
+			penWidth = 3
+		}
+		fmt.Fprintf(out, "  %s [label=%q, style=%s, fillcolor=%q, penwidth=%d];\n", n.id, n.label, style, nodeStateColors[n.state], penWidth)
+	}
+	for _, e := range g.edges {
+		style := "solid"
+		if e.param {
+			style = "dashed"
+		}
+		fmt.Fprintf(out, "  %s -> %s [label=%q, style=%s];\n", e.from, e.to, e.label, style)
+	}
+	out.WriteString("}\n")
+	return out.Bytes()
+}
+
+// mermaidUnsafeChars matches characters that need to be escaped in Mermaid
+// labels
+var mermaidUnsafeChars = regexp.MustCompile(`["{}<>|]`)
+
+// Mermaid renders the graph as a Mermaid flowchart
+func (g *workflowGraph) Mermaid() []byte {
+	escape := func(s string) string {
+		return mermaidUnsafeChars.ReplaceAllStringFunc(s, func(c string) string {
+			return fmt.Sprintf("#%d;", c[0])
+		})
+	}
+	out := &bytes.Buffer{}
+	out.WriteString("flowchart LR\n")
+	for _, state := range []string{nodeStateDone, nodeStateMissing, nodeStateFailed, nodeStateUnknown} {
+		fmt.Fprintf(out, "  classDef %s fill:%s,stroke:#333\n", state, nodeStateColors[state])
+	}
+	out.WriteString("  classDef highlighted stroke-width:4px\n")
+	for _, n := range g.nodes {
+		if n.component {
+			fmt.Fprintf(out, "  %s(\"%s\")\n", n.id, escape(n.label))
+		} else {
+			fmt.Fprintf(out, "  %s[\"%s\"]\n", n.id, escape(n.label))
+		}
+		fmt.Fprintf(out, "  class %s %s\n", n.id, n.state)
+		if n.highlighted {
+			fmt.Fprintf(out, "  class %s highlighted\n", n.id)
+		}
+	}
+	for _, e := range g.edges {
+		arrow := "-->"
+		if e.param {
+			arrow = "-.->"
+		}
+		fmt.Fprintf(out, "  %s %s|\"%s\"| %s\n", e.from, arrow, escape(e.label), e.to)
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+var graphTestGenes = []string{"DRD1", "HTR2B", "OPRM1", "PDE3A", "SLC6A4"}
+
+// newGraphTestWorkflow creates a workflow with a shared download, an extract
+// and a train process per gene, and a report gathering the models
+func newGraphTestWorkflow() *sp.Workflow {
+	wf := sp.NewWorkflow("graph_test", 1)
+	dlDB := wf.NewProc("dl_db", "echo db > {o:db}")
+	dlDB.SetPathStatic("db", "db.tsv")
+	report := NewReportGenerator(wf, "create_report", "report", "Graph test")
+	for _, gene := range graphTestGenes {
+		lcGene := str.ToLower(gene)
+		extract := wf.NewProc("extract_"+lcGene, "grep {p:gene} {i:db} > {o:data}")
+		extract.SetPathStatic("data", lcGene+".tsv")
+		extract.In("db").Connect(dlDB.Out("db"))
+		extract.ParamInPort("gene").ConnectStr(gene)
+		train := wf.NewProc("train_"+lcGene, "cat {i:data} > {o:model}")
+		train.SetPathExtend("data", "model", ".model")
+		train.In("data").Connect(extract.Out("data"))
+		report.InModels().Connect(train.Out("model"))
+	}
+	return wf
+}
+
+func TestReadFailedTasks(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "failed_tasks_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	reportPath := filepath.Join(tmpDir, "failure_report.txt")
+	logDir := filepath.Join(tmpDir, "failures")
+
+	if got := readFailedTasks(reportPath, logDir); len(got) != 0 {
+		t.Errorf("readFailedTasks() without report or logs = %v, want none", got)
+	}
+
+	report := "Failure report, 2020-12-14 10:00\n\n" +
+		"Failed targets: 1 of 2\n\n" +
+		"DRD1\n" +
+		"  Task cpsign_train_drd1_orig_r1 failed after 3 attempt(s): Command failed!\n" +
+		"    log/failures/cpsign_train_drd1_orig_r1.attempt1.log\n" +
+		"  Tasks skipped after the failure: 2\n"
+	if err := ioutil.WriteFile(reportPath, []byte(report), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"cpsign_precomp_htr2b_orig_r1.attempt1.log", "cpsign_precomp_htr2b_orig_r1.attempt2.log", "notes.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(logDir, name), []byte("Command failed!\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := map[string]bool{"cpsign_train_drd1_orig_r1": true, "cpsign_precomp_htr2b_orig_r1": true}
+	if got := readFailedTasks(reportPath, logDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("readFailedTasks() = %v, want %v", got, want)
+	}
+}
+
+// TestWorkflowGraph renders the graph of a workflow where the download and the
+// extraction for DRD1 are done, the training for DRD1 failed (with a failure
+// log), the extraction for HTR2B was skipped after a failure (with a
+// placeholder output), and the rest is still to run
+func TestWorkflowGraph(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "graph_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	files := map[string]string{
+		"db.tsv":    "db\n",
+		"drd1.tsv":  "DRD1\n",
+		"htr2b.tsv": placeholderPrefix + "extract_htr2b, which depends on a failed branch. It will be removed at the end of the run.\n",
+		failureLogDir + "/train_drd1.attempt1.log": "Command failed!\n",
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	failedTasks := readFailedTasks("failure_report.txt", failureLogDir)
+
+	// The edges are in node order, also past n9
+	wantDOT := `digraph workflow {
+  rankdir=LR;
+  node [shape=box, style=filled, fontname=Helvetica, fontsize=10];
+  edge [fontname=Helvetica, fontsize=8];
+  n0 [label="create_report", style="filled,rounded", fillcolor="#d9d9d9", penwidth=1];
+  n1 [label="dl_db", style=filled, fillcolor="#a6dba0", penwidth=1];
+  n2 [label="extract_drd1", style=filled, fillcolor="#a6dba0", penwidth=1];
+  n3 [label="extract_htr2b", style=filled, fillcolor="#f4a582", penwidth=1];
+  n4 [label="extract_oprm1", style=filled, fillcolor="#f7f7f7", penwidth=1];
+  n5 [label="extract_pde3a", style=filled, fillcolor="#f7f7f7", penwidth=1];
+  n6 [label="extract_slc6a4", style=filled, fillcolor="#f7f7f7", penwidth=1];
+  n7 [label="train_drd1", style=filled, fillcolor="#f4a582", penwidth=1];
+  n8 [label="train_htr2b", style=filled, fillcolor="#f7f7f7", penwidth=1];
+  n9 [label="train_oprm1", style=filled, fillcolor="#f7f7f7", penwidth=1];
+  n10 [label="train_pde3a", style=filled, fillcolor="#f7f7f7", penwidth=1];
+  n11 [label="train_slc6a4", style=filled, fillcolor="#f7f7f7", penwidth=1];
+  n1 -> n2 [label="db", style=solid];
+  n1 -> n3 [label="db", style=solid];
+  n1 -> n4 [label="db", style=solid];
+  n1 -> n5 [label="db", style=solid];
+  n1 -> n6 [label="db", style=solid];
+  n2 -> n7 [label="data", style=solid];
+  n3 -> n8 [label="data", style=solid];
+  n4 -> n9 [label="data", style=solid];
+  n5 -> n10 [label="data", style=solid];
+  n6 -> n11 [label="data", style=solid];
+  n7 -> n0 [label="model → models", style=solid];
+  n8 -> n0 [label="model → models", style=solid];
+  n9 -> n0 [label="model → models", style=solid];
+  n10 -> n0 [label="model → models", style=solid];
+  n11 -> n0 [label="model → models", style=solid];
+}
+`
+	if got := newWorkflowGraph(newGraphTestWorkflow(), "create_report", graphTestGenes, false, "", failedTasks).DOT(); string(got) != wantDOT {
+		t.Errorf("DOT() =\n%s\nwant:\n%s", got, wantDOT)
+	}
+
+	// The template branch shows the state of the highlighted gene
+	wantMermaid := `flowchart LR
+  classDef done fill:#a6dba0,stroke:#333
+  classDef missing fill:#f7f7f7,stroke:#333
+  classDef failed fill:#f4a582,stroke:#333
+  classDef unknown fill:#d9d9d9,stroke:#333
+  classDef highlighted stroke-width:4px
+  n0("create_report")
+  class n0 unknown
+  n1["dl_db"]
+  class n1 done
+  n2["extract_#123;gene#125;"]
+  class n2 done
+  class n2 highlighted
+  n3["train_#123;gene#125;"]
+  class n3 failed
+  class n3 highlighted
+  n1 -->|"db"| n2
+  n2 -->|"data"| n3
+  n3 -->|"model → models"| n0
+`
+	if got := newWorkflowGraph(newGraphTestWorkflow(), "create_report", graphTestGenes, true, "drd1", failedTasks).Mermaid(); string(got) != wantMermaid {
+		t.Errorf("Mermaid() =\n%s\nwant:\n%s", got, wantMermaid)
+	}
+}
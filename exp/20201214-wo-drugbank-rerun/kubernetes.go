@@ -0,0 +1,312 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	str "strings"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Kubernetes executor
+// ================================================================================
+
+// KubernetesConfig configures how KubernetesExecutor runs jobs. The workflow
+// directory must be on a shared volume, given by VolumeClaim, which is
+// mounted at MountPath in the job containers, where WorkDir is the workflow
+// directory. Resources are given per kind of process (such as "crossval" or
+// "train"), with the "default" resources used for kinds not listed. The
+// kubectl command can be replaced, for example by the fake one in
+// bin/fakekube, to test the executor without a cluster.
+type KubernetesConfig struct {
+	Namespace       string                        `json:"namespace"`
+	Image           string                        `json:"image"`
+	ServiceAccount  string                        `json:"service_account"`
+	VolumeClaim     string                        `json:"volume_claim"`
+	MountPath       string                        `json:"mount_path"`
+	WorkDir         string                        `json:"work_dir"`
+	Resources       map[string]kubernetesResource `json:"resources"`
+	PollInterval    string                        `json:"poll_interval"`
+	LogDir          string                        `json:"log_dir"`
+	DeleteSucceeded bool                          `json:"delete_succeeded"`
+	Kubectl         string                        `json:"kubectl"`
+}
+
+// kubernetesResource holds the resource requests (and limits) of a container
+type kubernetesResource struct {
+	CPU    string `json:"cpu"`
+	Memory string `json:"memory"`
+}
+
+// defaultKubernetesConfig returns defaults giving each CPSign task the four
+// cores it was given with SLURM
+func defaultKubernetesConfig() *KubernetesConfig {
+	return &KubernetesConfig{
+		Namespace: "default",
+		Image:     "pharmbio/ptp-cpsign:latest",
+		MountPath: "/data",
+		Resources: map[string]kubernetesResource{
+			"default": {CPU: "4", Memory: "8Gi"},
+		},
+		PollInterval:    "10s",
+		LogDir:          "log/kubernetes",
+		DeleteSucceeded: true,
+		Kubectl:         "kubectl",
+	}
+}
+
+// readKubernetesConfig reads a KubernetesConfig from a JSON file, with the
+// settings not in the file taken from defaultKubernetesConfig
+func readKubernetesConfig(path string) *KubernetesConfig {
+	cfg := defaultKubernetesConfig()
+	if path == "" {
+		return cfg
+	}
+	defaultResources := cfg.Resources
+	data, err := ioutil.ReadFile(path)
+	sp.CheckWithMsg(err, "Could not read Kubernetes config file: "+path)
+	sp.CheckWithMsg(json.Unmarshal(data, cfg), "Could not parse Kubernetes config file: "+path)
+	for kind, res := range defaultResources {
+		if _, ok := cfg.Resources[kind]; !ok {
+			cfg.Resources[kind] = res
+		}
+	}
+	if cfg.WorkDir == "" {
+		cfg.WorkDir = cfg.MountPath
+	}
+	return cfg
+}
+
+// KubernetesExecutor runs the tasks of processes as Kubernetes Jobs, one per
+// task, by way of kubectl. Each job runs the task command in the configured
+// image, with the shared volume mounted. The executor polls the job until it
+// succeeds or fails, and saves the job log in LogDir. If a job fails, or does
+// not produce its outputs, the task fails with the end of the job log.
+type KubernetesExecutor struct {
+	Config       *KubernetesConfig
+	pollInterval time.Duration
+}
+
+func NewKubernetesExecutor(cfg *KubernetesConfig) *KubernetesExecutor {
+	if cfg.VolumeClaim == "" {
+		sp.Failf("No volume claim specified for the shared volume, in the Kubernetes config\n")
+	}
+	pollInterval, err := time.ParseDuration(cfg.PollInterval)
+	sp.CheckWithMsg(err, "Could not parse Kubernetes poll interval: "+cfg.PollInterval)
+	sp.CheckWithMsg(os.MkdirAll(cfg.LogDir, 0755), "Could not create Kubernetes log directory: "+cfg.LogDir)
+	return &KubernetesExecutor{
+		Config:       cfg,
+		pollInterval: pollInterval,
+	}
+}
+
+// Apply makes the tasks of p run as Kubernetes Jobs, with the resources for
+// kind
+func (e *KubernetesExecutor) Apply(p *sp.Process, kind string) {
+	setTaskExecFunc(p, func(t *sp.Task) error {
+		jobName := kubernetesJobName(t.Name, t.Command)
+		logPath := e.Config.LogDir + "/" + jobName + ".log"
+
+		// Remove any job left from a previous run of the same task
+		if out, err := e.kubectl("delete", "job", jobName, "--ignore-not-found"); err != nil {
+			return fmt.Errorf("Could not delete old Kubernetes job %s: %s", jobName, out)
+		}
+		manifest, err := json.Marshal(e.jobManifest(jobName, kind, t))
+		sp.Check(err)
+		manifestPath := e.Config.LogDir + "/" + jobName + ".json"
+		sp.CheckWithMsg(ioutil.WriteFile(manifestPath, manifest, 0644), "Could not write Kubernetes job manifest: "+manifestPath)
+		if out, err := e.kubectl("create", "-f", manifestPath); err != nil {
+			return fmt.Errorf("Could not create Kubernetes job %s: %s", jobName, out)
+		}
+		sp.Audit.Printf("| %-32s | Created Kubernetes job %s\n", t.Name, jobName)
+
+		succeeded := e.wait(t.Name, jobName)
+		usage := &taskUsage{executor: "kubernetes", jobID: jobName, exitStatus: 1}
+		if succeeded {
+			usage.exitStatus = 0
+		}
+		metricsLog.reportUsage(t, usage)
+		logs, err := e.kubectl("logs", "job/"+jobName, "--all-containers")
+		if err != nil {
+			logs = "(Could not get job logs: " + logs + ")"
+		}
+		sp.CheckWithMsg(ioutil.WriteFile(logPath, []byte(logs), 0644), "Could not write Kubernetes job log: "+logPath)
+		if !succeeded {
+			return fmt.Errorf("Kubernetes job %s failed. End of log %s:\n%s", jobName, logPath, logTail(logPath, 40))
+		}
+		for _, oip := range t.OutIPs {
+			if _, err := os.Stat(oip.TempPath()); err != nil {
+				return fmt.Errorf("Kubernetes job %s succeeded, but did not produce %s. End of log %s:\n%s", jobName, oip.TempPath(), logPath, logTail(logPath, 40))
+			}
+		}
+		if e.Config.DeleteSucceeded {
+			if out, err := e.kubectl("delete", "job", jobName, "--ignore-not-found"); err != nil {
+				sp.Warning.Printf("| %-32s | Could not delete Kubernetes job %s: %s\n", t.Name, jobName, out)
+			}
+		}
+		sp.Audit.Printf("| %-32s | Kubernetes job %s succeeded\n", t.Name, jobName)
+		return nil
+	})
+}
+
+// jobManifest returns a batch/v1 Job running the command of t
+func (e *KubernetesExecutor) jobManifest(jobName string, kind string, t *sp.Task) map[string]interface{} {
+	res, ok := e.Config.Resources[kind]
+	if !ok {
+		res = e.Config.Resources["default"]
+	}
+	resources := map[string]string{}
+	if res.CPU != "" {
+		resources["cpu"] = res.CPU
+	}
+	if res.Memory != "" {
+		resources["memory"] = res.Memory
+	}
+	labels := map[string]string{
+		"app":          "ptp",
+		"ptp-process":  kubernetesLabelValue(t.Name),
+		"ptp-workflow": "wo-drugbank",
+	}
+	podSpec := map[string]interface{}{
+		"restartPolicy": "Never",
+		"containers": []interface{}{
+			map[string]interface{}{
+				"name":       "task",
+				"image":      e.Config.Image,
+				"command":    []string{"bash", "-c", t.Command},
+				"workingDir": e.Config.WorkDir,
+				"resources": map[string]interface{}{
+					"requests": resources,
+					"limits":   resources,
+				},
+				"volumeMounts": []interface{}{
+					map[string]string{"name": "data", "mountPath": e.Config.MountPath},
+				},
+			},
+		},
+		"volumes": []interface{}{
+			map[string]interface{}{
+				"name":                  "data",
+				"persistentVolumeClaim": map[string]string{"claimName": e.Config.VolumeClaim},
+			},
+		},
+	}
+	if e.Config.ServiceAccount != "" {
+		podSpec["serviceAccountName"] = e.Config.ServiceAccount
+	}
+	return map[string]interface{}{
+		"apiVersion": "batch/v1",
+		"kind":       "Job",
+		"metadata": map[string]interface{}{
+			"name":      jobName,
+			"namespace": e.Config.Namespace,
+			"labels":    labels,
+		},
+		"spec": map[string]interface{}{
+			"backoffLimit": 0, // Failing tasks are not retried, as with local execution
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{"labels": labels},
+				"spec":     podSpec,
+			},
+		},
+	}
+}
+
+// wait polls the job until it has succeeded or failed, and tells whether it
+// succeeded
+func (e *KubernetesExecutor) wait(taskName string, jobName string) bool {
+	for {
+		time.Sleep(e.pollInterval)
+		out, err := e.kubectl("get", "job", jobName, "-o", "json")
+		if err != nil {
+			sp.Warning.Printf("| %-32s | Could not get status of Kubernetes job %s, will try again: %s\n", taskName, jobName, out)
+			continue
+		}
+		job := &kubernetesJob{}
+		if err := json.Unmarshal([]byte(out), job); err != nil {
+			sp.Warning.Printf("| %-32s | Could not parse status of Kubernetes job %s, will try again: %s\n", taskName, jobName, err)
+			continue
+		}
+		if done, succeeded := job.finished(); done {
+			return succeeded
+		}
+	}
+}
+
+func (e *KubernetesExecutor) kubectl(args ...string) (string, error) {
+	return runCmdCombinedOutput(e.Config.Kubectl, append([]string{"--namespace", e.Config.Namespace}, args...)...)
+}
+
+// kubernetesJob holds the parts of a Job we need, from kubectl get -o json
+type kubernetesJob struct {
+	Status struct {
+		Succeeded  int `json:"succeeded"`
+		Failed     int `json:"failed"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+// finished tells whether the job is done, and if so, whether it succeeded, by
+// its Complete and Failed conditions, or else by its counts of succeeded and
+// failed pods
+func (job *kubernetesJob) finished() (done bool, succeeded bool) {
+	for _, cond := range job.Status.Conditions {
+		if cond.Status != "True" {
+			continue
+		}
+		if cond.Type == "Complete" {
+			return true, true
+		}
+		if cond.Type == "Failed" {
+			return true, false
+		}
+	}
+	if job.Status.Succeeded > 0 {
+		return true, true
+	}
+	if job.Status.Failed > 0 {
+		return true, false
+	}
+	return false, false
+}
+
+// ================================================================================
+// Helpers
+// ================================================================================
+
+var kubernetesInvalidNameChars = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// kubernetesJobName returns a valid job name (a DNS-1123 label) from the task
+// name, with a hash of the command appended, as task names are not unique
+// across runs with different parameters. Task names without any valid
+// characters give "task", as the name must start with a letter or digit.
+func kubernetesJobName(taskName string, cmd string) string {
+	name := kubernetesLabelValue(taskName)
+	if len(name) > 53 {
+		name = str.Trim(name[:53], "-")
+	}
+	if name == "" {
+		name = "task"
+	}
+	return fmt.Sprintf("%s-%x", name, sha1.Sum([]byte(cmd)))[:len(name)+9]
+}
+
+// kubernetesLabelValue returns s in lower case, with characters not allowed
+// in Kubernetes names and label values replaced by dashes
+func kubernetesLabelValue(s string) string {
+	name := kubernetesInvalidNameChars.ReplaceAllString(str.ToLower(s), "-")
+	name = str.Trim(name, "-")
+	if len(name) > 63 {
+		name = str.Trim(name[:63], "-")
+	}
+	return name
+}
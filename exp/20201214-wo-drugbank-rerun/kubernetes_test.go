@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	str "strings"
+	"testing"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+var dns1123Label = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+func TestKubernetesJobName(t *testing.T) {
+	tests := []struct {
+		taskName   string
+		wantPrefix string
+	}{
+		{"crossval_DRD2_fill_r1_c10", "crossval-drd2-fill-r1-c10-"},
+		{"Train_CHRM1", "train-chrm1-"},
+		{"__validate__", "validate-"},
+		{"___", "task-"},
+		{"", "task-"},
+		{"ÅÄÖ", "task-"},
+		{str.Repeat("a", 70), str.Repeat("a", 53) + "-"},
+		{str.Repeat("a", 52) + "_b", str.Repeat("a", 52) + "-"},
+	}
+	for _, tt := range tests {
+		name := kubernetesJobName(tt.taskName, "echo hello")
+		if !str.HasPrefix(name, tt.wantPrefix) || len(name) != len(tt.wantPrefix)+8 {
+			t.Errorf("kubernetesJobName(%q) = %q, want %q followed by 8 hex characters", tt.taskName, name, tt.wantPrefix)
+		}
+		if !dns1123Label.MatchString(name) || len(name) > 63 {
+			t.Errorf("kubernetesJobName(%q) = %q, which is not a valid job name", tt.taskName, name)
+		}
+	}
+	if kubernetesJobName("train_DRD2", "echo a") == kubernetesJobName("train_DRD2", "echo b") {
+		t.Errorf("kubernetesJobName gives the same name for different commands")
+	}
+}
+
+func TestKubernetesJobManifest(t *testing.T) {
+	cfg := defaultKubernetesConfig()
+	cfg.Namespace = "ptp"
+	cfg.VolumeClaim = "ptp-data"
+	cfg.WorkDir = "/data/exp"
+	cfg.ServiceAccount = "ptp-runner"
+	cfg.Resources["train"] = kubernetesResource{CPU: "2", Memory: "4Gi"}
+	e := &KubernetesExecutor{Config: cfg}
+	task := &sp.Task{Name: "train_DRD2", Command: "java -jar cpsign.jar train"}
+
+	tests := []struct {
+		kind          string
+		wantResources map[string]string
+	}{
+		{"train", map[string]string{"cpu": "2", "memory": "4Gi"}},
+		{"crossval", map[string]string{"cpu": "4", "memory": "8Gi"}},
+	}
+	for _, tt := range tests {
+		// Compare as JSON, the way the manifest is given to kubectl
+		data, err := json.Marshal(e.jobManifest("train-drd2-0123abcd", tt.kind, task))
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := struct {
+			APIVersion string `json:"apiVersion"`
+			Kind       string `json:"kind"`
+			Metadata   struct {
+				Name      string            `json:"name"`
+				Namespace string            `json:"namespace"`
+				Labels    map[string]string `json:"labels"`
+			} `json:"metadata"`
+			Spec struct {
+				BackoffLimit int `json:"backoffLimit"`
+				Template     struct {
+					Spec struct {
+						RestartPolicy      string `json:"restartPolicy"`
+						ServiceAccountName string `json:"serviceAccountName"`
+						Containers         []struct {
+							Image        string   `json:"image"`
+							Command      []string `json:"command"`
+							WorkingDir   string   `json:"workingDir"`
+							Resources    map[string]map[string]string
+							VolumeMounts []map[string]string `json:"volumeMounts"`
+						} `json:"containers"`
+						Volumes []struct {
+							Name                  string            `json:"name"`
+							PersistentVolumeClaim map[string]string `json:"persistentVolumeClaim"`
+						} `json:"volumes"`
+					} `json:"spec"`
+				} `json:"template"`
+			} `json:"spec"`
+		}{}
+		if err := json.Unmarshal(data, &job); err != nil {
+			t.Fatal(err)
+		}
+		if job.APIVersion != "batch/v1" || job.Kind != "Job" {
+			t.Errorf("Manifest is a %s %s, want a batch/v1 Job", job.APIVersion, job.Kind)
+		}
+		if job.Metadata.Name != "train-drd2-0123abcd" || job.Metadata.Namespace != "ptp" {
+			t.Errorf("Manifest has name %q in namespace %q", job.Metadata.Name, job.Metadata.Namespace)
+		}
+		if job.Metadata.Labels["ptp-process"] != "train-drd2" {
+			t.Errorf("Manifest has process label %q, want %q", job.Metadata.Labels["ptp-process"], "train-drd2")
+		}
+		if job.Spec.BackoffLimit != 0 || job.Spec.Template.Spec.RestartPolicy != "Never" {
+			t.Errorf("Manifest lets Kubernetes retry the job")
+		}
+		podSpec := job.Spec.Template.Spec
+		if podSpec.ServiceAccountName != "ptp-runner" {
+			t.Errorf("Manifest has service account %q, want %q", podSpec.ServiceAccountName, "ptp-runner")
+		}
+		if len(podSpec.Containers) != 1 {
+			t.Fatalf("Manifest has %d containers, want 1", len(podSpec.Containers))
+		}
+		c := podSpec.Containers[0]
+		if want := []string{"bash", "-c", task.Command}; !reflect.DeepEqual(c.Command, want) {
+			t.Errorf("Container command = %q, want %q", c.Command, want)
+		}
+		if c.Image != cfg.Image || c.WorkingDir != "/data/exp" {
+			t.Errorf("Container has image %q and working dir %q", c.Image, c.WorkingDir)
+		}
+		if !reflect.DeepEqual(c.Resources["requests"], tt.wantResources) || !reflect.DeepEqual(c.Resources["limits"], tt.wantResources) {
+			t.Errorf("Container resources for %s = %v, want requests and limits %v", tt.kind, c.Resources, tt.wantResources)
+		}
+		if len(c.VolumeMounts) != 1 || c.VolumeMounts[0]["mountPath"] != "/data" || c.VolumeMounts[0]["name"] != "data" {
+			t.Errorf("Container volume mounts = %v", c.VolumeMounts)
+		}
+		if len(podSpec.Volumes) != 1 || podSpec.Volumes[0].Name != "data" || podSpec.Volumes[0].PersistentVolumeClaim["claimName"] != "ptp-data" {
+			t.Errorf("Pod volumes = %+v", podSpec.Volumes)
+		}
+	}
+}
+
+func TestKubernetesJobFinished(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        string
+		wantDone      bool
+		wantSucceeded bool
+	}{
+		{"no status yet", `{}`, false, false},
+		{"running", `{"active": 1}`, false, false},
+		{"complete", `{"succeeded": 1, "conditions": [{"type": "Complete", "status": "True"}]}`, true, true},
+		{"failed", `{"failed": 1, "conditions": [{"type": "Failed", "status": "True"}]}`, true, false},
+		{"failed condition wins over counts", `{"succeeded": 1, "conditions": [{"type": "Failed", "status": "True"}]}`, true, false},
+		{"false conditions are ignored", `{"active": 1, "conditions": [{"type": "Failed", "status": "False"}, {"type": "Complete", "status": "False"}]}`, false, false},
+		{"suspended", `{"conditions": [{"type": "Suspended", "status": "True"}]}`, false, false},
+		{"succeeded pod without condition", `{"succeeded": 1}`, true, true},
+		{"failed pod without condition", `{"failed": 1}`, true, false},
+	}
+	for _, tt := range tests {
+		job := &kubernetesJob{}
+		if err := json.Unmarshal([]byte(`{"status": `+tt.status+`}`), job); err != nil {
+			t.Fatal(err)
+		}
+		done, succeeded := job.finished()
+		if done != tt.wantDone || succeeded != tt.wantSucceeded {
+			t.Errorf("%s: finished() = %t, %t, want %t, %t", tt.name, done, succeeded, tt.wantDone, tt.wantSucceeded)
+		}
+	}
+}
+
+// TestKubernetesWait checks that wait keeps polling through kubectl errors,
+// unparseable output and running jobs, until the job is done
+func TestKubernetesWait(t *testing.T) {
+	sp.InitLogError()
+	tests := []struct {
+		finalStatus string
+		want        bool
+	}{
+		{`{"status": {"succeeded": 1, "conditions": [{"type": "Complete", "status": "True"}]}}`, true},
+		{`{"status": {"failed": 1, "conditions": [{"type": "Failed", "status": "True"}]}}`, false},
+	}
+	for _, tt := range tests {
+		dir, err := ioutil.TempDir("", "kubernetes_wait_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		// Fake kubectl giving an error, then garbage, then a running job, and
+		// then the final status
+		kubectl := filepath.Join(dir, "kubectl")
+		script := `#!/bin/bash
+n=$(cat ` + dir + `/polls 2>/dev/null || echo 0)
+echo $((n+1)) > ` + dir + `/polls
+case $n in
+    0) echo "Unable to connect to the server" >&2; exit 1 ;;
+    1) echo "not json" ;;
+    2) echo '{"status": {"active": 1}}' ;;
+    *) echo '` + tt.finalStatus + `' ;;
+esac
+`
+		if err := ioutil.WriteFile(kubectl, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+		cfg := defaultKubernetesConfig()
+		cfg.Kubectl = kubectl
+		e := &KubernetesExecutor{Config: cfg, pollInterval: time.Millisecond}
+		if got := e.wait("train_DRD2", "train-drd2-0123abcd"); got != tt.want {
+			t.Errorf("wait() = %t, want %t", got, tt.want)
+		}
+		polls, err := ioutil.ReadFile(filepath.Join(dir, "polls"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if str.TrimSpace(string(polls)) != "4" {
+			t.Errorf("wait() polled %s times, want 4", str.TrimSpace(string(polls)))
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	str "strings"
+
+	ptpc "github.com/pharmbio/ptp-project/lib/components"
+	sp "github.com/scipipe/scipipe"
+)
+
+// Sources of the activity labels
+const (
+	labelsExcape = "excape"
+	labelsPXC50  = "pxc50"
+)
+
+var labelSources = []string{labelsExcape, labelsPXC50}
+
+// ================================================================================
+// Activity thresholds
+// ================================================================================
+
+// ActivityThreshold decides the activity label of a row from its pXC50 value.
+// Rows with a pXC50 of at least Threshold are active, and the others
+// non-active, except for those less than GreyZone from the threshold, which
+// are left out of the data.
+type ActivityThreshold struct {
+	Threshold float64 `json:"threshold"`
+	GreyZone  float64 `json:"grey_zone"`
+}
+
+// label returns the label (A or N) for a pXC50 value, or "" if it is in the
+// grey zone
+func (th ActivityThreshold) label(pxc50 float64) string {
+	if math.Abs(pxc50-th.Threshold) < th.GreyZone {
+		return ""
+	}
+	if pxc50 >= th.Threshold {
+		return "A"
+	}
+	return "N"
+}
+
+func (th ActivityThreshold) String() string {
+	return fmt.Sprintf("%g+-%g", th.Threshold, th.GreyZone)
+}
+
+// readActivityThresholds reads the thresholds per target (gene) from a JSON
+// file, such as {"default": {"threshold": 6}, "PDE3A": {"threshold": 5,
+// "grey_zone": 0.5}}, with the "default" threshold used for the other
+// targets. Thresholds not in the file (and the grey zones of targets in the
+// file without one) are taken from defaultThreshold.
+func readActivityThresholds(path string, defaultThreshold ActivityThreshold) map[string]ActivityThreshold {
+	thresholds := map[string]ActivityThreshold{"default": defaultThreshold}
+	if path == "" {
+		return thresholds
+	}
+	data, err := ioutil.ReadFile(path)
+	sp.CheckWithMsg(err, "Could not read label config file: "+path)
+	fromFile := map[string]map[string]float64{}
+	sp.CheckWithMsg(json.Unmarshal(data, &fromFile), "Could not parse label config file: "+path)
+	if def, ok := fromFile["default"]; ok {
+		thresholds["default"] = activityThresholdFrom(def, defaultThreshold, "default", path)
+	}
+	for target, values := range fromFile {
+		if target != "default" {
+			thresholds[str.ToUpper(target)] = activityThresholdFrom(values, thresholds["default"], target, path)
+		}
+	}
+	return thresholds
+}
+
+func activityThresholdFrom(values map[string]float64, def ActivityThreshold, target string, path string) ActivityThreshold {
+	th := def
+	for name, v := range values {
+		switch name {
+		case "threshold":
+			th.Threshold = v
+		case "grey_zone":
+			if v < 0 {
+				sp.Failf("grey_zone can not be negative, for %s in label config file %s\n", target, path)
+			}
+			th.GreyZone = v
+		default:
+			sp.Failf("Unknown setting %s for %s in label config file %s\n", name, target, path)
+		}
+	}
+	return th
+}
+
+// thresholdsString lists the thresholds, sorted by target, for the audit logs
+// and cache keys of the labeling process
+func thresholdsString(thresholds map[string]ActivityThreshold) string {
+	targets := []string{}
+	for target := range thresholds {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	parts := []string{}
+	for _, target := range targets {
+		parts = append(parts, target+":"+thresholds[target].String())
+	}
+	return str.Join(parts, ",")
+}
+
+// ================================================================================
+// Relabeling
+// ================================================================================
+
+// RelabelActivities is a SciPipe process extracting a gene/id/smiles/activity
+// (gisa) file from ExCAPE-DB, like extract_gene_id_smiles_activity, but with
+// the activity labels derived from the pXC50 values, with the threshold of
+// each target, instead of taken from the Activity_Flag column. Rows without a
+// pXC50 value keep their Activity_Flag, and rows in the grey zone of their
+// target are left out. The output is NOT sorted. A report per target tells how
+// many rows were relabeled, left out and kept.
+type RelabelActivities struct {
+	*sp.Process
+	Thresholds map[string]ActivityThreshold
+}
+
+func (p *RelabelActivities) InExcapeDB() *sp.InPort { return p.In("excapedb") }
+func (p *RelabelActivities) OutGISA() *sp.OutPort   { return p.Out("gisa") }
+func (p *RelabelActivities) OutReport() *sp.OutPort { return p.Out("report") }
+
+func NewRelabelActivities(wf *sp.Workflow, procName string, reportFileName string, thresholds map[string]ActivityThreshold) *RelabelActivities {
+	p := &RelabelActivities{
+		Process:    wf.NewProc(procName, "# RelabelActivities custom process. Ports: {i:excapedb} {o:gisa} {o:report} thresholds:{p:thresholds}"),
+		Thresholds: thresholds,
+	}
+	p.SetPathReplace("excapedb", "gisa", ".tsv", ".gisa_pxc50_unsorted.tsv")
+	p.SetPathStatic("report", reportFileName)
+	p.ParamInPort("thresholds").ConnectStr(thresholdsString(thresholds))
+	p.CustomExecute = p.execute
+	return p
+}
+
+// relabelCounts holds the counts of the relabel report, for one target
+type relabelCounts struct {
+	rows, toActive, toNonactive, greyZone, noPXC50, actives, nonactives int
+}
+
+func (p *RelabelActivities) execute(t *sp.Task) {
+	inFh, err := os.Open(t.InPath("excapedb"))
+	sp.CheckWithMsg(err, "Could not open file: "+t.InPath("excapedb"))
+	defer inFh.Close()
+	outPath := t.OutIP("gisa").TempPath()
+	outFh, err := os.Create(outPath)
+	sp.CheckWithMsg(err, "Could not create file: "+outPath)
+	outWrt := bufio.NewWriter(outFh)
+
+	counts := map[string]*relabelCounts{}
+	scanner := bufio.NewScanner(inFh)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		row := str.Split(scanner.Text(), "\t")
+		if lineNo == 1 || len(row) <= excapeColSmiles {
+			continue // Header, or incomplete row
+		}
+		gene := row[excapeColGene]
+		c, ok := counts[gene]
+		if !ok {
+			c = &relabelCounts{}
+			counts[gene] = c
+		}
+		c.rows++
+		label := row[excapeColActivity]
+		if pxc50, err := strconv.ParseFloat(row[excapeColPXC50], 64); err == nil && !math.IsNaN(pxc50) {
+			th, ok := p.Thresholds[str.ToUpper(gene)]
+			if !ok {
+				th = p.Thresholds["default"]
+			}
+			newLabel := th.label(pxc50)
+			switch {
+			case newLabel == "":
+				c.greyZone++
+				continue
+			case newLabel == "A" && label != "A":
+				c.toActive++
+			case newLabel == "N" && label != "N":
+				c.toNonactive++
+			}
+			label = newLabel
+		} else {
+			c.noPXC50++
+		}
+		switch label {
+		case "A":
+			c.actives++
+		case "N":
+			c.nonactives++
+		}
+		outWrt.WriteString(gene + "\t" + row[1] + "\t" + row[excapeColSmiles] + "\t" + label + "\n")
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read file: "+t.InPath("excapedb"))
+	sp.CheckWithMsg(outWrt.Flush(), "Could not write file: "+outPath)
+	outFh.Close()
+
+	reportPath := t.OutIP("report").TempPath()
+	reportFh, err := os.Create(reportPath)
+	sp.CheckWithMsg(err, "Could not create file: "+reportPath)
+	defer reportFh.Close()
+	tsvWrt := csv.NewWriter(reportFh)
+	tsvWrt.Comma = '\t'
+	tsvWrt.Write([]string{"Gene", "Threshold", "GreyZone", "Rows", "RelabeledToActive", "RelabeledToNonactive", "InGreyZone", "WithoutPXC50", "ActiveRows", "NonactiveRows"})
+	genes := []string{}
+	for gene := range counts {
+		genes = append(genes, gene)
+	}
+	sort.Strings(genes)
+	for _, gene := range genes {
+		c := counts[gene]
+		th, ok := p.Thresholds[str.ToUpper(gene)]
+		if !ok {
+			th = p.Thresholds["default"]
+		}
+		tsvWrt.Write([]string{
+			gene,
+			ptpc.FmtFloat(th.Threshold),
+			ptpc.FmtFloat(th.GreyZone),
+			fmt.Sprintf("%d", c.rows),
+			fmt.Sprintf("%d", c.toActive),
+			fmt.Sprintf("%d", c.toNonactive),
+			fmt.Sprintf("%d", c.greyZone),
+			fmt.Sprintf("%d", c.noPXC50),
+			fmt.Sprintf("%d", c.actives),
+			fmt.Sprintf("%d", c.nonactives),
+		})
+	}
+	tsvWrt.Flush()
+	sp.CheckWithMsg(tsvWrt.Error(), "Could not write file: "+reportPath)
+	sp.Audit.Printf("| %-32s | Relabeled the activities of %d genes by pXC50 (%s)\n", t.Name, len(genes), thresholdsString(p.Thresholds))
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestActivityThresholdLabel(t *testing.T) {
+	tests := []struct {
+		th    ActivityThreshold
+		pxc50 float64
+		want  string
+	}{
+		{ActivityThreshold{6, 0.5}, 7.0, "A"},
+		{ActivityThreshold{6, 0.5}, 6.5, "A"}, // The edges of the grey zone are kept
+		{ActivityThreshold{6, 0.5}, 6.2, ""},
+		{ActivityThreshold{6, 0.5}, 6.0, ""},
+		{ActivityThreshold{6, 0.5}, 5.8, ""},
+		{ActivityThreshold{6, 0.5}, 5.5, "N"},
+		{ActivityThreshold{6, 0}, 6.0, "A"},
+		{ActivityThreshold{6, 0}, 5.99, "N"},
+	}
+	for _, tt := range tests {
+		if got := tt.th.label(tt.pxc50); got != tt.want {
+			t.Errorf("ActivityThreshold{%s}.label(%g) = %q, want %q", tt.th, tt.pxc50, got, tt.want)
+		}
+	}
+}
+
+func TestReadActivityThresholds(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "label_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "labels.json")
+	config := `{"default": {"threshold": 6.5}, "pde3a": {"threshold": 5}, "DRD1": {"grey_zone": 1}}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want map[string]ActivityThreshold
+	}{
+		{"", map[string]ActivityThreshold{"default": {6, 0.3}}},
+		{path, map[string]ActivityThreshold{"default": {6.5, 0.3}, "PDE3A": {5, 0.3}, "DRD1": {6.5, 1}}},
+	}
+	for _, tt := range tests {
+		if got := readActivityThresholds(tt.path, ActivityThreshold{6, 0.3}); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readActivityThresholds(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+	if got, want := thresholdsString(readActivityThresholds(path, ActivityThreshold{6, 0.3})), "DRD1:6.5+-1,PDE3A:5+-0.3,default:6.5+-0.3"; got != want {
+		t.Errorf("thresholdsString() = %q, want %q", got, want)
+	}
+}
+
+// TestRelabelActivities relabels rows of two genes, one with the default
+// threshold and a grey zone, and one with its own threshold
+func TestRelabelActivities(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "relabel_activities_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	// ID, activity flag, pXC50 and gene
+	rows := [][]string{
+		{"CHEMBL1", "A", "7.0", "DRD1"},
+		{"CHEMBL2", "N", "6.8", "DRD1"}, // Relabeled to active
+		{"CHEMBL3", "A", "6.2", "DRD1"}, // In the grey zone
+		{"CHEMBL4", "A", "5.0", "DRD1"}, // Relabeled to non-active
+		{"CHEMBL5", "A", "", "DRD1"},    // Without pXC50
+		{"CHEMBL6", "N", "5.0", "PDE3A"},
+		{"CHEMBL7", "N", "4.9", "PDE3A"},
+	}
+	lines := []string{"Ambit_InchiKey\tOriginal_Entry_ID\tEntrez_ID\tActivity_Flag\tpXC50\tDB\tOriginal_Assay_ID\tTax_ID\tGene_Symbol\tOrtholog_Group\tInChI\tSMILES"}
+	for i, r := range rows {
+		lines = append(lines, str.Join([]string{"KEY", r[0], "1", r[1], r[2], "chembl20", "1", "9606", r[3], "1", "InChI", str.Repeat("C", i+1)}, "\t"))
+	}
+	dbPath := filepath.Join(tmpDir, "excapedb.tsv")
+	if err := ioutil.WriteFile(dbPath, []byte(str.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wf := sp.NewWorkflow("relabel_activities_test", 1)
+	excapeDB := wf.NewProc("excapedb", "echo {o:excapedb}")
+	excapeDB.SetPathStatic("excapedb", dbPath)
+	thresholds := map[string]ActivityThreshold{"default": {6, 0.5}, "PDE3A": {5, 0}}
+	relabel := NewRelabelActivities(wf, "relabel_activities", "res/relabel_report.tsv", thresholds)
+	relabel.InExcapeDB().Connect(excapeDB.Out("excapedb"))
+	wf.Run()
+
+	gisa, err := ioutil.ReadFile(filepath.Join(tmpDir, "excapedb.gisa_pxc50_unsorted.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantGISA := "DRD1\tCHEMBL1\tC\tA\n" +
+		"DRD1\tCHEMBL2\tCC\tA\n" +
+		"DRD1\tCHEMBL4\tCCCC\tN\n" +
+		"DRD1\tCHEMBL5\tCCCCC\tA\n" +
+		"PDE3A\tCHEMBL6\tCCCCCC\tA\n" +
+		"PDE3A\tCHEMBL7\tCCCCCCC\tN\n"
+	if string(gisa) != wantGISA {
+		t.Errorf("Relabeled gisa file:\n%s\nwant:\n%s", gisa, wantGISA)
+	}
+
+	report, err := ioutil.ReadFile("res/relabel_report.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantReport := "Gene\tThreshold\tGreyZone\tRows\tRelabeledToActive\tRelabeledToNonactive\tInGreyZone\tWithoutPXC50\tActiveRows\tNonactiveRows\n" +
+		"DRD1\t6\t0.5\t5\t1\t1\t1\t1\t3\t1\n" +
+		"PDE3A\t5\t0\t2\t1\t0\t0\t0\t1\t1\n"
+	if string(report) != wantReport {
+		t.Errorf("Relabel report:\n%s\nwant:\n%s", report, wantReport)
+	}
+}
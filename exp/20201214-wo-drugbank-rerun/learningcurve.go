@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+
+// LearningCurveSummarizer collects crossvalidation results for nested
+// subsamples of the training data, and writes them as a tidy table with one
+// row per gene, runset, replicate and subsample fraction. Incoming IPs are
+// expected to have the params gene, runset, replicate, frac and cost, and the
+// key trainsize.
+type LearningCurveSummarizer struct {
+	sp.BaseProcess
+	SummaryFileName string
+	Confidence      float64 // Confidence level at which to report validity
+}
+
+func NewLearningCurveSummarizer(wf *sp.Workflow, procName string, fileName string, confidence float64) *LearningCurveSummarizer {
+	p := &LearningCurveSummarizer{
+		BaseProcess:     sp.NewBaseProcess(wf, procName),
+		SummaryFileName: fileName,
+		Confidence:      confidence,
+	}
+	p.InitInPort(p, "cvstats")
+	p.InitOutPort(p, "summary")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *LearningCurveSummarizer) InCrossValStats() *sp.InPort { return p.InPort("cvstats") }
+func (p *LearningCurveSummarizer) OutSummary() *sp.OutPort     { return p.OutPort("summary") }
+
+func (p *LearningCurveSummarizer) Run() {
+	defer p.OutSummary().Close()
+
+	rows := [][]string{}
+	for iip := range p.InCrossValStats().Chan {
+		if failurePolicy.SkipIP(p.Name(), iip) {
+			continue
+		}
+		metrics := parseCrossValMetrics(iip.Read())
+		rows = append(rows, []string{
+			iip.Param("gene"),
+			iip.Param("runset"),
+			iip.Param("replicate"),
+			iip.Param("frac"),
+			iip.Key("trainsize"),
+			iip.Param("cost"),
+			fmt.Sprintf("%.3f", metrics.ObsFuzzOverall),
+			fmt.Sprintf("%.3f", metrics.ValidityAt(p.Confidence)),
+		})
+	}
+	// Sort on gene, runset, replicate and then (numerically) on fraction
+	sort.SliceStable(rows, func(i, j int) bool {
+		for c := 0; c < 3; c++ {
+			if rows[i][c] != rows[j][c] {
+				return rows[i][c] < rows[j][c]
+			}
+		}
+		fi, _ := strconv.ParseFloat(rows[i][3], 64)
+		fj, _ := strconv.ParseFloat(rows[j][3], 64)
+		return fi < fj
+	})
+
+	oip := sp.NewFileIP(p.SummaryFileName)
+	fh := oip.OpenWriteTemp()
+	tsvWriter := csv.NewWriter(fh)
+	tsvWriter.Comma = '\t'
+	tsvWriter.Write([]string{"Gene", "Runset", "Replicate", "Fraction", "TrainSize", "Cost", "ObsFuzzOverall", "Validity"})
+	for _, row := range rows {
+		tsvWriter.Write(row)
+	}
+	tsvWriter.Flush()
+	fh.Close()
+	oip.Atomize()
+	p.OutSummary().Send(oip)
+}
+
+// ================================================================================
+// Parsing of CPSign crossvalidation output
+// ================================================================================
+
+// crossValMetrics holds the metrics we use from CPSign crossvalidation
+// results. Different CPSign versions write the results in slightly different
+// JSON structures, so they are picked up wherever they are found.
+type crossValMetrics struct {
+	ObsFuzzOverall float64
+	Accuracy       float64 // Overall accuracy, if given, otherwise -1
+	Points         []calibrationPoint
+}
+
+// calibrationPoint is the accuracy (the fraction of prediction sets that
+// contain the true label) at one confidence level, overall and, if available,
+// per class
+type calibrationPoint struct {
+	Confidence    float64
+	Accuracy      float64
+	ClassAccuracy map[string]float64
+}
+
+// ValidityAt returns the accuracy at the calibration point closest to the
+// confidence level, or the overall accuracy if there are no points
+func (m *crossValMetrics) ValidityAt(confidence float64) float64 {
+	if len(m.Points) == 0 {
+		return m.Accuracy
+	}
+	best := m.Points[0]
+	for _, pt := range m.Points {
+		if math.Abs(pt.Confidence-confidence) < math.Abs(best.Confidence-confidence) {
+			best = pt
+		}
+	}
+	return best.Accuracy
+}
+
+func parseCrossValMetrics(data []byte) *crossValMetrics {
+	var doc interface{}
+	err := json.Unmarshal(data, &doc)
+	sp.CheckWithMsg(err, "Could not parse crossvalidation JSON output")
+
+	m := &crossValMetrics{ObsFuzzOverall: -1, Accuracy: -1}
+	var walk func(v interface{}, top bool)
+	walk = func(v interface{}, top bool) {
+		switch val := v.(type) {
+		case []interface{}:
+			for _, item := range val {
+				walk(item, false)
+			}
+		case map[string]interface{}:
+			conf, hasConf := val["confidence"].(float64)
+			if acc, ok := accuracyValue(val["accuracy"]); ok {
+				if hasConf {
+					m.Points = append(m.Points, calibrationPoint{Confidence: conf, Accuracy: acc, ClassAccuracy: classAccuracies(val)})
+				} else if top {
+					m.Accuracy = acc
+				}
+			}
+			if m.ObsFuzzOverall < 0 {
+				switch of := val["observedFuzziness"].(type) {
+				case float64:
+					m.ObsFuzzOverall = of
+				case map[string]interface{}:
+					if overall, ok := of["overall"].(float64); ok {
+						m.ObsFuzzOverall = overall
+					}
+				}
+			}
+			// Walk in key order, so that the first match is always the same
+			for _, k := range sortedJSONKeys(val) {
+				if k != "observedFuzziness" && k != "accuracy" {
+					walk(val[k], false)
+				}
+			}
+		}
+	}
+	walk(doc, true)
+	sort.SliceStable(m.Points, func(i, j int) bool { return m.Points[i].Confidence < m.Points[j].Confidence })
+	return m
+}
+
+func sortedJSONKeys(obj map[string]interface{}) []string {
+	keys := []string{}
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// classAccuracyKeyPtn matches keys for per-class accuracies, such as
+// "accuracy(A)" or "accuracy_N"
+var classAccuracyKeyPtn = regexp.MustCompile(`^accuracy[_(]([^)]+)\)?$`)
+
+// classAccuracies picks up per-class accuracies of a calibration point, given
+// either as the non-overall values of an accuracy object, or as separate keys
+// per class. If a class is given more than once, the value in the accuracy
+// object wins, and otherwise the first key in sort order.
+func classAccuracies(point map[string]interface{}) map[string]float64 {
+	classAcc := map[string]float64{}
+	if accObj, ok := point["accuracy"].(map[string]interface{}); ok {
+		for label, v := range accObj {
+			if acc, ok := v.(float64); ok && label != "overall" {
+				classAcc[label] = acc
+			}
+		}
+	}
+	for _, k := range sortedJSONKeys(point) {
+		if m := classAccuracyKeyPtn.FindStringSubmatch(k); m != nil {
+			if _, seen := classAcc[m[1]]; seen {
+				continue
+			}
+			if acc, ok := point[k].(float64); ok {
+				classAcc[m[1]] = acc
+			}
+		}
+	}
+	return classAcc
+}
+
+// accuracyValue reads an accuracy, given either as a number, or as an object
+// with an "overall" value
+func accuracyValue(v interface{}) (float64, bool) {
+	switch acc := v.(type) {
+	case float64:
+		return acc, true
+	case map[string]interface{}:
+		overall, ok := acc["overall"].(float64)
+		return overall, ok
+	}
+	return -1, false
+}
+
+// ================================================================================
+
+// NewSubsample returns a process that takes a random subsample of the rows of
+// the tab-separated file on the "data" in-port, with the fraction given by the
+// "frac" parameter. As the same random source gives the same shuffling of the
+// same file, the subsamples for different fractions are nested, so that each
+// subsample contains all the smaller ones.
+func NewSubsample(wf *sp.Workflow, procName string, hasHeader bool, outPathFunc func(t *sp.Task) string) *sp.Process {
+	cmd := `n=$(awk 'END { print int(NR*{p:frac} + 0.999) }' {i:data}) \
+		&& shuf --random-source={i:randsrc} {i:data} | head -n $n > {o:subsample}`
+	if hasHeader {
+		cmd = `n=$(awk 'NR > 1 { n++ } END { print int(n*{p:frac} + 0.999) }' {i:data}) \
+		&& head -n 1 {i:data} > {o:subsample} \
+		&& tail -n +2 {i:data} | shuf --random-source={i:randsrc} | head -n $n >> {o:subsample}`
+	}
+	p := wf.NewProc(procName, cmd+` # {p:gene} {p:runset} {p:replicate}`)
+	p.SetPathCustom("subsample", outPathFunc)
+	return p
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCrossValMetrics(t *testing.T) {
+	tests := []struct {
+		desc string
+		json string
+		want *crossValMetrics
+	}{
+		{
+			"flat",
+			`{"observedFuzziness": 0.12, "accuracy": 0.9}`,
+			&crossValMetrics{ObsFuzzOverall: 0.12, Accuracy: 0.9},
+		},
+		{
+			"overall objects",
+			`{"observedFuzziness": {"overall": 0.2, "A": 0.3}, "accuracy": {"overall": 0.85, "A": 0.8}}`,
+			&crossValMetrics{ObsFuzzOverall: 0.2, Accuracy: 0.85},
+		},
+		{
+			"nested calibration points, out of order",
+			`{"results": {"observedFuzziness": 0.1, "calibrationPoints": [
+				{"confidence": 0.9, "accuracy": {"overall": 0.91, "A": 0.88, "N": 0.93}},
+				{"confidence": 0.8, "accuracy": 0.79, "accuracy(A)": 0.75, "accuracy_N": 0.82}
+			]}}`,
+			&crossValMetrics{ObsFuzzOverall: 0.1, Accuracy: -1, Points: []calibrationPoint{
+				{Confidence: 0.8, Accuracy: 0.79, ClassAccuracy: map[string]float64{"A": 0.75, "N": 0.82}},
+				{Confidence: 0.9, Accuracy: 0.91, ClassAccuracy: map[string]float64{"A": 0.88, "N": 0.93}},
+			}},
+		},
+		{
+			"nested observed fuzziness and class accuracies given twice",
+			`{"validation": {"observedFuzziness": 0.3}, "crossvalidation": {"observedFuzziness": 0.2}, "points": [
+				{"confidence": 0.8, "accuracy": {"overall": 0.8, "A": 0.7}, "accuracy(A)": 0.1, "accuracy_N": 0.85, "accuracy(N)": 0.9}
+			]}`,
+			&crossValMetrics{ObsFuzzOverall: 0.2, Accuracy: -1, Points: []calibrationPoint{
+				{Confidence: 0.8, Accuracy: 0.8, ClassAccuracy: map[string]float64{"A": 0.7, "N": 0.9}},
+			}},
+		},
+		{
+			"list of results",
+			`[{"confidence": 0.8, "accuracy": 0.8}]`,
+			&crossValMetrics{ObsFuzzOverall: -1, Accuracy: -1, Points: []calibrationPoint{
+				{Confidence: 0.8, Accuracy: 0.8, ClassAccuracy: map[string]float64{}},
+			}},
+		},
+		{
+			"no metrics",
+			`{"other": 1}`,
+			&crossValMetrics{ObsFuzzOverall: -1, Accuracy: -1},
+		},
+	}
+	for _, tt := range tests {
+		// Parse a few times, as map iteration order differs between runs
+		for i := 0; i < 10; i++ {
+			if got := parseCrossValMetrics([]byte(tt.json)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCrossValMetrics(%s) = %+v, want %+v", tt.desc, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestValidityAt(t *testing.T) {
+	m := &crossValMetrics{Accuracy: 0.5, Points: []calibrationPoint{
+		{Confidence: 0.7, Accuracy: 0.72},
+		{Confidence: 0.8, Accuracy: 0.81},
+		{Confidence: 0.9, Accuracy: 0.88},
+	}}
+	tests := []struct {
+		metrics    *crossValMetrics
+		confidence float64
+		want       float64
+	}{
+		{m, 0.8, 0.81},
+		{m, 0.86, 0.88},
+		{m, 0.1, 0.72},
+		{&crossValMetrics{Accuracy: 0.5}, 0.8, 0.5}, // No points
+	}
+	for _, tt := range tests {
+		if got := tt.metrics.ValidityAt(tt.confidence); got != tt.want {
+			t.Errorf("ValidityAt(%.2f) = %.2f, want %.2f", tt.confidence, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	str "strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Per-task metrics
+// ================================================================================
+
+// TaskMetrics is one line of the run log, for one attempt at executing a
+// task. CPU time and peak memory are left out (null) when the executor can
+// not measure them.
+type TaskMetrics struct {
+	Run         string   `json:"run"` // Start time of the workflow run
+	Task        string   `json:"task"`
+	ProcessType string   `json:"process_type"` // Process name up to the gene, such as "crossval"
+	Kind        string   `json:"kind"`         // Kind of process, as for the retry policies and resources
+	Gene        string   `json:"gene"`
+	Attempt     int      `json:"attempt"`
+	Executor    string   `json:"executor"`
+	Host        string   `json:"host"`
+	JobID       string   `json:"job_id,omitempty"`
+	Start       string   `json:"start"`
+	WallSec     float64  `json:"wall_sec"`
+	CPUSec      *float64 `json:"cpu_sec"`
+	PeakRSSMB   *float64 `json:"peak_rss_mb"`
+	ExitStatus  int      `json:"exit_status"` // -1 if not known
+	Succeeded   bool     `json:"succeeded"`
+}
+
+// taskUsage is what an executor could measure of a task attempt
+type taskUsage struct {
+	executor   string
+	host       string
+	jobID      string
+	cpuSec     *float64
+	peakRSSMB  *float64
+	exitStatus int
+}
+
+// metricsLog is used by the executors to report the usage of the tasks they
+// run
+var metricsLog *MetricsLog
+
+// MetricsLog writes the metrics of every task attempt as a JSON line to a run
+// log, which is appended to across runs, and summarized by the runstats
+// command
+type MetricsLog struct {
+	Path     string
+	run      string
+	host     string
+	mx       sync.Mutex
+	file     *os.File
+	usages   map[*sp.Task]*taskUsage
+	attempts map[*sp.Task]int
+}
+
+func NewMetricsLog(path string) *MetricsLog {
+	sp.CheckWithMsg(os.MkdirAll(filepath.Dir(path), 0755), "Could not create directory for run log: "+path)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	sp.CheckWithMsg(err, "Could not open run log: "+path)
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return &MetricsLog{
+		Path:     path,
+		run:      time.Now().Format(time.RFC3339),
+		host:     host,
+		file:     file,
+		usages:   map[*sp.Task]*taskUsage{},
+		attempts: map[*sp.Task]int{},
+	}
+}
+
+// Apply makes every attempt at executing the tasks of the shell command
+// processes of wf be logged. It must be called after the executors are
+// applied, and before the FailurePolicy, so that each retry is logged.
+func (m *MetricsLog) Apply(wf *sp.Workflow) {
+	for _, proc := range wf.Procs() {
+		p, ok := proc.(*sp.Process)
+		if !ok {
+			continue
+		}
+		execFunc, ok := taskExecFuncs[p]
+		if !ok && p.CustomExecute != nil {
+			continue // Go code, which is not measured
+		}
+		if !ok {
+			execFunc = execLocalCommand
+		}
+		kind := failurePolicy.KindOf(p)
+		setTaskExecFunc(p, func(t *sp.Task) error {
+			start := time.Now()
+			err := execFunc(t)
+			m.write(t, kind, start, err)
+			return err
+		})
+	}
+}
+
+// reportUsage is called by the executors, with what they measured of the
+// latest attempt at executing t
+func (m *MetricsLog) reportUsage(t *sp.Task, usage *taskUsage) {
+	if m == nil {
+		return
+	}
+	m.mx.Lock()
+	m.usages[t] = usage
+	m.mx.Unlock()
+}
+
+func (m *MetricsLog) write(t *sp.Task, kind string, start time.Time, err error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	m.attempts[t]++
+	usage, ok := m.usages[t]
+	if !ok {
+		usage = &taskUsage{executor: "unknown", exitStatus: -1}
+	}
+	delete(m.usages, t)
+	gene := failurePolicy.taskGene(t)
+	metrics := &TaskMetrics{
+		Run:         m.run,
+		Task:        t.Name,
+		ProcessType: processType(t.Name, gene),
+		Kind:        kind,
+		Gene:        gene,
+		Attempt:     m.attempts[t],
+		Executor:    usage.executor,
+		Host:        usage.host,
+		JobID:       usage.jobID,
+		Start:       start.Format(time.RFC3339),
+		WallSec:     time.Since(start).Seconds(),
+		CPUSec:      usage.cpuSec,
+		PeakRSSMB:   usage.peakRSSMB,
+		ExitStatus:  usage.exitStatus,
+		Succeeded:   err == nil,
+	}
+	if metrics.Host == "" && usage.executor == "local" {
+		metrics.Host = m.host
+	}
+	data, jsonErr := json.Marshal(metrics)
+	sp.Check(jsonErr)
+	_, writeErr := m.file.Write(append(data, '\n'))
+	sp.CheckWithMsg(writeErr, "Could not write to run log: "+m.Path)
+}
+
+// Close closes the run log
+func (m *MetricsLog) Close() {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	sp.CheckWithMsg(m.file.Close(), "Could not close run log: "+m.Path)
+}
+
+// localTaskUsage returns the CPU time and peak memory of a finished local
+// command, and of the processes it waited for
+func localTaskUsage(state *os.ProcessState) *taskUsage {
+	usage := &taskUsage{executor: "local", exitStatus: -1}
+	if state == nil {
+		return usage // The command could not be started
+	}
+	usage.exitStatus = state.ExitCode()
+	cpuSec := (state.UserTime() + state.SystemTime()).Seconds()
+	usage.cpuSec = &cpuSec
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		peakRSSMB := float64(rusage.Maxrss) / 1024 // Maxrss is in kB on Linux
+		usage.peakRSSMB = &peakRSSMB
+	}
+	return usage
+}
+
+// processType returns the name of a process, up to the gene of its branch,
+// so that "crossval_ache_orig_r1_c10" becomes "crossval". Processes not in a
+// gene branch keep their name.
+func processType(procName string, gene string) string {
+	if gene == "" {
+		return procName
+	}
+	toks := str.Split(procName, "_")
+	for i, tok := range toks {
+		if tok == gene && i > 0 {
+			return str.Join(toks[:i], "_")
+		}
+	}
+	return procName
+}
+
+// ================================================================================
+// The runstats command
+// ================================================================================
+
+// runStatsCmd summarizes run logs, as CPU hours, wall hours and peak memory
+// per process type and per gene, for capacity planning
+func runStatsCmd(args []string) {
+	flags := flag.NewFlagSet("runstats", flag.ExitOnError)
+	runLogPath := flags.String("runlog", "log/run_metrics.jsonl", "Run log to summarize, as written by the workflow with -runlog")
+	run := flags.String("run", "all", "Which runs to summarize: all, last, or the start time of a run, as in the run log")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s runstats [flags]\n\nSummarizes the task metrics in a run log, per process type and per gene.\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	metrics := readRunLog(*runLogPath)
+	if *run != "all" {
+		selectedRun := *run
+		if selectedRun == "last" {
+			selectedRun = ""
+			for _, m := range metrics {
+				if m.Run > selectedRun {
+					selectedRun = m.Run
+				}
+			}
+		}
+		selected := []*TaskMetrics{}
+		for _, m := range metrics {
+			if m.Run == selectedRun {
+				selected = append(selected, m)
+			}
+		}
+		metrics = selected
+	}
+	if len(metrics) == 0 {
+		sp.Failf("No task metrics found for run %s in run log: %s\n", *run, *runLogPath)
+	}
+	printRunStats(os.Stdout, metrics)
+}
+
+// readRunLog reads the task metrics in a run log
+func readRunLog(path string) []*TaskMetrics {
+	file, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open run log: "+path)
+	defer file.Close()
+	metrics := []*TaskMetrics{}
+	sc := bufio.NewScanner(file)
+	sc.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		if str.TrimSpace(sc.Text()) == "" {
+			continue
+		}
+		m := &TaskMetrics{}
+		if err := json.Unmarshal(sc.Bytes(), m); err != nil {
+			sp.Warning.Printf("Could not parse line %d of run log %s, so skipping it: %s\n", lineNo, path, err)
+			continue
+		}
+		metrics = append(metrics, m)
+	}
+	sp.CheckWithMsg(sc.Err(), "Could not read run log: "+path)
+	return metrics
+}
+
+// runStats are the totals of a group of task attempts
+type runStats struct {
+	tasks      map[string]bool
+	attempts   int
+	failed     int
+	wallSec    float64
+	cpuSec     float64
+	unmeasured int // Attempts without CPU time
+	peakRSSMB  float64
+}
+
+func (s *runStats) add(m *TaskMetrics) {
+	s.tasks[m.Task] = true
+	s.attempts++
+	if !m.Succeeded {
+		s.failed++
+	}
+	s.wallSec += m.WallSec
+	if m.CPUSec != nil {
+		s.cpuSec += *m.CPUSec
+	} else {
+		s.unmeasured++
+	}
+	if m.PeakRSSMB != nil && *m.PeakRSSMB > s.peakRSSMB {
+		s.peakRSSMB = *m.PeakRSSMB
+	}
+}
+
+// printRunStats writes tables of the totals per process type and per gene
+func printRunStats(w io.Writer, metrics []*TaskMetrics) {
+	byType := map[string]*runStats{}
+	byGene := map[string]*runStats{}
+	total := &runStats{tasks: map[string]bool{}}
+	runs := map[string]bool{}
+	for _, m := range metrics {
+		gene := m.Gene
+		if gene == "" {
+			gene = "(none)"
+		}
+		for _, group := range []struct {
+			stats map[string]*runStats
+			key   string
+		}{{byType, m.ProcessType}, {byGene, gene}} {
+			if _, ok := group.stats[group.key]; !ok {
+				group.stats[group.key] = &runStats{tasks: map[string]bool{}}
+			}
+			group.stats[group.key].add(m)
+		}
+		total.add(m)
+		runs[m.Run] = true
+	}
+
+	fmt.Fprintf(w, "%d task attempts, in %d run(s)\n\n", len(metrics), len(runs))
+	fmt.Fprintln(w, "== Per process type ==")
+	printRunStatsTable(w, "Process type", byType, total)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "== Per gene ==")
+	printRunStatsTable(w, "Gene", byGene, total)
+	if total.unmeasured > 0 {
+		fmt.Fprintf(w, "\n%d attempts have no CPU time or peak memory, as their executor could not measure them\n", total.unmeasured)
+	}
+}
+
+func printRunStatsTable(w io.Writer, groupName string, stats map[string]*runStats, total *runStats) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "%s\tTasks\tAttempts\tFailed\tWall hours\tCPU hours\tMean wall min\tPeak RSS MB\t\n", groupName)
+	keys := []string{}
+	for key := range stats {
+		keys = append(keys, key)
+	}
+	// Most CPU hours first, as those matter the most for planning
+	sort.Slice(keys, func(i, j int) bool {
+		if stats[keys[i]].cpuSec != stats[keys[j]].cpuSec {
+			return stats[keys[i]].cpuSec > stats[keys[j]].cpuSec
+		}
+		return keys[i] < keys[j]
+	})
+	printRow := func(name string, s *runStats) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%.2f\t%.2f\t%.1f\t%.0f\t\n", name, len(s.tasks), s.attempts, s.failed, s.wallSec/3600, s.cpuSec/3600, s.wallSec/60/float64(s.attempts), s.peakRSSMB)
+	}
+	for _, key := range keys {
+		printRow(key, stats[key])
+	}
+	printRow("Total", total)
+	tw.Flush()
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestProcessType(t *testing.T) {
+	tests := []struct {
+		procName string
+		gene     string
+		want     string
+	}{
+		{"crossval_ache_orig_r1_c10", "ache", "crossval"},
+		{"cpsign_train_drd1_orig_r1", "drd1", "cpsign_train"},
+		{"extract_drd1", "", "extract_drd1"}, // Not in a gene branch
+		{"drd1_summary", "drd1", "drd1_summary"},
+		{"create_report", "drd1", "create_report"},
+	}
+	for _, tt := range tests {
+		if got := processType(tt.procName, tt.gene); got != tt.want {
+			t.Errorf("processType(%q, %q) = %q, want %q", tt.procName, tt.gene, got, tt.want)
+		}
+	}
+}
+
+// TestMetricsLog logs a measured and an unmeasured attempt at a task, and
+// reads them back from the run log
+func TestMetricsLog(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "metrics_log_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	defer func(fp *FailurePolicy) { failurePolicy = fp }(failurePolicy)
+	failurePolicy = NewFailurePolicy(readRetryPolicies(""), false, []string{"DRD1"})
+
+	runLogPath := "log/run_metrics.jsonl"
+	m := NewMetricsLog(runLogPath)
+	task := newRetryTestTask(sp.NewWorkflow("metrics_log_test", 1), "cpsign_train_drd1_orig_r1", "DRD1")
+	cpuSec, peakRSSMB := 120.0, 2048.0
+	m.reportUsage(task, &taskUsage{executor: "slurm", host: "n1", jobID: "42", cpuSec: &cpuSec, peakRSSMB: &peakRSSMB, exitStatus: 1})
+	m.write(task, "train", time.Now(), errors.New("Out of memory"))
+	m.write(task, "train", time.Now(), nil)
+	m.Close()
+
+	// Blank and broken lines are skipped
+	file, err := os.OpenFile(runLogPath, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString("\n{\"run\": \n"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	want := []*TaskMetrics{
+		{Task: "cpsign_train_drd1_orig_r1", ProcessType: "cpsign_train", Kind: "train", Gene: "drd1", Attempt: 1, Executor: "slurm", Host: "n1", JobID: "42", CPUSec: &cpuSec, PeakRSSMB: &peakRSSMB, ExitStatus: 1, Succeeded: false},
+		{Task: "cpsign_train_drd1_orig_r1", ProcessType: "cpsign_train", Kind: "train", Gene: "drd1", Attempt: 2, Executor: "unknown", ExitStatus: -1, Succeeded: true},
+	}
+	got := readRunLog(runLogPath)
+	for _, metrics := range got {
+		if metrics.Run != m.run || metrics.Start == "" {
+			t.Errorf("Task metrics of run %q, starting %q, want run %q", metrics.Run, metrics.Start, m.run)
+		}
+		metrics.Run, metrics.Start, metrics.WallSec = "", "", 0
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readRunLog() =\n%+v\nwant:\n%+v", got, want)
+	}
+}
+
+func TestPrintRunStats(t *testing.T) {
+	floatPtr := func(v float64) *float64 { return &v }
+	metrics := []*TaskMetrics{
+		{Run: "run1", Task: "cpsign_train_drd1", ProcessType: "cpsign_train", Gene: "drd1", WallSec: 3600, CPUSec: floatPtr(7200), PeakRSSMB: floatPtr(1500), Succeeded: false},
+		{Run: "run1", Task: "cpsign_train_drd1", ProcessType: "cpsign_train", Gene: "drd1", WallSec: 5400, CPUSec: floatPtr(10800), PeakRSSMB: floatPtr(2250), Succeeded: true},
+		{Run: "run2", Task: "cpsign_train_htr2b", ProcessType: "cpsign_train", Gene: "htr2b", WallSec: 1800, CPUSec: floatPtr(3600), PeakRSSMB: floatPtr(1000), Succeeded: true},
+		{Run: "run2", Task: "create_report", ProcessType: "create_report", WallSec: 360, Succeeded: true},
+	}
+	out := &bytes.Buffer{}
+	printRunStats(out, metrics)
+	// Most CPU hours first, and the unmeasured attempt noted
+	want := `4 task attempts, in 2 run(s)
+
+== Per process type ==
+   Process type  Tasks  Attempts  Failed  Wall hours  CPU hours  Mean wall min  Peak RSS MB
+   cpsign_train      2         3       1        3.00       6.00           60.0         2250
+  create_report      1         1       0        0.10       0.00            6.0            0
+          Total      3         4       1        3.10       6.00           46.5         2250
+
+== Per gene ==
+    Gene  Tasks  Attempts  Failed  Wall hours  CPU hours  Mean wall min  Peak RSS MB
+    drd1      1         2       1        2.50       5.00           75.0         2250
+   htr2b      1         1       0        0.50       1.00           30.0         1000
+  (none)      1         1       0        0.10       0.00            6.0            0
+   Total      3         4       1        3.10       6.00           46.5         2250
+
+1 attempts have no CPU time or peak memory, as their executor could not measure them
+`
+	if out.String() != want {
+		t.Errorf("printRunStats() =\n%s\nwant:\n%s", out.String(), want)
+	}
+}
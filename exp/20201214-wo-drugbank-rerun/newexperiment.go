@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	str "strings"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// The new-experiment command
+// ================================================================================
+
+// newExperimentCmd creates a dated experiment directory next to an existing
+// experiment. The workflow file (*_wf.go) of the existing experiment is copied,
+// to be edited for the new experiment, as are the other Go files (the
+// components, with their tests), the bin directory with the R scripts, and
+// the vendored dependencies, so that later changes to the existing
+// experiment do not change the results of the new one. Components shared
+// between experiments belong in the lib module, which is pinned by go.mod,
+// and vendored. A go.mod, a config file with the main settings of the
+// workflow, run scripts for local and SLURM runs, and a journal stub are
+// written too. The SLURM run script loads the environment modules given with
+// -modules, or else those loaded by the run scripts of the existing
+// experiment.
+func newExperimentCmd(args []string) {
+	flags := flag.NewFlagSet("new-experiment", flag.ExitOnError)
+	fromDir := flags.String("from", ".", "Experiment directory to create the new experiment from")
+	date := flags.String("date", time.Now().Format("20060102"), "Date to prefix the directory name with")
+	geneSetName := flags.String("geneset", *geneSet, "Gene set to put in the config file")
+	account := flags.String("account", "snic2017-7-89", "SLURM account for the SLURM run script")
+	modules := flags.String("modules", "", "Comma-separated environment modules to load in the SLURM run script, such as java/sun_jdk1.8.0_92,R/3.4.0 (default: the modules loaded by the run scripts of the -from experiment)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s new-experiment [flags] NAME\n\nCreates the experiment directory DATE-NAME, next to the -from experiment.\n\n", filepath.Base(os.Args[0]))
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	name := flags.Arg(0)
+	if !regexp.MustCompile(`^[a-z0-9][a-z0-9-]*$`).MatchString(name) {
+		sp.Failf("Experiment names may only contain lower case letters, digits and dashes, but got: %s\n", name)
+	}
+	if len(geneSets[*geneSetName]) == 0 {
+		sp.Failf("Unknown gene set: %s\n", *geneSetName)
+	}
+
+	srcDir, err := filepath.Abs(*fromDir)
+	sp.Check(err)
+	var moduleList []string
+	if *modules != "" {
+		moduleList = str.Split(*modules, ",")
+	} else {
+		moduleList = experimentModules(srcDir)
+	}
+	dstDir := newExperiment(srcDir, *date, name, *geneSetName, *account, moduleList)
+	sp.Audit.Printf("Created experiment %s, from %s\n", dstDir, srcDir)
+}
+
+// newExperiment creates the experiment directory date-name next to srcDir, as
+// described for newExperimentCmd, and returns its path
+func newExperiment(srcDir string, date string, name string, geneSetName string, account string, modules []string) string {
+	dirName := date + "-" + name
+	dstDir := filepath.Join(filepath.Dir(srcDir), dirName)
+	if _, err := os.Stat(dstDir); err == nil {
+		sp.Failf("Experiment directory already exists: %s\n", dstDir)
+	}
+	sp.CheckWithMsg(os.Mkdir(dstDir, 0755), "Could not create experiment directory: "+dstDir)
+	copied := []string{}
+
+	// Go files
+	goFiles, err := filepath.Glob(filepath.Join(srcDir, "*.go"))
+	sp.Check(err)
+	wfFile := ""
+	for _, goFile := range goFiles {
+		base := filepath.Base(goFile)
+		data, err := ioutil.ReadFile(goFile)
+		sp.CheckWithMsg(err, "Could not read Go file: "+goFile)
+		switch {
+		case buildIgnorePtn.Match(data):
+			continue // Stand-alone scripts
+		case str.HasSuffix(base, "_wf.go"):
+			if wfFile != "" {
+				sp.Failf("More than one workflow file (*_wf.go) in %s: %s and %s\n", srcDir, wfFile, base)
+			}
+			wfFile = base
+			dstFile := filepath.Join(dstDir, str.Replace(name, "-", "_", -1)+"_wf.go")
+			sp.CheckWithMsg(ioutil.WriteFile(dstFile, data, 0644), "Could not write workflow file: "+dstFile)
+		default:
+			copyExperimentPath(goFile, filepath.Join(dstDir, base))
+			copied = append(copied, base)
+		}
+	}
+	if wfFile == "" {
+		sp.Failf("No workflow file (*_wf.go) in %s\n", srcDir)
+	}
+	for _, dir := range []string{"bin", "vendor"} {
+		if _, err := os.Stat(filepath.Join(srcDir, dir)); err == nil {
+			copyExperimentPath(filepath.Join(srcDir, dir), filepath.Join(dstDir, dir))
+			copied = append(copied, dir)
+		}
+	}
+
+	// go.mod, with the module named after the new directory. The new
+	// directory is next to the existing one, so the path to lib in the
+	// replace directive still holds.
+	goMod, err := ioutil.ReadFile(filepath.Join(srcDir, "go.mod"))
+	sp.CheckWithMsg(err, "Could not read go.mod of "+srcDir)
+	modulePtn := regexp.MustCompile(`(?m)^module (\S+)/[^/\s]+$`)
+	if !modulePtn.Match(goMod) {
+		sp.Failf("Could not find the module path in the go.mod of %s\n", srcDir)
+	}
+	goMod = modulePtn.ReplaceAll(goMod, []byte("module ${1}/"+dirName))
+	writeExperimentFile(dstDir, "go.mod", string(goMod), 0644)
+
+	// Config file, with the settings most often changed between experiments
+	config := map[string]interface{}{
+		"geneset":  geneSetName,
+		"maxtasks": 4,
+		"threads":  1,
+		"procs":    "create_report",
+		"split":    splitDrugBank,
+	}
+	configData, err := json.MarshalIndent(config, "", "    ")
+	sp.Check(err)
+	writeExperimentFile(dstDir, "config.json", string(configData)+"\n", 0644)
+
+	writeExperimentFile(dstDir, "run-local.sh", `#!/bin/bash
+# Run the workflow locally, with the settings in config.json. Flags given to
+# this script override the config file, as in: ./run-local.sh -procs "crossval_.*"
+mkdir -p log
+go run . -config config.json "$@" 2>&1 | tee log/scipipe-$(date +%Y%m%d-%H%M%S).log
+`, 0755)
+	moduleLoads := ""
+	for _, module := range modules {
+		moduleLoads += "module load " + module + "\n"
+	}
+	writeExperimentFile(dstDir, "run-slurm.sh", fmt.Sprintf(`#!/bin/bash -l
+#SBATCH -A %s
+#SBATCH -p node
+#SBATCH -n 20
+#SBATCH -J ptp_%s
+#SBATCH -t 4-00:00:00
+#SBATCH --mail-type BEGIN,FAIL,END
+# Run the workflow on a SLURM node, with the settings in config.json. Add
+# -slurm to submit the heavy tasks as separate SLURM jobs instead.
+%smkdir -p log
+go run . -config config.json -maxtasks 19 "$@" &> log/scipipe-$(date +%%Y%%m%%d-%%H%%M%%S).log
+`, account, str.Replace(name, "-", "_", -1), moduleLoads), 0755)
+
+	sort.Strings(copied)
+	writeExperimentFile(dstDir, "journal.md", fmt.Sprintf(`# %s - TODO and Journal
+
+- [x] Create experiment from %s, with ptp new-experiment
+  - The workflow is in %s (copied from %s)
+  - Copied from %s: %s
+  - Settings are in config.json, and flags override them
+- [ ] Describe the aim of the experiment
+`, dirName, filepath.Base(srcDir), str.Replace(name, "-", "_", -1)+"_wf.go", wfFile, filepath.Base(srcDir), str.Join(copied, ", ")), 0644)
+
+	return dstDir
+}
+
+var buildIgnorePtn = regexp.MustCompile(`(?m)^(//go:build ignore|// \+build ignore)$`)
+
+var moduleLoadPtn = regexp.MustCompile(`(?m)^\s*module load (.+?)\s*$`)
+
+// experimentModules returns the environment modules loaded by the shell
+// scripts of an experiment, in the order they are first loaded
+func experimentModules(dir string) []string {
+	scripts, err := filepath.Glob(filepath.Join(dir, "*.sh"))
+	sp.Check(err)
+	modules := []string{}
+	seen := map[string]bool{}
+	for _, script := range scripts {
+		data, err := ioutil.ReadFile(script)
+		sp.CheckWithMsg(err, "Could not read script: "+script)
+		for _, m := range moduleLoadPtn.FindAllSubmatch(data, -1) {
+			for _, module := range str.Fields(string(m[1])) {
+				if !seen[module] {
+					seen[module] = true
+					modules = append(modules, module)
+				}
+			}
+		}
+	}
+	if len(modules) == 0 {
+		sp.Warning.Printf("No environment modules loaded in the scripts of %s, so the SLURM run script loads none\n", dir)
+	}
+	return modules
+}
+
+// copyExperimentPath copies a file, or a directory with all its files, keeping
+// the permissions, so that scripts stay executable. Symlinks are copied as
+// the files they point to.
+func copyExperimentPath(src string, dst string) {
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(dstPath, info.Mode().Perm())
+		}
+		info, err = os.Stat(path) // Follows symlinks
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(dstPath, data, info.Mode().Perm())
+	})
+	sp.CheckWithMsg(err, "Could not copy "+src+" to "+dst)
+}
+
+func writeExperimentFile(dir string, name string, content string, perm os.FileMode) {
+	path := filepath.Join(dir, name)
+	sp.CheckWithMsg(ioutil.WriteFile(path, []byte(content), perm), "Could not write file: "+path)
+}
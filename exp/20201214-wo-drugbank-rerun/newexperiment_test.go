@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// TestNewExperiment creates an experiment from a small source experiment, and
+// checks the renamed workflow file, the go.mod, the copied files and the run
+// scripts
+func TestNewExperiment(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "new_experiment_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	srcDir := filepath.Join(tmpDir, "20201214-wo-drugbank-rerun")
+	files := map[string]string{
+		"go.mod":             "module github.com/pharmbio/ptp-project/exp/20180426-wo-drugbank\n\ngo 1.15\n\nreplace github.com/pharmbio/ptp-project/lib => ../../lib\n",
+		"wo_drugbank_wf.go":  "package main\n\nfunc main() {}\n",
+		"components.go":      "package main\n",
+		"components_test.go": "package main\n",
+		"extract_table.go":   "//go:build ignore\n\npackage main\n",
+		"old_extract.go":     "// +build ignore\n\npackage main\n",
+		"run-fullwf.sh":      "#!/bin/bash -l\nmodule load java/sun_jdk1.8.0_92\nmodule load R/3.4.0\n",
+		"run-test.sh":        "#!/bin/bash -l\nmodule load R/3.4.0 bioinfo-tools\n",
+		"bin/plot.R":         "library(ggplot2)\n",
+		"vendor/modules.txt": "# github.com/scipipe/scipipe v0.9.9\n",
+		"res/summary.tsv":    "Gene\n",
+		"journal.md":         "# Journal\n",
+	}
+	for path, data := range files {
+		path = filepath.Join(srcDir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	modules := experimentModules(srcDir)
+	if want := []string{"java/sun_jdk1.8.0_92", "R/3.4.0", "bioinfo-tools"}; !reflect.DeepEqual(modules, want) {
+		t.Errorf("experimentModules() = %q, want %q", modules, want)
+	}
+	dstDir := newExperiment(srcDir, "20210105", "new-split", "bowes44", "snic2020-1-1", modules)
+	if want := filepath.Join(tmpDir, "20210105-new-split"); dstDir != want {
+		t.Errorf("newExperiment() = %s, want %s", dstDir, want)
+	}
+
+	// Build-ignored scripts, results and the old journal are not copied
+	dstFiles := []string{}
+	err = filepath.Walk(dstDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dstDir, path)
+			dstFiles = append(dstFiles, rel)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(dstFiles)
+	wantFiles := []string{"bin/plot.R", "components.go", "components_test.go", "config.json", "go.mod", "journal.md", "new_split_wf.go", "run-local.sh", "run-slurm.sh", "vendor/modules.txt"}
+	if !reflect.DeepEqual(dstFiles, wantFiles) {
+		t.Errorf("Files of the new experiment = %q, want %q", dstFiles, wantFiles)
+	}
+
+	for path, want := range map[string]string{
+		"new_split_wf.go": files["wo_drugbank_wf.go"],
+		"go.mod":          "module github.com/pharmbio/ptp-project/exp/20210105-new-split\n\ngo 1.15\n\nreplace github.com/pharmbio/ptp-project/lib => ../../lib\n",
+		"config.json":     "{\n    \"geneset\": \"bowes44\",\n    \"maxtasks\": 4,\n    \"procs\": \"create_report\",\n    \"split\": \"drugbank\",\n    \"threads\": 1\n}\n",
+	} {
+		data, err := ioutil.ReadFile(filepath.Join(dstDir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s of the new experiment =\n%s\nwant:\n%s", path, data, want)
+		}
+	}
+	runSlurm, err := ioutil.ReadFile(filepath.Join(dstDir, "run-slurm.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"#SBATCH -A snic2020-1-1\n", "#SBATCH -J ptp_new_split\n", "module load java/sun_jdk1.8.0_92\nmodule load R/3.4.0\nmodule load bioinfo-tools\nmkdir -p log\n"} {
+		if !str.Contains(string(runSlurm), want) {
+			t.Errorf("run-slurm.sh does not contain %q:\n%s", want, runSlurm)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(dstDir, "run-slurm.sh")); err != nil || info.Mode().Perm()&0100 == 0 {
+		t.Errorf("run-slurm.sh is not executable")
+	}
+}
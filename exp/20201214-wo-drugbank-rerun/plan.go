@@ -0,0 +1,490 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+	spc "github.com/scipipe/scipipe/components"
+)
+
+// ================================================================================
+// Dry-run planning
+// ================================================================================
+
+// plannedTask is a task that would be run by a workflow, as planned by
+// workflowPlanner, without executing anything
+type plannedTask struct {
+	procName  string
+	command   string // Empty for components, whose work is done in Go code
+	component bool
+	outPaths  []string
+	group     planGroup
+	decision  string // The TaskCache decision for shell tasks: run, rerun, reuse, keep, or check at run time
+	reason    string
+}
+
+// planGroup identifies the gene, runset and replicate a task belongs to.
+// Fields are empty for tasks that are shared between genes, runsets or
+// replicates.
+type planGroup struct {
+	gene      string
+	runset    string
+	replicate string
+}
+
+func (g planGroup) String() string {
+	if g == (planGroup{}) {
+		return "Shared tasks"
+	}
+	orDash := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+	return "Gene: " + orDash(g.gene) + ", Runset: " + orDash(g.runset) + ", Replicate: " + orDash(g.replicate)
+}
+
+// planPlaceholderPtn matches the placeholders used for file paths and
+// parameter values that are only known at run time
+var planPlaceholderPtn = regexp.MustCompile(`<[^<>]+>`)
+
+// workflowPlanner resolves the tasks that a workflow would run, by walking
+// the process graph from the upstream end, and creating (but not executing)
+// the tasks of each process, from the IPs that upstream tasks would produce.
+// Parameter values connected with ConnectStr are read from their ports, so
+// the planner consumes them, and the workflow can not be run after it has
+// been planned. Outputs of components (processes implemented in Go code) are
+// only known at run time, and are represented by placeholders on the form
+// <process.port>, as are parameter values sent by components. Whether each
+// shell task would be run is decided by the TaskCache, without removing any
+// outdated outputs, unless the planner has no cache.
+type workflowPlanner struct {
+	wf          *sp.Workflow
+	cache       *TaskCache
+	tasks       []*plannedTask
+	outIPs      map[*sp.OutPort][]*sp.FileIP
+	ipGroups    map[*sp.FileIP]planGroup
+	staticParam map[*sp.ParamInPort][]string
+	planned     map[string]bool
+	remade      map[string]bool // Outputs of tasks that would be run, or rerun
+}
+
+func newWorkflowPlanner(wf *sp.Workflow, cache *TaskCache) *workflowPlanner {
+	return &workflowPlanner{
+		wf:          wf,
+		cache:       cache,
+		outIPs:      map[*sp.OutPort][]*sp.FileIP{},
+		ipGroups:    map[*sp.FileIP]planGroup{},
+		staticParam: map[*sp.ParamInPort][]string{},
+		planned:     map[string]bool{},
+		remade:      map[string]bool{},
+	}
+}
+
+// PlanToRegex plans all processes upstream of, and including, the processes
+// whose names match procNamePattern, the same way as Workflow.RunToRegex
+// selects the processes to run
+func (wp *workflowPlanner) PlanToRegex(procNamePattern string) []*plannedTask {
+	ptn, err := regexp.Compile(procNamePattern)
+	sp.CheckWithMsg(err, "Regex pattern doesn't work: "+procNamePattern)
+	procNames := []string{}
+	for procName := range wp.wf.Procs() {
+		if ptn.MatchString(procName) {
+			procNames = append(procNames, procName)
+		}
+	}
+	if len(procNames) == 0 {
+		sp.Failf("No processes match the pattern: %s\n", procNamePattern)
+	}
+	sort.Strings(procNames)
+	for _, procName := range procNames {
+		wp.planProc(wp.wf.Proc(procName), map[string]bool{})
+	}
+	return wp.tasks
+}
+
+// planProc plans the tasks of proc, after planning the processes upstream of
+// it
+func (wp *workflowPlanner) planProc(proc sp.WorkflowProcess, visiting map[string]bool) {
+	if wp.planned[proc.Name()] {
+		return
+	}
+	if visiting[proc.Name()] {
+		sp.Failf("Found a cycle in the workflow, at process %s\n", proc.Name())
+	}
+	visiting[proc.Name()] = true
+	for _, inPort := range sortedInPorts(proc) {
+		for _, rpt := range sortedRemoteOutPorts(inPort) {
+			wp.planProc(rpt.Process(), visiting)
+		}
+	}
+	for _, pip := range proc.ParamInPorts() {
+		for _, rpp := range pip.RemotePorts {
+			if rpp.Process() != proc {
+				wp.planProc(rpp.Process(), visiting)
+			}
+		}
+	}
+	delete(visiting, proc.Name())
+
+	switch p := proc.(type) {
+	case *sp.Process:
+		wp.planShellProc(p)
+	case *spc.MapToKeys:
+		// MapToKeys only adds keys to the audit info, and passes on its IPs
+		ips := wp.receivedIPs(p.In())
+		wp.outIPs[p.Out()] = ips
+		wp.tasks = append(wp.tasks, &plannedTask{procName: p.Name(), component: true, outPaths: ipPaths(ips), group: wp.commonGroup(ips)})
+	default:
+		wp.planComponent(proc)
+	}
+	wp.planned[proc.Name()] = true
+}
+
+// planShellProc creates the tasks of a process, one per set of IPs and
+// parameters, as the process itself would
+func (wp *workflowPlanner) planShellProc(p *sp.Process) {
+	inIPs := map[string][]*sp.FileIP{}
+	params := map[string][]string{}
+	nTasks := -1
+	for name, inPort := range p.InPorts() {
+		inIPs[name] = wp.receivedIPs(inPort)
+		nTasks = minTasks(nTasks, len(inIPs[name]))
+	}
+	for name, pip := range p.ParamInPorts() {
+		params[name] = wp.receivedParams(pip)
+		nTasks = minTasks(nTasks, len(params[name]))
+	}
+	if nTasks < 0 {
+		nTasks = 1 // Processes without in-ports run once
+	}
+
+	for i := 0; i < nTasks; i++ {
+		taskInIPs := map[string]*sp.FileIP{}
+		groupIPs := []*sp.FileIP{}
+		for name, ips := range inIPs {
+			taskInIPs[name] = ips[i]
+			groupIPs = append(groupIPs, ips[i])
+		}
+		taskParams := map[string]string{}
+		for name, vals := range params {
+			taskParams[name] = vals[i]
+		}
+		t := sp.NewTask(p.Workflow(), p, p.Name(), p.CommandPattern, taskInIPs, p.PathFormatters, p.OutPortsDoStream, taskParams, p.Prepend, p.CustomExecute, p.CoresPerTask)
+
+		group := groupFromParams(taskParams, wp.commonGroup(groupIPs))
+		pt := &plannedTask{procName: p.Name(), command: t.Command, group: group}
+		onames := []string{}
+		for oname := range t.OutIPs {
+			onames = append(onames, oname)
+		}
+		sort.Strings(onames)
+		cachedPaths := []string{}
+		for _, oname := range onames {
+			oip := t.OutIPs[oname]
+			wp.outIPs[p.Out(oname)] = append(wp.outIPs[p.Out(oname)], oip)
+			wp.ipGroups[oip] = group
+			pt.outPaths = append(pt.outPaths, oip.Path())
+			if !p.OutPortsDoStream[oname] {
+				cachedPaths = append(cachedPaths, oip.Path())
+			}
+			// Commands write to temporary paths, that are moved to the
+			// final paths when the task is done
+			pt.command = str.Replace(pt.command, oip.TempPath(), oip.Path(), -1)
+		}
+		if wp.cache != nil {
+			pt.decision, pt.reason = wp.planDecision(p, t, cachedPaths)
+			if pt.decision != "reuse" && pt.decision != "keep" {
+				for _, path := range pt.outPaths {
+					wp.remade[path] = true
+				}
+			}
+		}
+		wp.tasks = append(wp.tasks, pt)
+	}
+}
+
+// planDecision returns the TaskCache decision for t, and why. Tasks whose
+// outputs would be kept regardless of their inputs, or that would be run as
+// they have no outputs, are decided as they would be at run time. Otherwise,
+// if any input is made first, by a task that would be run, or by a
+// component, the cache key can only be checked once it is made.
+func (wp *workflowPlanner) planDecision(p *sp.Process, t *sp.Task, paths []string) (decision string, reason string) {
+	for _, path := range paths {
+		if planPlaceholderPtn.MatchString(path) {
+			return "check at run time", "the output paths are only known at run time"
+		}
+	}
+	decision, reason, _ = wp.cache.taskDecision(p, t, paths)
+	if decision == "run" || decision == "keep" || reason == "some outputs are missing" {
+		return decision, reason
+	}
+	remadePorts := []string{}
+	for _, name := range sortedInIPNames(t.InIPs) {
+		path := t.InIPs[name].Path()
+		if wp.remade[path] || planPlaceholderPtn.MatchString(path) {
+			remadePorts = append(remadePorts, name)
+		}
+	}
+	if len(remadePorts) > 0 {
+		return "check at run time", "the inputs on " + str.Join(remadePorts, ", ") + " are made first"
+	}
+	return decision, reason
+}
+
+// planComponent plans a component as a single task, with one placeholder
+// output per out-port, as its outputs are only known at run time
+func (wp *workflowPlanner) planComponent(proc sp.WorkflowProcess) {
+	groupIPs := []*sp.FileIP{}
+	for _, inPort := range sortedInPorts(proc) {
+		groupIPs = append(groupIPs, wp.receivedIPs(inPort)...)
+	}
+	params := map[string]string{}
+	for name, pip := range proc.ParamInPorts() {
+		if vals := wp.receivedParams(pip); len(vals) > 0 {
+			params[name] = vals[0]
+		}
+	}
+	group := groupFromParams(params, wp.commonGroup(groupIPs))
+	pt := &plannedTask{procName: proc.Name(), component: true, group: group}
+	for _, oname := range sortedOutPortNames(proc.OutPorts()) {
+		outPort := proc.OutPorts()[oname]
+		oip := sp.NewFileIP("<" + outPort.Name() + ">")
+		wp.outIPs[outPort] = []*sp.FileIP{oip}
+		wp.ipGroups[oip] = group
+		pt.outPaths = append(pt.outPaths, oip.Path())
+	}
+	wp.tasks = append(wp.tasks, pt)
+}
+
+// receivedIPs returns the IPs that inPort would receive, from all the
+// out-ports it is connected to
+func (wp *workflowPlanner) receivedIPs(inPort *sp.InPort) []*sp.FileIP {
+	ips := []*sp.FileIP{}
+	for _, rpt := range sortedRemoteOutPorts(inPort) {
+		ips = append(ips, wp.outIPs[rpt]...)
+	}
+	return ips
+}
+
+// receivedParams returns the parameter values that pip would receive. Values
+// sent with ConnectStr are read from the port itself, while values sent by
+// other processes are represented by placeholders.
+func (wp *workflowPlanner) receivedParams(pip *sp.ParamInPort) []string {
+	if vals, ok := wp.staticParam[pip]; ok {
+		return vals
+	}
+	vals := []string{}
+	// ConnectStr sets the receiving process as the process of its feeder port,
+	// and the feeder port is removed from RemotePorts when all values are sent
+	static := pip.Connected()
+	for _, rpp := range pip.RemotePorts {
+		if rpp.Process() != pip.Process() {
+			static = false
+		}
+	}
+	if static {
+		for val := range pip.Chan {
+			vals = append(vals, val)
+		}
+	} else {
+		names := []string{}
+		for name := range pip.RemotePorts {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			vals = append(vals, "<"+name+">")
+		}
+	}
+	wp.staticParam[pip] = vals
+	return vals
+}
+
+// commonGroup returns the group shared by all the IPs, or the fields of it
+// that they have in common
+func (wp *workflowPlanner) commonGroup(ips []*sp.FileIP) planGroup {
+	if len(ips) == 0 {
+		return planGroup{}
+	}
+	group := wp.ipGroups[ips[0]]
+	for _, ip := range ips[1:] {
+		other := wp.ipGroups[ip]
+		if other.gene != group.gene {
+			group.gene = ""
+		}
+		if other.runset != group.runset {
+			group.runset = ""
+		}
+		if other.replicate != group.replicate {
+			group.replicate = ""
+		}
+	}
+	return group
+}
+
+// groupFromParams returns the group given by the gene, runset and replicate
+// parameters, where available, and otherwise by the fallback group
+func groupFromParams(params map[string]string, fallback planGroup) planGroup {
+	group := fallback
+	if gene, ok := params["gene"]; ok && !planPlaceholderPtn.MatchString(gene) {
+		group.gene = str.ToLower(gene)
+	}
+	if runset, ok := params["runset"]; ok && !planPlaceholderPtn.MatchString(runset) {
+		group.runset = runset
+	}
+	if replicate, ok := params["replicate"]; ok && !planPlaceholderPtn.MatchString(replicate) {
+		group.replicate = replicate
+	}
+	return group
+}
+
+// ================================================================================
+// Printing the plan
+// ================================================================================
+
+// printPlan writes the planned tasks, grouped by gene, runset and replicate,
+// with the command and output paths of each task, whether the outputs
+// already exist, and the TaskCache decision on whether to run the task.
+func printPlan(w io.Writer, tasks []*plannedTask) {
+	groups := []planGroup{}
+	tasksPerGroup := map[planGroup][]*plannedTask{}
+	for _, t := range tasks {
+		if _, ok := tasksPerGroup[t.group]; !ok {
+			groups = append(groups, t.group)
+		}
+		tasksPerGroup[t.group] = append(tasksPerGroup[t.group], t)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		gi, gj := groups[i], groups[j]
+		if gi.gene != gj.gene {
+			return gi.gene < gj.gene
+		}
+		if gi.runset != gj.runset {
+			return gi.runset < gj.runset
+		}
+		return gi.replicate < gj.replicate
+	})
+
+	nPerDecision := map[string]int{}
+	for _, group := range groups {
+		fmt.Fprintf(w, "== %s ==\n", group)
+		for _, t := range tasksPerGroup[group] {
+			action := "component"
+			if !t.component {
+				action = t.decision + ", as " + t.reason
+				nPerDecision[t.decision]++
+			}
+			fmt.Fprintf(w, "  %s (%s)\n", t.procName, action)
+			if t.command != "" {
+				fmt.Fprintf(w, "    cmd: %s\n", indentCommand(t.command))
+			}
+			for _, path := range t.outPaths {
+				fmt.Fprintf(w, "    out: %s [%s]\n", path, planOutputStatus(path))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	nComponents := len(tasks)
+	for _, n := range nPerDecision {
+		nComponents -= n
+	}
+	fmt.Fprintf(w, "Planned %d tasks: %d to run, %d to rerun, %d to reuse, %d to keep without cache key, %d to check at run time, and %d components\n",
+		len(tasks), nPerDecision["run"], nPerDecision["rerun"], nPerDecision["reuse"], nPerDecision["keep"], nPerDecision["check at run time"], nComponents)
+}
+
+// planOutputStatus tells whether an output path exists. For paths with
+// placeholders for values only known at run time, it tells whether any file
+// matches the path, with the placeholders as wildcards, unless the path
+// starts with a placeholder, and could match just about anything.
+func planOutputStatus(path string) string {
+	if !planPlaceholderPtn.MatchString(path) {
+		if _, err := os.Stat(path); err == nil {
+			return "exists"
+		}
+		return "missing"
+	}
+	if str.HasPrefix(path, "<") {
+		return "known at run time"
+	}
+	matches, err := filepath.Glob(planPlaceholderPtn.ReplaceAllString(path, "*"))
+	if err == nil && len(matches) > 0 {
+		return fmt.Sprintf("unresolved, %d matching file(s) exist", len(matches))
+	}
+	return "unresolved, missing"
+}
+
+// indentCommand strips the indentation of multi-line commands, and indents
+// them to line up after the "cmd: " prefix
+func indentCommand(cmd string) string {
+	lines := str.Split(str.TrimSpace(cmd), "\n")
+	for i := range lines {
+		lines[i] = str.TrimSpace(lines[i])
+	}
+	return str.Join(lines, "\n         ")
+}
+
+// ================================================================================
+// Helpers
+// ================================================================================
+
+func minTasks(n int, m int) int {
+	if n < 0 || m < n {
+		return m
+	}
+	return n
+}
+
+func ipPaths(ips []*sp.FileIP) []string {
+	paths := []string{}
+	for _, ip := range ips {
+		paths = append(paths, ip.Path())
+	}
+	return paths
+}
+
+func sortedInIPNames(ips map[string]*sp.FileIP) []string {
+	names := []string{}
+	for name := range ips {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortedInPorts(proc sp.WorkflowProcess) []*sp.InPort {
+	inPorts := []*sp.InPort{}
+	names := []string{}
+	for name := range proc.InPorts() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		inPorts = append(inPorts, proc.InPorts()[name])
+	}
+	return inPorts
+}
+
+func sortedRemoteOutPorts(inPort *sp.InPort) []*sp.OutPort {
+	outPorts := []*sp.OutPort{}
+	for _, name := range sortedOutPortNames(inPort.RemotePorts) {
+		outPorts = append(outPorts, inPort.RemotePorts[name])
+	}
+	return outPorts
+}
+
+func sortedOutPortNames(outPorts map[string]*sp.OutPort) []string {
+	names := []string{}
+	for name := range outPorts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// newPlanTestWorkflow creates a workflow of two tasks, where the second one
+// reads the output of the first
+func newPlanTestWorkflow(firstCmd string, secondCmd string) *sp.Workflow {
+	wf := sp.NewWorkflow("plan_test", 1)
+	first := wf.NewProc("first", firstCmd)
+	first.SetPathStatic("out", "first.txt")
+	second := wf.NewProc("second", secondCmd)
+	second.SetPathExtend("in", "out", ".second.txt")
+	second.In("in").Connect(first.Out("out"))
+	return wf
+}
+
+func planDecisions(wf *sp.Workflow) map[string]string {
+	decisions := map[string]string{}
+	for _, t := range newWorkflowPlanner(wf, NewTaskCache(false)).PlanToRegex("second") {
+		decisions[t.procName] = t.decision
+		if str.Contains(t.command, ".tmp") {
+			decisions[t.procName] += ", with temporary paths in the command"
+		}
+	}
+	return decisions
+}
+
+func TestPlanDecisions(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "plan_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	firstCmd, secondCmd := "echo first > {o:out}", "cat {i:in} > {o:out}"
+	wantDecisions := map[string]string{"first": "run", "second": "run"}
+	if got := planDecisions(newPlanTestWorkflow(firstCmd, secondCmd)); !equalStringMaps(got, wantDecisions) {
+		t.Errorf("Plan before running: %v, want %v", got, wantDecisions)
+	}
+
+	wf := newPlanTestWorkflow(firstCmd, secondCmd)
+	NewTaskCache(false).Apply(wf)
+	wf.Run()
+
+	tests := []struct {
+		desc      string
+		firstCmd  string
+		secondCmd string
+		want      map[string]string
+	}{
+		{"unchanged", firstCmd, secondCmd, map[string]string{"first": "reuse", "second": "reuse"}},
+		{"second command changed", firstCmd, "cat {i:in} {i:in} > {o:out}", map[string]string{"first": "reuse", "second": "rerun"}},
+		{"first command changed", "echo changed > {o:out}", secondCmd, map[string]string{"first": "rerun", "second": "check at run time"}},
+	}
+	for _, tt := range tests {
+		if got := planDecisions(newPlanTestWorkflow(tt.firstCmd, tt.secondCmd)); !equalStringMaps(got, tt.want) {
+			t.Errorf("Plan with %s: %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+
+	// Planning does not remove the outdated outputs
+	if _, err := os.Stat("first.txt"); err != nil {
+		t.Errorf("Output removed by planning: %s", err)
+	}
+}
+
+func equalStringMaps(a map[string]string, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if b[k] != v {
+			return false
+		}
+	}
+	return true
+}
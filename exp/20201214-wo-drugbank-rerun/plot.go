@@ -0,0 +1,602 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	str "strings"
+
+	ptpstats "github.com/pharmbio/ptp-project/lib/stats"
+)
+
+// Plot formats supported by the Go plotting code
+const (
+	plotFormatPDF = "pdf"
+	plotFormatSVG = "svg"
+)
+
+// Colors used in the plots, the same as in the earlier R plots
+const (
+	colBlack   = "#000000"
+	colGrey    = "#dddddd"
+	colDarkGry = "#888888"
+	colWhite   = "#ffffff"
+	colEff     = "#368645"
+	colOF      = "#167391"
+	colCAOF    = "#673BA8"
+)
+
+// ================================================================================
+// Canvas, with SVG and PDF backends
+// ================================================================================
+
+// drawStyle is the stroke and fill of a shape. An empty color means none.
+type drawStyle struct {
+	stroke string
+	fill   string
+	width  float64
+}
+
+// canvas is a minimal vector drawing surface. Coordinates are in points (1/72
+// inch), with the origin in the upper left corner.
+type canvas interface {
+	line(x1, y1, x2, y2 float64, style drawStyle)
+	polyline(xs, ys []float64, style drawStyle)
+	rect(x, y, w, h float64, style drawStyle)
+	circle(cx, cy, r float64, style drawStyle)
+	// text draws s with anchor "start", "middle" or "end" at (x, y), which
+	// is on the text baseline. Rotated text is turned 90 degrees
+	// counter-clockwise.
+	text(x, y, size float64, anchor string, rotated bool, color string, s string)
+}
+
+// renderFigure draws a figure of the given size (in points) with draw, and
+// returns it in the given format (pdf or svg)
+func renderFigure(format string, width, height float64, draw func(c canvas)) ([]byte, error) {
+	switch format {
+	case plotFormatSVG:
+		c := &svgCanvas{}
+		draw(c)
+		return c.bytes(width, height), nil
+	case plotFormatPDF:
+		c := &pdfCanvas{height: height}
+		draw(c)
+		return c.bytes(width, height), nil
+	}
+	return nil, fmt.Errorf("unknown plot format: %s", format)
+}
+
+type svgCanvas struct {
+	buf bytes.Buffer
+}
+
+func (c *svgCanvas) styleAttrs(style drawStyle) string {
+	fill := style.fill
+	if fill == "" {
+		fill = "none"
+	}
+	stroke := style.stroke
+	if stroke == "" {
+		stroke = "none"
+	}
+	width := style.width
+	if width == 0 {
+		width = 1
+	}
+	return fmt.Sprintf(`fill="%s" stroke="%s" stroke-width="%.2f"`, fill, stroke, width)
+}
+
+func (c *svgCanvas) line(x1, y1, x2, y2 float64, style drawStyle) {
+	fmt.Fprintf(&c.buf, `<line x1="%.2f" y1="%.2f" x2="%.2f" y2="%.2f" %s/>`+"\n", x1, y1, x2, y2, c.styleAttrs(style))
+}
+
+func (c *svgCanvas) polyline(xs, ys []float64, style drawStyle) {
+	points := []string{}
+	for i := range xs {
+		points = append(points, fmt.Sprintf("%.2f,%.2f", xs[i], ys[i]))
+	}
+	fmt.Fprintf(&c.buf, `<polyline points="%s" %s/>`+"\n", str.Join(points, " "), c.styleAttrs(style))
+}
+
+func (c *svgCanvas) rect(x, y, w, h float64, style drawStyle) {
+	fmt.Fprintf(&c.buf, `<rect x="%.2f" y="%.2f" width="%.2f" height="%.2f" %s/>`+"\n", x, y, w, h, c.styleAttrs(style))
+}
+
+func (c *svgCanvas) circle(cx, cy, r float64, style drawStyle) {
+	fmt.Fprintf(&c.buf, `<circle cx="%.2f" cy="%.2f" r="%.2f" %s/>`+"\n", cx, cy, r, c.styleAttrs(style))
+}
+
+var svgEscaper = str.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", `"`, "&quot;")
+
+func (c *svgCanvas) text(x, y, size float64, anchor string, rotated bool, color string, s string) {
+	transform := ""
+	if rotated {
+		transform = fmt.Sprintf(` transform="rotate(-90 %.2f %.2f)"`, x, y)
+	}
+	fmt.Fprintf(&c.buf, `<text x="%.2f" y="%.2f" font-family="Helvetica, Arial, sans-serif" font-size="%.1f" text-anchor="%s" fill="%s"%s>%s</text>`+"\n",
+		x, y, size, anchor, color, transform, svgEscaper.Replace(s))
+}
+
+func (c *svgCanvas) bytes(width, height float64) []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, `<?xml version="1.0" encoding="UTF-8"?>`+"\n")
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" width="%.0fpt" height="%.0fpt" viewBox="0 0 %.2f %.2f">`+"\n", width, height, width, height)
+	fmt.Fprintf(out, `<rect x="0" y="0" width="%.2f" height="%.2f" fill="white"/>`+"\n", width, height)
+	out.Write(c.buf.Bytes())
+	out.WriteString("</svg>\n")
+	return out.Bytes()
+}
+
+// pdfCanvas writes a single page PDF, with the standard Helvetica font
+type pdfCanvas struct {
+	height float64
+	buf    bytes.Buffer
+}
+
+func pdfColor(hex string) (float64, float64, float64) {
+	v, err := strconv.ParseUint(str.TrimPrefix(hex, "#"), 16, 32)
+	if err != nil {
+		return 0, 0, 0
+	}
+	return float64(v>>16&0xff) / 255, float64(v>>8&0xff) / 255, float64(v&0xff) / 255
+}
+
+// paint sets the colors and line width of style, and paints the current path
+func (c *pdfCanvas) paint(style drawStyle) {
+	width := style.width
+	if width == 0 {
+		width = 1
+	}
+	fmt.Fprintf(&c.buf, "%.2f w\n", width)
+	if style.fill != "" {
+		r, g, b := pdfColor(style.fill)
+		fmt.Fprintf(&c.buf, "%.3f %.3f %.3f rg\n", r, g, b)
+	}
+	if style.stroke != "" {
+		r, g, b := pdfColor(style.stroke)
+		fmt.Fprintf(&c.buf, "%.3f %.3f %.3f RG\n", r, g, b)
+	}
+	switch {
+	case style.fill != "" && style.stroke != "":
+		c.buf.WriteString("B\n")
+	case style.fill != "":
+		c.buf.WriteString("f\n")
+	case style.stroke != "":
+		c.buf.WriteString("S\n")
+	default:
+		c.buf.WriteString("n\n")
+	}
+}
+
+func (c *pdfCanvas) line(x1, y1, x2, y2 float64, style drawStyle) {
+	fmt.Fprintf(&c.buf, "%.2f %.2f m %.2f %.2f l\n", x1, c.height-y1, x2, c.height-y2)
+	style.fill = ""
+	c.paint(style)
+}
+
+func (c *pdfCanvas) polyline(xs, ys []float64, style drawStyle) {
+	if len(xs) == 0 {
+		return
+	}
+	fmt.Fprintf(&c.buf, "%.2f %.2f m\n", xs[0], c.height-ys[0])
+	for i := 1; i < len(xs); i++ {
+		fmt.Fprintf(&c.buf, "%.2f %.2f l\n", xs[i], c.height-ys[i])
+	}
+	style.fill = ""
+	c.paint(style)
+}
+
+func (c *pdfCanvas) rect(x, y, w, h float64, style drawStyle) {
+	fmt.Fprintf(&c.buf, "%.2f %.2f %.2f %.2f re\n", x, c.height-y-h, w, h)
+	c.paint(style)
+}
+
+func (c *pdfCanvas) circle(cx, cy, r float64, style drawStyle) {
+	// Four Bezier curves approximating a circle
+	k := 0.5523 * r
+	y := c.height - cy
+	fmt.Fprintf(&c.buf, "%.2f %.2f m\n", cx+r, y)
+	fmt.Fprintf(&c.buf, "%.2f %.2f %.2f %.2f %.2f %.2f c\n", cx+r, y+k, cx+k, y+r, cx, y+r)
+	fmt.Fprintf(&c.buf, "%.2f %.2f %.2f %.2f %.2f %.2f c\n", cx-k, y+r, cx-r, y+k, cx-r, y)
+	fmt.Fprintf(&c.buf, "%.2f %.2f %.2f %.2f %.2f %.2f c\n", cx-r, y-k, cx-k, y-r, cx, y-r)
+	fmt.Fprintf(&c.buf, "%.2f %.2f %.2f %.2f %.2f %.2f c h\n", cx+k, y-r, cx+r, y-k, cx+r, y)
+	c.paint(style)
+}
+
+var pdfEscaper = str.NewReplacer(`\`, `\\`, "(", `\(`, ")", `\)`)
+
+func (c *pdfCanvas) text(x, y, size float64, anchor string, rotated bool, color string, s string) {
+	// Approximate width of Helvetica text, used for anchoring
+	offset := 0.0
+	switch anchor {
+	case "middle":
+		offset = -textWidth(s, size) / 2
+	case "end":
+		offset = -textWidth(s, size)
+	}
+	r, g, b := pdfColor(color)
+	fmt.Fprintf(&c.buf, "%.3f %.3f %.3f rg\n", r, g, b)
+	if rotated {
+		fmt.Fprintf(&c.buf, "BT /F1 %.1f Tf 0 1 -1 0 %.2f %.2f Tm (%s) Tj ET\n", size, x, c.height-y+offset, pdfEscaper.Replace(s))
+	} else {
+		fmt.Fprintf(&c.buf, "BT /F1 %.1f Tf 1 0 0 1 %.2f %.2f Tm (%s) Tj ET\n", size, x+offset, c.height-y, pdfEscaper.Replace(s))
+	}
+}
+
+func (c *pdfCanvas) bytes(width, height float64) []byte {
+	content := c.buf.Bytes()
+	objects := []string{
+		"<< /Type /Catalog /Pages 2 0 R >>",
+		"<< /Type /Pages /Kids [3 0 R] /Count 1 >>",
+		fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Contents 4 0 R /Resources << /Font << /F1 5 0 R >> >> >>", width, height),
+		fmt.Sprintf("<< /Length %d >>\nstream\n%s\nendstream", len(content), content),
+		"<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>",
+	}
+	out := &bytes.Buffer{}
+	out.WriteString("%PDF-1.4\n")
+	offsets := []int{}
+	for i, obj := range objects {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(out, "%d 0 obj\n%s\nendobj\n", i+1, obj)
+	}
+	xrefOffset := out.Len()
+	fmt.Fprintf(out, "xref\n0 %d\n0000000000 65535 f \n", len(objects)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(out, "trailer\n<< /Size %d /Root 1 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(objects)+1, xrefOffset)
+	return out.Bytes()
+}
+
+// textWidth approximates the width of Helvetica text
+func textWidth(s string, size float64) float64 {
+	return float64(len(s)) * size * 0.52
+}
+
+// ================================================================================
+// Axes and panels
+// ================================================================================
+
+// frame is a rectangular region of a figure, in points
+type frame struct {
+	x, y, w, h float64
+}
+
+// plotArea maps data coordinates to a frame
+type plotArea struct {
+	frame
+	xmin, xmax, ymin, ymax float64
+	logX                   bool
+}
+
+func (a plotArea) px(x float64) float64 {
+	if a.logX {
+		return a.x + a.w*(math.Log10(x)-math.Log10(a.xmin))/(math.Log10(a.xmax)-math.Log10(a.xmin))
+	}
+	return a.x + a.w*(x-a.xmin)/(a.xmax-a.xmin)
+}
+
+func (a plotArea) py(y float64) float64 {
+	return a.y + a.h - a.h*(y-a.ymin)/(a.ymax-a.ymin)
+}
+
+// panelArea returns the plot area inside a panel frame, leaving space for
+// a title, tick labels and axis labels
+func panelArea(f frame, xmin, xmax, ymin, ymax float64) plotArea {
+	return plotArea{
+		frame: frame{x: f.x + 40, y: f.y + 22, w: f.w - 52, h: f.h - 58},
+		xmin:  xmin, xmax: xmax, ymin: ymin, ymax: ymax,
+	}
+}
+
+// drawAxes draws the axis lines, ticks with labels, axis labels and the title
+// of a plot area
+func drawAxes(c canvas, a plotArea, xticks, yticks []float64, xlabel, ylabel, title string) {
+	axisStyle := drawStyle{stroke: colBlack, width: 0.75}
+	c.line(a.x, a.y+a.h, a.x+a.w, a.y+a.h, axisStyle)
+	c.line(a.x, a.y, a.x, a.y+a.h, axisStyle)
+	for _, t := range xticks {
+		c.line(a.px(t), a.y+a.h, a.px(t), a.y+a.h+3, axisStyle)
+		c.text(a.px(t), a.y+a.h+12, 7, "middle", false, colBlack, fmtTick(t))
+	}
+	for _, t := range yticks {
+		c.line(a.x-3, a.py(t), a.x, a.py(t), axisStyle)
+		c.text(a.x-5, a.py(t)+2.5, 7, "end", false, colBlack, fmtTick(t))
+	}
+	c.text(a.x+a.w/2, a.y+a.h+25, 8, "middle", false, colBlack, xlabel)
+	c.text(a.x-28, a.y+a.h/2, 8, "middle", true, colBlack, ylabel)
+	c.text(a.x+a.w/2, a.y-8, 9, "middle", false, colBlack, title)
+}
+
+func fmtTick(v float64) string {
+	switch {
+	case v >= 1000000:
+		return strconv.FormatFloat(v/1000000, 'g', 3, 64) + " M"
+	case v >= 1000:
+		return strconv.FormatFloat(v/1000, 'g', 3, 64) + " k"
+	}
+	return strconv.FormatFloat(v, 'g', 3, 64)
+}
+
+// niceTicks returns about n evenly spaced, round, tick values from 0 up to at
+// least max
+func niceTicks(max float64, n int) []float64 {
+	if max <= 0 {
+		return []float64{0, 1}
+	}
+	rawStep := max / float64(n)
+	magnitude := math.Pow(10, math.Floor(math.Log10(rawStep)))
+	step := magnitude
+	for _, m := range []float64{1, 2, 5, 10} {
+		if m*magnitude >= rawStep {
+			step = m * magnitude
+			break
+		}
+	}
+	ticks := []float64{}
+	for t := 0.0; t < max+step; t += step {
+		ticks = append(ticks, t)
+	}
+	return ticks
+}
+
+// logTicks returns the powers of ten between min and max
+func logTicks(min, max float64) []float64 {
+	ticks := []float64{}
+	for t := math.Pow(10, math.Floor(math.Log10(min))); t <= max; t *= 10 {
+		if t >= min {
+			ticks = append(ticks, t)
+		}
+	}
+	return ticks
+}
+
+// panel draws a plot inside a frame
+type panel func(c canvas, f frame)
+
+// gridFigureSize returns the size of a figure with the panels in ncols
+// columns, with panels of size pw x ph
+func gridFigureSize(npanels, ncols int, pw, ph float64) (float64, float64) {
+	if npanels < ncols {
+		ncols = npanels
+	}
+	nrows := (npanels + ncols - 1) / ncols
+	return float64(ncols) * pw, float64(nrows) * ph
+}
+
+// drawGrid draws the panels in a grid with ncols columns
+func drawGrid(c canvas, panels []panel, ncols int, pw, ph float64) {
+	for i, p := range panels {
+		p(c, frame{x: float64(i%ncols) * pw, y: float64(i/ncols) * ph, w: pw, h: ph})
+	}
+}
+
+// ================================================================================
+// Specific plots
+// ================================================================================
+
+// summaryBar is one bar in the summary plot
+type summaryBar struct {
+	gene       string
+	active     float64
+	nonActive  float64
+	obsFuzz    float64
+	efficiency float64 // NaN if not available
+	obsFuzzCA  float64 // NaN if not available
+}
+
+// summaryPanel draws stacked bars of active and non-active compound counts per
+// gene, with 1 - observed fuzziness (and efficiency and class-averaged observed
+// fuzziness, if available) on a secondary axis, like plot_summary.r
+func summaryPanel(bars []summaryBar) panel {
+	return func(c canvas, f frame) {
+		maxCnt := 0.0
+		for _, b := range bars {
+			maxCnt = math.Max(maxCnt, b.active+b.nonActive)
+		}
+		yticks := niceTicks(maxCnt, 4)
+		a := plotArea{
+			frame: frame{x: f.x + 55, y: f.y + 20, w: f.w - 130, h: f.h - 90},
+			xmin:  0, xmax: float64(len(bars)), ymin: 0, ymax: yticks[len(yticks)-1],
+		}
+		drawAxes(c, a, nil, yticks, "", "Compounds", "")
+		barW := a.w / float64(len(bars))
+		for i, b := range bars {
+			x := a.px(float64(i)) + barW*0.1
+			c.rect(x, a.py(b.active), barW*0.8, a.py(0)-a.py(b.active), drawStyle{stroke: colBlack, fill: colWhite, width: 0.5})
+			c.rect(x, a.py(b.active+b.nonActive), barW*0.8, a.py(b.active)-a.py(b.active+b.nonActive), drawStyle{stroke: colBlack, fill: colGrey, width: 0.5})
+			c.text(x+barW*0.4+2.5, a.y+a.h+5, 6, "end", true, colBlack, b.gene)
+		}
+
+		// Secondary axis, with metrics between 0 and 1
+		a2 := a
+		a2.ymax = 1
+		for _, t := range []float64{0, 0.5, 1} {
+			c.line(a.x+a.w, a2.py(t), a.x+a.w+3, a2.py(t), drawStyle{stroke: colBlack, width: 0.75})
+			c.text(a.x+a.w+5, a2.py(t)+2.5, 7, "start", false, colBlack, fmtTick(1-t))
+		}
+		c.line(a.x+a.w, a.y, a.x+a.w, a.y+a.h, drawStyle{stroke: colBlack, width: 0.75})
+		series := []struct {
+			label string
+			color string
+			value func(b summaryBar) float64
+		}{
+			{"Observed Fuzziness (OF)", colOF, func(b summaryBar) float64 { return b.obsFuzz }},
+			{"M Criterion (MC)", colEff, func(b summaryBar) float64 { return b.efficiency }},
+			{"Class-averaged OF (CAOF)", colCAOF, func(b summaryBar) float64 { return b.obsFuzzCA }},
+		}
+		labelX := a.x + a.w + 22
+		for _, s := range series {
+			xs, ys := []float64{}, []float64{}
+			for i, b := range bars {
+				v := s.value(b)
+				if math.IsNaN(v) {
+					continue
+				}
+				xs = append(xs, a.px(float64(i)+0.5))
+				ys = append(ys, a2.py(1-v))
+				c.circle(xs[len(xs)-1], ys[len(ys)-1], 2, drawStyle{stroke: s.color, width: 0.75})
+			}
+			if len(xs) == 0 {
+				continue
+			}
+			c.polyline(xs, ys, drawStyle{stroke: s.color, width: 0.75})
+			c.text(labelX, a.y+a.h/2, 8, "middle", true, s.color, s.label)
+			labelX += 11
+		}
+
+		// Legend
+		c.rect(a.x+a.w-70, a.y+4, 8, 8, drawStyle{stroke: colBlack, fill: colWhite, width: 0.5})
+		c.text(a.x+a.w-58, a.y+11, 7, "start", false, colBlack, "Active")
+		c.rect(a.x+a.w-70, a.y+16, 8, 8, drawStyle{stroke: colBlack, fill: colGrey, width: 0.5})
+		c.text(a.x+a.w-58, a.y+23, 7, "start", false, colBlack, "Nonactive")
+	}
+}
+
+// calibrationPanel draws the accuracy against confidence of a conformal
+// predictor, together with the diagonal of perfect calibration
+func calibrationPanel(title string, points []calibrationPoint) panel {
+	return func(c canvas, f frame) {
+		a := panelArea(f, 0, 1, 0, 1)
+		drawAxes(c, a, []float64{0, 0.5, 1}, []float64{0, 0.5, 1}, "Confidence", "Accuracy", title)
+		c.line(a.px(0), a.py(0), a.px(1), a.py(1), drawStyle{stroke: colDarkGry, width: 0.75})
+		for _, pt := range points {
+			c.circle(a.px(pt.Confidence), a.py(pt.Accuracy), 2, drawStyle{stroke: colBlack, width: 0.75})
+		}
+	}
+}
+
+// Rows and columns of the validation confusion plot
+var (
+	confusionObserved  = []string{"A", "N"}
+	confusionPredicted = []string{"Both", "A", "N", "Null"}
+)
+
+// confusionPanel draws a ball plot of observed labels against predicted label
+// sets, with the area of each ball proportional to the count, like
+// plot_valdata.r
+func confusionPanel(title string, counts [2][4]int) panel {
+	return func(c canvas, f frame) {
+		a := panelArea(f, 0, 2, 0, 4)
+		drawAxes(c, a, nil, nil, "Observed", "Predicted", title)
+		maxCnt := 1
+		for _, row := range counts {
+			for _, cnt := range row {
+				if cnt > maxCnt {
+					maxCnt = cnt
+				}
+			}
+		}
+		maxR := math.Min(a.w/4, a.h/8) * 0.95
+		for i, obs := range confusionObserved {
+			x := a.px(float64(i) + 0.5)
+			c.text(x, a.y+a.h+12, 7, "middle", false, colBlack, obs)
+			for j, pred := range confusionPredicted {
+				y := a.py(3.5 - float64(j))
+				if i == 0 {
+					c.text(a.x-5, y+2.5, 7, "end", false, colBlack, pred)
+				}
+				c.line(a.x, y, a.x+a.w, y, drawStyle{stroke: colGrey, width: 0.5})
+				r := maxR * math.Sqrt(float64(counts[i][j])/float64(maxCnt))
+				if r > 0 {
+					c.circle(x, y, r, drawStyle{stroke: colBlack, fill: colGrey, width: 0.5})
+				}
+				c.text(x+maxR+2, y+2.5, 6, "start", false, colDarkGry, fmt.Sprintf("%d", counts[i][j]))
+			}
+		}
+	}
+}
+
+// learningCurvePoint is the result for one replicate and subsample fraction
+type learningCurvePoint struct {
+	trainSize float64
+	fraction  float64
+	obsFuzz   float64
+	validity  float64
+}
+
+// learningCurvePanel draws observed fuzziness and validity against training
+// set size (log scale), with one point per replicate and a line through the
+// median per fraction
+func learningCurvePanel(title string, points []learningCurvePoint) panel {
+	return func(c canvas, f frame) {
+		minSize, maxSize := math.Inf(1), 1.0
+		for _, pt := range points {
+			if pt.trainSize > 0 {
+				minSize = math.Min(minSize, pt.trainSize)
+				maxSize = math.Max(maxSize, pt.trainSize)
+			}
+		}
+		if math.IsInf(minSize, 1) || minSize == maxSize {
+			minSize = maxSize / 10
+		}
+		a := panelArea(f, minSize, maxSize, 0, 1)
+		a.logX = true
+		drawAxes(c, a, logTicks(minSize, maxSize), []float64{0, 0.5, 1}, "Training set size", "", title)
+
+		byFrac := map[float64][]learningCurvePoint{}
+		for _, pt := range points {
+			if pt.trainSize <= 0 {
+				continue
+			}
+			byFrac[pt.fraction] = append(byFrac[pt.fraction], pt)
+			c.circle(a.px(pt.trainSize), a.py(pt.obsFuzz), 2, drawStyle{stroke: colOF, width: 0.75})
+			c.rect(a.px(pt.trainSize)-2, a.py(pt.validity)-2, 4, 4, drawStyle{stroke: colEff, width: 0.75})
+		}
+		fracs := []float64{}
+		for frac := range byFrac {
+			fracs = append(fracs, frac)
+		}
+		sort.Float64s(fracs)
+		xs, ofs, vals := []float64{}, []float64{}, []float64{}
+		for _, frac := range fracs {
+			sizes, of, val := []float64{}, []float64{}, []float64{}
+			for _, pt := range byFrac[frac] {
+				sizes = append(sizes, pt.trainSize)
+				of = append(of, pt.obsFuzz)
+				val = append(val, pt.validity)
+			}
+			xs = append(xs, a.px(ptpstats.Median(sizes)))
+			ofs = append(ofs, a.py(ptpstats.Median(of)))
+			vals = append(vals, a.py(ptpstats.Median(val)))
+		}
+		c.polyline(xs, ofs, drawStyle{stroke: colOF, width: 0.75})
+		c.polyline(xs, vals, drawStyle{stroke: colEff, width: 0.75})
+		c.text(a.x+a.w, a.y+8, 6, "end", false, colOF, "Obs. fuzziness")
+		c.text(a.x+a.w, a.y+16, 6, "end", false, colEff, "Validity")
+	}
+}
+
+// costPerfPanel draws observed fuzziness against the cost (log scale) in the
+// hyperparameter search, marking the selected cost
+func costPerfPanel(title string, costs []float64, obsFuzz []float64, bestCost float64) panel {
+	return func(c canvas, f frame) {
+		minCost, maxCost := math.Inf(1), math.Inf(-1)
+		maxOF := 0.0
+		for i := range costs {
+			minCost = math.Min(minCost, costs[i])
+			maxCost = math.Max(maxCost, costs[i])
+			maxOF = math.Max(maxOF, obsFuzz[i])
+		}
+		if minCost <= 0 || minCost == maxCost {
+			minCost, maxCost = 1, 10*math.Max(1, maxCost)
+		}
+		yticks := niceTicks(maxOF, 3)
+		a := panelArea(f, minCost, maxCost, 0, yticks[len(yticks)-1])
+		a.logX = true
+		drawAxes(c, a, logTicks(minCost, maxCost), yticks, "Cost", "Obs. fuzziness", title)
+		xs, ys := []float64{}, []float64{}
+		for i := range costs {
+			xs = append(xs, a.px(costs[i]))
+			ys = append(ys, a.py(obsFuzz[i]))
+			style := drawStyle{stroke: colOF, width: 0.75}
+			if costs[i] == bestCost {
+				style.fill = colOF
+			}
+			c.circle(xs[i], ys[i], 2.5, style)
+		}
+		c.polyline(xs, ys, drawStyle{stroke: colOF, width: 0.75})
+	}
+}
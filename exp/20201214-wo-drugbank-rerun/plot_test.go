@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+func TestNiceTicks(t *testing.T) {
+	tests := []struct {
+		max  float64
+		n    int
+		want []float64
+	}{
+		{87, 4, []float64{0, 50, 100}},
+		{100, 4, []float64{0, 50, 100}},
+		{12, 5, []float64{0, 5, 10, 15}},
+		{3, 3, []float64{0, 1, 2, 3}},
+		{0, 4, []float64{0, 1}}, // No data
+	}
+	for _, tt := range tests {
+		if got := niceTicks(tt.max, tt.n); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("niceTicks(%g, %d) = %v, want %v", tt.max, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestLogTicks(t *testing.T) {
+	tests := []struct {
+		min, max float64
+		want     []float64
+	}{
+		{0.5, 2000, []float64{1, 10, 100, 1000}},
+		{1, 100, []float64{1, 10, 100}},
+		{20, 50, []float64{}},
+	}
+	for _, tt := range tests {
+		if got := logTicks(tt.min, tt.max); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("logTicks(%g, %g) = %v, want %v", tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestFmtTick(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0.5, "0.5"},
+		{250, "250"},
+		{1500, "1.5 k"},
+		{2000000, "2 M"},
+	}
+	for _, tt := range tests {
+		if got := fmtTick(tt.v); got != tt.want {
+			t.Errorf("fmtTick(%g) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestGridFigureSize(t *testing.T) {
+	tests := []struct {
+		npanels, ncols        int
+		wantWidth, wantHeight float64
+	}{
+		{10, 4, 400, 150},
+		{8, 4, 400, 100},
+		{3, 7, 300, 50}, // Fewer panels than columns
+	}
+	for _, tt := range tests {
+		if w, h := gridFigureSize(tt.npanels, tt.ncols, 100, 50); w != tt.wantWidth || h != tt.wantHeight {
+			t.Errorf("gridFigureSize(%d, %d) = %g x %g, want %g x %g", tt.npanels, tt.ncols, w, h, tt.wantWidth, tt.wantHeight)
+		}
+	}
+}
+
+func TestRenderFigure(t *testing.T) {
+	draw := func(c canvas) {
+		c.rect(10, 10, 50, 20, drawStyle{stroke: colBlack, fill: colGrey})
+		c.text(10, 40, 8, "middle", false, colBlack, "f(x) < 1 & y")
+	}
+
+	svg, err := renderFigure(plotFormatSVG, 200, 100, draw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`<svg xmlns="http://www.w3.org/2000/svg" width="200pt" height="100pt"`,
+		`<rect x="10.00" y="10.00" width="50.00" height="20.00" fill="#dddddd" stroke="#000000" stroke-width="1.00"/>`,
+		`>f(x) &lt; 1 &amp; y</text>`,
+	} {
+		if !bytes.Contains(svg, []byte(want)) {
+			t.Errorf("SVG does not contain %s:\n%s", want, svg)
+		}
+	}
+
+	pdf, err := renderFigure(plotFormatPDF, 200, 100, draw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"%PDF-1.4\n",
+		"/MediaBox [0 0 200.00 100.00]",
+		"10.00 70.00 50.00 20.00 re\n", // Flipped y axis
+		`(f\(x\) < 1 & y) Tj`,
+	} {
+		if !bytes.Contains(pdf, []byte(want)) {
+			t.Errorf("PDF does not contain %s:\n%s", want, pdf)
+		}
+	}
+	// The cross-reference table should point at the objects
+	xrefPos, err := strconv.Atoi(string(regexp.MustCompile(`startxref\n(\d+)\n`).FindSubmatch(pdf)[1]))
+	if err != nil || !bytes.HasPrefix(pdf[xrefPos:], []byte("xref\n")) {
+		t.Errorf("startxref %d does not point at the xref table", xrefPos)
+	}
+	for i, m := range regexp.MustCompile(`(\d{10}) 00000 n `).FindAllSubmatch(pdf, -1) {
+		offset, _ := strconv.Atoi(string(m[1]))
+		if want := fmt.Sprintf("%d 0 obj\n", i+1); !bytes.HasPrefix(pdf[offset:], []byte(want)) {
+			t.Errorf("Offset %d of object %d does not point at %q", offset, i+1, want)
+		}
+	}
+
+	if _, err := renderFigure("png", 200, 100, draw); err == nil {
+		t.Errorf("renderFigure(png) did not return an error")
+	}
+}
+
+func TestValidationConfusion(t *testing.T) {
+	data := []byte(`Validation of model DRD1
+{"molecule": {"activity": "A"}, "prediction": {"predictedLabels": [{"confidence": 0.8, "labels": ["A"]}, {"confidence": 0.9, "labels": ["A", "N"]}]}}
+{"molecule": {"activity": "N"}, "prediction": {"predictedLabels": [{"confidence": 0.8, "labels": ["N"]}, {"confidence": 0.9, "labels": ["A", "N"]}]}}
+{"molecule": {"activity": "N"}, "prediction": {"predictedLabels": [{"confidence": 0.8, "labels": ["A"]}, {"confidence": 0.9, "labels": []}]}}
+{"molecule": {"activity": "A"}, "prediction": {"predictedLabels": [{"labels": []}]}}
+{"molecule": {"activity": "X"}, "prediction": {"predictedLabels": [{"confidence": 0.8, "labels": ["A"]}]}}
+`)
+	// Rows are observed A and N, columns predicted Both, A, N and Null
+	tests := []struct {
+		confidence float64
+		want       [2][4]int
+	}{
+		{0.8, [2][4]int{{0, 1, 0, 1}, {0, 1, 1, 0}}},
+		{0.9, [2][4]int{{1, 0, 0, 1}, {1, 0, 0, 1}}},
+		{0.5, [2][4]int{{0, 1, 0, 1}, {0, 1, 1, 0}}}, // Not tagged with 0.5, so the first sets are used
+	}
+	for _, tt := range tests {
+		if got := validationConfusion(data, tt.confidence); got != tt.want {
+			t.Errorf("validationConfusion(%.1f) = %v, want %v", tt.confidence, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+
+// NewPlotSummary returns a process plotting compound counts and observed
+// fuzziness (and efficiency, if available) per gene, for the runset given by
+// the "runset" parameter, from a final models summary. Only the first
+// replicate of each gene is plotted, in the order of the summary file.
+func NewPlotSummary(wf *sp.Workflow, procName string, format string) *sp.Process {
+	p := wf.NewProc(procName, "# PlotSummary custom process. Ports: {i:summary} {o:plot} {p:runset}")
+	p.CustomExecute = func(t *sp.Task) {
+		rows := readTSVWithHeader(t.InPath("summary"))
+		bars := []summaryBar{}
+		seen := map[string]bool{}
+		for _, row := range rows {
+			if row["Runset"] != t.Param("runset") || seen[row["Gene"]] {
+				continue
+			}
+			seen[row["Gene"]] = true
+			bars = append(bars, summaryBar{
+				gene:       row["Gene"],
+				active:     parseFloatOrNaN(row["ActiveCnt"]),
+				nonActive:  parseFloatOrNaN(row["NonactiveCnt"]),
+				obsFuzz:    parseFloatOrNaN(row["ObsFuzzOverall"]),
+				efficiency: parseFloatOrNaN(row["Efficiency"]),
+				obsFuzzCA:  parseFloatOrNaN(row["ObsFuzzClassAvg"]),
+			})
+		}
+		if len(bars) == 0 {
+			sp.Failf("| %-32s | No rows for runset %s in summary %s\n", t.Name, t.Param("runset"), t.InPath("summary"))
+		}
+		width := math.Max(414, 60+14*float64(len(bars))+130)
+		writeFigure(t.OutIP("plot").TempPath(), format, width, 432, summaryPanel(bars))
+	}
+	return p
+}
+
+// NewPlotLearningCurve returns a process plotting learning curves, with one
+// panel per gene, from the summary written by LearningCurveSummarizer
+func NewPlotLearningCurve(wf *sp.Workflow, procName string, format string) *sp.Process {
+	p := wf.NewProc(procName, "# PlotLearningCurve custom process. Ports: {i:summary} {o:plot}")
+	p.CustomExecute = func(t *sp.Task) {
+		pointsPerGene := map[string][]learningCurvePoint{}
+		genes := []string{}
+		for _, row := range readTSVWithHeader(t.InPath("summary")) {
+			if _, ok := pointsPerGene[row["Gene"]]; !ok {
+				genes = append(genes, row["Gene"])
+			}
+			pointsPerGene[row["Gene"]] = append(pointsPerGene[row["Gene"]], learningCurvePoint{
+				trainSize: parseFloatOrNaN(row["TrainSize"]),
+				fraction:  parseFloatOrNaN(row["Fraction"]),
+				obsFuzz:   parseFloatOrNaN(row["ObsFuzzOverall"]),
+				validity:  parseFloatOrNaN(row["Validity"]),
+			})
+		}
+		sort.Strings(genes)
+		panels := []panel{}
+		for _, gene := range genes {
+			panels = append(panels, learningCurvePanel(gene, pointsPerGene[gene]))
+		}
+		writeGridFigure(t.OutIP("plot").TempPath(), format, panels, 4, 180, 160)
+	}
+	return p
+}
+
+// ================================================================================
+
+// CalibrationPlotter plots calibration curves (accuracy against confidence)
+// from the crossvalidation of each final model, for the cost selected for the
+// model, with one plot per gene, replicate and runset, and all of them in a
+// grid figure. It takes the crossvalidation results for all costs, and the
+// final models, which carry the selected cost as a parameter.
+type CalibrationPlotter struct {
+	sp.BaseProcess
+	Format       string
+	GridFileName string
+}
+
+func NewCalibrationPlotter(wf *sp.Workflow, procName string, format string, gridFileName string) *CalibrationPlotter {
+	p := &CalibrationPlotter{
+		BaseProcess:  sp.NewBaseProcess(wf, procName),
+		Format:       format,
+		GridFileName: gridFileName,
+	}
+	p.InitInPort(p, "cvstats")
+	p.InitInPort(p, "model")
+	p.InitOutPort(p, "plots")
+	p.InitOutPort(p, "grid")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *CalibrationPlotter) InCrossValStats() *sp.InPort { return p.InPort("cvstats") }
+func (p *CalibrationPlotter) InModel() *sp.InPort         { return p.InPort("model") }
+func (p *CalibrationPlotter) OutPlots() *sp.OutPort       { return p.OutPort("plots") }
+func (p *CalibrationPlotter) OutGrid() *sp.OutPort        { return p.OutPort("grid") }
+
+func (p *CalibrationPlotter) Run() {
+	defer p.CloseAllOutPorts()
+
+	panels := []panel{}
+	for _, cvIP := range receiveSelectedCrossValStats(p.Name(), p.InCrossValStats(), p.InModel()) {
+		uniq := str.ToLower(cvIP.Param("gene")) + "." + cvIP.Param("replicate") + "." + cvIP.Param("runset")
+		metrics := parseCrossValMetrics(cvIP.Read())
+		title := cvIP.Param("gene") + " " + cvIP.Param("replicate")
+		pnl := calibrationPanel(title, metrics.Points)
+		panels = append(panels, pnl)
+
+		oip := sp.NewFileIP("res/calibration/" + uniq + ".calibration." + p.Format)
+		writeFigure(oip.TempPath(), p.Format, 200, 200, pnl)
+		oip.Atomize()
+		p.OutPlots().Send(oip)
+	}
+
+	if len(panels) > 0 {
+		oip := sp.NewFileIP(p.GridFileName)
+		writeGridFigure(oip.TempPath(), p.Format, panels, 7, 150, 150)
+		oip.Atomize()
+		p.OutGrid().Send(oip)
+	}
+}
+
+// ================================================================================
+
+// ValidationPlotter plots, for validation results from CPSign validate,
+// observed labels against predicted label sets at the given confidence level,
+// with one plot per gene, replicate and runset, one for all targets together,
+// and all the per-target plots in a grid figure
+type ValidationPlotter struct {
+	sp.BaseProcess
+	Format     string
+	Confidence float64
+	OutDir     string
+}
+
+func NewValidationPlotter(wf *sp.Workflow, procName string, format string, confidence float64, outDir string) *ValidationPlotter {
+	p := &ValidationPlotter{
+		BaseProcess: sp.NewBaseProcess(wf, procName),
+		Format:      format,
+		Confidence:  confidence,
+		OutDir:      outDir,
+	}
+	p.InitInPort(p, "validation")
+	p.InitOutPort(p, "plots")
+	p.InitOutPort(p, "grid")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *ValidationPlotter) InValidation() *sp.InPort { return p.InPort("validation") }
+func (p *ValidationPlotter) OutPlots() *sp.OutPort    { return p.OutPort("plots") }
+func (p *ValidationPlotter) OutGrid() *sp.OutPort     { return p.OutPort("grid") }
+
+func (p *ValidationPlotter) Run() {
+	defer p.CloseAllOutPorts()
+
+	confStr := str.Replace(strconv.FormatFloat(p.Confidence, 'f', -1, 64), ".", "p", 1) // We use 'p' instead of '.' to avoid confusion in the file name
+	ips := []*sp.FileIP{}
+	for ip := range p.InValidation().Chan {
+		if failurePolicy.SkipIP(p.Name(), ip) {
+			continue
+		}
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool { return ips[i].Path() < ips[j].Path() })
+
+	panels := []panel{}
+	total := [2][4]int{}
+	for _, ip := range ips {
+		counts := validationConfusion(ip.Read(), p.Confidence)
+		for i := range counts {
+			for j := range counts[i] {
+				total[i][j] += counts[i][j]
+			}
+		}
+		uniq := str.ToLower(ip.Param("gene")) + "." + ip.Param("replicate") + "." + ip.Param("runset")
+		pnl := confusionPanel(str.ToUpper(ip.Param("gene"))+" "+ip.Param("replicate"), counts)
+		panels = append(panels, pnl)
+
+		oip := sp.NewFileIP(p.OutDir + "/" + uniq + ".valdata." + confStr + "." + p.Format)
+		writeFigure(oip.TempPath(), p.Format, 216, 260, pnl)
+		oip.Atomize()
+		p.OutPlots().Send(oip)
+	}
+	if len(panels) == 0 {
+		return
+	}
+
+	allOIP := sp.NewFileIP(p.OutDir + "/all_targets.valdata." + confStr + "." + p.Format)
+	writeFigure(allOIP.TempPath(), p.Format, 216, 260, confusionPanel("Confidence: "+strconv.FormatFloat(p.Confidence, 'f', -1, 64), total))
+	allOIP.Atomize()
+	p.OutPlots().Send(allOIP)
+
+	gridOIP := sp.NewFileIP(p.OutDir + "/valdata_grid." + confStr + "." + p.Format)
+	writeGridFigure(gridOIP.TempPath(), p.Format, panels, 7, 150, 180)
+	gridOIP.Atomize()
+	p.OutGrid().Send(gridOIP)
+}
+
+// ================================================================================
+// Helpers
+// ================================================================================
+
+func writeFigure(path string, format string, width, height float64, pnl panel) {
+	data, err := renderFigure(format, width, height, func(c canvas) {
+		pnl(c, frame{x: 0, y: 0, w: width, h: height})
+	})
+	sp.Check(err)
+	writePlotFile(path, data)
+}
+
+func writeGridFigure(path string, format string, panels []panel, ncols int, pw, ph float64) {
+	if len(panels) < ncols {
+		ncols = len(panels)
+	}
+	width, height := gridFigureSize(len(panels), ncols, pw, ph)
+	data, err := renderFigure(format, width, height, func(c canvas) {
+		drawGrid(c, panels, ncols, pw, ph)
+	})
+	sp.Check(err)
+	writePlotFile(path, data)
+}
+
+func writePlotFile(path string, data []byte) {
+	sp.CheckWithMsg(os.MkdirAll(filepath.Dir(path), 0755), "Could not create directory for plot: "+path)
+	sp.CheckWithMsg(ioutil.WriteFile(path, data, 0644), "Could not write plot: "+path)
+}
+
+// readTSVWithHeader reads a tab-separated file with a header row, into one map
+// per row, keyed on column names
+func readTSVWithHeader(path string) []map[string]string {
+	data, err := ioutil.ReadFile(path)
+	sp.CheckWithMsg(err, "Could not read file: "+path)
+	tsvReader := csv.NewReader(bytes.NewReader(data))
+	tsvReader.Comma = '\t'
+	tsvReader.FieldsPerRecord = -1
+	rows, err := tsvReader.ReadAll()
+	sp.CheckWithMsg(err, "Could not parse tab-separated file: "+path)
+	out := []map[string]string{}
+	if len(rows) < 2 {
+		return out
+	}
+	for _, row := range rows[1:] {
+		m := map[string]string{}
+		for i, name := range rows[0] {
+			if i < len(row) {
+				m[name] = row[i]
+			}
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func parseFloatOrNaN(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.NaN()
+	}
+	return v
+}
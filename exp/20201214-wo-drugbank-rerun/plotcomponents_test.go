@@ -0,0 +1,120 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestReadTSVWithHeader(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "read_tsv_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		data string
+		want []map[string]string
+	}{
+		{
+			"Gene\tRunset\tEfficiency\nDRD1\torig\t0.8\nDRD2\tfill\n",
+			[]map[string]string{
+				{"Gene": "DRD1", "Runset": "orig", "Efficiency": "0.8"},
+				{"Gene": "DRD2", "Runset": "fill"}, // Short rows lack the last columns
+			},
+		},
+		{"Gene\tRunset\n", []map[string]string{}},
+		{"", []map[string]string{}},
+	}
+	for i, tt := range tests {
+		path := filepath.Join(tmpDir, "table.tsv")
+		if err := ioutil.WriteFile(path, []byte(tt.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTSVWithHeader(path); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("readTSVWithHeader(table %d) = %v, want %v", i, got, tt.want)
+		}
+	}
+}
+
+func TestParseFloatOrNaN(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+	}{
+		{"0.25", 0.25},
+		{"1e3", 1000},
+		{"NA", math.NaN()},
+		{"", math.NaN()},
+	}
+	for _, tt := range tests {
+		got := parseFloatOrNaN(tt.s)
+		if got != tt.want && !(math.IsNaN(got) && math.IsNaN(tt.want)) {
+			t.Errorf("parseFloatOrNaN(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+// TestPlotSummary plots the first replicate of each gene for one of two
+// runsets in a summary
+func TestPlotSummary(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "plot_summary_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	summary := "Gene\tReplicate\tRunset\tActiveCnt\tNonactiveCnt\tObsFuzzOverall\tEfficiency\tObsFuzzClassAvg\n" +
+		"DRD1\tr1\torig\t120\t80\t0.10\t0.85\t0.12\n" +
+		"DRD1\tr2\torig\t120\t80\t0.90\t0.85\t0.12\n" +
+		"HTR2B\tr1\torig\t30\t60\t0.20\tNA\tNA\n" +
+		"PDE3A\tr1\tfill\t10\t20\t0.30\t0.70\t0.31\n"
+	summaryPath := filepath.Join(tmpDir, "summary.tsv")
+	if err := ioutil.WriteFile(summaryPath, []byte(summary), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wf := sp.NewWorkflow("plot_summary_test", 1)
+	summaryProc := wf.NewProc("summary", "echo {o:summary}")
+	summaryProc.SetPathStatic("summary", summaryPath)
+	plotSummary := NewPlotSummary(wf, "plot_summary", plotFormatSVG)
+	plotSummary.SetPathExtend("summary", "plot", ".orig.svg")
+	plotSummary.In("summary").Connect(summaryProc.Out("summary"))
+	plotSummary.ParamInPort("runset").ConnectStr("orig")
+	wf.Run()
+
+	svg, err := ioutil.ReadFile(summaryPath + ".orig.svg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, gene := range []string{"DRD1", "HTR2B"} {
+		if n := str.Count(string(svg), ">"+gene+"</text>"); n != 1 {
+			t.Errorf("Gene %s is labeled %d times in the plot, want once", gene, n)
+		}
+	}
+	if str.Contains(string(svg), ">PDE3A</text>") {
+		t.Errorf("Gene PDE3A of another runset is in the plot")
+	}
+	// Points for the observed fuzziness of both genes, and for the efficiency
+	// and class-averaged observed fuzziness of DRD1 only
+	if n := str.Count(string(svg), `<circle`); n != 4 {
+		t.Errorf("Plot has %d points, want 4", n)
+	}
+}
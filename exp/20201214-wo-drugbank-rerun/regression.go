@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	str "strings"
+	"sync"
+
+	ptpc "github.com/pharmbio/ptp-project/lib/components"
+	ptpstats "github.com/pharmbio/ptp-project/lib/stats"
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Conformal regression on pXC50
+// ================================================================================
+
+// ExtractRegressionData is a SciPipe process extracting the data for one
+// target (the "gene" parameter) from a gene/id/smiles/pxc50 (gspa) file, as
+// "smiles<tab>pxc50" lines with a header. Structures measured more than once
+// get the median of their pXC50 values.
+type ExtractRegressionData struct {
+	*sp.Process
+}
+
+func (p *ExtractRegressionData) InGSPA() *sp.InPort      { return p.In("gspa") }
+func (p *ExtractRegressionData) InGene() *sp.ParamInPort { return p.ParamInPort("gene") }
+func (p *ExtractRegressionData) OutData() *sp.OutPort    { return p.Out("data") }
+
+func NewExtractRegressionData(wf *sp.Workflow, procName string, pathFunc func(t *sp.Task) string) *ExtractRegressionData {
+	p := &ExtractRegressionData{wf.NewProc(procName, "# ExtractRegressionData custom process. Ports: {i:gspa} {p:gene} {o:data}")}
+	p.SetPathCustom("data", pathFunc)
+	p.CustomExecute = func(t *sp.Task) {
+		gene := str.ToUpper(t.Param("gene"))
+		smilesList := []string{}
+		values := map[string][]float64{}
+		forEachGISARow(t.InPath("gspa"), func(row []string) {
+			if row[0] != gene {
+				return
+			}
+			v, err := strconv.ParseFloat(row[3], 64)
+			if err != nil || math.IsNaN(v) {
+				return
+			}
+			if _, ok := values[row[2]]; !ok {
+				smilesList = append(smilesList, row[2])
+			}
+			values[row[2]] = append(values[row[2]], v)
+		})
+		sort.Strings(smilesList)
+
+		outPath := t.OutIP("data").TempPath()
+		outFh, err := os.Create(outPath)
+		sp.CheckWithMsg(err, "Could not create file: "+outPath)
+		defer outFh.Close()
+		outWrt := bufio.NewWriter(outFh)
+		outWrt.WriteString("smiles\tpxc50\n")
+		for _, smiles := range smilesList {
+			outWrt.WriteString(smiles + "\t" + strconv.FormatFloat(ptpstats.Median(values[smiles]), 'f', 2, 64) + "\n")
+		}
+		sp.CheckWithMsg(outWrt.Flush(), "Could not write file: "+outPath)
+		sp.Audit.Printf("| %-32s | Extracted pXC50 values of %d structures for %s\n", t.Name, len(smilesList), gene)
+	}
+	return p
+}
+
+// ================================================================================
+
+// RegressionCostSelector is a SciPipe component selecting the cost of a
+// conformal regression model from its crossvalidation results, one per cost.
+// The cost giving the narrowest median prediction interval at the Confidence
+// level is selected, with the RMSE deciding between costs giving equally wide
+// intervals, as efficiency is to conformal regression what observed
+// fuzziness is to classification. The results are written to a table, like
+// those of SummarizeCostGammaPerf.
+type RegressionCostSelector struct {
+	sp.BaseProcess
+	FileName   string
+	Confidence float64
+}
+
+func NewRegressionCostSelector(wf *sp.Workflow, procName string, fileName string, confidence float64) *RegressionCostSelector {
+	p := &RegressionCostSelector{
+		BaseProcess: sp.NewBaseProcess(wf, procName),
+		FileName:    fileName,
+		Confidence:  confidence,
+	}
+	p.InitInPort(p, "cvstats")
+	p.InitOutPort(p, "stats")
+	p.InitParamOutPort(p, "best_cost")
+	p.InitParamOutPort(p, "best_rmse")
+	p.InitParamOutPort(p, "best_width")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *RegressionCostSelector) InCrossValStats() *sp.InPort    { return p.InPort("cvstats") }
+func (p *RegressionCostSelector) OutStats() *sp.OutPort          { return p.OutPort("stats") }
+func (p *RegressionCostSelector) OutBestCost() *sp.ParamOutPort  { return p.ParamOutPort("best_cost") }
+func (p *RegressionCostSelector) OutBestRMSE() *sp.ParamOutPort  { return p.ParamOutPort("best_rmse") }
+func (p *RegressionCostSelector) OutBestWidth() *sp.ParamOutPort { return p.ParamOutPort("best_width") }
+
+func (p *RegressionCostSelector) Run() {
+	defer p.OutStats().Close()
+	defer p.OutBestCost().Close()
+	defer p.OutBestRMSE().Close()
+	defer p.OutBestWidth().Close()
+
+	iips := []*sp.FileIP{}
+	skipped := 0
+	for iip := range p.InCrossValStats().Chan {
+		if failurePolicy.SkipIP(p.Name(), iip) {
+			skipped++
+			continue
+		}
+		iips = append(iips, iip)
+	}
+	sort.Slice(iips, func(i, j int) bool {
+		return parseFloatOrNaN(iips[i].Param("cost")) < parseFloatOrNaN(iips[j].Param("cost"))
+	})
+
+	rows := [][]string{{"Gene", "Cost", "RMSE", "MedianWidth"}}
+	bestCost, bestRMSE, bestWidth := "-1", math.NaN(), math.NaN()
+	for _, iip := range iips {
+		rmse, width, err := regressionCrossValStats(iip.Read(), p.Confidence)
+		if err != nil {
+			sp.Failf("| %-32s | Could not read regression crossvalidation results %s: %v\n", p.Name(), iip.Path(), err)
+		}
+		rows = append(rows, []string{iip.Param("gene"), iip.Param("cost"), ptpc.FmtFloat(rmse), ptpc.FmtFloat(width)})
+		if bestCost == "-1" || lessRegressionPerf(width, rmse, bestWidth, bestRMSE) {
+			bestCost, bestRMSE, bestWidth = iip.Param("cost"), rmse, width
+		}
+	}
+
+	outIp := sp.NewFileIP(p.FileName)
+	ofh := outIp.OpenWriteTemp()
+	tsvWriter := csv.NewWriter(ofh)
+	tsvWriter.Comma = '\t'
+	tsvWriter.WriteAll(rows)
+	ofh.Close()
+	if skipped > 0 || len(iips) == 0 {
+		// The cost can not be selected for a failed branch
+		failurePolicy.MarkPlaceholder(outIp.Path())
+		bestCost, bestRMSE, bestWidth = "-1", math.NaN(), math.NaN()
+	}
+	outIp.Atomize()
+	p.OutStats().Send(outIp)
+	p.OutBestCost().Send(bestCost)
+	p.OutBestRMSE().Send(ptpc.FmtFloat(bestRMSE))
+	p.OutBestWidth().Send(ptpc.FmtFloat(bestWidth))
+}
+
+// lessRegressionPerf tells whether the interval width and RMSE of one cost are
+// better than those of another. Missing widths are compared on RMSE only.
+func lessRegressionPerf(width float64, rmse float64, otherWidth float64, otherRMSE float64) bool {
+	if !math.IsNaN(width) && !math.IsNaN(otherWidth) && width != otherWidth {
+		return width < otherWidth
+	}
+	if math.IsNaN(otherRMSE) {
+		return !math.IsNaN(rmse)
+	}
+	return rmse < otherRMSE
+}
+
+// --------------------------------------------------------------------------------
+// JSON output of cpSign crossvalidate, for a regression model, with the
+// coverage (accuracy) and the median prediction interval width (efficiency)
+// at each of the --calibration-points
+// {
+//     "rmse": 0.742,
+//     "calibrationPoints": [
+//         {"confidence": 0.8, "accuracy": 0.806, "efficiency": 2.131},
+//         {"confidence": 0.9, "accuracy": 0.902, "efficiency": 2.874}
+//     ]
+// }
+// --------------------------------------------------------------------------------
+
+type cpSignRegressionCrossValOutput struct {
+	RMSE              *float64 `json:"rmse"`
+	CalibrationPoints []struct {
+		Confidence float64  `json:"confidence"`
+		Accuracy   *float64 `json:"accuracy"`
+		Efficiency *float64 `json:"efficiency"`
+	} `json:"calibrationPoints"`
+}
+
+// regressionCrossValStats reads the RMSE, and the median prediction interval
+// width at the confidence level, from the JSON output of CPSign crossvalidate
+// for a regression model. It returns an error if either is missing.
+func regressionCrossValStats(data []byte, confidence float64) (rmse float64, width float64, err error) {
+	out := &cpSignRegressionCrossValOutput{}
+	if err := json.Unmarshal(data, out); err != nil {
+		return math.NaN(), math.NaN(), err
+	}
+	if out.RMSE == nil {
+		return math.NaN(), math.NaN(), fmt.Errorf("no rmse field")
+	}
+	for _, point := range out.CalibrationPoints {
+		if math.Abs(point.Confidence-confidence) < 1e-6 && point.Efficiency != nil {
+			return *out.RMSE, *point.Efficiency, nil
+		}
+	}
+	return math.NaN(), math.NaN(), fmt.Errorf("no efficiency at confidence %.2f in calibrationPoints", confidence)
+}
+
+// ================================================================================
+
+// RegressionSummarizer is a SciPipe component summarizing the conformal
+// regression models, with their selected costs and crossvalidation results
+// (from the parameters of the final models), and their validation on the
+// held-out data: the RMSE of the point predictions, and the coverage (the
+// fraction of observed values within the prediction interval) and median
+// width of the prediction intervals, at each of the Confidences.
+type RegressionSummarizer struct {
+	sp.BaseProcess
+	SummaryFileName string
+	Confidences     []float64
+}
+
+func NewRegressionSummarizer(wf *sp.Workflow, procName string, fileName string, confidences ...float64) *RegressionSummarizer {
+	p := &RegressionSummarizer{
+		BaseProcess:     sp.NewBaseProcess(wf, procName),
+		SummaryFileName: fileName,
+		Confidences:     confidences,
+	}
+	p.InitInPort(p, "model")
+	p.InitInPort(p, "validation")
+	p.InitOutPort(p, "summary")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *RegressionSummarizer) InModel() *sp.InPort      { return p.InPort("model") }
+func (p *RegressionSummarizer) InValidation() *sp.InPort { return p.InPort("validation") }
+func (p *RegressionSummarizer) OutSummary() *sp.OutPort  { return p.OutPort("summary") }
+
+func (p *RegressionSummarizer) Run() {
+	defer p.OutSummary().Close()
+
+	// Receive on both in-ports concurrently, as the validations depend on the
+	// models
+	modelIPs, validationIPs := []*sp.FileIP{}, []*sp.FileIP{}
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for ip := range p.InModel().Chan {
+			if !failurePolicy.SkipIP(p.Name(), ip) {
+				modelIPs = append(modelIPs, ip)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for ip := range p.InValidation().Chan {
+			if !failurePolicy.SkipIP(p.Name(), ip) {
+				validationIPs = append(validationIPs, ip)
+			}
+		}
+	}()
+	wg.Wait()
+
+	validationOf := map[string]*sp.FileIP{}
+	for _, ip := range validationIPs {
+		validationOf[str.ToUpper(ip.Param("gene"))+"\t"+ip.Param("replicate")] = ip
+	}
+	sort.Slice(modelIPs, func(i, j int) bool {
+		return ptpc.LessKeys([]string{str.ToUpper(modelIPs[i].Param("gene")), modelIPs[i].Param("replicate")}, []string{str.ToUpper(modelIPs[j].Param("gene")), modelIPs[j].Param("replicate")})
+	})
+
+	header := []string{"Gene", "Replicate", "Cost", "CrossValRMSE", "CrossValMedianWidth", "ValidationCnt", "ValidationRMSE"}
+	for _, conf := range p.Confidences {
+		header = append(header, fmt.Sprintf("Coverage%02.0f", conf*100), fmt.Sprintf("MedianWidth%02.0f", conf*100))
+	}
+	rows := [][]string{header}
+	for _, mip := range modelIPs {
+		gene := str.ToUpper(mip.Param("gene"))
+		row := []string{gene, mip.Param("replicate"), mip.Param("cost"), mip.Param("cv_rmse"), mip.Param("cv_width")}
+		vip, ok := validationOf[gene+"\t"+mip.Param("replicate")]
+		var stats regressionValidationStats
+		if ok {
+			stats = regressionValidation(vip.Read(), p.Confidences)
+		}
+		row = append(row, fmt.Sprintf("%d", stats.n), ptpc.FmtFloat(stats.rmse))
+		for i := range p.Confidences {
+			if stats.n == 0 {
+				row = append(row, "NA", "NA")
+				continue
+			}
+			row = append(row, ptpc.FmtFloat(stats.coverage[i]), ptpc.FmtFloat(stats.medianWidth[i]))
+		}
+		rows = append(rows, row)
+	}
+
+	oip := sp.NewFileIP(p.SummaryFileName)
+	fh := oip.OpenWriteTemp()
+	tsvWriter := csv.NewWriter(fh)
+	tsvWriter.Comma = '\t'
+	tsvWriter.WriteAll(rows)
+	fh.Close()
+	oip.Atomize()
+	p.OutSummary().Send(oip)
+}
+
+// ================================================================================
+// Parsing of CPSign regression validation output
+// ================================================================================
+
+// cpSignRegressionRecord is one line of the JSON lines written by CPSign
+// validate with --print-predictions, for a regression model. The observed
+// value is in the endpoint (pxc50) field of the molecule.
+type cpSignRegressionRecord struct {
+	Molecule   map[string]interface{} `json:"molecule"`
+	Prediction struct {
+		Midpoint  *float64 `json:"midpoint"`
+		Intervals []struct {
+			Confidence *float64 `json:"confidence"`
+			Lower      float64  `json:"lower"`
+			Upper      float64  `json:"upper"`
+		} `json:"predictionIntervals"`
+	} `json:"prediction"`
+}
+
+// regressionValidationStats holds the validation metrics of a regression
+// model, with the coverage and median width per confidence level
+type regressionValidationStats struct {
+	n           int
+	rmse        float64
+	coverage    []float64
+	medianWidth []float64
+}
+
+// regressionValidation computes the validation metrics of a regression model
+// from CPSign validation output. The point prediction is the midpoint of the
+// prediction, or of its first interval if missing. If the intervals are not
+// tagged with confidence, they are taken to be in the order of confidences.
+func regressionValidation(data []byte, confidences []float64) regressionValidationStats {
+	stats := regressionValidationStats{rmse: math.NaN()}
+	covered := make([]int, len(confidences))
+	widths := make([][]float64, len(confidences))
+	sqErrSum := 0.0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		rec := &cpSignRegressionRecord{}
+		if err := json.Unmarshal(line, rec); err != nil || len(rec.Prediction.Intervals) == 0 {
+			continue
+		}
+		observed, ok := jsonFloat(rec.Molecule["pxc50"])
+		if !ok {
+			continue
+		}
+		stats.n++
+		predicted := (rec.Prediction.Intervals[0].Lower + rec.Prediction.Intervals[0].Upper) / 2
+		if rec.Prediction.Midpoint != nil {
+			predicted = *rec.Prediction.Midpoint
+		}
+		sqErrSum += (predicted - observed) * (predicted - observed)
+		for i, conf := range confidences {
+			idx := -1
+			for j, interval := range rec.Prediction.Intervals {
+				if interval.Confidence != nil && math.Abs(*interval.Confidence-conf) < 1e-6 {
+					idx = j
+				}
+			}
+			if idx < 0 && i < len(rec.Prediction.Intervals) && rec.Prediction.Intervals[i].Confidence == nil {
+				idx = i
+			}
+			if idx < 0 {
+				continue
+			}
+			interval := rec.Prediction.Intervals[idx]
+			if observed >= interval.Lower && observed <= interval.Upper {
+				covered[i]++
+			}
+			widths[i] = append(widths[i], interval.Upper-interval.Lower)
+		}
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read regression validation output")
+	if stats.n > 0 {
+		stats.rmse = math.Sqrt(sqErrSum / float64(stats.n))
+	}
+	for i := range confidences {
+		coverage, medianWidth := math.NaN(), math.NaN()
+		if len(widths[i]) > 0 {
+			coverage = float64(covered[i]) / float64(len(widths[i]))
+			medianWidth = ptpstats.Median(widths[i])
+		}
+		stats.coverage = append(stats.coverage, coverage)
+		stats.medianWidth = append(stats.medianWidth, medianWidth)
+	}
+	return stats
+}
+
+// jsonFloat returns the value of a JSON number, or of a string holding one
+func jsonFloat(v interface{}) (float64, bool) {
+	switch val := v.(type) {
+	case float64:
+		return val, true
+	case string:
+		f, err := strconv.ParseFloat(val, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// ================================================================================
+
+// cpSignRegressionCrossValCmd returns the command pattern for crossvalidating
+// a conformal regression model with a given cost, run with javaCmd
+func cpSignRegressionCrossValCmd(javaCmd string) string {
+	return javaCmd + ` -jar ` + cpSignPath + ` crossvalidate \
+									--license ` + cpSignLicensePath + `\
+									--predictor-type ACP_Regression \
+									--seed {p:seed} \
+									--scorer LinearSVR:cost={p:cost} \
+									--train-data CSV delim:'\t' {i:traindata} \
+									--endpoint pxc50 \
+									--sampling-strategy random:numSamples={p:nrmdl}:calibRatio=0.2 \
+									--cv-folds {p:cvfolds} \
+									--result-format json \
+									--result-output {o:stats} \
+									--logfile {o:logfile} \
+									--calibration-points "{p:confidences}" # {p:gene} {p:replicate}`
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// floatsEqual compares float slices, with NaNs equal to each other
+func floatsEqual(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9 && !(math.IsNaN(a[i]) && math.IsNaN(b[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRegressionCrossValStats(t *testing.T) {
+	tests := []struct {
+		data      string
+		wantRMSE  float64
+		wantWidth float64
+		wantErr   bool
+	}{
+		{`{"rmse": 0.742, "calibrationPoints": [{"confidence": 0.8, "accuracy": 0.806, "efficiency": 2.131}, {"confidence": 0.9, "accuracy": 0.902, "efficiency": 2.874}]}`, 0.742, 2.131, false},
+		{`{"rmse": 0.742, "calibrationPoints": [{"confidence": 0.9, "efficiency": 2.874}, {"confidence": 0.80000001, "efficiency": 2.131}]}`, 0.742, 2.131, false},
+		{`{"calibrationPoints": [{"confidence": 0.8, "efficiency": 2.131}]}`, math.NaN(), math.NaN(), true},                // No RMSE
+		{`{"rmse": 0.742, "calibrationPoints": [{"confidence": 0.9, "efficiency": 2.874}]}`, math.NaN(), math.NaN(), true}, // No point at 0.8
+		{`{"rmse": 0.742, "calibrationPoints": [{"confidence": 0.8, "accuracy": 0.806}]}`, math.NaN(), math.NaN(), true},   // No width
+		{`{"RMSE": 0.742, "medianWidth": 2.131}`, math.NaN(), math.NaN(), true},
+		{`Crossvalidation failed`, math.NaN(), math.NaN(), true},
+	}
+	for _, tt := range tests {
+		rmse, width, err := regressionCrossValStats([]byte(tt.data), 0.8)
+		if (err != nil) != tt.wantErr || !floatsEqual([]float64{rmse, width}, []float64{tt.wantRMSE, tt.wantWidth}) {
+			t.Errorf("regressionCrossValStats(%s) = %v, %v, %v, want %v, %v, error: %t", tt.data, rmse, width, err, tt.wantRMSE, tt.wantWidth, tt.wantErr)
+		}
+	}
+}
+
+func TestLessRegressionPerf(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		width, rmse, otherWidth, otherRMSE float64
+		want                               bool
+	}{
+		{1.5, 0.9, 2.0, 0.7, true}, // Narrower intervals win over RMSE
+		{2.0, 0.7, 1.5, 0.9, false},
+		{1.5, 0.7, 1.5, 0.9, true}, // Equally wide, so lower RMSE wins
+		{1.5, 0.9, 1.5, 0.7, false},
+		{1.5, 0.7, 1.5, 0.7, false},
+		{nan, 0.7, 1.5, 0.9, true}, // Missing width, so RMSE only
+		{1.5, 0.9, nan, 0.7, false},
+		{1.5, 0.9, 1.5, nan, true}, // Missing RMSE loses
+		{1.5, nan, 1.5, 0.9, false},
+		{nan, nan, nan, nan, false},
+	}
+	for _, tt := range tests {
+		if got := lessRegressionPerf(tt.width, tt.rmse, tt.otherWidth, tt.otherRMSE); got != tt.want {
+			t.Errorf("lessRegressionPerf(%v, %v, %v, %v) = %t, want %t", tt.width, tt.rmse, tt.otherWidth, tt.otherRMSE, got, tt.want)
+		}
+	}
+}
+
+func TestRegressionValidation(t *testing.T) {
+	tagged := `Validation of model DRD1
+{"molecule": {"pxc50": 6.0}, "prediction": {"midpoint": 6.5, "predictionIntervals": [{"confidence": 0.8, "lower": 5.5, "upper": 7.5}, {"confidence": 0.9, "lower": 5.0, "upper": 8.0}]}}
+{"molecule": {"pxc50": "8.0"}, "prediction": {"midpoint": 7.0, "predictionIntervals": [{"confidence": 0.8, "lower": 6.0, "upper": 7.5}, {"confidence": 0.9, "lower": 5.0, "upper": 9.0}]}}
+{"molecule": {"pxc50": 5.0}, "prediction": {"midpoint": 5.0, "predictionIntervals": [{"confidence": 0.9, "lower": 3.0, "upper": 7.0}, {"confidence": 0.8, "lower": 4.0, "upper": 6.0}]}}
+{"molecule": {"smiles": "CCO"}, "prediction": {"midpoint": 5.0, "predictionIntervals": [{"confidence": 0.8, "lower": 4.0, "upper": 6.0}]}}
+{"molecule": {"pxc50": 5.0}, "prediction": {"predictionIntervals": []}}
+`
+	// Without midpoints or confidences, the midpoint of the first interval is
+	// the prediction, and the intervals are in the order of confidences
+	untagged := `{"molecule": {"pxc50": 6.0}, "prediction": {"predictionIntervals": [{"lower": 6.0, "upper": 8.0}, {"lower": 5.0, "upper": 9.0}]}}
+{"molecule": {"pxc50": 4.0}, "prediction": {"predictionIntervals": [{"lower": 4.5, "upper": 5.5}, {"lower": 3.5, "upper": 6.5}]}}
+`
+	tests := []struct {
+		data            string
+		wantN           int
+		wantRMSE        float64
+		wantCoverage    []float64
+		wantMedianWidth []float64
+	}{
+		// Errors are 0.5, 1 and 0
+		{tagged, 3, math.Sqrt(1.25 / 3), []float64{2.0 / 3, 1}, []float64{2, 4}},
+		// Errors are 1 and 1
+		{untagged, 2, 1, []float64{0.5, 1}, []float64{1.5, 3.5}},
+		{"", 0, math.NaN(), []float64{math.NaN(), math.NaN()}, []float64{math.NaN(), math.NaN()}},
+	}
+	for i, tt := range tests {
+		got := regressionValidation([]byte(tt.data), []float64{0.8, 0.9})
+		if got.n != tt.wantN || !floatsEqual([]float64{got.rmse}, []float64{tt.wantRMSE}) || !floatsEqual(got.coverage, tt.wantCoverage) || !floatsEqual(got.medianWidth, tt.wantMedianWidth) {
+			t.Errorf("regressionValidation(output %d) = %+v, want n %d, RMSE %v, coverage %v and median width %v", i, got, tt.wantN, tt.wantRMSE, tt.wantCoverage, tt.wantMedianWidth)
+		}
+	}
+}
+
+// TestExtractRegressionData extracts the pXC50 values of a gene, with the
+// median of the values of structures measured more than once
+func TestExtractRegressionData(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "extract_regression_data_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	gspa := "DRD1\tCHEMBL1\tCCO\t5.0\n" +
+		"DRD1\tCHEMBL2\tCCO\t6.0\n" +
+		"DRD1\tCHEMBL3\tCCO\t8.5\n" +
+		"DRD1\tCHEMBL4\tc1ccccc1\t7.25\n" +
+		"DRD1\tCHEMBL5\tCCN\t4.0\n" +
+		"DRD1\tCHEMBL6\tCCN\t5.0\n" +
+		"DRD1\tCHEMBL7\tCCC\tNA\n" + // Not a number
+		"DRD2\tCHEMBL8\tCCCl\t6.0\n" + // Another gene
+		"DRD1\tCHEMBL9\n"
+	if err := ioutil.WriteFile("gspa.tsv", []byte(gspa), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wf := sp.NewWorkflow("extract_regression_data_test", 1)
+	gspaProc := wf.NewProc("gspa", "echo {o:gspa}")
+	gspaProc.SetPathStatic("gspa", "gspa.tsv")
+	extract := NewExtractRegressionData(wf, "extract_regression_data_drd1", func(t *sp.Task) string {
+		return "drd1.pxc50.tsv"
+	})
+	extract.InGSPA().Connect(gspaProc.Out("gspa"))
+	extract.InGene().ConnectStr("drd1")
+	wf.Run()
+
+	data, err := ioutil.ReadFile("drd1.pxc50.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "smiles\tpxc50\n" +
+		"CCN\t4.50\n" +
+		"CCO\t6.00\n" +
+		"c1ccccc1\t7.25\n"
+	if string(data) != want {
+		t.Errorf("Extracted regression data =\n%s\nwant:\n%s", data, want)
+	}
+}
+
+// TestReplicateAggregatorRegression aggregates the regression columns of a
+// final models summary over replicates
+func TestReplicateAggregatorRegression(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "replicate_aggregator_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	summary := "Gene\tReplicate\tRunset\tObsFuzzOverall\tCost\tRegressionCost\tRegressionRMSE\tRegressionCoverage80\tRegressionMedianWidth80\n" +
+		"DRD1\tr1\torig\t0.2\t1\t10\t0.7\t0.8\t2.0\n" +
+		"DRD1\tr2\torig\t0.3\t1\t10\t0.9\t0.85\t2.5\n" +
+		"HTR2B\tr1\torig\t0.4\t10\tNA\tNA\tNA\tNA\n"
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "summary.tsv"), []byte(summary), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wf := sp.NewWorkflow("replicate_aggregator_test", 1)
+	aggregator := NewReplicateAggregator(wf, "aggregate_replicates", "summary.replicates.tsv", 0.8)
+	aggregator.InSummary().Chan <- sp.NewFileIP("summary.tsv")
+	close(aggregator.InSummary().Chan)
+	close(aggregator.InValidation().Chan)
+	wf.Sink().Connect(aggregator.OutAggregated())
+	aggregator.Run()
+
+	rows := readTSVWithHeader("summary.replicates.tsv")
+	if len(rows) != 2 {
+		t.Fatalf("Aggregated summary has %d rows, want 2", len(rows))
+	}
+	tests := []struct {
+		row  int
+		col  string
+		want string
+	}{
+		{0, "RegressionRMSEMean", "0.800"},
+		{0, "RegressionRMSESD", "0.141"},
+		{0, "RegressionCoverage80Mean", "0.825"},
+		{0, "RegressionMedianWidth80Mean", "2.250"},
+		{1, "Gene", "HTR2B"},
+		{1, "RegressionRMSEMean", "NA"},
+		{1, "ObsFuzzOverallMean", "0.400"},
+	}
+	for _, tt := range tests {
+		if got := rows[tt.row][tt.col]; got != tt.want {
+			t.Errorf("Row %d, column %s of the aggregated summary = %q, want %q", tt.row, tt.col, got, tt.want)
+		}
+	}
+	if _, ok := rows[0]["RegressionCostMean"]; ok {
+		t.Errorf("The regression cost is aggregated, as a metric")
+	}
+}
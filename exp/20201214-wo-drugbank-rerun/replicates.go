@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	str "strings"
+
+	ptpstats "github.com/pharmbio/ptp-project/lib/stats"
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+
+// ReplicateAggregator groups the per-replicate rows of the final models
+// summary on gene and runset, and reports mean, standard deviation and a 95%
+// confidence interval (based on the t-distribution) across replicates, for
+// observed fuzziness, and for validity and efficiency on the validation data,
+// at the given confidence level. The validation metrics of the conformal
+// regression models, if in the summary, are aggregated too. It also flags the
+// gene/runset combinations where replicates did not select the same cost.
+type ReplicateAggregator struct {
+	sp.BaseProcess
+	SummaryFileName string
+	Confidence      float64
+}
+
+func NewReplicateAggregator(wf *sp.Workflow, procName string, fileName string, confidence float64) *ReplicateAggregator {
+	p := &ReplicateAggregator{
+		BaseProcess:     sp.NewBaseProcess(wf, procName),
+		SummaryFileName: fileName,
+		Confidence:      confidence,
+	}
+	p.InitInPort(p, "summary")
+	p.InitInPort(p, "validation")
+	p.InitOutPort(p, "aggregated")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *ReplicateAggregator) InSummary() *sp.InPort      { return p.InPort("summary") }
+func (p *ReplicateAggregator) InValidation() *sp.InPort   { return p.InPort("validation") }
+func (p *ReplicateAggregator) OutAggregated() *sp.OutPort { return p.OutPort("aggregated") }
+
+// replicateGroup holds the per-replicate values for one gene and runset
+type replicateGroup struct {
+	gene       string
+	runSet     string
+	obsFuzz    []float64
+	validity   []float64
+	efficiency []float64
+	regression map[string][]float64 // Per column in replicateRegressionCols
+	costs      []string
+}
+
+// replicateRegressionCols are the columns of the final models summary with
+// the validation metrics of the conformal regression models
+var replicateRegressionCols = []string{"RegressionRMSE", "RegressionCoverage80", "RegressionMedianWidth80"}
+
+func (p *ReplicateAggregator) Run() {
+	defer p.OutAggregated().Close()
+
+	groups := map[string]*replicateGroup{}
+	hasRegression := false
+	getGroup := func(gene string, runSet string) *replicateGroup {
+		gene = str.ToUpper(gene)
+		uniq := gene + "_" + runSet
+		if _, ok := groups[uniq]; !ok {
+			groups[uniq] = &replicateGroup{gene: gene, runSet: runSet, regression: map[string][]float64{}}
+		}
+		return groups[uniq]
+	}
+
+	for sip := range p.InSummary().Chan {
+		tsvReader := csv.NewReader(bytes.NewReader(sip.Read()))
+		tsvReader.Comma = '\t'
+		rows, err := tsvReader.ReadAll()
+		sp.CheckWithMsg(err, "Could not read final models summary: "+sip.Path())
+		if len(rows) < 2 {
+			continue
+		}
+		col := map[string]int{}
+		for i, name := range rows[0] {
+			col[name] = i
+		}
+		for _, name := range []string{"Gene", "Runset", "ObsFuzzOverall", "Cost"} {
+			if _, ok := col[name]; !ok {
+				sp.Failf("| %-32s | Column %s missing in final models summary: %s\n", p.Name(), name, sip.Path())
+			}
+		}
+		if _, ok := col[replicateRegressionCols[0]]; ok {
+			hasRegression = true
+		}
+		for _, row := range rows[1:] {
+			g := getGroup(row[col["Gene"]], row[col["Runset"]])
+			obsFuzz, err := strconv.ParseFloat(row[col["ObsFuzzOverall"]], 64)
+			sp.CheckWithMsg(err, "Could not parse observed fuzziness value")
+			g.obsFuzz = append(g.obsFuzz, obsFuzz)
+			g.costs = append(g.costs, row[col["Cost"]])
+			for _, name := range replicateRegressionCols {
+				if i, ok := col[name]; ok && i < len(row) {
+					if v := parseFloatOrNaN(row[i]); !math.IsNaN(v) {
+						g.regression[name] = append(g.regression[name], v)
+					}
+				}
+			}
+		}
+	}
+
+	for vip := range p.InValidation().Chan {
+		if failurePolicy.SkipIP(p.Name(), vip) {
+			continue
+		}
+		g := getGroup(vip.Param("gene"), vip.Param("runset"))
+		validity, efficiency, ok := validityAndEfficiency(vip.Read(), p.Confidence)
+		if !ok {
+			sp.Audit.Printf("| %-32s | No predictions found in validation output: %s\n", p.Name(), vip.Path())
+			continue
+		}
+		g.validity = append(g.validity, validity)
+		g.efficiency = append(g.efficiency, efficiency)
+	}
+
+	uniqs := []string{}
+	for uniq := range groups {
+		uniqs = append(uniqs, uniq)
+	}
+	sort.Strings(uniqs)
+
+	oip := sp.NewFileIP(p.SummaryFileName)
+	fh := oip.OpenWriteTemp()
+	tsvWriter := csv.NewWriter(fh)
+	tsvWriter.Comma = '\t'
+	header := []string{"Gene", "Runset", "Replicates"}
+	for _, metric := range []string{"ObsFuzzOverall", "Validity", "Efficiency"} {
+		header = append(header, metric+"Mean", metric+"SD", metric+"CILow", metric+"CIHigh")
+	}
+	if hasRegression {
+		for _, metric := range replicateRegressionCols {
+			header = append(header, metric+"Mean", metric+"SD", metric+"CILow", metric+"CIHigh")
+		}
+	}
+	header = append(header, "Costs", "CostsDiffer")
+	tsvWriter.Write(header)
+	for _, uniq := range uniqs {
+		g := groups[uniq]
+		row := []string{g.gene, g.runSet, fmt.Sprintf("%d", len(g.obsFuzz))}
+		for _, vals := range [][]float64{g.obsFuzz, g.validity, g.efficiency} {
+			row = append(row, formatMeanSDCI(vals)...)
+		}
+		if hasRegression {
+			for _, metric := range replicateRegressionCols {
+				row = append(row, formatMeanSDCI(g.regression[metric])...)
+			}
+		}
+		costsDiffer := "false"
+		for _, cost := range g.costs {
+			if cost != g.costs[0] {
+				costsDiffer = "true"
+			}
+		}
+		row = append(row, str.Join(g.costs, ","), costsDiffer)
+		tsvWriter.Write(row)
+	}
+	tsvWriter.Flush()
+	fh.Close()
+	oip.Atomize()
+	p.OutAggregated().Send(oip)
+}
+
+// formatMeanSDCI returns the mean, standard deviation and the lower and upper
+// limits of the 95% confidence interval of the mean, formatted as strings.
+// Statistics that can not be computed for too few values are given as NA.
+func formatMeanSDCI(vals []float64) []string {
+	out := []string{"NA", "NA", "NA", "NA"}
+	n := len(vals)
+	if n == 0 {
+		return out
+	}
+	m := ptpstats.Mean(vals)
+	out[0] = fmt.Sprintf("%.3f", m)
+	if n < 2 {
+		return out
+	}
+	sd := ptpstats.SampleSD(vals)
+	halfWidth := tCritical95(n-1) * sd / math.Sqrt(float64(n))
+	out[1] = fmt.Sprintf("%.3f", sd)
+	out[2] = fmt.Sprintf("%.3f", m-halfWidth)
+	out[3] = fmt.Sprintf("%.3f", m+halfWidth)
+	return out
+}
+
+// tCritical95 returns the two-sided 95% critical value of Student's
+// t-distribution with df degrees of freedom
+func tCritical95(df int) float64 {
+	table := []float64{12.706, 4.303, 3.182, 2.776, 2.571, 2.447, 2.365, 2.306, 2.262, 2.228,
+		2.201, 2.179, 2.160, 2.145, 2.131, 2.120, 2.110, 2.101, 2.093, 2.086,
+		2.080, 2.074, 2.069, 2.064, 2.060, 2.056, 2.052, 2.048, 2.045, 2.042}
+	if df >= 1 && df <= len(table) {
+		return table[df-1]
+	}
+	return 1.960
+}
+
+// ================================================================================
+// Parsing of CPSign validation output
+// ================================================================================
+
+// cpSignValidationRecord is one line of the JSON lines written by CPSign
+// validate with --print-predictions
+type cpSignValidationRecord struct {
+	Molecule struct {
+		Activity string `json:"activity"`
+	} `json:"molecule"`
+	Prediction struct {
+		PredictedLabels []struct {
+			Confidence *float64 `json:"confidence"`
+			Labels     []string `json:"labels"`
+		} `json:"predictedLabels"`
+	} `json:"prediction"`
+}
+
+// validityAndEfficiency computes validity (the fraction of prediction sets
+// containing the true label) and efficiency (the fraction of single-label
+// prediction sets) at the given confidence level, from CPSign validation
+// output. Returns false if there were no predictions.
+func validityAndEfficiency(data []byte, confidence float64) (float64, float64, bool) {
+	counts := validationConfusion(data, confidence)
+	total := 0
+	for i := range counts {
+		for j := range counts[i] {
+			total += counts[i][j]
+		}
+	}
+	if total == 0 {
+		return 0, 0, false
+	}
+	// Rows are observed A and N, columns predicted Both, A, N and Null
+	valid := counts[0][0] + counts[0][1] + counts[1][0] + counts[1][2]
+	single := counts[0][1] + counts[0][2] + counts[1][1] + counts[1][2]
+	return float64(valid) / float64(total), float64(single) / float64(total), true
+}
+
+// validationConfusion counts the prediction sets (both labels, A, N, or
+// none) at the given confidence level, per observed label (A or N), in CPSign
+// validation output. If the prediction sets are not tagged with confidence,
+// the first one is used.
+func validationConfusion(data []byte, confidence float64) [2][4]int {
+	counts := [2][4]int{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] != '{' {
+			continue
+		}
+		rec := &cpSignValidationRecord{}
+		if err := json.Unmarshal(line, rec); err != nil || len(rec.Prediction.PredictedLabels) == 0 {
+			continue
+		}
+		predLabels := rec.Prediction.PredictedLabels[0]
+		for _, pl := range rec.Prediction.PredictedLabels {
+			if pl.Confidence != nil && math.Abs(*pl.Confidence-confidence) < 1e-6 {
+				predLabels = pl
+			}
+		}
+		obsIdx := 0
+		if rec.Molecule.Activity == "N" {
+			obsIdx = 1
+		} else if rec.Molecule.Activity != "A" {
+			continue
+		}
+		predIdx := 3
+		switch {
+		case len(predLabels.Labels) >= 2:
+			predIdx = 0
+		case len(predLabels.Labels) == 1 && predLabels.Labels[0] == "A":
+			predIdx = 1
+		case len(predLabels.Labels) == 1 && predLabels.Labels[0] == "N":
+			predIdx = 2
+		}
+		counts[obsIdx][predIdx]++
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read validation output")
+	return counts
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Confidence intervals are checked against t.test(vals)$conf.int in R
+func TestFormatMeanSDCI(t *testing.T) {
+	tests := []struct {
+		vals []float64
+		want []string
+	}{
+		{[]float64{}, []string{"NA", "NA", "NA", "NA"}},
+		{[]float64{5}, []string{"5.000", "NA", "NA", "NA"}},
+		{[]float64{1, 2, 3}, []string{"2.000", "1.000", "-0.484", "4.484"}},
+		{[]float64{0.8, 0.9}, []string{"0.850", "0.071", "0.215", "1.485"}},
+		{[]float64{0.7, 0.7, 0.7}, []string{"0.700", "0.000", "0.700", "0.700"}},
+	}
+	for _, tt := range tests {
+		if got := formatMeanSDCI(tt.vals); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("formatMeanSDCI(%v) = %v, want %v", tt.vals, got, tt.want)
+		}
+	}
+}
+
+func TestTCritical95(t *testing.T) {
+	tests := []struct {
+		df   int
+		want float64
+	}{
+		{1, 12.706},
+		{4, 2.776},
+		{30, 2.042},
+		{31, 1.960}, // Normal approximation
+		{0, 1.960},
+	}
+	for _, tt := range tests {
+		if got := tCritical95(tt.df); got != tt.want {
+			t.Errorf("tCritical95(%d) = %.3f, want %.3f", tt.df, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	str "strings"
+	"sync"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+
+// ReportGenerator builds a static HTML report of an experiment, in OutDir,
+// with a sortable table of per-target results and data counts, and for each
+// target the hyperparameter search curves, the calibration and validation
+// plots, and links to the audit logs of the final models. Plots and audit
+// logs are copied into the report directory, so that it can be moved and
+// shared as a whole.
+type ReportGenerator struct {
+	sp.BaseProcess
+	OutDir string
+	Title  string
+}
+
+func NewReportGenerator(wf *sp.Workflow, procName string, outDir string, title string) *ReportGenerator {
+	p := &ReportGenerator{
+		BaseProcess: sp.NewBaseProcess(wf, procName),
+		OutDir:      outDir,
+		Title:       title,
+	}
+	p.InitInPort(p, "summary")
+	p.InitInPort(p, "replicates")
+	p.InitInPort(p, "costperf")
+	p.InitInPort(p, "plots")
+	p.InitInPort(p, "models")
+	p.InitInPort(p, "calibsummary")
+	p.InitInPort(p, "calibcurves")
+	p.InitInPort(p, "speciescounts")
+	p.InitOutPort(p, "report")
+	wf.AddProc(p)
+	return p
+}
+
+// InSummary takes the final models summary
+func (p *ReportGenerator) InSummary() *sp.InPort { return p.InPort("summary") }
+
+// InReplicates takes the replicate aggregated summary from ReplicateAggregator
+func (p *ReportGenerator) InReplicates() *sp.InPort { return p.InPort("replicates") }
+
+// InCostPerf takes the hyperparameter search results from SummarizeCostGammaPerf
+func (p *ReportGenerator) InCostPerf() *sp.InPort { return p.InPort("costperf") }
+
+// InPlots takes per-target plots, named with the gene as the first part of
+// the file name, such as those from CalibrationPlotter and ValidationPlotter.
+// Plots named all_targets.*, *_grid.* or *_summary.* (such as those from
+// PlotSummary) are shown for all targets.
+func (p *ReportGenerator) InPlots() *sp.InPort { return p.InPort("plots") }
+
+// InModels takes the final models, to link to their audit logs
+func (p *ReportGenerator) InModels() *sp.InPort { return p.InPort("models") }
+
+// InCalibSummary takes the cross-target summary from CalibrationAnalyzer
+func (p *ReportGenerator) InCalibSummary() *sp.InPort { return p.InPort("calibsummary") }
+
+// InCalibCurves takes the per-target calibration curve tables from
+// CalibrationAnalyzer, named with the gene as the first part of the file name
+func (p *ReportGenerator) InCalibCurves() *sp.InPort { return p.InPort("calibcurves") }
+
+// InRegression takes the summary of the conformal regression models from
+// RegressionSummarizer. The in-port is created on first use, as it is only
+// connected with -regression.
+func (p *ReportGenerator) InRegression() *sp.InPort {
+	if _, ok := p.InPorts()["regression"]; !ok {
+		p.InitInPort(p, "regression")
+	}
+	return p.InPort("regression")
+}
+
+// InSpeciesCounts takes the table of training structures per target and
+// species, from TableGatherer
+func (p *ReportGenerator) InSpeciesCounts() *sp.InPort { return p.InPort("speciescounts") }
+
+func (p *ReportGenerator) OutReport() *sp.OutPort { return p.OutPort("report") }
+
+func (p *ReportGenerator) Run() {
+	defer p.OutReport().Close()
+
+	// Receive on all in-ports concurrently, as the upstream processes send
+	// to several processes each, and might otherwise block each other
+	inPorts := []*sp.InPort{p.InSummary(), p.InReplicates(), p.InCostPerf(), p.InPlots(), p.InModels(), p.InCalibSummary(), p.InCalibCurves(), p.InSpeciesCounts()}
+	if _, ok := p.InPorts()["regression"]; ok {
+		inPorts = append(inPorts, p.InRegression())
+	}
+	received := make([][]*sp.FileIP, 9) // Including the optional regression in-port
+	wg := &sync.WaitGroup{}
+	for i, inPort := range inPorts {
+		wg.Add(1)
+		go func(i int, inPort *sp.InPort) {
+			defer wg.Done()
+			for ip := range inPort.Chan {
+				if failurePolicy.SkipIP(p.Name(), ip) {
+					continue
+				}
+				received[i] = append(received[i], ip)
+			}
+		}(i, inPort)
+	}
+	wg.Wait()
+	summaryIPs, replicateIPs, costPerfIPs, plotIPs, modelIPs, calibSummaryIPs, calibCurveIPs, speciesCountIPs, regressionIPs := received[0], received[1], received[2], received[3], received[4], received[5], received[6], received[7], received[8]
+
+	for _, dir := range []string{p.OutDir + "/plots", p.OutDir + "/audit", p.OutDir + "/calibration"} {
+		sp.CheckWithMsg(os.MkdirAll(dir, 0755), "Could not create directory: "+dir)
+	}
+
+	// Collect everything per gene (in lower case)
+	genes := map[string]bool{}
+	plotsPerGene := map[string][]string{}
+	otherPlots := []string{}
+	for _, ip := range plotIPs {
+		name := filepath.Base(ip.Path())
+		copyFile(ip.Path(), p.OutDir+"/plots/"+name)
+		gene := str.ToLower(str.SplitN(name, ".", 2)[0])
+		if gene == "all_targets" || str.HasSuffix(gene, "_grid") || str.HasSuffix(gene, "_summary") {
+			otherPlots = append(otherPlots, name)
+			continue
+		}
+		genes[gene] = true
+		plotsPerGene[gene] = append(plotsPerGene[gene], name)
+	}
+	calibCurvesPerGene := map[string][]string{}
+	for _, ip := range calibCurveIPs {
+		name := filepath.Base(ip.Path())
+		copyFile(ip.Path(), p.OutDir+"/calibration/"+name)
+		gene := str.ToLower(str.SplitN(name, ".", 2)[0])
+		genes[gene] = true
+		calibCurvesPerGene[gene] = append(calibCurvesPerGene[gene], name)
+	}
+	auditPerGene := map[string][]string{}
+	for _, ip := range modelIPs {
+		gene := str.ToLower(ip.Param("gene"))
+		genes[gene] = true
+		if _, err := os.Stat(ip.AuditFilePath()); err != nil {
+			continue
+		}
+		auditName := filepath.Base(ip.AuditFilePath())
+		copyFile(ip.AuditFilePath(), p.OutDir+"/audit/"+auditName)
+		auditPerGene[gene] = append(auditPerGene[gene], auditName)
+	}
+	costCurvesPerGene := map[string][]string{}
+	sort.Slice(costPerfIPs, func(i, j int) bool { return costPerfIPs[i].Path() < costPerfIPs[j].Path() })
+	for _, ip := range costPerfIPs {
+		// Paths are on the form dat/<runset>/<gene>/<replicate>/<gene>_cost_gamma_perf_stats.tsv
+		replicate := filepath.Base(filepath.Dir(ip.Path()))
+		rows := readTSVWithHeader(ip.Path())
+		if len(rows) == 0 {
+			continue
+		}
+		gene := str.ToLower(rows[0]["Gene"])
+		genes[gene] = true
+		costCurvesPerGene[gene] = append(costCurvesPerGene[gene], costPerfSVG(str.ToUpper(gene)+" "+replicate, rows))
+	}
+	regressionRows := []map[string]string{}
+	regressionRowsPerGene := map[string][]map[string]string{}
+	for _, ip := range regressionIPs {
+		for _, row := range readTSVWithHeader(ip.Path()) {
+			gene := str.ToLower(row["Gene"])
+			genes[gene] = true
+			regressionRows = append(regressionRows, row)
+			regressionRowsPerGene[gene] = append(regressionRowsPerGene[gene], row)
+		}
+	}
+
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, reportHeader, html.EscapeString(p.Title), html.EscapeString(p.Title), time.Now().Format("2006-01-02 15:04"))
+
+	for _, ip := range replicateIPs {
+		out.WriteString("<h2>Targets (aggregated over replicates)</h2>\n")
+		writeHTMLTable(out, readTSVWithHeader(ip.Path()), func(col, val string) string {
+			if col == "Gene" {
+				return fmt.Sprintf(`<a href="#%s">%s</a>`, html.EscapeString(str.ToLower(val)), html.EscapeString(val))
+			}
+			if col == "CostsDiffer" && val == "true" {
+				return `<span class="warn">true</span>`
+			}
+			return html.EscapeString(val)
+		})
+	}
+	for _, ip := range summaryIPs {
+		out.WriteString("<h2>Final models</h2>\n")
+		writeHTMLTable(out, readTSVWithHeader(ip.Path()), func(col, val string) string {
+			if col == "Gene" {
+				return fmt.Sprintf(`<a href="#%s">%s</a>`, html.EscapeString(str.ToLower(val)), html.EscapeString(val))
+			}
+			return html.EscapeString(val)
+		})
+	}
+	for _, ip := range speciesCountIPs {
+		out.WriteString("<h2>Training structures per species</h2>\n")
+		writeHTMLTable(out, readTSVWithHeader(ip.Path()), func(col, val string) string {
+			if col == "Gene" {
+				return fmt.Sprintf(`<a href="#%s">%s</a>`, html.EscapeString(str.ToLower(val)), html.EscapeString(val))
+			}
+			return html.EscapeString(val)
+		})
+	}
+	if len(regressionRows) > 0 {
+		out.WriteString("<h2>Conformal regression models (pXC50)</h2>\n")
+		writeHTMLTable(out, regressionRows, func(col, val string) string {
+			if col == "Gene" {
+				return fmt.Sprintf(`<a href="#%s">%s</a>`, html.EscapeString(str.ToLower(val)), html.EscapeString(val))
+			}
+			return html.EscapeString(val)
+		})
+	}
+	for _, ip := range calibSummaryIPs {
+		out.WriteString("<h2>Calibration</h2>\n")
+		writeHTMLTable(out, readTSVWithHeader(ip.Path()), func(col, val string) string {
+			if col == "Gene" {
+				return fmt.Sprintf(`<a href="#%s">%s</a>`, html.EscapeString(str.ToLower(val)), html.EscapeString(val))
+			}
+			if col == "Miscalibrated" && val == "true" {
+				return `<span class="warn">true</span>`
+			}
+			return html.EscapeString(val)
+		})
+	}
+	if len(otherPlots) > 0 {
+		out.WriteString("<h2>All targets</h2>\n<div class=\"plots\">\n")
+		sort.Strings(otherPlots)
+		for _, name := range otherPlots {
+			writeHTMLPlot(out, name)
+		}
+		out.WriteString("</div>\n")
+	}
+
+	geneList := []string{}
+	for gene := range genes {
+		geneList = append(geneList, gene)
+	}
+	sort.Strings(geneList)
+	for _, gene := range geneList {
+		fmt.Fprintf(out, "<h2 id=\"%s\">%s</h2>\n", html.EscapeString(gene), html.EscapeString(str.ToUpper(gene)))
+		if len(costCurvesPerGene[gene]) > 0 {
+			out.WriteString("<h3>Hyperparameter search</h3>\n<div class=\"plots\">\n")
+			for _, svg := range costCurvesPerGene[gene] {
+				out.WriteString(svg)
+			}
+			out.WriteString("</div>\n")
+		}
+		if len(plotsPerGene[gene]) > 0 {
+			out.WriteString("<h3>Calibration and validation</h3>\n<div class=\"plots\">\n")
+			sort.Strings(plotsPerGene[gene])
+			for _, name := range plotsPerGene[gene] {
+				writeHTMLPlot(out, name)
+			}
+			out.WriteString("</div>\n")
+		}
+		if len(regressionRowsPerGene[gene]) > 0 {
+			out.WriteString("<h3>Conformal regression on pXC50</h3>\n")
+			writeHTMLTable(out, regressionRowsPerGene[gene], func(col, val string) string {
+				return html.EscapeString(val)
+			})
+		}
+		if len(calibCurvesPerGene[gene]) > 0 {
+			out.WriteString("<h3>Calibration curves</h3>\n<ul>\n")
+			sort.Strings(calibCurvesPerGene[gene])
+			for _, name := range calibCurvesPerGene[gene] {
+				fmt.Fprintf(out, "<li><a href=\"calibration/%s\">%s</a></li>\n", html.EscapeString(name), html.EscapeString(name))
+			}
+			out.WriteString("</ul>\n")
+		}
+		if len(auditPerGene[gene]) > 0 {
+			out.WriteString("<h3>Audit logs of final models</h3>\n<ul>\n")
+			sort.Strings(auditPerGene[gene])
+			for _, name := range auditPerGene[gene] {
+				fmt.Fprintf(out, "<li><a href=\"audit/%s\">%s</a></li>\n", html.EscapeString(name), html.EscapeString(name))
+			}
+			out.WriteString("</ul>\n")
+		}
+	}
+	out.WriteString(reportFooter)
+
+	oip := sp.NewFileIP(p.OutDir + "/index.html")
+	sp.CheckWithMsg(ioutil.WriteFile(oip.TempPath(), out.Bytes(), 0644), "Could not write report: "+oip.TempPath())
+	oip.Atomize()
+	p.OutReport().Send(oip)
+}
+
+// costPerfSVG renders the hyperparameter search results in a
+// SummarizeCostGammaPerf output as an inline SVG
+func costPerfSVG(title string, rows []map[string]string) string {
+	sort.Slice(rows, func(i, j int) bool { return parseFloatOrNaN(rows[i]["Cost"]) < parseFloatOrNaN(rows[j]["Cost"]) })
+	costs, obsFuzz := []float64{}, []float64{}
+	bestCost, bestOF := 0.0, 1000000.0
+	for _, row := range rows {
+		cost, of := parseFloatOrNaN(row["Cost"]), parseFloatOrNaN(row["ObsFuzzOverall"])
+		if math.IsNaN(cost) || math.IsNaN(of) {
+			continue
+		}
+		costs = append(costs, cost)
+		obsFuzz = append(obsFuzz, of)
+		if of < bestOF { // Smaller is better, as in BestCostGamma
+			bestCost, bestOF = cost, of
+		}
+	}
+	pnl := costPerfPanel(title, costs, obsFuzz, bestCost)
+	svg, err := renderFigure(plotFormatSVG, 220, 180, func(c canvas) { pnl(c, frame{w: 220, h: 180}) })
+	sp.Check(err)
+	// Drop the XML declaration, to inline the SVG in HTML
+	return string(svg[bytes.Index(svg, []byte("<svg")):])
+}
+
+// writeHTMLTable writes rows as an HTML table, sortable by clicking the column
+// headers, with cell contents formatted by formatCell
+func writeHTMLTable(out *bytes.Buffer, rows []map[string]string, formatCell func(col, val string) string) {
+	if len(rows) == 0 {
+		return
+	}
+	cols := []string{}
+	for col := range rows[0] {
+		cols = append(cols, col)
+	}
+	// Keep identifying columns first, and the rest in alphabetical order
+	idCols := map[string]int{"Gene": 0, "Replicate": 1, "Runset": 2}
+	sort.Slice(cols, func(i, j int) bool {
+		oi, iIsID := idCols[cols[i]]
+		oj, jIsID := idCols[cols[j]]
+		switch {
+		case iIsID && jIsID:
+			return oi < oj
+		case iIsID != jIsID:
+			return iIsID
+		}
+		return cols[i] < cols[j]
+	})
+	out.WriteString("<table class=\"sortable\">\n<thead><tr>")
+	for _, col := range cols {
+		fmt.Fprintf(out, "<th>%s</th>", html.EscapeString(col))
+	}
+	out.WriteString("</tr></thead>\n<tbody>\n")
+	for _, row := range rows {
+		out.WriteString("<tr>")
+		for _, col := range cols {
+			class := ""
+			if _, err := strconv.ParseFloat(row[col], 64); err == nil {
+				class = ` class="num"`
+			}
+			fmt.Fprintf(out, "<td%s>%s</td>", class, formatCell(col, row[col]))
+		}
+		out.WriteString("</tr>\n")
+	}
+	out.WriteString("</tbody>\n</table>\n")
+}
+
+// writeHTMLPlot embeds a plot in the report's plots directory, with SVGs as
+// images, and PDFs as embedded objects
+func writeHTMLPlot(out *bytes.Buffer, name string) {
+	src := "plots/" + html.EscapeString(name)
+	if str.HasSuffix(name, "."+plotFormatSVG) {
+		fmt.Fprintf(out, "<a href=\"%s\"><img src=\"%s\" alt=\"%s\"></a>\n", src, src, html.EscapeString(name))
+		return
+	}
+	fmt.Fprintf(out, "<div><embed src=\"%s\" type=\"application/pdf\" width=\"300\" height=\"320\"><br><a href=\"%s\">%s</a></div>\n", src, src, html.EscapeString(name))
+}
+
+func copyFile(src string, dst string) {
+	data, err := ioutil.ReadFile(src)
+	sp.CheckWithMsg(err, "Could not read file: "+src)
+	sp.CheckWithMsg(ioutil.WriteFile(dst, data, 0644), "Could not write file: "+dst)
+}
+
+var reportHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: Helvetica, Arial, sans-serif; font-size: 14px; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ddd; padding: 3px 8px; }
+th { background: #f3f3f3; cursor: pointer; user-select: none; }
+th.asc::after { content: " \25B2"; }
+th.desc::after { content: " \25BC"; }
+td.num { text-align: right; font-variant-numeric: tabular-nums; }
+tr:hover td { background: #f8f8ff; }
+.plots { display: flex; flex-wrap: wrap; gap: 8px; align-items: flex-start; }
+.plots img { max-width: 300px; }
+.warn { color: #b00; font-weight: bold; }
+.meta { color: #888; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<p class="meta">Generated %s</p>
+`
+
+var reportFooter = `<script>
+document.querySelectorAll("table.sortable").forEach(function(table) {
+  table.querySelectorAll("th").forEach(function(th, col) {
+    th.addEventListener("click", function() {
+      var asc = !th.classList.contains("asc");
+      table.querySelectorAll("th").forEach(function(h) { h.classList.remove("asc", "desc"); });
+      th.classList.add(asc ? "asc" : "desc");
+      var tbody = table.tBodies[0];
+      var rows = Array.prototype.slice.call(tbody.rows);
+      rows.sort(function(a, b) {
+        var x = a.cells[col].textContent, y = b.cells[col].textContent;
+        var nx = parseFloat(x), ny = parseFloat(y);
+        var cmp = (!isNaN(nx) && !isNaN(ny)) ? nx - ny : x.localeCompare(y);
+        return asc ? cmp : -cmp;
+      });
+      rows.forEach(function(r) { tbody.appendChild(r); });
+    });
+  });
+});
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestWriteHTMLTable(t *testing.T) {
+	tests := []struct {
+		desc string
+		rows []map[string]string
+		want string
+	}{
+		{
+			"identifying columns first",
+			[]map[string]string{{"Validity": "0.81", "Runset": "orig", "Gene": "DRD1", "Accuracy": "NA", "Replicate": "r1"}},
+			"<table class=\"sortable\">\n<thead><tr><th>Gene</th><th>Replicate</th><th>Runset</th><th>Accuracy</th><th>Validity</th></tr></thead>\n" +
+				"<tbody>\n<tr><td>[DRD1]</td><td>[r1]</td><td>[orig]</td><td>[NA]</td><td class=\"num\">[0.81]</td></tr>\n</tbody>\n</table>\n",
+		},
+		{
+			"escaped headers",
+			[]map[string]string{{"A<B": "1"}},
+			"<table class=\"sortable\">\n<thead><tr><th>A&lt;B</th></tr></thead>\n" +
+				"<tbody>\n<tr><td class=\"num\">[1]</td></tr>\n</tbody>\n</table>\n",
+		},
+		{"no rows", []map[string]string{}, ""},
+	}
+	for _, tt := range tests {
+		out := &bytes.Buffer{}
+		writeHTMLTable(out, tt.rows, func(col, val string) string { return "[" + val + "]" })
+		if out.String() != tt.want {
+			t.Errorf("writeHTMLTable(%s) =\n%s\nwant:\n%s", tt.desc, out.String(), tt.want)
+		}
+	}
+}
+
+func TestWriteHTMLPlot(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"drd1.calibration.svg", "<a href=\"plots/drd1.calibration.svg\"><img src=\"plots/drd1.calibration.svg\" alt=\"drd1.calibration.svg\"></a>\n"},
+		{"drd1.calibration.pdf", "<div><embed src=\"plots/drd1.calibration.pdf\" type=\"application/pdf\" width=\"300\" height=\"320\"><br><a href=\"plots/drd1.calibration.pdf\">drd1.calibration.pdf</a></div>\n"},
+	}
+	for _, tt := range tests {
+		out := &bytes.Buffer{}
+		writeHTMLPlot(out, tt.name)
+		if out.String() != tt.want {
+			t.Errorf("writeHTMLPlot(%q) = %q, want %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+// TestReportGenerator generates a report from one file on each in-port, and
+// checks that the tables, per-target sections and copied files are there
+func TestReportGenerator(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "report_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	files := map[string]string{
+		"res/final_models_summary.sorted.tsv":             "Gene\tReplicate\tRunset\tEfficiency\nDRD1\tr1\torig\t0.85\n",
+		"res/replicates.tsv":                              "Gene\tRunset\tCostsDiffer\nDRD1\torig\ttrue\n",
+		"dat/orig/drd1/r1/drd1_cost_gamma_perf_stats.tsv": "Gene\tCost\tObsFuzzOverall\nDRD1\t10\t0.2\nDRD1\t1\t0.3\nDRD1\t100\tNA\n",
+		"res/drd1.r1.orig.calibration.svg":                "<svg></svg>\n",
+		"res/all_targets.valdata.0p8.svg":                 "<svg></svg>\n",
+		"res/final_models_summary.sorted.tsv.orig.svg":    "<svg></svg>\n",
+		"dat/drd1/r1/orig/drd1.r1.orig.jar":               "model\n",
+		"dat/drd1/r1/orig/drd1.r1.orig.jar.audit.json":    "{}\n",
+		"res/calibration_summary.tsv":                     "Gene\tMiscalibrated\nHTR2B\ttrue\n",
+		"res/htr2b.r1.orig.calibration_curve.tsv":         "Confidence\tAccuracy\n0.8\t0.7\n",
+		"res/species_counts.tsv":                          "Gene\tHuman\nDRD1\t120\n",
+	}
+	for path, data := range files {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wf := sp.NewWorkflow("report_test", 1)
+	report := NewReportGenerator(wf, "create_report", "report", "Test <report>")
+	send := func(inPort *sp.InPort, paths ...string) {
+		for _, path := range paths {
+			ip := sp.NewFileIP(path)
+			if str.HasSuffix(path, ".jar") {
+				ai := sp.NewAuditInfo()
+				ai.Params["gene"] = "drd1"
+				ip.SetAuditInfo(ai)
+			}
+			inPort.Chan <- ip
+		}
+		close(inPort.Chan)
+	}
+	send(report.InSummary(), "res/final_models_summary.sorted.tsv")
+	send(report.InReplicates(), "res/replicates.tsv")
+	send(report.InCostPerf(), "dat/orig/drd1/r1/drd1_cost_gamma_perf_stats.tsv")
+	send(report.InPlots(), "res/drd1.r1.orig.calibration.svg", "res/all_targets.valdata.0p8.svg", "res/final_models_summary.sorted.tsv.orig.svg")
+	send(report.InModels(), "dat/drd1/r1/orig/drd1.r1.orig.jar")
+	send(report.InCalibSummary(), "res/calibration_summary.tsv")
+	send(report.InCalibCurves(), "res/htr2b.r1.orig.calibration_curve.tsv")
+	send(report.InSpeciesCounts(), "res/species_counts.tsv")
+	report.Run()
+
+	index, err := ioutil.ReadFile("report/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	html := string(index)
+	for _, want := range []string{
+		"<title>Test &lt;report&gt;</title>",
+		"<h2>Targets (aggregated over replicates)</h2>",
+		"<h2>Final models</h2>",
+		"<h2>Training structures per species</h2>",
+		"<h2>Calibration</h2>",
+		`<td><a href="#drd1">DRD1</a></td><td>orig</td><td><span class="warn">true</span></td>`,
+		`<td><a href="#htr2b">HTR2B</a></td><td><span class="warn">true</span></td>`,
+		"<h2>All targets</h2>\n<div class=\"plots\">\n" +
+			"<a href=\"plots/all_targets.valdata.0p8.svg\"><img src=\"plots/all_targets.valdata.0p8.svg\" alt=\"all_targets.valdata.0p8.svg\"></a>\n" +
+			"<a href=\"plots/final_models_summary.sorted.tsv.orig.svg\"><img src=\"plots/final_models_summary.sorted.tsv.orig.svg\" alt=\"final_models_summary.sorted.tsv.orig.svg\"></a>\n</div>",
+		"<h2 id=\"drd1\">DRD1</h2>\n<h3>Hyperparameter search</h3>\n<div class=\"plots\">\n<svg",
+		`<img src="plots/drd1.r1.orig.calibration.svg"`,
+		`<li><a href="audit/drd1.r1.orig.jar.audit.json">drd1.r1.orig.jar.audit.json</a></li>`,
+		"<h2 id=\"htr2b\">HTR2B</h2>\n<h3>Calibration curves</h3>",
+	} {
+		if !str.Contains(html, want) {
+			t.Errorf("Report does not contain:\n%s", want)
+		}
+	}
+	if str.Contains(html, "Conformal regression") {
+		t.Errorf("Report has a regression section, without regression results")
+	}
+	if str.Index(html, `id="drd1"`) > str.Index(html, `id="htr2b"`) {
+		t.Errorf("Target sections are not sorted")
+	}
+	for _, path := range []string{
+		"report/plots/drd1.r1.orig.calibration.svg",
+		"report/plots/all_targets.valdata.0p8.svg",
+		"report/audit/drd1.r1.orig.jar.audit.json",
+		"report/calibration/htr2b.r1.orig.calibration_curve.tsv",
+	} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("File not copied into the report: %s", path)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	str "strings"
+	"sync"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Resource-weighted local scheduling
+// ================================================================================
+
+// TaskResources are the cores and memory (in MB) that a task of a kind of
+// process (such as "crossval" or "train") needs
+type TaskResources struct {
+	Cores int `json:"cores"`
+	MemMB int `json:"mem_mb"`
+}
+
+// defaultTaskResources returns the resources per kind of process, with the
+// "default" resources used for processes of other kinds, which are mostly
+// small awk, sort and Go tasks. The CPSign kinds get the cores they were given
+// with SLURM.
+func defaultTaskResources() map[string]TaskResources {
+	return map[string]TaskResources{
+		"default":       {Cores: 1, MemMB: 256},
+		"extract":       {Cores: 1, MemMB: 512},
+		"precompute":    {Cores: 1, MemMB: 2048},
+		"crossval":      {Cores: 4, MemMB: 4096},
+		"learningcurve": {Cores: 4, MemMB: 4096},
+		"train":         {Cores: 4, MemMB: 4096},
+		"validate":      {Cores: 1, MemMB: 2048},
+	}
+}
+
+// readTaskResources reads the resources per kind of process from a JSON file,
+// with the kinds not in the file taken from defaultTaskResources
+func readTaskResources(path string) map[string]TaskResources {
+	resources := defaultTaskResources()
+	if path == "" {
+		return resources
+	}
+	data, err := ioutil.ReadFile(path)
+	sp.CheckWithMsg(err, "Could not read resource config file: "+path)
+	fromFile := map[string]TaskResources{}
+	sp.CheckWithMsg(json.Unmarshal(data, &fromFile), "Could not parse resource config file: "+path)
+	for kind, res := range fromFile {
+		if res.Cores < 1 || res.MemMB < 1 {
+			sp.Failf("Cores and memory must be positive, for %s in resource config file %s\n", kind, path)
+		}
+		resources[kind] = res
+	}
+	return resources
+}
+
+// javaHeapOpt returns the java option for the max heap size of the JVM of a
+// task with the given resources, leaving a fifth of the memory (and at least
+// 128 MB) for the JVM itself and the bash process around it
+func javaHeapOpt(res TaskResources) string {
+	overhead := res.MemMB / 5
+	if overhead < 128 {
+		overhead = 128
+	}
+	heapMB := res.MemMB - overhead
+	if heapMB < 64 {
+		heapMB = 64
+	}
+	return fmt.Sprintf("-Xmx%dm", heapMB)
+}
+
+// ResourceScheduler runs local tasks only when their cores and memory fit in
+// what is left of the budget of the host, so that a few JVMs can run next to
+// many small tasks, without oversubscribing the memory. Tasks needing more
+// than the whole budget run alone.
+//
+// The scheduler runs inside the SciPipe task slots, so -maxtasks should be
+// set high enough that tasks waiting for resources do not keep small tasks
+// from getting a slot.
+type ResourceScheduler struct {
+	Cores     int
+	MemMB     int
+	Resources map[string]TaskResources
+	kinds     map[*sp.Process]string
+	usedCores int
+	usedMemMB int
+	mx        sync.Mutex
+	freed     *sync.Cond
+}
+
+func NewResourceScheduler(cores int, memMB int, resources map[string]TaskResources) *ResourceScheduler {
+	if cores < 1 {
+		cores = runtime.NumCPU()
+	}
+	if memMB < 1 {
+		memMB = hostMemMB() * 4 / 5
+	}
+	s := &ResourceScheduler{
+		Cores:     cores,
+		MemMB:     memMB,
+		Resources: resources,
+		kinds:     map[*sp.Process]string{},
+	}
+	s.freed = sync.NewCond(&s.mx)
+	return s
+}
+
+// ResourcesFor returns the resources of the given kind of process
+func (s *ResourceScheduler) ResourcesFor(kind string) TaskResources {
+	if res, ok := s.Resources[kind]; ok {
+		return res
+	}
+	return s.Resources["default"]
+}
+
+// JavaCmd returns the java command for a task of the given kind, with the max
+// heap size fitted to its resources. Without the scheduler (a nil s), plain
+// java is returned, so that the JVM sizes its heap from the memory of the
+// SLURM or Kubernetes job, or the host, rather than from local resources.
+func (s *ResourceScheduler) JavaCmd(kind string) string {
+	if s == nil {
+		return "java"
+	}
+	return "java " + javaHeapOpt(s.ResourcesFor(kind))
+}
+
+// Annotate sets the kind of process of p, deciding the resources of its tasks
+// (Processes not annotated get the default resources)
+func (s *ResourceScheduler) Annotate(p *sp.Process, kind string) {
+	s.kinds[p] = kind
+}
+
+// Apply makes the tasks of all the shell command processes of wf, that are
+// not already run by another executor, wait for their resources before
+// running
+func (s *ResourceScheduler) Apply(wf *sp.Workflow) {
+	procNames := []string{}
+	for procName := range wf.Procs() {
+		procNames = append(procNames, procName)
+	}
+	sort.Strings(procNames)
+	for _, procName := range procNames {
+		p, ok := wf.Proc(procName).(*sp.Process)
+		if !ok || p.CustomExecute != nil {
+			continue
+		}
+		res := s.ResourcesFor(s.kinds[p])
+		if res.Cores > s.Cores || res.MemMB > s.MemMB {
+			sp.Warning.Printf("| %-32s | Tasks need %d cores and %d MB, more than the budget of %d cores and %d MB, so will run alone\n", procName, res.Cores, res.MemMB, s.Cores, s.MemMB)
+			if res.Cores > s.Cores {
+				res.Cores = s.Cores
+			}
+			if res.MemMB > s.MemMB {
+				res.MemMB = s.MemMB
+			}
+		}
+		setTaskExecFunc(p, func(t *sp.Task) error {
+			taskRes := s.resourcesForCommand(res, t.Command)
+			s.acquire(taskRes)
+			defer s.release(taskRes)
+			sp.Audit.Printf("| %-32s | Executing with %d cores and %d MB: %s\n", t.Name, taskRes.Cores, taskRes.MemMB, t.Command)
+			return execLocalCommand(t)
+		})
+	}
+}
+
+// resourcesForCommand returns res, with the memory increased to fit the Java
+// heap size of cmd (which is increased when retrying tasks), within the budget
+func (s *ResourceScheduler) resourcesForCommand(res TaskResources, cmd string) TaskResources {
+	if heapMB := javaHeapMB(cmd); heapMB > 0 {
+		if memMB := heapMB * 5 / 4; memMB > res.MemMB {
+			res.MemMB = memMB
+		}
+		if res.MemMB > s.MemMB {
+			res.MemMB = s.MemMB
+		}
+	}
+	return res
+}
+
+// acquire waits until res fits in what is left of the budget, and reserves it
+func (s *ResourceScheduler) acquire(res TaskResources) {
+	s.mx.Lock()
+	for s.usedCores+res.Cores > s.Cores || s.usedMemMB+res.MemMB > s.MemMB {
+		s.freed.Wait()
+	}
+	s.usedCores += res.Cores
+	s.usedMemMB += res.MemMB
+	s.mx.Unlock()
+}
+
+func (s *ResourceScheduler) release(res TaskResources) {
+	s.mx.Lock()
+	s.usedCores -= res.Cores
+	s.usedMemMB -= res.MemMB
+	s.mx.Unlock()
+	s.freed.Broadcast()
+}
+
+// hostMemMB returns the total memory of the host in MB, from /proc/meminfo,
+// or 4096 if it can not be read
+func hostMemMB() int {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		sp.Warning.Printf("Could not read the memory of the host, so assuming 4096 MB: %s\n", err)
+		return 4096
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		fields := str.Fields(sc.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kB, err := strconv.Atoi(fields[1])
+			if err == nil {
+				return kB / 1024
+			}
+		}
+	}
+	sp.Warning.Printf("Could not find the memory of the host in /proc/meminfo, so assuming 4096 MB\n")
+	return 4096
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestJavaHeapOpt(t *testing.T) {
+	tests := []struct {
+		memMB int
+		want  string
+	}{
+		{4096, "-Xmx3277m"},
+		{2048, "-Xmx1639m"},
+		{512, "-Xmx384m"},
+		{100, "-Xmx64m"},
+	}
+	for _, tt := range tests {
+		if got := javaHeapOpt(TaskResources{Cores: 1, MemMB: tt.memMB}); got != tt.want {
+			t.Errorf("javaHeapOpt(%d MB) = %q, want %q", tt.memMB, got, tt.want)
+		}
+	}
+}
+
+func TestJavaCmd(t *testing.T) {
+	var noSched *ResourceScheduler
+	if got := noSched.JavaCmd("crossval"); got != "java" {
+		t.Errorf("JavaCmd without the scheduler = %q, want %q", got, "java")
+	}
+	sched := NewResourceScheduler(8, 16384, defaultTaskResources())
+	tests := []struct {
+		kind string
+		want string
+	}{
+		{"crossval", "java -Xmx3277m"},
+		{"validate", "java -Xmx1639m"},
+		{"unknown", "java -Xmx128m"},
+	}
+	for _, tt := range tests {
+		if got := sched.JavaCmd(tt.kind); got != tt.want {
+			t.Errorf("JavaCmd(%q) = %q, want %q", tt.kind, got, tt.want)
+		}
+	}
+}
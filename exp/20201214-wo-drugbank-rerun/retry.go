@@ -0,0 +1,481 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	str "strings"
+	"sync"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Task execution with errors
+// ================================================================================
+
+// taskExecFunc executes a task, and returns an error if it failed, instead of
+// failing the workflow, so that the task can be retried
+type taskExecFunc func(t *sp.Task) error
+
+// taskExecFuncs holds the taskExecFunc of each process run by an executor
+var taskExecFuncs = map[*sp.Process]taskExecFunc{}
+
+// setTaskExecFunc makes the tasks of p execute with execFunc, failing the
+// workflow if it returns an error, unless a FailurePolicy is applied
+func setTaskExecFunc(p *sp.Process, execFunc taskExecFunc) {
+	taskExecFuncs[p] = execFunc
+	p.CustomExecute = func(t *sp.Task) {
+		if err := execFunc(t); err != nil {
+			sp.Failf("| %-32s | %s\n", t.Name, err)
+		}
+	}
+}
+
+// execLocalCommand executes the command of a task locally, via bash, as
+// SciPipe does, and checks that it produced its outputs
+func execLocalCommand(t *sp.Task) error {
+	cmd := exec.Command("bash", "-c", t.Command)
+	out, err := cmd.CombinedOutput()
+	metricsLog.reportUsage(t, localTaskUsage(cmd.ProcessState))
+	if err != nil {
+		return fmt.Errorf("Command failed!\nCommand:\n%s\n\nOutput:\n%s\nOriginal error:%s", t.Command, string(out), err.Error())
+	}
+	for _, oip := range t.OutIPs {
+		if _, err := os.Stat(oip.TempPath()); err != nil {
+			return fmt.Errorf("Command did not produce %s!\nCommand:\n%s\n\nOutput:\n%s", oip.TempPath(), t.Command, string(out))
+		}
+	}
+	return nil
+}
+
+// ================================================================================
+// Retry and failure isolation
+// ================================================================================
+
+// RetryPolicy says how many times a task is tried, how long to wait before
+// each retry, and how much to increase the Java heap size (the -Xmx option)
+// of its command for each retry. The heap only grows for commands with an
+// -Xmx option, which CPSign commands only get with -resources. On Kubernetes,
+// the heap can not grow beyond the memory limit of the job.
+type RetryPolicy struct {
+	MaxAttempts   int     `json:"max_attempts"`
+	Backoff       string  `json:"backoff"`        // Wait before the first retry
+	BackoffFactor float64 `json:"backoff_factor"` // Factor to increase the wait with for each further retry
+	HeapFactor    float64 `json:"heap_factor"`    // Factor to increase the heap size with for each retry (1 for no increase)
+}
+
+// defaultRetryPolicies returns the retry policies per kind of process, with
+// the "default" policy used for processes of other kinds. The CPSign kinds are
+// retried, with a larger heap, as they are the ones failing from running out
+// of memory, or from temporary license and file system issues.
+func defaultRetryPolicies() map[string]RetryPolicy {
+	cpSignPolicy := RetryPolicy{MaxAttempts: 3, Backoff: "30s", BackoffFactor: 2, HeapFactor: 1.5}
+	return map[string]RetryPolicy{
+		"default":       {MaxAttempts: 1, Backoff: "0s", BackoffFactor: 1, HeapFactor: 1},
+		"extract":       {MaxAttempts: 2, Backoff: "10s", BackoffFactor: 1, HeapFactor: 1},
+		"precompute":    cpSignPolicy,
+		"crossval":      cpSignPolicy,
+		"learningcurve": cpSignPolicy,
+		"train":         cpSignPolicy,
+		"validate":      cpSignPolicy,
+	}
+}
+
+// readRetryPolicies reads the retry policies per kind of process from a JSON
+// file, with the kinds not in the file taken from defaultRetryPolicies
+func readRetryPolicies(path string) map[string]RetryPolicy {
+	policies := defaultRetryPolicies()
+	if path == "" {
+		return policies
+	}
+	data, err := ioutil.ReadFile(path)
+	sp.CheckWithMsg(err, "Could not read retry config file: "+path)
+	fromFile := map[string]RetryPolicy{}
+	sp.CheckWithMsg(json.Unmarshal(data, &fromFile), "Could not parse retry config file: "+path)
+	for kind, policy := range fromFile {
+		if policy.MaxAttempts < 1 {
+			sp.Failf("max_attempts must be at least 1, for %s in retry config file %s\n", kind, path)
+		}
+		if policy.Backoff == "" {
+			policy.Backoff = "0s"
+		}
+		_, err := time.ParseDuration(policy.Backoff)
+		sp.CheckWithMsg(err, "Could not parse backoff for "+kind+" in retry config file: "+path)
+		if policy.BackoffFactor < 1 {
+			policy.BackoffFactor = 1
+		}
+		if policy.HeapFactor < 1 {
+			policy.HeapFactor = 1
+		}
+		policies[kind] = policy
+	}
+	return policies
+}
+
+// failurePolicy is used by the components, to leave out the outputs of
+// failed target branches
+var failurePolicy *FailurePolicy
+
+// FailurePolicy retries failing tasks according to the retry policy of their
+// kind of process. Tasks that still fail make the workflow fail, unless
+// ContinueOnFailure is set, in which case the target (gene) branch of the
+// task is marked as failed, and the rest of the panel is completed:
+//
+// Failed tasks, and the tasks depending on them, write placeholder outputs
+// instead of running, so that SciPipe can send them on, and the components
+// leave the placeholders out (see SkipIP). After the run, the placeholders are
+// removed, so that the next run tries the branch again, and WriteReport lists
+// the failed targets, with their log files.
+//
+// Failing tasks not in a target branch still make the workflow fail. Tasks of
+// processes with Go code are never retried, as they fail the workflow
+// themselves.
+type FailurePolicy struct {
+	Policies          map[string]RetryPolicy
+	ContinueOnFailure bool
+	genes             []string
+	kinds             map[*sp.Process]string
+	mx                sync.Mutex
+	failedGenes       map[string]bool
+	failures          []*taskFailure
+	skippedTasks      map[string][]string
+	placeholders      map[string]bool
+	partialProcs      map[string]int
+}
+
+// taskFailure is a task that failed after all its attempts
+type taskFailure struct {
+	gene     string
+	taskName string
+	attempts int
+	err      error
+	logPaths []string
+}
+
+func NewFailurePolicy(policies map[string]RetryPolicy, continueOnFailure bool, genes []string) *FailurePolicy {
+	lowerGenes := []string{}
+	for _, gene := range genes {
+		lowerGenes = append(lowerGenes, str.ToLower(gene))
+	}
+	return &FailurePolicy{
+		Policies:          policies,
+		ContinueOnFailure: continueOnFailure,
+		genes:             lowerGenes,
+		kinds:             map[*sp.Process]string{},
+		failedGenes:       map[string]bool{},
+		skippedTasks:      map[string][]string{},
+		placeholders:      map[string]bool{},
+		partialProcs:      map[string]int{},
+	}
+}
+
+// PolicyFor returns the retry policy of the given kind of process
+func (f *FailurePolicy) PolicyFor(kind string) RetryPolicy {
+	if policy, ok := f.Policies[kind]; ok {
+		return policy
+	}
+	return f.Policies["default"]
+}
+
+// Annotate sets the kind of process of p, deciding its retry policy
+// (Processes not annotated get the default policy)
+func (f *FailurePolicy) Annotate(p *sp.Process, kind string) {
+	f.kinds[p] = kind
+}
+
+// KindOf returns the kind of process of p, or "default" if not annotated
+func (f *FailurePolicy) KindOf(p *sp.Process) string {
+	if kind, ok := f.kinds[p]; ok {
+		return kind
+	}
+	return "default"
+}
+
+// Apply applies the policy to the tasks of all the processes of wf. It must
+// be called after the executors are applied.
+func (f *FailurePolicy) Apply(wf *sp.Workflow) {
+	for _, proc := range wf.Procs() {
+		p, ok := proc.(*sp.Process)
+		if !ok {
+			continue
+		}
+		policy := f.PolicyFor(f.kinds[p])
+		execFunc, ok := taskExecFuncs[p]
+		if !ok && p.CustomExecute == nil {
+			execFunc = execLocalCommand
+		} else if !ok {
+			customExecute := p.CustomExecute
+			execFunc = func(t *sp.Task) error {
+				customExecute(t)
+				return nil
+			}
+			policy.MaxAttempts = 1
+		}
+		p.CustomExecute = func(t *sp.Task) {
+			f.execute(t, execFunc, policy)
+		}
+	}
+}
+
+func (f *FailurePolicy) execute(t *sp.Task, execFunc taskExecFunc, policy RetryPolicy) {
+	gene := f.taskGene(t)
+	if f.ContinueOnFailure && ((gene != "" && f.geneFailed(gene)) || f.anyPlaceholderInput(t)) {
+		sp.Audit.Printf("| %-32s | Skipping, as it depends on a failed branch\n", t.Name)
+		f.writePlaceholders(t)
+		f.mx.Lock()
+		f.skippedTasks[gene] = append(f.skippedTasks[gene], t.Name)
+		f.mx.Unlock()
+		return
+	}
+
+	backoff, _ := time.ParseDuration(policy.Backoff)
+	logPaths := []string{}
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		err = execFunc(t)
+		if err == nil {
+			return
+		}
+		logPaths = append(logPaths, f.keepFailedLogs(t, attempt, err)...)
+		if attempt >= policy.MaxAttempts {
+			break
+		}
+		sp.Warning.Printf("| %-32s | Attempt %d of %d failed, retrying in %s: %s\n", t.Name, attempt, policy.MaxAttempts, backoff, firstLine(err.Error()))
+		time.Sleep(backoff)
+		backoff = time.Duration(float64(backoff) * policy.BackoffFactor)
+		if policy.HeapFactor > 1 {
+			t.Command = increaseJavaHeap(t.Command, policy.HeapFactor)
+		}
+	}
+	if !f.ContinueOnFailure || gene == "" {
+		sp.Failf("| %-32s | Failed after %d attempt(s): %s\nLog files: %s\n", t.Name, attempt, err, str.Join(logPaths, ", "))
+	}
+
+	sp.Error.Printf("| %-32s | Failed after %d attempt(s), so marking the branch of %s as failed: %s\n", t.Name, attempt, str.ToUpper(gene), err)
+	f.mx.Lock()
+	f.failedGenes[gene] = true
+	f.failures = append(f.failures, &taskFailure{gene: gene, taskName: t.Name, attempts: attempt, err: err, logPaths: logPaths})
+	f.mx.Unlock()
+	f.writePlaceholders(t)
+}
+
+// failureLogDir is where the errors of failed attempts are saved, as
+// <task name>.attempt<N>.log
+const failureLogDir = "log/failures"
+
+// placeholderPrefix starts the content of placeholder outputs
+const placeholderPrefix = "Placeholder for an output of task "
+
+// keepFailedLogs saves the error of a failed attempt, and moves the log files
+// among the temporary outputs of the task aside, and removes the other
+// temporary outputs, so that the task can be tried again. It returns the
+// paths of the saved log files.
+func (f *FailurePolicy) keepFailedLogs(t *sp.Task, attempt int, err error) []string {
+	sp.CheckWithMsg(os.MkdirAll(failureLogDir, 0755), "Could not create directory: "+failureLogDir)
+	errPath := fmt.Sprintf("%s/%s.attempt%d.log", failureLogDir, t.Name, attempt)
+	sp.CheckWithMsg(ioutil.WriteFile(errPath, []byte(err.Error()+"\n"), 0644), "Could not write error log: "+errPath)
+	logPaths := []string{errPath}
+	for portName, oip := range t.OutIPs {
+		if _, err := os.Stat(oip.TempPath()); err != nil {
+			continue
+		}
+		if str.Contains(portName, "log") {
+			failedPath := fmt.Sprintf("%s.attempt%d.failed", oip.Path(), attempt)
+			sp.CheckWithMsg(os.Rename(oip.TempPath(), failedPath), "Could not move failed log file: "+oip.TempPath())
+			logPaths = append(logPaths, failedPath)
+			continue
+		}
+		sp.CheckWithMsg(os.RemoveAll(oip.TempPath()), "Could not remove temporary output of failed task: "+oip.TempPath())
+	}
+	sort.Strings(logPaths[1:])
+	return logPaths
+}
+
+// writePlaceholders writes placeholder outputs for a task depending on a
+// failed branch
+func (f *FailurePolicy) writePlaceholders(t *sp.Task) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for _, oip := range t.OutIPs {
+		content := fmt.Sprintf("%s%s, which depends on a failed branch. It will be removed at the end of the run.\n", placeholderPrefix, t.Name)
+		sp.CheckWithMsg(ioutil.WriteFile(oip.TempPath(), []byte(content), 0644), "Could not write placeholder: "+oip.TempPath())
+		f.placeholders[oip.Path()] = true
+	}
+}
+
+// MarkPlaceholder marks an output written by a component as a placeholder,
+// for components which write per-target outputs from failed branches
+func (f *FailurePolicy) MarkPlaceholder(path string) {
+	if f == nil {
+		return
+	}
+	f.mx.Lock()
+	f.placeholders[path] = true
+	f.mx.Unlock()
+}
+
+// IsPlaceholder tells whether path is a placeholder for an output of a failed
+// branch
+func (f *FailurePolicy) IsPlaceholder(path string) bool {
+	if f == nil {
+		return false
+	}
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.placeholders[path]
+}
+
+// SkipIP tells whether a component should leave out ip, as it is a
+// placeholder for an output of a failed branch, and notes that the outputs of
+// the component leave out failed targets
+func (f *FailurePolicy) SkipIP(procName string, ip *sp.FileIP) bool {
+	if !f.IsPlaceholder(ip.Path()) {
+		return false
+	}
+	f.mx.Lock()
+	f.partialProcs[procName]++
+	f.mx.Unlock()
+	return true
+}
+
+// HasFailures tells whether any target branch failed
+func (f *FailurePolicy) HasFailures() bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return len(f.failures) > 0
+}
+
+// RemovePlaceholders removes the placeholder outputs (and their audit logs),
+// so that the failed branches are run again in the next run
+func (f *FailurePolicy) RemovePlaceholders() {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	for path := range f.placeholders {
+		for _, p := range []string{path, path + ".audit.json"} {
+			if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+				sp.Warning.Printf("Could not remove placeholder %s: %s\n", p, err)
+			}
+		}
+	}
+}
+
+// WriteReport writes a report of the failed targets, with the failed tasks
+// and their log files, the number of tasks skipped in each branch, and the
+// components whose outputs leave out the failed targets
+func (f *FailurePolicy) WriteReport(path string) {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	genes := []string{}
+	failuresPerGene := map[string][]*taskFailure{}
+	for _, failure := range f.failures {
+		if _, ok := failuresPerGene[failure.gene]; !ok {
+			genes = append(genes, failure.gene)
+		}
+		failuresPerGene[failure.gene] = append(failuresPerGene[failure.gene], failure)
+	}
+	sort.Strings(genes)
+
+	out := &str.Builder{}
+	fmt.Fprintf(out, "Failure report, %s\n\n", time.Now().Format("2006-01-02 15:04"))
+	fmt.Fprintf(out, "Failed targets: %d of %d\n", len(genes), len(f.genes))
+	for _, gene := range genes {
+		fmt.Fprintf(out, "\n%s\n", str.ToUpper(gene))
+		for _, failure := range failuresPerGene[gene] {
+			fmt.Fprintf(out, "  Task %s failed after %d attempt(s): %s\n", failure.taskName, failure.attempts, firstLine(failure.err.Error()))
+			for _, logPath := range failure.logPaths {
+				fmt.Fprintf(out, "    %s\n", logPath)
+			}
+		}
+		if n := len(f.skippedTasks[gene]); n > 0 {
+			fmt.Fprintf(out, "  Tasks skipped after the failure: %d\n", n)
+		}
+	}
+	if n := len(f.skippedTasks[""]); n > 0 {
+		fmt.Fprintf(out, "\nTasks outside the target branches skipped after the failures: %d\n", n)
+	}
+	if len(f.partialProcs) > 0 {
+		procNames := []string{}
+		for procName := range f.partialProcs {
+			procNames = append(procNames, procName)
+		}
+		sort.Strings(procNames)
+		out.WriteString("\nThe outputs of these processes leave out the failed targets, and need to be removed to include them in a later run:\n")
+		for _, procName := range procNames {
+			fmt.Fprintf(out, "  %s (%d inputs left out)\n", procName, f.partialProcs[procName])
+		}
+	}
+
+	oip := sp.NewFileIP(path)
+	oip.Write([]byte(out.String()))
+	oip.Atomize()
+}
+
+// taskGene returns the gene (in lower case) of the target branch of a task,
+// from its gene parameter, or else from the name of the task, or an empty
+// string for tasks not in a target branch
+func (f *FailurePolicy) taskGene(t *sp.Task) string {
+	if gene, ok := t.Params["gene"]; ok && strInSlice(str.ToLower(gene), f.genes) {
+		return str.ToLower(gene)
+	}
+	for _, tok := range str.Split(t.Name, "_") {
+		if strInSlice(tok, f.genes) {
+			return tok
+		}
+	}
+	return ""
+}
+
+func (f *FailurePolicy) geneFailed(gene string) bool {
+	f.mx.Lock()
+	defer f.mx.Unlock()
+	return f.failedGenes[gene]
+}
+
+func (f *FailurePolicy) anyPlaceholderInput(t *sp.Task) bool {
+	for _, iip := range t.InIPs {
+		if f.IsPlaceholder(iip.Path()) {
+			return true
+		}
+	}
+	return false
+}
+
+// ================================================================================
+// Helpers
+// ================================================================================
+
+var javaHeapPtn = regexp.MustCompile(`-Xmx(\d+)m`)
+
+// increaseJavaHeap returns cmd with its Java heap sizes increased by factor
+func increaseJavaHeap(cmd string, factor float64) string {
+	return javaHeapPtn.ReplaceAllStringFunc(cmd, func(opt string) string {
+		heapMB, _ := strconv.Atoi(javaHeapPtn.FindStringSubmatch(opt)[1])
+		return fmt.Sprintf("-Xmx%dm", int(math.Ceil(float64(heapMB)*factor)))
+	})
+}
+
+// javaHeapMB returns the largest Java heap size in cmd, in MB, or 0 if there
+// is none
+func javaHeapMB(cmd string) int {
+	maxHeapMB := 0
+	for _, m := range javaHeapPtn.FindAllStringSubmatch(cmd, -1) {
+		heapMB, _ := strconv.Atoi(m[1])
+		if heapMB > maxHeapMB {
+			maxHeapMB = heapMB
+		}
+	}
+	return maxHeapMB
+}
+
+func firstLine(s string) string {
+	return str.SplitN(str.TrimSpace(s), "\n", 2)[0]
+}
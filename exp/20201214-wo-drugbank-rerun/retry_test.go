@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	str "strings"
+	"testing"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestReadRetryPolicies(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "retry_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "retry.json")
+	config := `{"train": {"max_attempts": 5, "backoff": "1m", "backoff_factor": 3, "heap_factor": 2}, "plot": {"max_attempts": 2, "backoff_factor": 0.5, "heap_factor": 0}}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		kind string
+		want RetryPolicy
+	}{
+		{"", "train", RetryPolicy{MaxAttempts: 3, Backoff: "30s", BackoffFactor: 2, HeapFactor: 1.5}},
+		{"", "default", RetryPolicy{MaxAttempts: 1, Backoff: "0s", BackoffFactor: 1, HeapFactor: 1}},
+		{path, "train", RetryPolicy{MaxAttempts: 5, Backoff: "1m", BackoffFactor: 3, HeapFactor: 2}},
+		{path, "plot", RetryPolicy{MaxAttempts: 2, Backoff: "0s", BackoffFactor: 1, HeapFactor: 1}},        // Missing and too small values
+		{path, "validate", RetryPolicy{MaxAttempts: 3, Backoff: "30s", BackoffFactor: 2, HeapFactor: 1.5}}, // Not in the file
+	}
+	for _, tt := range tests {
+		if got := readRetryPolicies(tt.path)[tt.kind]; got != tt.want {
+			t.Errorf("readRetryPolicies(%q)[%q] = %+v, want %+v", tt.path, tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestIncreaseJavaHeap(t *testing.T) {
+	tests := []struct {
+		cmd        string
+		factor     float64
+		want       string
+		wantHeapMB int
+	}{
+		{"java -Xmx1000m -jar cpsign.jar train", 1.5, "java -Xmx1500m -jar cpsign.jar train", 1500},
+		{"java -Xmx999m -jar a.jar && java -Xmx2000m -jar b.jar", 1.5, "java -Xmx1499m -jar a.jar && java -Xmx3000m -jar b.jar", 3000}, // Rounded up
+		{"java -jar cpsign.jar train", 2, "java -jar cpsign.jar train", 0},
+	}
+	for _, tt := range tests {
+		got := increaseJavaHeap(tt.cmd, tt.factor)
+		if got != tt.want {
+			t.Errorf("increaseJavaHeap(%q, %g) = %q, want %q", tt.cmd, tt.factor, got, tt.want)
+		}
+		if heapMB := javaHeapMB(got); heapMB != tt.wantHeapMB {
+			t.Errorf("javaHeapMB(%q) = %d, want %d", got, heapMB, tt.wantHeapMB)
+		}
+	}
+}
+
+// newRetryTestTask returns a task of a CPSign-like command for gene, with a
+// model and a log file output, reading the files in inPaths
+func newRetryTestTask(wf *sp.Workflow, name string, gene string, inPaths ...string) *sp.Task {
+	p := wf.NewProc(name, "java -Xmx1000m -jar cpsign.jar train > {o:model} 2> {o:logfile} # {p:gene}")
+	p.SetPathStatic("model", name+".model")
+	p.SetPathStatic("logfile", name+".log")
+	inIPs := map[string]*sp.FileIP{}
+	for i, path := range inPaths {
+		inIPs[fmt.Sprintf("in%d", i)] = sp.NewFileIP(path)
+	}
+	return sp.NewTask(wf, p, name, p.CommandPattern, inIPs, p.PathFormatters, nil, map[string]string{"gene": gene}, "", nil, 1)
+}
+
+// failingExecFunc returns an execFunc that writes the temporary outputs of
+// its task, and fails the first nFailures times, and the commands it was
+// called with
+func failingExecFunc(nFailures int) (taskExecFunc, *[]string) {
+	commands := &[]string{}
+	return func(t *sp.Task) error {
+		*commands = append(*commands, t.Command)
+		for _, oip := range t.OutIPs {
+			if err := ioutil.WriteFile(oip.TempPath(), []byte("output\n"), 0644); err != nil {
+				return err
+			}
+		}
+		if len(*commands) <= nFailures {
+			return fmt.Errorf("Command failed!\nOut of memory")
+		}
+		return nil
+	}, commands
+}
+
+var heapOptPtn = regexp.MustCompile(`-Xmx\d+m`)
+
+func TestFailurePolicyExecute(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "failure_policy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	policy := RetryPolicy{MaxAttempts: 3, Backoff: "10ms", BackoffFactor: 2, HeapFactor: 1.5}
+	tests := []struct {
+		name       string
+		failures   int
+		wantHeaps  []string
+		wantWait   time.Duration
+		wantLogs   []string
+		wantFailed bool
+	}{
+		{"success", 0, []string{"-Xmx1000m"}, 0, nil, false},
+		{
+			"retried", 2, []string{"-Xmx1000m", "-Xmx1500m", "-Xmx2250m"}, 30 * time.Millisecond,
+			[]string{"log/failures/cpsign_train_drd1_retried.attempt1.log", "log/failures/cpsign_train_drd1_retried.attempt2.log"},
+			false,
+		},
+		{
+			"failed", 3, []string{"-Xmx1000m", "-Xmx1500m", "-Xmx2250m"}, 30 * time.Millisecond,
+			[]string{"log/failures/cpsign_train_drd1_failed.attempt1.log", "log/failures/cpsign_train_drd1_failed.attempt2.log", "log/failures/cpsign_train_drd1_failed.attempt3.log"},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		f := NewFailurePolicy(map[string]RetryPolicy{"default": policy}, true, []string{"DRD1"})
+		task := newRetryTestTask(sp.NewWorkflow("failure_policy_test", 1), "cpsign_train_drd1_"+tt.name, "DRD1")
+		execFunc, commands := failingExecFunc(tt.failures)
+		start := time.Now()
+		f.execute(task, execFunc, policy)
+
+		heaps := []string{}
+		for _, cmd := range *commands {
+			heaps = append(heaps, heapOptPtn.FindString(cmd))
+		}
+		if !reflect.DeepEqual(heaps, tt.wantHeaps) {
+			t.Errorf("%s: Heap sizes of the attempts = %v, want %v", tt.name, heaps, tt.wantHeaps)
+		}
+		if wait := time.Since(start); wait < tt.wantWait {
+			t.Errorf("%s: Waited %s between the attempts, want at least %s", tt.name, wait, tt.wantWait)
+		}
+		logs, err := filepath.Glob("log/failures/" + task.Name + ".*")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(logs, tt.wantLogs) {
+			t.Errorf("%s: Failure logs = %v, want %v", tt.name, logs, tt.wantLogs)
+		}
+		// The log files of the failed attempts are kept, and the other
+		// outputs removed
+		for attempt := 1; attempt <= len(tt.wantLogs); attempt++ {
+			if _, err := os.Stat(fmt.Sprintf("%s.log.attempt%d.failed", task.Name, attempt)); err != nil {
+				t.Errorf("%s: Log file of attempt %d not kept: %s", tt.name, attempt, err)
+			}
+		}
+		if f.HasFailures() != tt.wantFailed || f.geneFailed("drd1") != tt.wantFailed {
+			t.Errorf("%s: HasFailures() = %t, and DRD1 failed: %t, want %t", tt.name, f.HasFailures(), f.geneFailed("drd1"), tt.wantFailed)
+		}
+		modelIP := task.OutIPs["model"]
+		data, err := ioutil.ReadFile(modelIP.TempPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isPlaceholder := str.HasPrefix(string(data), placeholderPrefix); isPlaceholder != tt.wantFailed || f.IsPlaceholder(modelIP.Path()) != tt.wantFailed {
+			t.Errorf("%s: Model output is a placeholder: %t, want %t", tt.name, isPlaceholder, tt.wantFailed)
+		}
+	}
+}
+
+// TestFailurePolicyPlaceholders fails the branch of DRD1, and checks that
+// the tasks depending on it are skipped, that components leave out its
+// outputs, and that the placeholders are removed and reported
+func TestFailurePolicyPlaceholders(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "failure_policy_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	var noPolicy *FailurePolicy
+	noPolicy.MarkPlaceholder("drd1.model")
+	if noPolicy.IsPlaceholder("drd1.model") || noPolicy.SkipIP("create_report", sp.NewFileIP("drd1.model")) {
+		t.Errorf("A nil FailurePolicy has placeholders")
+	}
+
+	policy := RetryPolicy{MaxAttempts: 2, Backoff: "1ms", BackoffFactor: 1, HeapFactor: 1}
+	f := NewFailurePolicy(map[string]RetryPolicy{"default": policy}, true, []string{"DRD1", "HTR2B"})
+	wf := sp.NewWorkflow("failure_policy_test", 1)
+	train := newRetryTestTask(wf, "cpsign_train_drd1", "DRD1")
+	execFunc, _ := failingExecFunc(2)
+	f.execute(train, execFunc, policy)
+
+	// Tasks in the failed branch, and tasks reading placeholders, are skipped
+	tests := []struct {
+		task     *sp.Task
+		wantRuns int
+	}{
+		{newRetryTestTask(wf, "cpsign_validate_drd1", "DRD1"), 0},
+		{newRetryTestTask(wf, "summarize", "all", train.OutIPs["model"].Path()), 0},
+		{newRetryTestTask(wf, "cpsign_train_htr2b", "HTR2B"), 1},
+	}
+	for _, tt := range tests {
+		execFunc, commands := failingExecFunc(0)
+		f.execute(tt.task, execFunc, policy)
+		if len(*commands) != tt.wantRuns {
+			t.Errorf("Task %s ran %d times, want %d", tt.task.Name, len(*commands), tt.wantRuns)
+		}
+		for _, oip := range tt.task.OutIPs {
+			if f.IsPlaceholder(oip.Path()) != (tt.wantRuns == 0) {
+				t.Errorf("Output %s of task %s is a placeholder: %t, want %t", oip.Path(), tt.task.Name, f.IsPlaceholder(oip.Path()), tt.wantRuns == 0)
+			}
+		}
+	}
+
+	// Components mark their per-target outputs of failed branches, and skip
+	// the placeholders
+	f.MarkPlaceholder("res/drd1.calibration.svg")
+	skipTests := []struct {
+		path string
+		want bool
+	}{
+		{"res/drd1.calibration.svg", true},
+		{"cpsign_validate_drd1.model", true},
+		{"cpsign_train_htr2b.model", false},
+	}
+	for _, tt := range skipTests {
+		if got := f.SkipIP("create_report", sp.NewFileIP(tt.path)); got != tt.want {
+			t.Errorf("SkipIP(%q) = %t, want %t", tt.path, got, tt.want)
+		}
+	}
+
+	// SciPipe moves the placeholders in place, with audit logs
+	placeholderPaths := []string{"cpsign_train_drd1.model", "cpsign_train_drd1.log", "cpsign_validate_drd1.model", "cpsign_validate_drd1.log", "summarize.model", "summarize.log"}
+	for _, path := range placeholderPaths {
+		sp.NewFileIP(path).Atomize()
+		if err := ioutil.WriteFile(path+".audit.json", []byte("{}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sp.NewFileIP("cpsign_train_htr2b.model").Atomize()
+	f.RemovePlaceholders()
+	for _, path := range placeholderPaths {
+		for _, p := range []string{path, path + ".audit.json"} {
+			if _, err := os.Stat(p); !os.IsNotExist(err) {
+				t.Errorf("Placeholder %s not removed", p)
+			}
+		}
+	}
+	if _, err := os.Stat("cpsign_train_htr2b.model"); err != nil {
+		t.Errorf("Output of a successful task removed: %s", err)
+	}
+
+	f.WriteReport("res/failure_report.txt")
+	report, err := ioutil.ReadFile("res/failure_report.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantReport := "\n" +
+		"Failed targets: 1 of 2\n" +
+		"\n" +
+		"DRD1\n" +
+		"  Task cpsign_train_drd1 failed after 2 attempt(s): Command failed!\n" +
+		"    log/failures/cpsign_train_drd1.attempt1.log\n" +
+		"    cpsign_train_drd1.log.attempt1.failed\n" +
+		"    log/failures/cpsign_train_drd1.attempt2.log\n" +
+		"    cpsign_train_drd1.log.attempt2.failed\n" +
+		"  Tasks skipped after the failure: 1\n" +
+		"\n" +
+		"Tasks outside the target branches skipped after the failures: 1\n" +
+		"\n" +
+		"The outputs of these processes leave out the failed targets, and need to be removed to include them in a later run:\n" +
+		"  create_report (2 inputs left out)\n"
+	// The first line has the time of the report
+	if got := string(report[str.Index(string(report), "\n")+1:]); got != wantReport {
+		t.Errorf("Failure report:\n%s\nwant:\n%s", got, wantReport)
+	}
+}
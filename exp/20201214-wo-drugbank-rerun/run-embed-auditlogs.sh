@@ -9,4 +9,4 @@
 #SBATCH --mail-type BEGIN,FAIL,END
 module load java/sun_jdk1.8.0_92
 module load R/3.4.0
-go run wo_drugbank_wf.go components.go -threads 1 -maxtasks 2 -geneset "bowes44min100percls" -procs "embed_audit.*" # -debug
+go run . -threads 1 -maxtasks 2 -geneset "bowes44min100percls" -procs "embed_audit.*" # -debug
@@ -9,4 +9,4 @@
 #SBATCH --mail-type BEGIN,FAIL,END
 module load java/sun_jdk1.8.0_92
 module load R/3.4.0
-go run wo_drugbank_wf.go components.go -threads 1 -maxtasks 1 -geneset "bowes44min100percls" -procs "validate_drugbank.*" &> log/scipipe-$(date +%Y%m%d-%H%M%S).log # -debug
\ No newline at end of file
+go run . -threads 1 -maxtasks 1 -geneset "bowes44min100percls" -procs "validate_drugbank.*" &> log/scipipe-$(date +%Y%m%d-%H%M%S).log # -debug
\ No newline at end of file
@@ -1,2 +1,2 @@
 #!/bin/bash -l
-go run wo_drugbank_wf.go components.go -threads 2 -maxtasks 16 -geneset "bowes44min100percls" -procs "validate_drugbank_.*" &> log/scipipe-$(date +%Y%m%d-%H%M%S).log # -debug
\ No newline at end of file
+go run . -threads 2 -maxtasks 16 -geneset "bowes44min100percls" -procs "create_report" &> log/scipipe-$(date +%Y%m%d-%H%M%S).log # -debug
\ No newline at end of file
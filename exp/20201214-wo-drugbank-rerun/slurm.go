@@ -0,0 +1,545 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	str "strings"
+	"sync"
+	"time"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// SLURM executor
+// ================================================================================
+
+// SlurmConfig configures how SlurmExecutor submits jobs. Time limits are
+// given per kind of process (such as "crossval" or "train"), with the
+// "default" time limit used for kinds not listed. The sbatch, squeue and
+// sacct commands can be replaced, for example by the fake ones in
+// bin/fakeslurm, to test the executor without a cluster.
+type SlurmConfig struct {
+	Account      string            `json:"account"`
+	Partition    string            `json:"partition"`
+	Cores        int               `json:"cores"`
+	TimeLimits   map[string]string `json:"time_limits"`
+	ExtraArgs    []string          `json:"extra_args"`
+	UseArrays    bool              `json:"use_arrays"`
+	ArrayWindow  string            `json:"array_window"`
+	PollInterval string            `json:"poll_interval"`
+	LogDir       string            `json:"log_dir"`
+	Sbatch       string            `json:"sbatch"`
+	Squeue       string            `json:"squeue"`
+	Sacct        string            `json:"sacct"`
+}
+
+// defaultSlurmConfig returns the settings previously hard-coded in the salloc
+// strings of the workflow
+func defaultSlurmConfig() *SlurmConfig {
+	return &SlurmConfig{
+		Account: "snic2017-7-89",
+		Cores:   4,
+		TimeLimits: map[string]string{
+			"default":       "1-00:00:00",
+			"extract":       "1:00:00",
+			"precompute":    "1-00:00:00",
+			"crossval":      "1-00:00:00",
+			"learningcurve": "1-00:00:00",
+			"train":         "1-00:00:00",
+		},
+		ArrayWindow:  "10s",
+		PollInterval: "30s",
+		LogDir:       "log/slurm",
+		Sbatch:       "sbatch",
+		Squeue:       "squeue",
+		Sacct:        "sacct",
+	}
+}
+
+// readSlurmConfig reads a SlurmConfig from a JSON file, with the settings not
+// in the file taken from defaultSlurmConfig. With an empty path, the defaults
+// are returned.
+func readSlurmConfig(path string) *SlurmConfig {
+	cfg := defaultSlurmConfig()
+	if path == "" {
+		return cfg
+	}
+	defaultTimeLimits := cfg.TimeLimits
+	data, err := ioutil.ReadFile(path)
+	sp.CheckWithMsg(err, "Could not read SLURM config file: "+path)
+	sp.CheckWithMsg(json.Unmarshal(data, cfg), "Could not parse SLURM config file: "+path)
+	for kind, timeLimit := range defaultTimeLimits {
+		if _, ok := cfg.TimeLimits[kind]; !ok {
+			cfg.TimeLimits[kind] = timeLimit
+		}
+	}
+	return cfg
+}
+
+// SlurmExecutor runs the tasks of processes as SLURM jobs, submitted with
+// sbatch. Tasks of processes applied with an array key are submitted together
+// as a job array, once the expected number of tasks for the key have arrived,
+// or when ArrayWindow has passed since the first one did. The state of all
+// jobs is polled with a single squeue call per poll interval, and the final
+// state of finished jobs is looked up with sacct. If a job does not complete,
+// or does not produce its outputs, the task fails with the end of the job log.
+type SlurmExecutor struct {
+	Config       *SlurmConfig
+	pollInterval time.Duration
+	arrayWindow  time.Duration
+	mu           sync.Mutex
+	waiting      map[string]chan string // Final state per job ID
+	arrays       map[string]*slurmArray
+	pollerOnce   sync.Once
+}
+
+// slurmArray collects the commands of tasks to submit as one job array
+type slurmArray struct {
+	jobName   string
+	kind      string
+	size      int
+	cmds      []string
+	submitted bool
+	baseID    string
+	err       error // Of submitting the array, for all its tasks
+	done      chan struct{}
+}
+
+func NewSlurmExecutor(cfg *SlurmConfig) *SlurmExecutor {
+	pollInterval, err := time.ParseDuration(cfg.PollInterval)
+	sp.CheckWithMsg(err, "Could not parse SLURM poll interval: "+cfg.PollInterval)
+	arrayWindow, err := time.ParseDuration(cfg.ArrayWindow)
+	sp.CheckWithMsg(err, "Could not parse SLURM array window: "+cfg.ArrayWindow)
+	sp.CheckWithMsg(os.MkdirAll(cfg.LogDir, 0755), "Could not create SLURM log directory: "+cfg.LogDir)
+	return &SlurmExecutor{
+		Config:       cfg,
+		pollInterval: pollInterval,
+		arrayWindow:  arrayWindow,
+		waiting:      map[string]chan string{},
+		arrays:       map[string]*slurmArray{},
+	}
+}
+
+// Apply makes the tasks of p run as SLURM jobs, with the time limit for kind.
+// If arrays are enabled in the config, tasks with the same arrayKey are
+// submitted as one job array of (up to) arraySize jobs. An empty arrayKey, or
+// an arraySize of 1, submits each task as a separate job.
+func (e *SlurmExecutor) Apply(p *sp.Process, kind string, arrayKey string, arraySize int) {
+	setTaskExecFunc(p, func(t *sp.Task) error {
+		var jobID, logPath string
+		var err error
+		if e.Config.UseArrays && arrayKey != "" && arraySize > 1 {
+			jobID, logPath, err = e.submitToArray(arrayKey, kind, arraySize, t.Command)
+		} else {
+			jobID, logPath, err = e.submit(t.Name, kind, []string{t.Command}, false)
+		}
+		if err != nil {
+			return err
+		}
+		sp.Audit.Printf("| %-32s | Submitted SLURM job %s (log: %s)\n", t.Name, jobID, logPath)
+
+		state := e.wait(jobID)
+		metricsLog.reportUsage(t, e.jobUsage(jobID))
+		if state != "COMPLETED" {
+			return fmt.Errorf("SLURM job %s ended with state %s. End of log %s:\n%s", jobID, state, logPath, logTail(logPath, 40))
+		}
+		for _, oip := range t.OutIPs {
+			if _, err := os.Stat(oip.TempPath()); err != nil {
+				return fmt.Errorf("SLURM job %s completed, but did not produce %s. End of log %s:\n%s", jobID, oip.TempPath(), logPath, logTail(logPath, 40))
+			}
+		}
+		sp.Audit.Printf("| %-32s | SLURM job %s completed\n", t.Name, jobID)
+		return nil
+	})
+}
+
+// submit submits cmds as a job, or as a job array if array is true, and
+// returns the job ID, and the log path (for arrays, of the first job). Errors
+// are returned rather than stopping the workflow, so that failed submissions
+// can be retried, or skipped with -continue, like failed jobs.
+func (e *SlurmExecutor) submit(jobName string, kind string, cmds []string, array bool) (jobID string, logPath string, err error) {
+	for i, cmd := range cmds {
+		cmdPath := fmt.Sprintf("%s/%s.%d.sh", e.Config.LogDir, jobName, i)
+		if err := ioutil.WriteFile(cmdPath, []byte("#!/bin/bash\n"+cmd+"\n"), 0755); err != nil {
+			return "", "", fmt.Errorf("Could not write SLURM job command %s: %s", cmdPath, err)
+		}
+	}
+	scriptPath := e.Config.LogDir + "/" + jobName + ".sbatch.sh"
+	script := fmt.Sprintf("#!/bin/bash\nbash %s/%s.${SLURM_ARRAY_TASK_ID:-0}.sh\n", e.Config.LogDir, jobName)
+	if err := ioutil.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		return "", "", fmt.Errorf("Could not write SLURM job script %s: %s", scriptPath, err)
+	}
+
+	timeLimit, ok := e.Config.TimeLimits[kind]
+	if !ok {
+		timeLimit = e.Config.TimeLimits["default"]
+	}
+	outPattern := e.Config.LogDir + "/" + jobName + ".%j.out"
+	if array {
+		outPattern = e.Config.LogDir + "/" + jobName + ".%A_%a.out"
+	}
+	args := []string{
+		"--parsable",
+		"--job-name=" + jobName,
+		"--account=" + e.Config.Account,
+		"--ntasks=1",
+		fmt.Sprintf("--cpus-per-task=%d", e.Config.Cores),
+		"--time=" + timeLimit,
+		"--output=" + outPattern,
+	}
+	if e.Config.Partition != "" {
+		args = append(args, "--partition="+e.Config.Partition)
+	}
+	if array {
+		args = append(args, fmt.Sprintf("--array=0-%d", len(cmds)-1))
+	}
+	args = append(args, e.Config.ExtraArgs...)
+	args = append(args, scriptPath)
+
+	out, err := runCmdCombinedOutput(e.Config.Sbatch, args...)
+	if err != nil {
+		return "", "", fmt.Errorf("Could not submit SLURM job %s (%s): %s", jobName, err, out)
+	}
+	jobID, ok = parseSbatchJobID(out)
+	if !ok {
+		return "", "", fmt.Errorf("Could not parse job ID from sbatch output for SLURM job %s: %s", jobName, out)
+	}
+	if array {
+		return jobID, slurmLogPath(outPattern, jobID, "0"), nil
+	}
+	return jobID, slurmLogPath(outPattern, jobID, ""), nil
+}
+
+// submitToArray adds cmd to the job array for arrayKey, and returns the job
+// ID and log path of its job in the array, once the array is submitted, or
+// the error of submitting the array
+func (e *SlurmExecutor) submitToArray(arrayKey string, kind string, size int, cmd string) (jobID string, logPath string, err error) {
+	e.mu.Lock()
+	arr, ok := e.arrays[arrayKey]
+	if !ok {
+		arr = &slurmArray{jobName: arrayKey, kind: kind, size: size, done: make(chan struct{})}
+		e.arrays[arrayKey] = arr
+		// Submit what we have after the window, as the rest of the tasks
+		// might be waiting for free task slots in the workflow
+		time.AfterFunc(e.arrayWindow, func() { e.flushArray(arrayKey, arr) })
+	}
+	idx := len(arr.cmds)
+	arr.cmds = append(arr.cmds, cmd)
+	if len(arr.cmds) >= arr.size {
+		e.submitArray(arrayKey, arr)
+	}
+	e.mu.Unlock()
+
+	<-arr.done
+	if arr.err != nil {
+		return "", "", arr.err
+	}
+	idxStr := fmt.Sprintf("%d", idx)
+	return arr.baseID + "_" + idxStr, slurmLogPath(e.Config.LogDir+"/"+arr.jobName+".%A_%a.out", arr.baseID, idxStr), nil
+}
+
+func (e *SlurmExecutor) flushArray(arrayKey string, arr *slurmArray) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.submitArray(arrayKey, arr)
+}
+
+// submitArray submits an array, unless already submitted. It must be called
+// with e.mu locked.
+func (e *SlurmExecutor) submitArray(arrayKey string, arr *slurmArray) {
+	if arr.submitted {
+		return
+	}
+	arr.submitted = true
+	if e.arrays[arrayKey] == arr {
+		delete(e.arrays, arrayKey) // Tasks arriving later go into a new array
+	}
+	jobName := arr.jobName
+	if arr.size > len(arr.cmds) || e.arraySubmittedBefore(jobName) {
+		jobName = fmt.Sprintf("%s_%d", arr.jobName, time.Now().UnixNano())
+		arr.jobName = jobName
+	}
+	arr.baseID, _, arr.err = e.submit(jobName, arr.kind, arr.cmds, true)
+	close(arr.done)
+}
+
+// arraySubmittedBefore tells whether a job script for jobName already exists
+// in the log directory, so that a new array needs a unique name
+func (e *SlurmExecutor) arraySubmittedBefore(jobName string) bool {
+	_, err := os.Stat(e.Config.LogDir + "/" + jobName + ".sbatch.sh")
+	return err == nil
+}
+
+// wait waits for the job with jobID to finish, and returns its final state
+func (e *SlurmExecutor) wait(jobID string) string {
+	stateChan := make(chan string, 1)
+	e.mu.Lock()
+	e.waiting[jobID] = stateChan
+	e.mu.Unlock()
+	e.pollerOnce.Do(func() { go e.poll() })
+	return <-stateChan
+}
+
+// poll polls the state of the jobs waited for, and sends the final state of
+// finished jobs to their waiters
+func (e *SlurmExecutor) poll() {
+	for {
+		time.Sleep(e.pollInterval)
+		e.mu.Lock()
+		jobIDs := []string{}
+		for jobID := range e.waiting {
+			jobIDs = append(jobIDs, jobID)
+		}
+		e.mu.Unlock()
+		if len(jobIDs) == 0 {
+			continue
+		}
+		sort.Strings(jobIDs)
+
+		baseIDs := uniqSlurmBaseIDs(jobIDs)
+		active, pendingBases := e.queuedJobs(baseIDs)
+		finished := []string{}
+		for _, jobID := range jobIDs {
+			if !active[jobID] && !pendingBases[slurmBaseID(jobID)] {
+				finished = append(finished, jobID)
+			}
+		}
+		if len(finished) == 0 {
+			continue
+		}
+		states := e.finalStates(uniqSlurmBaseIDs(finished))
+		e.mu.Lock()
+		for _, jobID := range finished {
+			state, ok := states[jobID]
+			if !ok {
+				continue // Not yet in the accounting database, so check again later
+			}
+			e.waiting[jobID] <- state
+			delete(e.waiting, jobID)
+		}
+		e.mu.Unlock()
+	}
+}
+
+// queuedJobs returns the IDs of jobs in the queue, and the base IDs of job
+// arrays with jobs still pending, which squeue lists as one line per array,
+// such as "1234_[3-9]"
+func (e *SlurmExecutor) queuedJobs(baseIDs []string) (active map[string]bool, pendingBases map[string]bool) {
+	active, pendingBases = map[string]bool{}, map[string]bool{}
+	out, err := runCmdCombinedOutput(e.Config.Squeue, "-h", "-o", "%i %T", "-j", str.Join(baseIDs, ","))
+	if err != nil {
+		// squeue fails when none of the jobs are known to it anymore, so
+		// leave it to sacct to find out what happened to them
+		sp.Debug.Printf("squeue failed (%s): %s\n", err, out)
+		return active, pendingBases
+	}
+	return parseSqueueJobs(out)
+}
+
+// finalStates returns the states of the jobs with baseIDs (and of the jobs in
+// arrays with those base IDs) from sacct
+func (e *SlurmExecutor) finalStates(baseIDs []string) map[string]string {
+	out, err := runCmdCombinedOutput(e.Config.Sacct, "-n", "-X", "-P", "-o", "JobID,State", "-j", str.Join(baseIDs, ","))
+	if err != nil {
+		sp.Warning.Printf("sacct failed (%s), will try again: %s\n", err, out)
+		return map[string]string{}
+	}
+	return parseSacctFinalStates(out)
+}
+
+// jobUsage returns the CPU time, peak memory, node and exit status of a
+// finished job, from sacct, as far as they are accounted
+func (e *SlurmExecutor) jobUsage(jobID string) *taskUsage {
+	out, err := runCmdCombinedOutput(e.Config.Sacct, "-n", "-P", "-o", "JobID,TotalCPU,MaxRSS,NodeList,ExitCode", "-j", jobID)
+	if err != nil {
+		sp.Warning.Printf("sacct failed (%s), so no usage is logged for SLURM job %s: %s\n", err, jobID, out)
+		return &taskUsage{executor: "slurm", jobID: jobID, exitStatus: -1}
+	}
+	return parseSacctUsage(out, jobID)
+}
+
+// ================================================================================
+// Helpers
+// ================================================================================
+
+// parseSbatchJobID parses the job ID from the output of sbatch --parsable,
+// which is "jobid" or "jobid;cluster"
+func parseSbatchJobID(out string) (string, bool) {
+	jobID := str.TrimSpace(str.SplitN(str.TrimSpace(out), ";", 2)[0])
+	if _, err := strconv.Atoi(jobID); err != nil {
+		return "", false
+	}
+	return jobID, true
+}
+
+// parseSqueueJobs parses the output of squeue -h -o "%i %T" into the IDs of
+// the jobs in the queue, and the base IDs of job arrays with jobs still
+// pending, which squeue lists as one line per array, such as "1234_[3-9]"
+func parseSqueueJobs(out string) (active map[string]bool, pendingBases map[string]bool) {
+	active, pendingBases = map[string]bool{}, map[string]bool{}
+	for _, line := range str.Split(out, "\n") {
+		fields := str.Fields(line)
+		if len(fields) < 1 {
+			continue
+		}
+		if str.Contains(fields[0], "[") {
+			pendingBases[slurmBaseID(fields[0])] = true
+			continue
+		}
+		active[fields[0]] = true
+	}
+	return active, pendingBases
+}
+
+// parseSacctFinalStates parses the output of sacct -n -X -P -o JobID,State
+// into the states of the jobs that have finished
+func parseSacctFinalStates(out string) map[string]string {
+	states := map[string]string{}
+	for _, line := range str.Split(out, "\n") {
+		fields := str.Split(str.TrimSpace(line), "|")
+		if len(fields) < 2 || fields[1] == "" {
+			continue
+		}
+		// States can have a suffix, as in "CANCELLED by 1234"
+		state := str.Fields(fields[1])[0]
+		if state == "PENDING" || state == "RUNNING" || state == "REQUEUED" || state == "COMPLETING" {
+			continue
+		}
+		states[fields[0]] = state
+	}
+	return states
+}
+
+// parseSacctUsage parses the output of sacct -n -P -o
+// JobID,TotalCPU,MaxRSS,NodeList,ExitCode into the usage of the job with
+// jobID, with the largest CPU time and memory use of the job and its steps
+func parseSacctUsage(out string, jobID string) *taskUsage {
+	usage := &taskUsage{executor: "slurm", jobID: jobID, exitStatus: -1}
+	for _, line := range str.Split(out, "\n") {
+		fields := str.Split(str.TrimSpace(line), "|")
+		// Steps of the job, such as "1234.batch", have the memory use
+		if len(fields) < 5 || (fields[0] != jobID && !str.HasPrefix(fields[0], jobID+".")) {
+			continue
+		}
+		if cpuSec, ok := parseSlurmDuration(fields[1]); ok && (usage.cpuSec == nil || cpuSec > *usage.cpuSec) {
+			usage.cpuSec = &cpuSec
+		}
+		if rssMB, ok := parseSlurmMemMB(fields[2]); ok && (usage.peakRSSMB == nil || rssMB > *usage.peakRSSMB) {
+			usage.peakRSSMB = &rssMB
+		}
+		if fields[0] == jobID {
+			usage.host = fields[3]
+			// The exit code is given as "exitcode:signal"
+			if code, err := strconv.Atoi(str.SplitN(fields[4], ":", 2)[0]); err == nil {
+				usage.exitStatus = code
+			}
+		}
+	}
+	return usage
+}
+
+// parseSlurmDuration parses a duration from sacct, such as "1-02:03:04",
+// "02:03:04", "03:04.567", in seconds
+func parseSlurmDuration(s string) (float64, bool) {
+	days := 0.0
+	if parts := str.SplitN(s, "-", 2); len(parts) == 2 {
+		d, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil {
+			return 0, false
+		}
+		days, s = d, parts[1]
+	}
+	secs := 0.0
+	for _, part := range str.Split(s, ":") {
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return 0, false
+		}
+		secs = secs*60 + v
+	}
+	return days*86400 + secs, true
+}
+
+// parseSlurmMemMB parses a memory size from sacct, such as "123456K" or
+// "1.5G", in MB
+func parseSlurmMemMB(s string) (float64, bool) {
+	if s == "" {
+		return 0, false
+	}
+	factor := 1.0 / 1024 / 1024 // Bytes, without a suffix
+	switch s[len(s)-1] {
+	case 'K':
+		factor = 1.0 / 1024
+	case 'M':
+		factor = 1
+	case 'G':
+		factor = 1024
+	case 'T':
+		factor = 1024 * 1024
+	}
+	if factor != 1.0/1024/1024 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * factor, true
+}
+
+// runCmdCombinedOutput runs a command, and returns its stdout and stderr
+// together
+func runCmdCombinedOutput(name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	var outBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &outBuf
+	err := cmd.Run()
+	return outBuf.String(), err
+}
+
+// slurmBaseID returns the job ID of the array that a job belongs to, or the
+// job ID itself for jobs not in an array
+func slurmBaseID(jobID string) string {
+	return str.SplitN(jobID, "_", 2)[0]
+}
+
+func uniqSlurmBaseIDs(jobIDs []string) []string {
+	seen := map[string]bool{}
+	baseIDs := []string{}
+	for _, jobID := range jobIDs {
+		baseID := slurmBaseID(jobID)
+		if !seen[baseID] {
+			seen[baseID] = true
+			baseIDs = append(baseIDs, baseID)
+		}
+	}
+	return baseIDs
+}
+
+// slurmLogPath fills in the job ID (%j, %A) and array index (%a) in a SLURM
+// output file pattern
+func slurmLogPath(pattern string, jobID string, arrayIdx string) string {
+	return str.NewReplacer("%j", jobID, "%A", jobID, "%a", arrayIdx).Replace(pattern)
+}
+
+// logTail returns the last n lines of the file at path
+func logTail(path string, n int) string {
+	data, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return "(Could not read log: " + err.Error() + ")"
+	}
+	lines := str.Split(str.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return str.Join(lines, "\n")
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestParseSbatchJobID(t *testing.T) {
+	tests := []struct {
+		out    string
+		wantID string
+		wantOK bool
+	}{
+		{"1234\n", "1234", true},
+		{"1234;rackham\n", "1234", true},
+		{"  1234 ", "1234", true},
+		{"", "", false},
+		{"sbatch: error: Batch job submission failed: Invalid account\n", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := parseSbatchJobID(tt.out)
+		if id != tt.wantID || ok != tt.wantOK {
+			t.Errorf("parseSbatchJobID(%q) = %q, %t, want %q, %t", tt.out, id, ok, tt.wantID, tt.wantOK)
+		}
+	}
+}
+
+func TestParseSqueueJobs(t *testing.T) {
+	tests := []struct {
+		name             string
+		out              string
+		wantActive       map[string]bool
+		wantPendingBases map[string]bool
+	}{
+		{"empty queue", "", map[string]bool{}, map[string]bool{}},
+		{"single jobs", "1234 RUNNING\n1235 PENDING\n", map[string]bool{"1234": true, "1235": true}, map[string]bool{}},
+		{"array with pending jobs", "1240_0 RUNNING\n1240_1 RUNNING\n1240_[2-9] PENDING\n", map[string]bool{"1240_0": true, "1240_1": true}, map[string]bool{"1240": true}},
+		{"array with throttled jobs", "1250_[0-9%4] PENDING\n\n", map[string]bool{}, map[string]bool{"1250": true}},
+	}
+	for _, tt := range tests {
+		active, pendingBases := parseSqueueJobs(tt.out)
+		if !reflect.DeepEqual(active, tt.wantActive) || !reflect.DeepEqual(pendingBases, tt.wantPendingBases) {
+			t.Errorf("%s: parseSqueueJobs() = %v, %v, want %v, %v", tt.name, active, pendingBases, tt.wantActive, tt.wantPendingBases)
+		}
+	}
+}
+
+func TestParseSacctFinalStates(t *testing.T) {
+	out := "1234|COMPLETED\n" +
+		"1235|FAILED\n" +
+		"1236|CANCELLED by 5678\n" +
+		"1237|RUNNING\n" +
+		"1238|PENDING\n" +
+		"1239|COMPLETING\n" +
+		"1240_0|TIMEOUT\n" +
+		"1240_1|OUT_OF_MEMORY\n" +
+		"1240_[2-3]|PENDING\n" +
+		"1241|\n" +
+		"garbage\n"
+	want := map[string]string{
+		"1234":   "COMPLETED",
+		"1235":   "FAILED",
+		"1236":   "CANCELLED",
+		"1240_0": "TIMEOUT",
+		"1240_1": "OUT_OF_MEMORY",
+	}
+	if got := parseSacctFinalStates(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSacctFinalStates() = %v, want %v", got, want)
+	}
+}
+
+func TestParseSacctUsage(t *testing.T) {
+	out := "1234|01:02:03|||0:0\n" +
+		"1234.batch|01:02:03|2048000K|r101|0:0\n" +
+		"1234.extern|00:00:01|1024K|r101|0:0\n" +
+		"12345|99:00:00|9G|r102|1:0\n"
+	usage := parseSacctUsage(out, "1234")
+	if usage.cpuSec == nil || *usage.cpuSec != 3723 {
+		t.Errorf("CPU time = %v, want 3723 s", usage.cpuSec)
+	}
+	if usage.peakRSSMB == nil || *usage.peakRSSMB != 2000 {
+		t.Errorf("Peak RSS = %v, want 2000 MB", usage.peakRSSMB)
+	}
+	if usage.exitStatus != 0 {
+		t.Errorf("Exit status = %d, want 0", usage.exitStatus)
+	}
+
+	usage = parseSacctUsage("1240_1|00:10.500|1.5G|r103|137:9\n", "1240_1")
+	if usage.cpuSec == nil || *usage.cpuSec != 10.5 || usage.peakRSSMB == nil || *usage.peakRSSMB != 1536 {
+		t.Errorf("Usage of array job = %v s, %v MB, want 10.5 s, 1536 MB", usage.cpuSec, usage.peakRSSMB)
+	}
+	if usage.host != "r103" || usage.exitStatus != 137 {
+		t.Errorf("Array job ran on %q with exit status %d, want r103 and 137", usage.host, usage.exitStatus)
+	}
+
+	usage = parseSacctUsage("", "1234")
+	if usage.cpuSec != nil || usage.peakRSSMB != nil || usage.exitStatus != -1 {
+		t.Errorf("Usage of unaccounted job = %+v, want no usage and exit status -1", usage)
+	}
+}
+
+func TestParseSlurmDuration(t *testing.T) {
+	tests := []struct {
+		s      string
+		want   float64
+		wantOK bool
+	}{
+		{"1-02:03:04", 93784, true},
+		{"02:03:04", 7384, true},
+		{"03:04.567", 184.567, true},
+		{"00:00:00", 0, true},
+		{"", 0, false},
+		{"INVALID", 0, false},
+		{"x-01:00:00", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseSlurmDuration(tt.s)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("parseSlurmDuration(%q) = %v, %t, want %v, %t", tt.s, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestParseSlurmMemMB(t *testing.T) {
+	tests := []struct {
+		s      string
+		want   float64
+		wantOK bool
+	}{
+		{"123456K", 120.5625, true},
+		{"512M", 512, true},
+		{"1.5G", 1536, true},
+		{"2T", 2 * 1024 * 1024, true},
+		{"1048576", 1, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"K", 0, false},
+		{"12Q", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseSlurmMemMB(tt.s)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("parseSlurmMemMB(%q) = %v, %t, want %v, %t", tt.s, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+// TestSlurmSubmitFailure checks that a failed sbatch gives an error, for
+// single jobs and all the tasks of an array, instead of stopping the workflow
+func TestSlurmSubmitFailure(t *testing.T) {
+	logDir, err := ioutil.TempDir("", "slurm_submit_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(logDir)
+	cfg := defaultSlurmConfig()
+	cfg.LogDir = logDir
+	cfg.Sbatch = "false"
+	cfg.UseArrays = true
+	cfg.ArrayWindow = "1h"
+	e := NewSlurmExecutor(cfg)
+
+	if _, _, err := e.submit("train_DRD2", "train", []string{"echo hello"}, false); err == nil {
+		t.Errorf("submit() with a failing sbatch gave no error")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, 3)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, _, errs[i] = e.submitToArray("crossval_DRD2", "crossval", len(errs), "echo hello")
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			t.Errorf("submitToArray() with a failing sbatch gave no error for task %d", i)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	str "strings"
+
+	ptpc "github.com/pharmbio/ptp-project/lib/components"
+	sp "github.com/scipipe/scipipe"
+)
+
+// Columns of ExCAPE-DB (0-based), in addition to those in dbstats.go
+const (
+	excapeColTaxID         = 7
+	excapeColOrthologGroup = 9
+)
+
+const taxIDHuman = "9606"
+
+// speciesTaxIDs are the species in ExCAPE-DB, by name
+var speciesTaxIDs = map[string]string{
+	"human": taxIDHuman,
+	"rat":   "10116",
+	"mouse": "10090",
+}
+
+// speciesName returns the name of a species, by its tax ID, or "tax<ID>" for
+// species not in speciesTaxIDs
+func speciesName(taxID string) string {
+	for name, id := range speciesTaxIDs {
+		if id == taxID {
+			return name
+		}
+	}
+	return "tax" + taxID
+}
+
+// lessSpecies orders species with human first, and the others by tax ID
+func lessSpecies(a string, b string) bool {
+	if (a == taxIDHuman) != (b == taxIDHuman) {
+		return a == taxIDHuman
+	}
+	ai, aErr := strconv.Atoi(a)
+	bi, bErr := strconv.Atoi(b)
+	if aErr == nil && bErr == nil {
+		return ai < bi
+	}
+	return a < b
+}
+
+// parseSpecies parses a comma-separated list of species, by name or tax ID,
+// into tax IDs. "all" gives nil, meaning all species.
+func parseSpecies(speciesStr string) []string {
+	if str.TrimSpace(speciesStr) == "all" {
+		return nil
+	}
+	taxIDs := []string{}
+	for _, s := range str.Split(speciesStr, ",") {
+		s = str.ToLower(str.TrimSpace(s))
+		if id, ok := speciesTaxIDs[s]; ok {
+			s = id
+		}
+		if _, err := strconv.Atoi(s); err != nil {
+			sp.Failf("Unknown species %s (use human, rat, mouse, a tax ID, or all)\n", s)
+		}
+		if !strInSlice(s, taxIDs) {
+			taxIDs = append(taxIDs, s)
+		}
+	}
+	sort.Slice(taxIDs, func(i, j int) bool { return lessSpecies(taxIDs[i], taxIDs[j]) })
+	return taxIDs
+}
+
+// parseSpeciesWeights parses comma-separated species:weight pairs, such as
+// "rat:0.5,mouse:0.25", into weights by tax ID
+func parseSpeciesWeights(weightsStr string) map[string]float64 {
+	weights := map[string]float64{}
+	if str.TrimSpace(weightsStr) == "" {
+		return weights
+	}
+	for _, pair := range str.Split(weightsStr, ",") {
+		parts := str.SplitN(str.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			sp.Failf("Species weights should be given as species:weight, but got: %s\n", pair)
+		}
+		taxIDs := parseSpecies(parts[0])
+		if len(taxIDs) != 1 {
+			sp.Failf("Species weights should be given for one species at a time, but got: %s\n", pair)
+		}
+		weight, err := strconv.ParseFloat(parts[1], 64)
+		if err != nil || weight < 0 || weight > 1 {
+			sp.Failf("Species weights should be between 0 and 1, but got: %s\n", pair)
+		}
+		weights[taxIDs[0]] = weight
+	}
+	return weights
+}
+
+// speciesWeightsString lists the weights, sorted by tax ID, for the audit
+// logs and cache keys of the selection process. No weights give "none", as
+// SciPipe does not accept empty parameter values.
+func speciesWeightsString(weights map[string]float64) string {
+	if len(weights) == 0 {
+		return "none"
+	}
+	taxIDs := []string{}
+	for taxID := range weights {
+		taxIDs = append(taxIDs, taxID)
+	}
+	sort.Slice(taxIDs, func(i, j int) bool { return lessSpecies(taxIDs[i], taxIDs[j]) })
+	parts := []string{}
+	for _, taxID := range taxIDs {
+		parts = append(parts, speciesName(taxID)+":"+ptpc.FmtFloat(weights[taxID]))
+	}
+	return str.Join(parts, ",")
+}
+
+// ================================================================================
+// Species selection
+// ================================================================================
+
+// SelectSpecies is a SciPipe process selecting the rows of ExCAPE-DB to train
+// on by species, as ExCAPE-DB gives orthologs (such as the rat and mouse
+// versions of a human target) the same Gene_Symbol, so that selecting on the
+// symbol alone mixes the data of all species.
+//
+// Rows of the Species (tax IDs, or all if empty) are kept. With Orthologs,
+// rows of other species are also kept if their Ortholog_Group has one human
+// gene, with the symbol of that gene, so that they end up in the data of the
+// human target even if their own symbol differs. Rows of non-human species
+// are then kept with the probability given by their Weight, if any, decided
+// by a hash of their structure, so that the same structures are kept in every
+// run, to down-weight species less relevant to the human target. The output
+// has the same columns as ExCAPE-DB. A report per gene and species tells how
+// many rows were kept, and why others were dropped.
+type SelectSpecies struct {
+	*sp.Process
+	Species   []string
+	Orthologs bool
+	Weights   map[string]float64
+}
+
+func (p *SelectSpecies) InExcapeDB() *sp.InPort   { return p.In("excapedb") }
+func (p *SelectSpecies) OutExcapeDB() *sp.OutPort { return p.Out("selected") }
+func (p *SelectSpecies) OutReport() *sp.OutPort   { return p.Out("report") }
+
+func NewSelectSpecies(wf *sp.Workflow, procName string, reportFileName string, species []string, orthologs bool, weights map[string]float64) *SelectSpecies {
+	p := &SelectSpecies{
+		Process:   wf.NewProc(procName, "# SelectSpecies custom process. Ports: {i:excapedb} {o:selected} {o:report} species:{p:species} orthologs:{p:orthologs} weights:{p:weights}"),
+		Species:   species,
+		Orthologs: orthologs,
+		Weights:   weights,
+	}
+	speciesStr := "all"
+	if len(species) > 0 {
+		speciesStr = str.Join(species, ",")
+	}
+	p.ParamInPort("species").ConnectStr(speciesStr)
+	p.ParamInPort("orthologs").ConnectStr(fmt.Sprintf("%t", orthologs))
+	p.ParamInPort("weights").ConnectStr(speciesWeightsString(weights))
+	p.SetPathStatic("selected", "dat/excapedb."+p.selectionTag()+".tsv")
+	p.SetPathStatic("report", reportFileName)
+	p.CustomExecute = p.execute
+	return p
+}
+
+// selectionTag names the selection in the path of the output, such as
+// "human_orthologs_weighted"
+func (p *SelectSpecies) selectionTag() string {
+	names := []string{}
+	for _, taxID := range p.Species {
+		names = append(names, speciesName(taxID))
+	}
+	if len(names) == 0 {
+		names = append(names, "allspecies")
+	}
+	tag := str.Join(names, "-")
+	if p.Orthologs {
+		tag += "_orthologs"
+	}
+	if len(p.Weights) > 0 {
+		tag += "_weighted"
+	}
+	return tag
+}
+
+// speciesSelectionCounts holds the counts of the selection report, for one
+// gene and species
+type speciesSelectionCounts struct {
+	rows, kept, fromOrthologs, droppedBySpecies, droppedByWeight int
+}
+
+func (p *SelectSpecies) execute(t *sp.Task) {
+	inPath := t.InPath("excapedb")
+	humanGenesOf := map[string][]string{}
+	if p.Orthologs {
+		humanGenesOf = readHumanOrthologGenes(inPath)
+		sp.Audit.Printf("| %-32s | Read the human genes of %d ortholog groups\n", t.Name, len(humanGenesOf))
+	}
+
+	inFh, err := os.Open(inPath)
+	sp.CheckWithMsg(err, "Could not open file: "+inPath)
+	defer inFh.Close()
+	outPath := t.OutIP("selected").TempPath()
+	outFh, err := os.Create(outPath)
+	sp.CheckWithMsg(err, "Could not create file: "+outPath)
+	outWrt := bufio.NewWriter(outFh)
+
+	counts := map[[2]string]*speciesSelectionCounts{}
+	countsOf := func(gene string, taxID string) *speciesSelectionCounts {
+		c, ok := counts[[2]string{gene, taxID}]
+		if !ok {
+			c = &speciesSelectionCounts{}
+			counts[[2]string{gene, taxID}] = c
+		}
+		return c
+	}
+	scanner := bufio.NewScanner(inFh)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		row := str.Split(line, "\t")
+		if lineNo == 1 {
+			outWrt.WriteString(line + "\n") // Header
+			continue
+		}
+		if len(row) <= excapeColSmiles {
+			continue
+		}
+		taxID := row[excapeColTaxID]
+		gene := row[excapeColGene]
+		selected := len(p.Species) == 0 || strInSlice(taxID, p.Species)
+		fromOrthologs := false
+		if p.Orthologs && taxID != taxIDHuman {
+			if humanGenes := humanGenesOf[row[excapeColOrthologGroup]]; len(humanGenes) == 1 {
+				fromOrthologs = !selected || humanGenes[0] != gene
+				gene = humanGenes[0]
+				selected = true
+			}
+		}
+		c := countsOf(gene, taxID)
+		c.rows++
+		if !selected {
+			c.droppedBySpecies++
+			continue
+		}
+		if weight, ok := p.Weights[taxID]; ok && taxID != taxIDHuman && !keepWeighted(row, weight) {
+			c.droppedByWeight++
+			continue
+		}
+		c.kept++
+		if fromOrthologs {
+			c.fromOrthologs++
+		}
+		row[excapeColGene] = gene
+		outWrt.WriteString(str.Join(row, "\t") + "\n")
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read file: "+inPath)
+	sp.CheckWithMsg(outWrt.Flush(), "Could not write file: "+outPath)
+	outFh.Close()
+
+	keys := [][2]string{}
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return lessSpecies(keys[i][1], keys[j][1])
+	})
+	reportPath := t.OutIP("report").TempPath()
+	reportFh, err := os.Create(reportPath)
+	sp.CheckWithMsg(err, "Could not create file: "+reportPath)
+	defer reportFh.Close()
+	tsvWrt := csv.NewWriter(reportFh)
+	tsvWrt.Comma = '\t'
+	tsvWrt.Write([]string{"Gene", "TaxID", "Species", "Rows", "Kept", "FromOrthologs", "DroppedBySpecies", "DroppedByWeight"})
+	kept, total := 0, 0
+	for _, key := range keys {
+		c := counts[key]
+		kept += c.kept
+		total += c.rows
+		tsvWrt.Write([]string{
+			key[0],
+			key[1],
+			speciesName(key[1]),
+			fmt.Sprintf("%d", c.rows),
+			fmt.Sprintf("%d", c.kept),
+			fmt.Sprintf("%d", c.fromOrthologs),
+			fmt.Sprintf("%d", c.droppedBySpecies),
+			fmt.Sprintf("%d", c.droppedByWeight),
+		})
+	}
+	tsvWrt.Flush()
+	sp.CheckWithMsg(tsvWrt.Error(), "Could not write file: "+reportPath)
+	sp.Audit.Printf("| %-32s | Kept %d of %d rows (species: %s, orthologs: %t, weights: %s)\n", t.Name, kept, total, t.Param("species"), p.Orthologs, t.Param("weights"))
+}
+
+// readHumanOrthologGenes reads the human gene symbols of each ortholog group
+// in ExCAPE-DB
+func readHumanOrthologGenes(path string) map[string][]string {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open file: "+path)
+	defer fh.Close()
+	humanGenesOf := map[string][]string{}
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		row := str.Split(scanner.Text(), "\t")
+		if lineNo == 1 || len(row) <= excapeColSmiles {
+			continue
+		}
+		group := row[excapeColOrthologGroup]
+		if row[excapeColTaxID] != taxIDHuman || group == "" || strInSlice(row[excapeColGene], humanGenesOf[group]) {
+			continue
+		}
+		humanGenesOf[group] = append(humanGenesOf[group], row[excapeColGene])
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read file: "+path)
+	return humanGenesOf
+}
+
+// keepWeighted decides whether to keep a row of a species with a weight, by
+// a hash of its structure (InChIKey, or SMILES when missing) and species
+func keepWeighted(row []string, weight float64) bool {
+	structKey := row[excapeColInchiKey]
+	if structKey == "" {
+		structKey = row[excapeColSmiles]
+	}
+	h := fnv.New64a()
+	h.Write([]byte(structKey + "\t" + row[excapeColTaxID]))
+	return float64(h.Sum64())/math.MaxUint64 < weight
+}
+
+// ================================================================================
+// Species counts
+// ================================================================================
+
+// CountSpecies is a SciPipe process counting the structures of the training
+// data of a target (the "gene" parameter) per species, by looking them up in
+// a gene/smiles/tax ID file extracted from the data the target data was
+// extracted from. Structures measured in several species are counted for
+// each, and structures not found (such as those changed by standardization)
+// are counted as unknown. Assumed non-actives are not counted, as they are
+// not measured for the target. The counts are written as NAME<tab>VALUE lines,
+// for TableGatherer.
+type CountSpecies struct {
+	*sp.Process
+}
+
+func (p *CountSpecies) InTargetData() *sp.InPort      { return p.In("target_data") }
+func (p *CountSpecies) InGeneSmilesTaxID() *sp.InPort { return p.In("gene_smiles_taxid") }
+func (p *CountSpecies) InGene() *sp.ParamInPort       { return p.ParamInPort("gene") }
+func (p *CountSpecies) OutCounts() *sp.OutPort        { return p.Out("counts") }
+
+func NewCountSpecies(wf *sp.Workflow, procName string) *CountSpecies {
+	p := &CountSpecies{wf.NewProc(procName, "# CountSpecies custom process. Ports: {i:target_data} {i:gene_smiles_taxid} {p:gene} {o:counts}")}
+	p.SetPathReplace("target_data", "counts", ".tsv", ".species_counts.tsv")
+	p.CustomExecute = func(t *sp.Task) {
+		gene := str.ToUpper(t.Param("gene"))
+		taxIDsOf := map[string]map[string]bool{}
+		for _, row := range readTSVWithHeader(t.InPath("target_data")) {
+			taxIDsOf[row["smiles"]] = map[string]bool{}
+		}
+		gstPath := t.InPath("gene_smiles_taxid")
+		gstFh, err := os.Open(gstPath)
+		sp.CheckWithMsg(err, "Could not open file: "+gstPath)
+		defer gstFh.Close()
+		scanner := bufio.NewScanner(gstFh)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			row := str.Split(scanner.Text(), "\t")
+			if len(row) < 3 || row[0] != gene {
+				continue
+			}
+			if taxIDs, ok := taxIDsOf[row[1]]; ok {
+				taxIDs[row[2]] = true
+			}
+		}
+		sp.CheckWithMsg(scanner.Err(), "Could not read file: "+gstPath)
+
+		structsPerTaxID := map[string]int{}
+		unknown := 0
+		for _, taxIDs := range taxIDsOf {
+			if len(taxIDs) == 0 {
+				unknown++
+			}
+			for taxID := range taxIDs {
+				structsPerTaxID[taxID]++
+			}
+		}
+		for _, taxID := range []string{taxIDHuman, speciesTaxIDs["rat"], speciesTaxIDs["mouse"]} {
+			if _, ok := structsPerTaxID[taxID]; !ok {
+				structsPerTaxID[taxID] = 0
+			}
+		}
+		taxIDs := []string{}
+		for taxID := range structsPerTaxID {
+			taxIDs = append(taxIDs, taxID)
+		}
+		sort.Slice(taxIDs, func(i, j int) bool { return lessSpecies(taxIDs[i], taxIDs[j]) })
+
+		out := fmt.Sprintf("Structures\t%d\n", len(taxIDsOf))
+		for _, taxID := range taxIDs {
+			out += fmt.Sprintf("%s\t%d\n", str.Title(speciesName(taxID)), structsPerTaxID[taxID])
+		}
+		out += fmt.Sprintf("Unknown\t%d\n", unknown)
+		t.OutIP("counts").Write([]byte(out))
+		sp.Audit.Printf("| %-32s | Counted the %d structures of %s per species\n", t.Name, len(taxIDsOf), gene)
+	}
+	return p
+}
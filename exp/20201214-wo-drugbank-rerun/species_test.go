@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestSpeciesWeightsString(t *testing.T) {
+	tests := []struct {
+		weightsStr string
+		want       string
+	}{
+		{"", "none"},
+		{"rat:0.5", "rat:0.5"},
+		{"rat:0.5,mouse:0.25", "mouse:0.25,rat:0.5"},
+		{"10116:1,9823:0", "tax9823:0,rat:1"},
+	}
+	for _, tt := range tests {
+		if got := speciesWeightsString(parseSpeciesWeights(tt.weightsStr)); got != tt.want {
+			t.Errorf("speciesWeightsString(parseSpeciesWeights(%q)) = %q, want %q", tt.weightsStr, got, tt.want)
+		}
+	}
+}
+
+// TestSelectSpeciesWithoutWeights runs the species selection as set up by
+// -species human, without -speciesweights
+func TestSelectSpeciesWithoutWeights(t *testing.T) {
+	sp.InitLogError()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, err := ioutil.TempDir("", "select_species_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	header := "Ambit_InchiKey\tOriginal_Entry_ID\tEntrez_ID\tActivity_Flag\tpXC50\tDB\tOriginal_Assay_ID\tTax_ID\tGene_Symbol\tOrtholog_Group\tInChI\tSMILES"
+	humanRow := "KEY1\tCHEMBL1\t1812\tA\t7.1\tchembl20\t1\t9606\tDRD1\t1\tInChI=1\tCCO"
+	ratRow := "KEY2\tCHEMBL2\t24316\tN\t4.2\tchembl20\t2\t10116\tDRD1\t1\tInChI=2\tCCN"
+	dbPath := filepath.Join(tmpDir, "excapedb.tsv")
+	if err := ioutil.WriteFile(dbPath, []byte(header+"\n"+humanRow+"\n"+ratRow+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wf := sp.NewWorkflow("select_species_test", 1)
+	excapeDB := wf.NewProc("excapedb", "echo {o:excapedb}")
+	excapeDB.SetPathStatic("excapedb", dbPath)
+	selectSpecies := NewSelectSpecies(wf, "select_species", "res/species_selection.tsv", parseSpecies("human"), false, parseSpeciesWeights(""))
+	selectSpecies.InExcapeDB().Connect(excapeDB.Out("excapedb"))
+	wf.Run()
+
+	selected, err := ioutil.ReadFile("dat/excapedb.human.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := header + "\n" + humanRow + "\n"; string(selected) != want {
+		t.Errorf("Selected rows = %q, want %q", selected, want)
+	}
+	report, err := ioutil.ReadFile("res/species_selection.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !str.Contains(string(report), "DRD1\t10116\trat\t1\t0\t0\t1\t0") {
+		t.Errorf("Report does not count the dropped rat row:\n%s", report)
+	}
+}
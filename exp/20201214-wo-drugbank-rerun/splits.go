@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// Split modes for the validation data. In the drugbank mode, the held-out
+// DrugBank compounds are used for validation, while the scaffold and time
+// modes hold out a part of the data for each target.
+const (
+	splitDrugBank = "drugbank"
+	splitScaffold = "scaffold"
+	splitTime     = "time"
+)
+
+var splitModes = []string{splitDrugBank, splitScaffold, splitTime}
+
+// ================================================================================
+
+// SplitTargetData is a SciPipe process that extracts the data for one target
+// (the "gene" parameter) from a gene/id/smiles/activity file, and splits it
+// into a training and a test set, either on (approximate) Bemis-Murcko
+// scaffolds, or on the year of the earliest document the compound is
+// reported in.
+//
+// Training data is written with a "smiles<tab>activity" header, like the
+// extract_target_data_* outputs, while test data is written without header,
+// like the DrugBank validation data.
+type SplitTargetData struct {
+	*sp.Process
+	Mode     string
+	TestFrac float64
+}
+
+func (p *SplitTargetData) InGISA() *sp.InPort          { return p.In("gisa") }
+func (p *SplitTargetData) InDocYears() *sp.InPort      { return p.In("docyears") }
+func (p *SplitTargetData) InGene() *sp.ParamInPort     { return p.ParamInPort("gene") }
+func (p *SplitTargetData) OutTrain() *sp.OutPort       { return p.Out("train") }
+func (p *SplitTargetData) OutTest() *sp.OutPort        { return p.Out("test") }
+func (p *SplitTargetData) OutSplitReport() *sp.OutPort { return p.Out("report") }
+
+// NewSplitTargetData returns a new SplitTargetData process. The time mode
+// also needs a document year file connected to InDocYears().
+func NewSplitTargetData(wf *sp.Workflow, procName string, mode string, testFrac float64) *SplitTargetData {
+	cmd := "# SplitTargetData custom process. Ports: {i:gisa} {p:gene} {o:train} {o:test} {o:report}"
+	if mode == splitTime {
+		cmd += " {i:docyears}"
+	}
+	p := &SplitTargetData{
+		Process:  wf.NewProc(procName, cmd),
+		Mode:     mode,
+		TestFrac: testFrac,
+	}
+	splitPathFunc := func(t *sp.Task) string {
+		gene := str.ToLower(t.Param("gene"))
+		return "dat/" + gene + "/" + p.Mode + "_split/" + gene + "." + p.Mode
+	}
+	p.SetPathCustom("train", func(t *sp.Task) string { return splitPathFunc(t) + ".train.tsv" })
+	p.SetPathCustom("test", func(t *sp.Task) string { return splitPathFunc(t) + ".test.tsv" })
+	p.SetPathCustom("report", func(t *sp.Task) string { return splitPathFunc(t) + ".split_report.tsv" })
+	p.CustomExecute = p.execute
+	return p
+}
+
+// splitCompound is a structure in the target data, with the IDs it was
+// reported with
+type splitCompound struct {
+	smiles   string
+	activity string
+	ids      []string
+	group    string
+	year     int
+}
+
+func (p *SplitTargetData) execute(t *sp.Task) {
+	gene := t.Param("gene")
+	compounds := []*splitCompound{}
+	bySmiles := map[string]*splitCompound{}
+	forEachGISARow(t.InPath("gisa"), func(row []string) {
+		if row[0] != gene {
+			return
+		}
+		c, ok := bySmiles[row[2]]
+		if !ok {
+			c = &splitCompound{smiles: row[2], activity: row[3]}
+			bySmiles[row[2]] = c
+			compounds = append(compounds, c)
+		}
+		c.ids = append(c.ids, row[1])
+	})
+	if len(compounds) == 0 {
+		sp.Failf("| %-32s | No data found for target %s\n", t.Name, gene)
+	}
+
+	var testIdx map[int]bool
+	switch p.Mode {
+	case splitScaffold:
+		for _, c := range compounds {
+			c.group = murckoScaffoldKey(c.smiles)
+		}
+		testIdx = scaffoldTestSet(compounds, p.TestFrac)
+	case splitTime:
+		docYears := readDocYears(t.InPath("docyears"))
+		for _, c := range compounds {
+			for _, id := range c.ids {
+				if y, ok := docYears[id]; ok && (c.year == 0 || y < c.year) {
+					c.year = y
+				}
+			}
+		}
+		testIdx = timeTestSet(compounds, p.TestFrac)
+	default:
+		sp.Failf("| %-32s | Unknown split mode: %s\n", t.Name, p.Mode)
+	}
+
+	if err := checkSplitSizes(len(compounds)-len(testIdx), len(testIdx)); err != nil {
+		sp.Failf("| %-32s | Could not split the %d compounds of %s on %s: %v (try another -testfrac or -split)\n", t.Name, len(compounds), gene, p.Mode, err)
+	}
+
+	trainWrt, trainFh := createTempWriter(t.OutIP("train"))
+	testWrt, testFh := createTempWriter(t.OutIP("test"))
+	trainWrt.WriteString("smiles\tactivity\n")
+	counts := map[string]int{}
+	for i, c := range compounds {
+		set := "train"
+		wrt := trainWrt
+		if testIdx[i] {
+			set = "test"
+			wrt = testWrt
+		}
+		wrt.WriteString(c.smiles + "\t" + c.activity + "\n")
+		counts[set+"_"+c.activity]++
+		if p.Mode == splitTime && c.year == 0 {
+			counts[set+"_noyear"]++
+		}
+	}
+	closeTempWriter(trainWrt, trainFh)
+	closeTempWriter(testWrt, testFh)
+
+	repWrt, repFh := createTempWriter(t.OutIP("report"))
+	repWrt.WriteString("Gene\tMode\tSet\tActiveCnt\tNonactiveCnt\tNoYearCnt\n")
+	for _, set := range []string{"train", "test"} {
+		repWrt.WriteString(fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%d\n", gene, p.Mode, set, counts[set+"_A"], counts[set+"_N"], counts[set+"_noyear"]))
+	}
+	closeTempWriter(repWrt, repFh)
+}
+
+// scaffoldTestSet assigns whole scaffold groups to the training set, largest
+// groups first, until it holds (1 - testFrac) of the compounds. The remaining,
+// rarer, scaffolds make up the test set. Returns the indices of test compounds.
+func scaffoldTestSet(compounds []*splitCompound, testFrac float64) map[int]bool {
+	groups := map[string][]int{}
+	groupNames := []string{}
+	for i, c := range compounds {
+		if _, ok := groups[c.group]; !ok {
+			groupNames = append(groupNames, c.group)
+		}
+		groups[c.group] = append(groups[c.group], i)
+	}
+	sort.SliceStable(groupNames, func(i, j int) bool {
+		if len(groups[groupNames[i]]) != len(groups[groupNames[j]]) {
+			return len(groups[groupNames[i]]) > len(groups[groupNames[j]])
+		}
+		return groupNames[i] < groupNames[j]
+	})
+	trainSize := int(math.Ceil(float64(len(compounds)) * (1 - testFrac)))
+	testIdx := map[int]bool{}
+	nTrain := 0
+	for _, g := range groupNames {
+		if nTrain+len(groups[g]) <= trainSize || nTrain == 0 {
+			nTrain += len(groups[g])
+			continue
+		}
+		for _, i := range groups[g] {
+			testIdx[i] = true
+		}
+	}
+	return testIdx
+}
+
+// checkSplitSizes returns an error if the training or the test set is empty,
+// since neither a model nor a validation can be made from no data
+func checkSplitSizes(nTrain int, nTest int) error {
+	if nTrain == 0 {
+		return fmt.Errorf("the training set is empty (%d compounds in the test set)", nTest)
+	}
+	if nTest == 0 {
+		return fmt.Errorf("the test set is empty (%d compounds in the training set)", nTrain)
+	}
+	return nil
+}
+
+// timeTestSet puts the most recently reported testFrac of the compounds with
+// a known year in the test set. Compounds without a year are always kept for
+// training. Compounds from the same year are never split across the sets, so
+// the cut is put before or after the year at the cut, whichever gives a test
+// set closer to testFrac, but never so that all compounds end up in the test
+// set. Returns the indices of test compounds.
+func timeTestSet(compounds []*splitCompound, testFrac float64) map[int]bool {
+	withYear := []int{}
+	for i, c := range compounds {
+		if c.year > 0 {
+			withYear = append(withYear, i)
+		}
+	}
+	sort.SliceStable(withYear, func(i, j int) bool {
+		return compounds[withYear[i]].year > compounds[withYear[j]].year
+	})
+	testIdx := map[int]bool{}
+	nTest := int(math.Floor(float64(len(withYear)) * testFrac))
+	if nTest == 0 {
+		return testIdx
+	}
+	// The number of compounds after, and up to and including, the year at
+	// the cut
+	cutYear := compounds[withYear[nTest-1]].year
+	nAfter, nUpTo := 0, 0
+	for _, i := range withYear {
+		if compounds[i].year > cutYear {
+			nAfter++
+		}
+		if compounds[i].year >= cutYear {
+			nUpTo++
+		}
+	}
+	nCut := nAfter
+	if nUpTo-nTest <= nTest-nAfter && nUpTo < len(compounds) {
+		nCut = nUpTo
+	}
+	for _, i := range withYear[:nCut] {
+		testIdx[i] = true
+	}
+	return testIdx
+}
+
+// readDocYears reads a tab-separated file of compound IDs (such as ChEMBL
+// IDs) and the year of a document reporting the compound, into a map with
+// the earliest year for each ID. Such a file can be extracted from the
+// molecule_dictionary, activities and docs tables of a ChEMBL release.
+func readDocYears(path string) map[string]int {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open document years file: "+path)
+	defer fh.Close()
+	years := map[string]int{}
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		fields := str.Split(scanner.Text(), "\t")
+		if len(fields) < 2 {
+			continue
+		}
+		year, err := strconv.Atoi(str.TrimSpace(fields[1]))
+		if err != nil {
+			continue // Header, or missing year
+		}
+		if y, ok := years[fields[0]]; !ok || year < y {
+			years[fields[0]] = year
+		}
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read document years file: "+path)
+	return years
+}
+
+// createTempWriter creates the temp file of ip, and a buffered writer for it
+func createTempWriter(ip *sp.FileIP) (*bufio.Writer, *os.File) {
+	fh, err := os.Create(ip.TempPath())
+	sp.CheckWithMsg(err, "Could not create file: "+ip.TempPath())
+	return bufio.NewWriter(fh), fh
+}
+
+func closeTempWriter(wrt *bufio.Writer, fh *os.File) {
+	sp.CheckWithMsg(wrt.Flush(), "Could not write to file: "+fh.Name())
+	fh.Close()
+}
+
+// ================================================================================
+// Bemis-Murcko scaffolds
+// ================================================================================
+
+// murckoScaffoldKey returns a key approximating the Bemis-Murcko scaffold
+// (ring systems and the linkers between them) of the largest fragment of a
+// SMILES string. It is a heuristic on the parsed SMILES, not a real Murcko
+// scaffold from a chemistry toolkit: side chains are pruned by repeatedly
+// removing terminal atoms, after which terminal atoms double bonded to the
+// rest are put back. The key is a hash of Weisfeiler-Lehman refined atom
+// labels of the remaining atoms, which is the same regardless of how the
+// SMILES was written, but may, rarely, be the same for different scaffolds.
+// Acyclic compounds all get the same, empty, key.
+func murckoScaffoldKey(smiles string) string {
+	tokens, ok := tokenizeSmiles(smiles)
+	if !ok {
+		return "unparsable:" + smiles
+	}
+	atoms, ok := parseSmilesAtoms(largestFragment(tokens))
+	if !ok {
+		return "unparsable:" + smiles
+	}
+
+	// Prune side chains by repeatedly removing terminal atoms
+	removed := make([]bool, len(atoms))
+	for i, a := range atoms {
+		removed[i] = a.symbol == "H"
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := range atoms {
+			if !removed[i] && scaffoldDegree(atoms, removed, i) <= 1 {
+				removed[i] = true
+				changed = true
+			}
+		}
+	}
+	// Put back terminal atoms double bonded to the scaffold, such as carbonyl
+	// oxygens
+	for i, a := range atoms {
+		if removed[i] && a.symbol != "H" && len(a.neighbors) == 1 && a.bondOrders[0] == 2 && !removed[a.neighbors[0]] {
+			removed[i] = false
+		}
+	}
+
+	labels := map[int]string{}
+	for i, a := range atoms {
+		if !removed[i] {
+			labels[i] = a.symbol
+		}
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	for round := 0; round < 4; round++ {
+		newLabels := map[int]string{}
+		for i := range labels {
+			nbLabels := []string{}
+			for k, n := range atoms[i].neighbors {
+				if !removed[n] {
+					nbLabels = append(nbLabels, fmt.Sprintf("%.1f%s", atoms[i].bondOrders[k], labels[n]))
+				}
+			}
+			sort.Strings(nbLabels)
+			newLabels[i] = shortHash(labels[i] + "(" + str.Join(nbLabels, ",") + ")")
+		}
+		labels = newLabels
+	}
+	all := []string{}
+	for _, l := range labels {
+		all = append(all, l)
+	}
+	sort.Strings(all)
+	return shortHash(str.Join(all, ";"))
+}
+
+func scaffoldDegree(atoms []*smilesAtom, removed []bool, i int) int {
+	degree := 0
+	for _, n := range atoms[i].neighbors {
+		if !removed[n] {
+			degree++
+		}
+	}
+	return degree
+}
+
+func shortHash(s string) string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(s)))[:16]
+}
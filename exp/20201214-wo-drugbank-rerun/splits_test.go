@@ -0,0 +1,96 @@
+package main
+
+import (
+	"reflect"
+	str "strings"
+	"testing"
+)
+
+func TestMurckoScaffoldKey(t *testing.T) {
+	// The key of each compound should be that of its scaffold, written as
+	// SMILES
+	scaffoldTests := []struct {
+		smiles   string
+		scaffold string
+	}{
+		{"OCCc1ccccc1", "c1ccccc1"},
+		{"c1ccccc1CCCN", "c1ccccc1"},
+		{"Cl.c1ccncc1", "c1ccncc1"},
+		{"CCc1ccc(cc1)Cc1ccccc1O", "c1ccc(cc1)Cc1ccccc1"},
+		{"CC1CCC(=O)CC1", "O=C1CCCCC1"},
+		{"c1ccc2ccccc2c1", "c1ccc2ccccc2c1"},
+		{"n1ccccc1", "c1ccncc1"},
+	}
+	for _, tt := range scaffoldTests {
+		if got, want := murckoScaffoldKey(tt.smiles), murckoScaffoldKey(tt.scaffold); got != want {
+			t.Errorf("murckoScaffoldKey(%q) = %q, want the key of %s: %q", tt.smiles, got, tt.scaffold, want)
+		}
+	}
+
+	// Scaffolds differing in linkers, aromaticity, ring atoms or double
+	// bonded atoms should all have different keys
+	distinct := []string{"c1ccccc1", "C1CCCCC1", "c1ccncc1", "O=C1CCCCC1", "c1ccc(cc1)Cc1ccccc1", "c1ccc(cc1)CCc1ccccc1", "c1ccc2ccccc2c1"}
+	scaffoldOfKey := map[string]string{}
+	for _, scaffold := range distinct {
+		key := murckoScaffoldKey(scaffold)
+		if other, ok := scaffoldOfKey[key]; ok {
+			t.Errorf("murckoScaffoldKey(%q) = murckoScaffoldKey(%q) = %q, want different keys", scaffold, other, key)
+		}
+		scaffoldOfKey[key] = scaffold
+	}
+
+	for _, smiles := range []string{"CCO", "CC(=O)O", "[Na+].[Cl-]"} {
+		if key := murckoScaffoldKey(smiles); key != "" {
+			t.Errorf("murckoScaffoldKey(%q) = %q, want the empty key of acyclic compounds", smiles, key)
+		}
+	}
+	for _, smiles := range []string{"C1CC", "C(C"} {
+		if key := murckoScaffoldKey(smiles); !str.HasPrefix(key, "unparsable:") {
+			t.Errorf("murckoScaffoldKey(%q) = %q, want an unparsable key", smiles, key)
+		}
+	}
+}
+
+func TestTimeTestSet(t *testing.T) {
+	tests := []struct {
+		years    []int
+		testFrac float64
+		want     map[int]bool
+	}{
+		{[]int{2001, 2002, 2003, 2004, 0}, 0.5, map[int]bool{2: true, 3: true}},
+		{[]int{2001, 2003, 2003, 2002}, 0.25, map[int]bool{1: true, 2: true}},                // Years are not split
+		{[]int{2005, 2004, 2004, 2004, 2004, 2004, 2003, 2002}, 0.25, map[int]bool{0: true}}, // The cut is put before a large year
+		{[]int{2001, 2001, 2001, 2001}, 0.5, map[int]bool{}},                                 // Not everything in the test set
+		{[]int{2001, 2001, 0}, 0.5, map[int]bool{0: true, 1: true}},                          // The compound without a year is left for training
+		{[]int{2001, 2002}, 0.0, map[int]bool{}},
+		{[]int{0, 0, 0}, 0.5, map[int]bool{}}, // Compounds without a year are kept for training
+		{[]int{}, 0.2, map[int]bool{}},
+	}
+	for _, tt := range tests {
+		compounds := []*splitCompound{}
+		for _, year := range tt.years {
+			compounds = append(compounds, &splitCompound{year: year})
+		}
+		if got := timeTestSet(compounds, tt.testFrac); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("timeTestSet(years %v, %.2f) = %v, want %v", tt.years, tt.testFrac, got, tt.want)
+		}
+	}
+}
+
+func TestCheckSplitSizes(t *testing.T) {
+	tests := []struct {
+		nTrain  int
+		nTest   int
+		wantErr bool
+	}{
+		{8, 2, false},
+		{0, 10, true}, // Empty training set
+		{10, 0, true}, // Empty test set
+		{0, 0, true},
+	}
+	for _, tt := range tests {
+		if err := checkSplitSizes(tt.nTrain, tt.nTest); (err != nil) != tt.wantErr {
+			t.Errorf("checkSplitSizes(%d, %d) = %v, want error: %t", tt.nTrain, tt.nTest, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+
+// Standardizer turns a list of raw SMILES strings into standardized ones, so
+// that salt forms, charge states and stereo variants of the same compound end
+// up as one and the same structure. The returned slice has the same length and
+// order as the input.
+type Standardizer interface {
+	Standardize(smiles []string) []string
+}
+
+// defaultStandardizerCmd canonicalizes the SMILES with Open Babel, after
+// keeping the largest fragment, neutralizing charges and removing stereo
+const defaultStandardizerCmd = "obabel -ismi -ocan -xi -r --neutralize"
+
+// builtinStandardizer is the standardizer command that selects the built-in
+// BasicStandardizer, for when no external tool is installed
+const builtinStandardizer = "builtin"
+
+// NewStandardizer returns the built-in BasicStandardizer for the command
+// "builtin", and otherwise an ExternalStandardizer running the command, which
+// has to be on the PATH
+func NewStandardizer(command string) Standardizer {
+	if command == builtinStandardizer {
+		return &BasicStandardizer{}
+	}
+	fields := str.Fields(command)
+	if len(fields) == 0 {
+		sp.Failf("No standardizer command given (use -standardizer %s for the built-in standardizer)\n", builtinStandardizer)
+	}
+	if _, err := exec.LookPath(fields[0]); err != nil {
+		sp.Failf("Standardizer command not found: %s (install it, or use -standardizer %s for the built-in standardizer, which does not canonicalize the SMILES)\n", fields[0], builtinStandardizer)
+	}
+	return &ExternalStandardizer{Command: command}
+}
+
+// ExternalStandardizer runs an external tool for the standardization. The
+// command gets one "SMILES<tab>ID" line per structure on stdin, and should
+// write the standardized structures in the same format on stdout, which is
+// what for example defaultStandardizerCmd does. Structures that the tool drops
+// are kept as they were.
+type ExternalStandardizer struct {
+	Command string
+}
+
+func (s *ExternalStandardizer) Standardize(smiles []string) []string {
+	var inBuf bytes.Buffer
+	for i, smi := range smiles {
+		inBuf.WriteString(fmt.Sprintf("%s\t%d\n", smi, i))
+	}
+	cmd := exec.Command("bash", "-c", s.Command)
+	cmd.Stdin = &inBuf
+	var errBuf bytes.Buffer
+	cmd.Stderr = &errBuf
+	out, err := cmd.Output()
+	sp.CheckWithMsg(err, fmt.Sprintf("Standardizer command failed: %s\n%s", s.Command, errBuf.String()))
+
+	stdSmiles := make([]string, len(smiles))
+	copy(stdSmiles, smiles)
+	for _, line := range str.Split(string(out), "\n") {
+		fields := str.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		idx, err := strconv.Atoi(fields[len(fields)-1])
+		if err != nil || idx < 0 || idx >= len(smiles) {
+			sp.Warning.Printf("Standardizer: Could not parse ID in output line: %s\n", line)
+			continue
+		}
+		stdSmiles[idx] = fields[0]
+	}
+	return stdSmiles
+}
+
+// BasicStandardizer is a pure Go stand-in for a full standardization tool. It
+// keeps the largest fragment, neutralizes charges that can be neutralized by
+// adding or removing hydrogens, and removes stereo information.
+//
+// Limitation: it does NOT canonicalize the SMILES. The atom order is kept, so
+// the same compound written in different atom orders (e.g. "OCC" and "CCO")
+// stays as two structures, and is neither merged nor checked for conflicting
+// labels. It is therefore not the default; use it only when no external
+// standardizer is available.
+type BasicStandardizer struct{}
+
+func (s *BasicStandardizer) Standardize(smiles []string) []string {
+	stdSmiles := make([]string, len(smiles))
+	for i, smi := range smiles {
+		stdSmiles[i] = basicStandardizeSmiles(smi)
+	}
+	return stdSmiles
+}
+
+// ================================================================================
+
+// StandardizeStructures is a SciPipe process that standardizes the SMILES
+// column of a gene/id/smiles/activity (gisa) file, and writes a per-target
+// report of how many structures were merged by the standardization. The
+// input file is expected to be sorted on gene and SMILES, and the output is
+// NOT sorted (sort it again before removing conflicting records).
+type StandardizeStructures struct {
+	*sp.Process
+}
+
+func (p *StandardizeStructures) InGISA() *sp.InPort     { return p.In("gisa") }
+func (p *StandardizeStructures) OutGISA() *sp.OutPort   { return p.Out("std_gisa") }
+func (p *StandardizeStructures) OutReport() *sp.OutPort { return p.Out("report") }
+
+func NewStandardizeStructures(wf *sp.Workflow, procName string, reportFileName string, standardizer Standardizer) *StandardizeStructures {
+	p := &StandardizeStructures{wf.NewProc(procName, "# StandardizeStructures custom process. Ports: {i:gisa} {o:std_gisa} {o:report}")}
+	p.SetPathReplace("gisa", "std_gisa", ".tsv", ".std_unsorted.tsv")
+	p.SetPathStatic("report", reportFileName)
+	p.CustomExecute = func(t *sp.Task) {
+		// First pass: Collect and standardize all unique structures
+		uniqSmiles := []string{}
+		seen := map[string]bool{}
+		forEachGISARow(t.InPath("gisa"), func(row []string) {
+			if !seen[row[2]] {
+				seen[row[2]] = true
+				uniqSmiles = append(uniqSmiles, row[2])
+			}
+		})
+		stdSmiles := standardizer.Standardize(uniqSmiles)
+		stdOf := make(map[string]string, len(uniqSmiles))
+		for i, smi := range uniqSmiles {
+			stdOf[smi] = stdSmiles[i]
+		}
+		sp.Audit.Printf("| %-32s | Standardized %d unique structures\n", t.Name, len(uniqSmiles))
+
+		// Second pass: Write standardized rows, and count merged structures per target
+		outFh, err := os.Create(t.OutIP("std_gisa").TempPath())
+		sp.CheckWithMsg(err, "Could not create file: "+t.OutIP("std_gisa").TempPath())
+		outWrt := bufio.NewWriter(outFh)
+
+		genes := []string{}
+		rawRecords := map[string]int{}
+		rawStructs := map[string]int{}
+		stdStructs := map[string]int{}
+		prevGene, prevSmiles := "", ""
+		var geneStdSmiles map[string]bool
+		forEachGISARow(t.InPath("gisa"), func(row []string) {
+			gene, smiles := row[0], row[2]
+			if gene != prevGene {
+				genes = append(genes, gene)
+				geneStdSmiles = map[string]bool{}
+				prevSmiles = ""
+			}
+			rawRecords[gene]++
+			if smiles != prevSmiles {
+				rawStructs[gene]++
+			}
+			std := stdOf[smiles]
+			if !geneStdSmiles[std] {
+				geneStdSmiles[std] = true
+				stdStructs[gene]++
+			}
+			row[2] = std
+			outWrt.WriteString(str.Join(row, "\t") + "\n")
+			prevGene, prevSmiles = gene, smiles
+		})
+		sp.Check(outWrt.Flush())
+		outFh.Close()
+
+		reportFh, err := os.Create(t.OutIP("report").TempPath())
+		sp.CheckWithMsg(err, "Could not create file: "+t.OutIP("report").TempPath())
+		defer reportFh.Close()
+		tsvWrt := csv.NewWriter(reportFh)
+		tsvWrt.Comma = '\t'
+		tsvWrt.Write([]string{"Gene", "RawRecords", "RawStructures", "StdStructures", "MergedStructures"})
+		sort.Strings(genes)
+		for _, gene := range genes {
+			tsvWrt.Write([]string{
+				gene,
+				fmt.Sprintf("%d", rawRecords[gene]),
+				fmt.Sprintf("%d", rawStructs[gene]),
+				fmt.Sprintf("%d", stdStructs[gene]),
+				fmt.Sprintf("%d", rawStructs[gene]-stdStructs[gene]),
+			})
+		}
+		tsvWrt.Flush()
+	}
+	return p
+}
+
+// forEachGISARow calls rowFunc with the (tab-separated) fields of each line in
+// a gene/id/smiles/activity file, skipping lines with too few fields
+func forEachGISARow(path string, rowFunc func(row []string)) {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open file: "+path)
+	defer fh.Close()
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		row := str.Split(scanner.Text(), "\t")
+		if len(row) < 4 {
+			continue
+		}
+		rowFunc(row)
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read file: "+path)
+}
+
+// ================================================================================
+// SMILES handling for the BasicStandardizer
+// ================================================================================
+
+var (
+	smilesTokenPtn  = regexp.MustCompile(`^(\[[^\]]*\]|Br|Cl|[BCNOSPFI]|[bcnosp]|\*|%\d\d|\d|[-=#$:/\\]|[().])`)
+	bracketAtomPtn  = regexp.MustCompile(`^\[(\d*)([A-Z][a-z]?|[a-z][a-z]?|\*)(@@|@[A-Z]{2}\d{1,2}|@)?(H\d*)?([+-]+|[+-]\d+)?(:\d+)?\]$`)
+	defaultValences = map[string][]int{
+		"B": {3}, "C": {4}, "N": {3, 5}, "O": {2}, "P": {3, 5}, "S": {2, 4, 6},
+		"F": {1}, "Cl": {1}, "Br": {1}, "I": {1},
+	}
+)
+
+// smilesAtom is an atom in a parsed SMILES string, along with the token
+// index it came from, so that it can be written back in place
+type smilesAtom struct {
+	tokenIdx   int
+	isotope    string
+	symbol     string
+	chirality  string
+	hCount     int
+	charge     int
+	class      string
+	bracket    bool
+	bondSum    float64
+	neighbors  []int
+	bondOrders []float64
+}
+
+func (a *smilesAtom) aromatic() bool {
+	return a.symbol != "" && a.symbol[0] >= 'a' && a.symbol[0] <= 'z'
+}
+
+func (a *smilesAtom) element() string {
+	if a.aromatic() {
+		return str.ToUpper(a.symbol[:1]) + a.symbol[1:]
+	}
+	return a.symbol
+}
+
+// basicStandardizeSmiles keeps the largest fragment of a SMILES string,
+// neutralizes it, and strips stereo information. SMILES that can't be parsed
+// are returned unchanged.
+func basicStandardizeSmiles(smiles string) string {
+	tokens, ok := tokenizeSmiles(smiles)
+	if !ok {
+		return smiles
+	}
+	fragment := largestFragment(tokens)
+	atoms, ok := parseSmilesAtoms(fragment)
+	if !ok {
+		return smiles
+	}
+	neutralizeAtoms(atoms)
+
+	out := make([]string, 0, len(fragment))
+	atomAtToken := map[int]*smilesAtom{}
+	for _, a := range atoms {
+		atomAtToken[a.tokenIdx] = a
+	}
+	for i, tok := range fragment {
+		if tok == "/" || tok == `\` {
+			continue // Drop double bond stereo
+		}
+		if a, isAtom := atomAtToken[i]; isAtom {
+			a.chirality = ""
+			tok = formatSmilesAtom(a)
+		}
+		out = append(out, tok)
+	}
+	return str.Join(out, "")
+}
+
+func tokenizeSmiles(smiles string) (tokens []string, ok bool) {
+	for rest := smiles; rest != ""; {
+		tok := smilesTokenPtn.FindString(rest)
+		if tok == "" {
+			return nil, false
+		}
+		tokens = append(tokens, tok)
+		rest = rest[len(tok):]
+	}
+	return tokens, len(tokens) > 0
+}
+
+// largestFragment returns the tokens of the fragment with the most heavy
+// atoms, using the alphabetically first one to break ties
+func largestFragment(tokens []string) []string {
+	fragments := [][]string{{}}
+	for _, tok := range tokens {
+		if tok == "." {
+			fragments = append(fragments, []string{})
+			continue
+		}
+		fragments[len(fragments)-1] = append(fragments[len(fragments)-1], tok)
+	}
+	best, bestCnt := fragments[0], -1
+	for _, frag := range fragments {
+		cnt := 0
+		for _, tok := range frag {
+			if tok[0] == '[' && isHeavyBracketAtom(tok) || tok[0] != '[' && isAtomToken(tok) {
+				cnt++
+			}
+		}
+		if cnt > bestCnt || (cnt == bestCnt && str.Join(frag, "") < str.Join(best, "")) {
+			best, bestCnt = frag, cnt
+		}
+	}
+	return best
+}
+
+func isAtomToken(tok string) bool {
+	c := tok[0]
+	return c == '[' || c == '*' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isHeavyBracketAtom(tok string) bool {
+	m := bracketAtomPtn.FindStringSubmatch(tok)
+	return m != nil && m[2] != "H"
+}
+
+// parseSmilesAtoms parses atoms, bonds, branches and ring closures, to get the
+// neighbours and the bond order sum of each atom
+func parseSmilesAtoms(tokens []string) (atoms []*smilesAtom, ok bool) {
+	prev := -1
+	branchStack := []int{}
+	bondOrder := 0.0
+	ringBonds := map[string][2]float64{} // ring label -> [atom index, bond order]
+
+	addBond := func(a, b int, order float64) {
+		if order == 0 {
+			order = 1
+			if atoms[a].aromatic() && atoms[b].aromatic() {
+				order = 1.5
+			}
+		}
+		atoms[a].bondSum += order
+		atoms[b].bondSum += order
+		atoms[a].neighbors = append(atoms[a].neighbors, b)
+		atoms[b].neighbors = append(atoms[b].neighbors, a)
+		atoms[a].bondOrders = append(atoms[a].bondOrders, order)
+		atoms[b].bondOrders = append(atoms[b].bondOrders, order)
+	}
+
+	for i, tok := range tokens {
+		switch {
+		case tok == ".":
+			prev, bondOrder = -1, 0 // Fragments are not bonded
+		case tok == "(":
+			branchStack = append(branchStack, prev)
+		case tok == ")":
+			if len(branchStack) == 0 {
+				return nil, false
+			}
+			prev = branchStack[len(branchStack)-1]
+			branchStack = branchStack[:len(branchStack)-1]
+		case str.ContainsAny(tok[:1], `-=#$:/\`):
+			bondOrder = map[string]float64{"-": 1, "=": 2, "#": 3, "$": 4, ":": 1.5, "/": 1, `\`: 1}[tok]
+		case tok[0] == '%' || (tok[0] >= '0' && tok[0] <= '9'):
+			if prev < 0 {
+				return nil, false
+			}
+			if open, exists := ringBonds[tok]; exists {
+				order := bondOrder
+				if order == 0 {
+					order = open[1]
+				}
+				addBond(int(open[0]), prev, order)
+				delete(ringBonds, tok)
+			} else {
+				ringBonds[tok] = [2]float64{float64(prev), bondOrder}
+			}
+			bondOrder = 0
+		default:
+			atom := &smilesAtom{tokenIdx: i, symbol: tok}
+			if tok[0] == '[' {
+				m := bracketAtomPtn.FindStringSubmatch(tok)
+				if m == nil {
+					return nil, false
+				}
+				atom.bracket = true
+				atom.isotope, atom.symbol, atom.chirality, atom.class = m[1], m[2], m[3], m[6]
+				if m[4] != "" {
+					atom.hCount = 1
+					if len(m[4]) > 1 {
+						atom.hCount, _ = strconv.Atoi(m[4][1:])
+					}
+				}
+				atom.charge = parseSmilesCharge(m[5])
+			}
+			atoms = append(atoms, atom)
+			if prev >= 0 {
+				addBond(prev, len(atoms)-1, bondOrder)
+			}
+			prev = len(atoms) - 1
+			bondOrder = 0
+		}
+	}
+	return atoms, len(ringBonds) == 0 && len(branchStack) == 0
+}
+
+func parseSmilesCharge(chargeStr string) int {
+	if chargeStr == "" {
+		return 0
+	}
+	sign := 1
+	if chargeStr[0] == '-' {
+		sign = -1
+	}
+	if n, err := strconv.Atoi(chargeStr[1:]); err == nil {
+		return sign * n
+	}
+	return sign * len(chargeStr)
+}
+
+// neutralizeAtoms removes charges that can be neutralized by adding or
+// removing a hydrogen. Charges that are part of a (formally) charged group,
+// such as nitro groups and N-oxides, are kept, as are negative charges needed
+// to balance quaternary nitrogens.
+func neutralizeAtoms(atoms []*smilesAtom) {
+	hasChargedNeighbor := func(a *smilesAtom, sign int) bool {
+		for _, n := range a.neighbors {
+			if atoms[n].charge*sign > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	nonRemovablePos := 0
+	for _, a := range atoms {
+		if a.charge > 0 && a.hCount == 0 && !hasChargedNeighbor(a, -1) {
+			nonRemovablePos += a.charge
+		}
+	}
+	for _, a := range atoms {
+		if a.charge > 0 && a.hCount >= a.charge && !hasChargedNeighbor(a, -1) {
+			a.hCount -= a.charge
+			a.charge = 0
+		}
+	}
+	for _, a := range atoms {
+		if a.charge < 0 && !hasChargedNeighbor(a, 1) && strInSlice(a.element(), []string{"O", "S", "N"}) {
+			if nonRemovablePos > 0 {
+				nonRemovablePos += a.charge
+				continue
+			}
+			a.hCount -= a.charge
+			a.charge = 0
+		}
+	}
+}
+
+// formatSmilesAtom writes an atom back to SMILES, using the short organic
+// subset form whenever that means the same thing as the bracket form
+func formatSmilesAtom(a *smilesAtom) string {
+	if !a.bracket {
+		return a.symbol
+	}
+	if a.isotope == "" && a.chirality == "" && a.charge == 0 && a.class == "" && a.hCount == implicitHCount(a) {
+		if _, organic := defaultValences[a.element()]; organic && (!a.aromatic() || strInSlice(a.symbol, []string{"b", "c", "n", "o", "p", "s"})) {
+			return a.symbol
+		}
+	}
+	out := "[" + a.isotope + a.symbol + a.chirality
+	if a.hCount == 1 {
+		out += "H"
+	} else if a.hCount > 1 {
+		out += fmt.Sprintf("H%d", a.hCount)
+	}
+	if a.charge == 1 {
+		out += "+"
+	} else if a.charge == -1 {
+		out += "-"
+	} else if a.charge > 1 {
+		out += fmt.Sprintf("+%d", a.charge)
+	} else if a.charge < -1 {
+		out += fmt.Sprintf("-%d", -a.charge)
+	}
+	return out + a.class + "]"
+}
+
+// implicitHCount returns the number of hydrogens an organic subset atom would
+// get implicitly, given its bonds, or -1 if it isn't in the organic subset
+func implicitHCount(a *smilesAtom) int {
+	valences, ok := defaultValences[a.element()]
+	if !ok {
+		return -1
+	}
+	bondSum := int(a.bondSum)
+	for _, v := range valences {
+		if v >= bondSum {
+			return v - bondSum
+		}
+	}
+	return 0
+}
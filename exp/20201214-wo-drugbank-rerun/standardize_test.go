@@ -0,0 +1,181 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBasicStandardizeSmiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		smiles string
+		want   string
+	}{
+		// Salts: the largest fragment is kept
+		{"sodium salt", "CC(=O)[O-].[Na+]", "CC(=O)O"},
+		{"hydrochloride", "CC(=O)O.Cl", "CC(=O)O"},
+		{"dihydrochloride", "Cl.Cl.NCCN", "NCCN"},
+		{"calcium salt with two equal fragments", "O=C([O-])c1ccccc1.O=C([O-])c1ccccc1.[Ca+2]", "O=C(O)c1ccccc1"},
+		{"inorganic salt, tie broken alphabetically", "[Na+].[Cl-]", "[Cl-]"},
+		// Charges
+		{"zwitterion", "[NH3+]CCC(=O)[O-]", "NCCC(=O)O"},
+		{"thiolate", "CC[S-]", "CCS"},
+		{"quaternary nitrogen kept", "C[N+](C)(C)C.[Cl-]", "C[N+](C)(C)C"},
+		{"nitro group kept", "C[N+](=O)[O-]", "C[N+](=O)[O-]"},
+		{"N-oxide kept", "c1cc[n+]([O-])cc1", "c1cc[n+]([O-])cc1"},
+		{"metal ion kept", "[Fe+2]", "[Fe+2]"},
+		// Stereo
+		{"tetrahedral @", "C[C@H](N)C(=O)O", "CC(N)C(=O)O"},
+		{"tetrahedral @@", "C[C@@H](O)F", "CC(O)F"},
+		{"trans double bond", "F/C=C/F", "FC=CF"},
+		{"cis double bond", `F/C=C\F`, "FC=CF"},
+		// Ring closures
+		{"aromatic ring", "c1ccccc1O", "c1ccccc1O"},
+		{"bicycle", "C1CC2CCC1CC2", "C1CC2CCC1CC2"},
+		{"two-digit ring label", "C%12CCCCC%12", "C%12CCCCC%12"},
+		{"ring closure with bond order", "C=1CCCCC1", "C=1CCCCC1"},
+		// Bracket atoms
+		{"isotope kept", "[13CH3]O", "[13CH3]O"},
+		{"deuterium kept", "[2H]C", "[2H]C"},
+		{"aromatic NH kept", "[nH]1cccc1", "[nH]1cccc1"},
+		{"atom class kept", "[CH3:1]C", "[CH3:1]C"},
+		{"organic bracket atom simplified", "[CH3][OH]", "CO"},
+		{"metal without charge", "[Cu]", "[Cu]"},
+		// Unparseable SMILES are returned unchanged
+		{"unclosed ring", "C1CC", "C1CC"},
+		{"unclosed branch", "C(C", "C(C"},
+		{"unopened branch", "C)", "C)"},
+		{"unknown element", "Xx", "Xx"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := basicStandardizeSmiles(tt.smiles); got != tt.want {
+				t.Errorf("basicStandardizeSmiles(%q) = %q, want %q", tt.smiles, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewStandardizer(t *testing.T) {
+	if _, ok := NewStandardizer(builtinStandardizer).(*BasicStandardizer); !ok {
+		t.Errorf("NewStandardizer(%q) is not a BasicStandardizer", builtinStandardizer)
+	}
+	// A stand-in for a canonicalizing tool, which also drops one structure
+	cmd := `awk -F'\t' '$1 != "XX" { print ($1 == "OCC" ? "CCO" : $1) "\t" $2 }'`
+	s, ok := NewStandardizer(cmd).(*ExternalStandardizer)
+	if !ok {
+		t.Fatalf("NewStandardizer(%q) is not an ExternalStandardizer", cmd)
+	}
+	smiles := []string{"OCC", "CCO", "XX", "c1ccccc1"}
+	want := []string{"CCO", "CCO", "XX", "c1ccccc1"}
+	if got := s.Standardize(smiles); !reflect.DeepEqual(got, want) {
+		t.Errorf("Standardize(%v) = %v, want %v", smiles, got, want)
+	}
+}
+
+func TestTokenizeSmiles(t *testing.T) {
+	tests := []struct {
+		smiles string
+		want   []string
+		ok     bool
+	}{
+		{"CCO", []string{"C", "C", "O"}, true},
+		{"ClCBr", []string{"Cl", "C", "Br"}, true},
+		{"C[C@@H](Br)c1ccc(Cl)cc1", []string{"C", "[C@@H]", "(", "Br", ")", "c", "1", "c", "c", "c", "(", "Cl", ")", "c", "c", "1"}, true},
+		{"CC(=O)[O-].[Na+]", []string{"C", "C", "(", "=", "O", ")", "[O-]", ".", "[Na+]"}, true},
+		{"C%12CC%12", []string{"C", "%12", "C", "C", "%12"}, true},
+		{`F/C=C\F`, []string{"F", "/", "C", "=", "C", `\`, "F"}, true},
+		{"[13CH3:2]#N", []string{"[13CH3:2]", "#", "N"}, true},
+		{"", nil, false},
+		{"CXC", nil, false},
+		{"C[CH3", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := tokenizeSmiles(tt.smiles)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeSmiles(%q) = %q, %t, want %q, %t", tt.smiles, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseSmilesAtoms(t *testing.T) {
+	type atomWant struct {
+		symbol    string
+		chirality string
+		hCount    int
+		charge    int
+		bondSum   float64
+		neighbors []int
+	}
+	tests := []struct {
+		name   string
+		smiles string
+		want   []atomWant
+		ok     bool
+	}{
+		{"chain with branch", "CC(C)O", []atomWant{
+			{"C", "", 0, 0, 1, []int{1}},
+			{"C", "", 0, 0, 3, []int{0, 2, 3}},
+			{"C", "", 0, 0, 1, []int{1}},
+			{"O", "", 0, 0, 1, []int{1}},
+		}, true},
+		{"double and triple bonds", "C=CC#N", []atomWant{
+			{"C", "", 0, 0, 2, []int{1}},
+			{"C", "", 0, 0, 3, []int{0, 2}},
+			{"C", "", 0, 0, 4, []int{1, 3}},
+			{"N", "", 0, 0, 3, []int{2}},
+		}, true},
+		{"aromatic ring closure", "c1ccccc1", []atomWant{
+			{"c", "", 0, 0, 3, []int{1, 5}},
+			{"c", "", 0, 0, 3, []int{0, 2}},
+			{"c", "", 0, 0, 3, []int{1, 3}},
+			{"c", "", 0, 0, 3, []int{2, 4}},
+			{"c", "", 0, 0, 3, []int{3, 5}},
+			{"c", "", 0, 0, 3, []int{4, 0}},
+		}, true},
+		{"ring closure bond order on opening", "C=1CC1", []atomWant{
+			{"C", "", 0, 0, 3, []int{1, 2}},
+			{"C", "", 0, 0, 2, []int{0, 2}},
+			{"C", "", 0, 0, 3, []int{1, 0}},
+		}, true},
+		{"bracket atoms", "[NH3+]C[C@@H]([O-])[13CH3]", []atomWant{
+			{"N", "", 3, 1, 1, []int{1}},
+			{"C", "", 0, 0, 2, []int{0, 2}},
+			{"C", "@@", 1, 0, 3, []int{1, 3, 4}},
+			{"O", "", 0, -1, 1, []int{2}},
+			{"C", "", 3, 0, 1, []int{2}},
+		}, true},
+		{"multiple charges", "[Fe+2].[O--]", []atomWant{
+			{"Fe", "", 0, 2, 0, nil},
+			{"O", "", 0, -2, 0, nil},
+		}, true},
+		{"unclosed ring", "C1CC", nil, false},
+		{"unclosed branch", "C(C", nil, false},
+		{"ring closure before any atom", "1CC1", nil, false},
+		{"unopened branch", "C)C", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tokens, ok := tokenizeSmiles(tt.smiles)
+			if !ok {
+				t.Fatalf("Could not tokenize %q", tt.smiles)
+			}
+			atoms, ok := parseSmilesAtoms(tokens)
+			if ok != tt.ok {
+				t.Fatalf("parseSmilesAtoms(%q) ok = %t, want %t", tt.smiles, ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if len(atoms) != len(tt.want) {
+				t.Fatalf("parseSmilesAtoms(%q) gave %d atoms, want %d", tt.smiles, len(atoms), len(tt.want))
+			}
+			for i, a := range atoms {
+				got := atomWant{a.symbol, a.chirality, a.hCount, a.charge, a.bondSum, a.neighbors}
+				if !reflect.DeepEqual(got, tt.want[i]) {
+					t.Errorf("parseSmilesAtoms(%q) atom %d = %+v, want %+v", tt.smiles, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
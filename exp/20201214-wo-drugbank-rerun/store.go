@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// ================================================================================
+// Indexed store of gene/id/smiles/activity (gisa) files
+// ================================================================================
+
+// A GISA store holds the rows of a gisa file, indexed by gene and structure,
+// so that the data of a target can be read without scanning the full file.
+// The store is one file, made up of:
+//
+//   - the magic line gisaStoreMagic
+//   - the rows of each gene, as in the gisa file
+//   - the unique structures (SMILES) of all genes, sorted, one per line
+//   - the gob-encoded index, with the offsets of the sections above
+//   - the offset of the index, as 8 bytes little-endian
+const gisaStoreMagic = "GISASTORE1\n"
+
+// gisaStoreIndex is the index of a GISA store
+type gisaStoreIndex struct {
+	Genes         map[string]gisaStoreGene
+	StructsOffset int64
+	StructsSize   int64
+	NumStructs    int
+}
+
+// gisaStoreGene is the index entry of the rows of a gene
+type gisaStoreGene struct {
+	Offset     int64
+	Size       int64
+	Rows       int
+	Actives    int
+	Nonactives int
+}
+
+// writeGISAStore builds a store from a gisa file, which has to be grouped by
+// gene, as the sorted gisa files of the workflow are
+func writeGISAStore(gisaPath string, storePath string) *gisaStoreIndex {
+	outFh, err := os.Create(storePath)
+	sp.CheckWithMsg(err, "Could not create GISA store: "+storePath)
+	defer outFh.Close()
+	outWrt := bufio.NewWriterSize(outFh, 1024*1024)
+	offset := int64(0)
+	write := func(s string) {
+		n, err := outWrt.WriteString(s)
+		sp.CheckWithMsg(err, "Could not write GISA store: "+storePath)
+		offset += int64(n)
+	}
+
+	index := &gisaStoreIndex{Genes: map[string]gisaStoreGene{}}
+	structs := map[string]bool{}
+	write(gisaStoreMagic)
+	gene := ""
+	entry := gisaStoreGene{}
+	forEachGISARow(gisaPath, func(row []string) {
+		if row[0] != gene {
+			if gene != "" {
+				index.Genes[gene] = entry
+			}
+			gene = row[0]
+			if _, ok := index.Genes[gene]; ok {
+				sp.Failf("The rows of gene %s are not grouped together in %s, so can not build a store from it (sort it on gene first)\n", gene, gisaPath)
+			}
+			entry = gisaStoreGene{Offset: offset}
+		}
+		start := offset
+		write(str.Join(row, "\t") + "\n")
+		entry.Size += offset - start
+		entry.Rows++
+		switch row[3] {
+		case "A":
+			entry.Actives++
+		case "N":
+			entry.Nonactives++
+		}
+		structs[row[2]] = true
+	})
+	if gene != "" {
+		index.Genes[gene] = entry
+	}
+
+	sorted := make([]string, 0, len(structs))
+	for smiles := range structs {
+		sorted = append(sorted, smiles)
+	}
+	sort.Strings(sorted)
+	index.StructsOffset = offset
+	for _, smiles := range sorted {
+		write(smiles + "\n")
+	}
+	index.StructsSize = offset - index.StructsOffset
+	index.NumStructs = len(sorted)
+
+	indexOffset := offset
+	var indexBuf bytes.Buffer
+	sp.CheckWithMsg(gob.NewEncoder(&indexBuf).Encode(index), "Could not encode the index of GISA store: "+storePath)
+	write(indexBuf.String())
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(footer, uint64(indexOffset))
+	write(string(footer))
+	sp.CheckWithMsg(outWrt.Flush(), "Could not write GISA store: "+storePath)
+	return index
+}
+
+// GISAStore is an opened GISA store
+type GISAStore struct {
+	path    string
+	fh      *os.File
+	index   gisaStoreIndex
+	structs []string
+}
+
+// OpenGISAStore opens a GISA store, and reads its index
+func OpenGISAStore(path string) *GISAStore {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open GISA store: "+path)
+	s := &GISAStore{path: path, fh: fh}
+
+	magic := make([]byte, len(gisaStoreMagic))
+	if _, err := io.ReadFull(fh, magic); err != nil || string(magic) != gisaStoreMagic {
+		sp.Failf("Not a GISA store: %s\n", path)
+	}
+	info, err := fh.Stat()
+	sp.CheckWithMsg(err, "Could not stat GISA store: "+path)
+	footer := make([]byte, 8)
+	_, err = fh.ReadAt(footer, info.Size()-8)
+	sp.CheckWithMsg(err, "Could not read the footer of GISA store: "+path)
+	indexOffset := int64(binary.LittleEndian.Uint64(footer))
+	indexReader := io.NewSectionReader(fh, indexOffset, info.Size()-8-indexOffset)
+	sp.CheckWithMsg(gob.NewDecoder(indexReader).Decode(&s.index), "Could not decode the index of GISA store: "+path)
+	return s
+}
+
+func (s *GISAStore) Close() {
+	s.fh.Close()
+}
+
+// Genes returns the genes in the store, sorted
+func (s *GISAStore) Genes() []string {
+	genes := []string{}
+	for gene := range s.index.Genes {
+		genes = append(genes, gene)
+	}
+	sort.Strings(genes)
+	return genes
+}
+
+// ForEachRow calls rowFunc with the fields of each row of a gene, in the
+// order of the gisa file. Genes not in the store have no rows.
+func (s *GISAStore) ForEachRow(gene string, rowFunc func(row []string)) {
+	entry, ok := s.index.Genes[gene]
+	if !ok {
+		return
+	}
+	scanner := bufio.NewScanner(io.NewSectionReader(s.fh, entry.Offset, entry.Size))
+	scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+	for scanner.Scan() {
+		rowFunc(str.Split(scanner.Text(), "\t"))
+	}
+	sp.CheckWithMsg(scanner.Err(), "Could not read the rows of "+gene+" in GISA store: "+s.path)
+}
+
+// Structures returns the unique structures (SMILES) of all genes, sorted. They
+// are read on first use.
+func (s *GISAStore) Structures() []string {
+	if s.structs == nil {
+		data := make([]byte, s.index.StructsSize)
+		_, err := s.fh.ReadAt(data, s.index.StructsOffset)
+		sp.CheckWithMsg(err, "Could not read the structures of GISA store: "+s.path)
+		s.structs = make([]string, 0, s.index.NumStructs)
+		for _, line := range str.SplitAfter(string(data), "\n") {
+			if line != "" {
+				s.structs = append(s.structs, str.TrimSuffix(line, "\n"))
+			}
+		}
+	}
+	return s.structs
+}
+
+// StructureIndex returns the index of a structure in Structures(), and whether
+// it is in the store
+func (s *GISAStore) StructureIndex(smiles string) (int, bool) {
+	structs := s.Structures()
+	i := sort.SearchStrings(structs, smiles)
+	return i, i < len(structs) && structs[i] == smiles
+}
+
+// ================================================================================
+// Processes using GISA stores
+// ================================================================================
+
+// BuildGISAStore is a SciPipe process building a GISA store from a gisa
+// file, once, for the extraction processes below to read from
+type BuildGISAStore struct {
+	*sp.Process
+}
+
+func (p *BuildGISAStore) InGISA() *sp.InPort    { return p.In("gisa") }
+func (p *BuildGISAStore) OutStore() *sp.OutPort { return p.Out("store") }
+
+func NewBuildGISAStore(wf *sp.Workflow, procName string) *BuildGISAStore {
+	p := &BuildGISAStore{wf.NewProc(procName, "# BuildGISAStore custom process. Ports: {i:gisa} {o:store}")}
+	p.SetPathReplace("gisa", "store", ".tsv", ".gisastore")
+	p.CustomExecute = func(t *sp.Task) {
+		index := writeGISAStore(t.InPath("gisa"), t.OutIP("store").TempPath())
+		sp.Audit.Printf("| %-32s | Stored the rows of %d genes, with %d unique structures\n", t.Name, len(index.Genes), index.NumStructs)
+	}
+	return p
+}
+
+// ExtractTargetDataFromStore is a SciPipe process extracting the data for one
+// target (the "gene" parameter) from a GISA store, as "smiles<tab>activity"
+// lines with a header, like the awk-based extract_target_data_* processes.
+// The panel symbol and Entrez ID parameters are only kept in the audit logs.
+type ExtractTargetDataFromStore struct {
+	*sp.Process
+}
+
+func (p *ExtractTargetDataFromStore) InStore() *sp.InPort     { return p.In("store") }
+func (p *ExtractTargetDataFromStore) InGene() *sp.ParamInPort { return p.ParamInPort("gene") }
+func (p *ExtractTargetDataFromStore) InPanelSymbol() *sp.ParamInPort {
+	return p.ParamInPort("panel_symbol")
+}
+func (p *ExtractTargetDataFromStore) InEntrezID() *sp.ParamInPort { return p.ParamInPort("entrez_id") }
+func (p *ExtractTargetDataFromStore) OutTargetData() *sp.OutPort  { return p.Out("target_data") }
+
+func NewExtractTargetDataFromStore(wf *sp.Workflow, procName string) *ExtractTargetDataFromStore {
+	p := &ExtractTargetDataFromStore{wf.NewProc(procName, "# ExtractTargetDataFromStore custom process. Ports: {i:store} {p:gene} {o:target_data} panel_symbol:{p:panel_symbol} entrez_id:{p:entrez_id}")}
+	p.CustomExecute = func(t *sp.Task) {
+		store := OpenGISAStore(t.InPath("store"))
+		defer store.Close()
+		outPath := t.OutIP("target_data").TempPath()
+		outFh, err := os.Create(outPath)
+		sp.CheckWithMsg(err, "Could not create file: "+outPath)
+		defer outFh.Close()
+		outWrt := bufio.NewWriter(outFh)
+		outWrt.WriteString("smiles\tactivity\n")
+		rows := 0
+		store.ForEachRow(t.Param("gene"), func(row []string) {
+			outWrt.WriteString(row[2] + "\t" + row[3] + "\n")
+			rows++
+		})
+		sp.CheckWithMsg(outWrt.Flush(), "Could not write file: "+outPath)
+		sp.Audit.Printf("| %-32s | Extracted %d rows for %s\n", t.Name, rows, t.Param("gene"))
+	}
+	return p
+}
+
+// SampleAssumedNonActives is a SciPipe process sampling assumed non-actives
+// for a target (the "gene" parameter) from a GISA store, to fill up its target
+// data to twice as many non-actives as actives. The candidates are the
+// structures of the other genes that are neither in the target data nor
+// reported for the gene. The sample is drawn with a seed read from the random
+// source file, so that it is the same for the same random source, and written
+// as sorted "smiles<tab>N" lines, without header. It replaces the awk/shuf
+// based extract_assumed_n_* processes, although the samples drawn differ.
+type SampleAssumedNonActives struct {
+	*sp.Process
+}
+
+func (p *SampleAssumedNonActives) InStore() *sp.InPort          { return p.In("store") }
+func (p *SampleAssumedNonActives) InTargetData() *sp.InPort     { return p.In("targetdata") }
+func (p *SampleAssumedNonActives) InRandSrc() *sp.InPort        { return p.In("randsrc") }
+func (p *SampleAssumedNonActives) InGene() *sp.ParamInPort      { return p.ParamInPort("gene") }
+func (p *SampleAssumedNonActives) InReplicate() *sp.ParamInPort { return p.ParamInPort("replicate") }
+func (p *SampleAssumedNonActives) OutAssumedN() *sp.OutPort     { return p.Out("assumed_n") }
+
+func NewSampleAssumedNonActives(wf *sp.Workflow, procName string) *SampleAssumedNonActives {
+	p := &SampleAssumedNonActives{wf.NewProc(procName, "# SampleAssumedNonActives custom process. Ports: {i:store} {i:targetdata} {i:randsrc} {p:gene} {o:assumed_n} replicate:{p:replicate}")}
+	p.CustomExecute = func(t *sp.Task) {
+		gene := t.Param("gene")
+		store := OpenGISAStore(t.InPath("store"))
+		defer store.Close()
+
+		// Structures to exclude, and the number of non-actives to add
+		exclude := map[int]bool{}
+		actives, nonactives := 0, 0
+		fh, err := os.Open(t.InPath("targetdata"))
+		sp.CheckWithMsg(err, "Could not open file: "+t.InPath("targetdata"))
+		scanner := bufio.NewScanner(fh)
+		scanner.Buffer(make([]byte, 1024*1024), 16*1024*1024)
+		for scanner.Scan() {
+			fields := str.Split(scanner.Text(), "\t")
+			if len(fields) < 2 {
+				continue
+			}
+			switch fields[1] {
+			case "A":
+				actives++
+			case "N":
+				nonactives++
+			}
+			if i, ok := store.StructureIndex(fields[0]); ok {
+				exclude[i] = true
+			}
+		}
+		sp.CheckWithMsg(scanner.Err(), "Could not read file: "+t.InPath("targetdata"))
+		fh.Close()
+		store.ForEachRow(gene, func(row []string) {
+			if i, ok := store.StructureIndex(row[2]); ok {
+				exclude[i] = true
+			}
+		})
+
+		candidates := make([]int, 0, len(store.Structures())-len(exclude))
+		for i := range store.Structures() {
+			if !exclude[i] {
+				candidates = append(candidates, i)
+			}
+		}
+		n := actives*2 - nonactives
+		if n < 0 {
+			n = 0
+		}
+		if n > len(candidates) {
+			sp.Warning.Printf("| %-32s | Only %d candidate non-actives for %s, but %d needed\n", t.Name, len(candidates), gene, n)
+			n = len(candidates)
+		}
+		rnd := rand.New(rand.NewSource(seedFromFile(t.InPath("randsrc"))))
+		for i := 0; i < n; i++ {
+			j := i + rnd.Intn(len(candidates)-i)
+			candidates[i], candidates[j] = candidates[j], candidates[i]
+		}
+		sample := candidates[:n]
+		sort.Ints(sample)
+
+		outPath := t.OutIP("assumed_n").TempPath()
+		outFh, err := os.Create(outPath)
+		sp.CheckWithMsg(err, "Could not create file: "+outPath)
+		defer outFh.Close()
+		outWrt := bufio.NewWriter(outFh)
+		for _, i := range sample {
+			outWrt.WriteString(store.Structures()[i] + "\tN\n")
+		}
+		sp.CheckWithMsg(outWrt.Flush(), "Could not write file: "+outPath)
+		sp.Audit.Printf("| %-32s | Sampled %d assumed non-actives for %s, out of %d candidates\n", t.Name, n, gene, len(candidates))
+	}
+	return p
+}
+
+// seedFromFile returns a seed made from the first 8 bytes of a random source
+// file
+func seedFromFile(path string) int64 {
+	fh, err := os.Open(path)
+	sp.CheckWithMsg(err, "Could not open random source file: "+path)
+	defer fh.Close()
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(fh, buf)
+	sp.CheckWithMsg(err, fmt.Sprintf("Could not read 8 bytes from random source file: %s", path))
+	return int64(binary.LittleEndian.Uint64(buf))
+}
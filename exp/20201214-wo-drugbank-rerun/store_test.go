@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	str "strings"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+func TestGISAStoreRoundTrip(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "gisa_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	rows := map[string][][]string{
+		"DRD1": {
+			{"DRD1", "CHEMBL1", "CCO", "A"},
+			{"DRD1", "CHEMBL2,CHEMBL3", "c1ccccc1", "N"},
+			{"DRD1", "CHEMBL4", "CCN", "N"},
+		},
+		"ADRB1": {
+			{"ADRB1", "CHEMBL1", "CCO", "N"},
+			{"ADRB1", "CHEMBL5", "C1CC1", "A", "extra"},
+		},
+	}
+	lines := []string{}
+	for _, gene := range []string{"DRD1", "ADRB1"} { // Grouped, but not sorted
+		for _, row := range rows[gene] {
+			lines = append(lines, str.Join(row, "\t"))
+		}
+	}
+	lines = append(lines, "too\tshort")
+	gisaPath := filepath.Join(tmpDir, "data.gisa.tsv")
+	if err := ioutil.WriteFile(gisaPath, []byte(str.Join(lines, "\n")+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	storePath := filepath.Join(tmpDir, "data.gisa.store")
+	index := writeGISAStore(gisaPath, storePath)
+	wantGenes := map[string][3]int{"DRD1": {3, 1, 2}, "ADRB1": {2, 1, 1}} // Rows, actives and non-actives
+	for gene, want := range wantGenes {
+		entry := index.Genes[gene]
+		if got := [3]int{entry.Rows, entry.Actives, entry.Nonactives}; got != want {
+			t.Errorf("Index of %s (rows, actives, non-actives) = %v, want %v", gene, got, want)
+		}
+	}
+
+	store := OpenGISAStore(storePath)
+	defer store.Close()
+	if got, want := store.Genes(), []string{"ADRB1", "DRD1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Genes() = %v, want %v", got, want)
+	}
+	for _, gene := range []string{"ADRB1", "DRD1", "HTR2B"} {
+		got := [][]string{}
+		store.ForEachRow(gene, func(row []string) { got = append(got, row) })
+		want := rows[gene]
+		if want == nil {
+			want = [][]string{}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Rows of %s = %v, want %v", gene, got, want)
+		}
+	}
+
+	wantStructs := []string{"C1CC1", "CCN", "CCO", "c1ccccc1"}
+	if got := store.Structures(); !reflect.DeepEqual(got, wantStructs) {
+		t.Errorf("Structures() = %v, want %v", got, wantStructs)
+	}
+	structTests := []struct {
+		smiles string
+		index  int
+		ok     bool
+	}{
+		{"C1CC1", 0, true},
+		{"c1ccccc1", 3, true},
+		{"CCC", 1, false},
+	}
+	for _, tt := range structTests {
+		if i, ok := store.StructureIndex(tt.smiles); i != tt.index || ok != tt.ok {
+			t.Errorf("StructureIndex(%q) = %d, %t, want %d, %t", tt.smiles, i, ok, tt.index, tt.ok)
+		}
+	}
+}
+
+func TestEmptyGISAStore(t *testing.T) {
+	sp.InitLogError()
+	tmpDir, err := ioutil.TempDir("", "gisa_store_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	gisaPath := filepath.Join(tmpDir, "empty.gisa.tsv")
+	if err := ioutil.WriteFile(gisaPath, []byte{}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storePath := filepath.Join(tmpDir, "empty.gisa.store")
+	writeGISAStore(gisaPath, storePath)
+
+	store := OpenGISAStore(storePath)
+	defer store.Close()
+	if len(store.Genes()) != 0 || len(store.Structures()) != 0 {
+		t.Errorf("Empty store has genes %v and structures %v, want none", store.Genes(), store.Structures())
+	}
+}
@@ -0,0 +1,4 @@
+#!/bin/bash
+# Run the smallest gene set via the Kubernetes executor, with the fake kubectl
+# in bin/fakekube, which runs the jobs locally
+go run . -threads 1 -maxtasks 40 -geneset "smallest1" -kubernetes -k8sconfig bin/fakekube/kubernetes.json -procs "create_report" &> log/scipipe-fakekube-$(date +%Y%m%d-%H%M%S).log # -debug
@@ -0,0 +1,4 @@
+#!/bin/bash
+# Run the smallest gene set via the SLURM executor, with the fake sbatch,
+# squeue and sacct in bin/fakeslurm, which run the jobs locally
+go run . -threads 1 -maxtasks 40 -geneset "smallest1" -slurm -slurmconfig bin/fakeslurm/slurm.json -procs "create_report" &> log/scipipe-fakeslurm-$(date +%Y%m%d-%H%M%S).log # -debug
@@ -5,7 +5,10 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	str "strings"
@@ -15,13 +18,54 @@ import (
 )
 
 var (
-	graph      = flag.Bool("graph", false, "If this flag is specified, the workflow will just print out the workflow as a graph in dot and pdf format, and nothing else")
-	maxTasks   = flag.Int("maxtasks", 4, "Max number of local cores to use")
-	threads    = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
-	geneSet    = flag.String("geneset", "smallest1", "Gene set to use (one of smallest1, smallest3, smallest4, bowes44)")
-	runSlurm   = flag.Bool("slurm", false, "Start computationally heavy jobs via SLURM")
-	debug      = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
-	procsRegex = flag.String("procs", "plot_summary.*", "A regex specifying which processes (by name) to run up to")
+	graph           = flag.Bool("graph", false, "If this flag is specified, the workflow will just write out the workflow graph (up to the processes matched by -procs), with processes coloured by the state of their outputs on disk, and by the failures in the -failurereport and failure logs of earlier runs, and nothing else")
+	graphFormat     = flag.String("graphformat", graphFormatDOT, "Format for the workflow graph (dot or mermaid)")
+	graphCollapse   = flag.Bool("graphcollapse", false, "Collapse the per-gene branches of the workflow graph into one template branch")
+	graphGene       = flag.String("graphgene", "", "Gene whose branch to highlight in the workflow graph. With -graphcollapse, the template branch shows the state of this gene")
+	maxTasks        = flag.Int("maxtasks", 4, "Max number of local cores to use")
+	threads         = flag.Int("threads", 1, "Number of threads that Go is allowed to start")
+	geneSet         = flag.String("geneset", "smallest1", "Gene set to use (one of smallest1, smallest3, smallest4, bowes44)")
+	runSlurm        = flag.Bool("slurm", false, "Run computationally heavy tasks as SLURM jobs, submitted with sbatch (Use a high -maxtasks, as each waiting job takes a task slot)")
+	slurmConfig     = flag.String("slurmconfig", "", "JSON file with SLURM settings (account, partition, cores, time_limits per process kind, use_arrays, etc., see slurm.go). Settings not in the file get defaults")
+	runKubernetes   = flag.Bool("kubernetes", false, "Run CPSign tasks (precompute, crossval, train, validate) as Kubernetes Jobs, created with kubectl, on a volume shared with the workflow (Use a high -maxtasks, as each running job takes a task slot)")
+	k8sConfig       = flag.String("k8sconfig", "", "JSON file with Kubernetes settings (namespace, image, volume_claim, mount_path, resources per process kind, etc., see kubernetes.go). Settings not in the file get defaults")
+	localResources  = flag.Bool("resources", false, "Schedule local tasks by the cores and memory they need (see resources.go), against the -cores and -mem budget of the host, instead of only counting tasks (Use a high -maxtasks, as each task waiting for resources takes a task slot)")
+	localCores      = flag.Int("cores", 0, "Number of cores that local tasks may use, with -resources (default: the number of cores of the host)")
+	localMemMB      = flag.Int("mem", 0, "Memory in MB that local tasks may use, with -resources (default: 80% of the memory of the host)")
+	resourceConfig  = flag.String("resourceconfig", "", "JSON file with the cores and memory (mem_mb) per process kind (precompute, crossval, learningcurve, train, validate, extract, default), also deciding the Java heap size of CPSign. Kinds not in the file get defaults")
+	retryConfig     = flag.String("retryconfig", "", "JSON file with retry policies (max_attempts, backoff, backoff_factor, heap_factor) per process kind (precompute, crossval, learningcurve, train, validate, extract, default), see retry.go. Kinds not in the file get defaults")
+	continueOnFail  = flag.Bool("continue", false, "If a target branch fails (after retries), mark it as failed and continue with the other targets, and write a failure report at the end, instead of stopping the workflow")
+	failureReport   = flag.String("failurereport", "res/failure_report.txt", "File to write the failure report to, with -continue")
+	runLog          = flag.String("runlog", "log/run_metrics.jsonl", "JSONL file to append the metrics of each task attempt to (wall time, CPU time, peak memory, exit status, host and executor), as summarized by the runstats command")
+	explain         = flag.Bool("explain", false, "Log why each task is run, rerun or reused, based on the cache keys stored next to the outputs (command, parameters, input checksums and CPSign version)")
+	geneAliases     = flag.String("genealiases", "", "NCBI gene_info file (such as Homo_sapiens.gene_info.gz) or HGNC complete set file, to resolve the gene symbols of the panel that are not in ExCAPE-DB")
+	geneTaxID       = flag.String("genetaxid", "9606", "Taxonomy ID of the genes to read from an NCBI gene_info file")
+	skipUnresolved  = flag.Bool("skipunresolved", false, "Leave out genes of the panel that are missing in ExCAPE-DB, or ambiguous, instead of failing")
+	minPerClass     = flag.Int("minpercls", 100, "Min number of unique, non-conflicting, structures per class (active and non-active) for a gene to be eligible for modelling, as selected by the excapedb_stats process")
+	statsPanel      = flag.String("statspanel", "bowes44", "Gene set to select the genes eligible for modelling from, in the excapedb_stats process (or \"all\", for all genes in ExCAPE-DB)")
+	geneSetFile     = flag.String("genesetfile", "", "File with the gene symbols of a gene set, one per line, such as the eligible panel written by the excapedb_stats process, to use instead of -geneset")
+	configFile      = flag.String("config", "", "JSON file with flag values, such as {\"geneset\": \"bowes44\"}. Flags given on the command line override the file")
+	debug           = flag.Bool("debug", false, "Increase logging level to include DEBUG messages")
+	procsRegex      = flag.String("procs", "create_report", "A regex specifying which processes (by name) to run up to (the report depends on all the summaries and plots)")
+	plan            = flag.Bool("plan", false, "Only print the tasks that would be run (up to the processes matched by -procs), with their commands and outputs, and whether the task cache would run, rerun or reuse them, grouped by gene, runset and replicate")
+	useStore        = flag.Bool("store", false, "Build an indexed store of the ExCAPE-DB data (without the DrugBank compounds) once, and extract the target data, and sample assumed non-actives, from it, instead of scanning the full data file with awk per target and replicate. The sampled assumed non-actives differ from those sampled with shuf")
+	speciesStr      = flag.String("species", "all", "Species whose ExCAPE-DB data to train on (comma-separated names: human, rat, mouse, or tax IDs, or all). ExCAPE-DB gives orthologs the same gene symbol, so with all, the data of all species is mixed, as before")
+	orthologs       = flag.Bool("orthologs", false, "Also train on the data of other species for the genes in the ortholog group of each human target, under the symbol of the human gene, whichever species are selected with -species")
+	speciesWeightsS = flag.String("speciesweights", "", "Comma-separated weights of non-human species, such as \"rat:0.5,mouse:0.5\", as the fraction of their rows to keep (sampled by structure, the same in every run)")
+	labelSource     = flag.String("labels", labelsExcape, "Source of the activity labels (one of excape, pxc50). With pxc50, the labels are derived from the pXC50 values, with the -pxc50threshold, instead of taken from the Activity_Flag of ExCAPE-DB")
+	pxc50Threshold  = flag.Float64("pxc50threshold", 6.0, "pXC50 value from which compounds are labelled active, with -labels pxc50")
+	pxc50GreyZone   = flag.Float64("pxc50greyzone", 0.0, "Compounds with pXC50 values closer than this to the threshold are left out of the data, with -labels pxc50")
+	labelConfig     = flag.String("labelconfig", "", "JSON file with pXC50 thresholds (threshold, grey_zone) per target, and for the other targets (default), with -labels pxc50, such as {\"PDE3A\": {\"threshold\": 5}}. Targets not in the file get the -pxc50threshold and -pxc50greyzone")
+	standardize     = flag.Bool("standardize", false, "Standardize chemical structures (keep largest fragment, neutralize charges, remove stereo) before removing conflicting records, with the command given with -standardizer")
+	standardizerCmd = flag.String("standardizer", defaultStandardizerCmd, "Standardization command, reading and writing \"SMILES<tab>ID\" lines on stdin/stdout and canonicalizing the SMILES, or \""+builtinStandardizer+"\" for the built-in Go standardizer, which does NOT canonicalize (the same compound in different atom orders is not merged)")
+	plotFormat      = flag.String("plotformat", plotFormatPDF, "Format for plots (pdf or svg)")
+	learningCurve   = flag.Bool("learningcurve", false, "Also crossvalidate each model, with the selected cost, on nested subsamples of the training data, to get learning curves")
+	lcFracsStr      = flag.String("lcfracs", "0.1,0.25,0.5,1.0", "Comma-separated subsample fractions for the learning curves")
+	splitMode       = flag.String("split", splitDrugBank, "How to select validation data (one of drugbank, scaffold, time). The scaffold and time modes hold out a part of each target's data, on Bemis-Murcko scaffolds or document years")
+	testFrac        = flag.Float64("testfrac", 0.2, "Fraction of each target's compounds to hold out for validation, in the scaffold and time split modes")
+	docYearsFile    = flag.String("docyears", "", "Tab-separated file with compound IDs (such as ChEMBL IDs) and document years, for the time split mode")
+	regression      = flag.Bool("regression", false, "Also train conformal regression models on the pXC50 values of each target, tuning their cost, and validate them on the DrugBank compounds, with the RMSE and the coverage and width of the prediction intervals (see regression.go)")
+	regCostsStr     = flag.String("regcosts", "1,10,100", "Comma-separated costs to crossvalidate the conformal regression models with, with -regression")
 
 	cpSignPath        = "../../bin/cpsign-1.5.0-beta9.jar"
 	cpSignLicensePath = "../../bin/cpsign-10-develop-standard-2021.license"
@@ -61,11 +105,13 @@ var (
 			"PDE3A", "SCN5A", "CCKAR", "ADRB1",
 		},
 	}
-	//costVals = []string{
-	//	"1",
-	//	"10",
-	//	"100",
-	//}
+	// Costs to search among for the targets not in costsPerTarget, such as
+	// those of gene set files
+	defaultCosts = []string{
+		"1",
+		"10",
+		"100",
+	}
 	costsPerTarget = map[string][]string{
 		"PDE3A":   []string{"1"},
 		"SCN5A":   []string{"10"},
@@ -107,16 +153,59 @@ var (
 	//}
 )
 
+// costsOf returns the costs to cross-validate for a gene: the one selected
+// for it in earlier runs, or else all the default costs
+func costsOf(gene string) []string {
+	if costs, ok := costsPerTarget[gene]; ok {
+		return costs
+	}
+	return defaultCosts
+}
+
 func main() {
 	// --------------------------------
 	// Parse flags and stuff
 	// --------------------------------
+	flag.Usage = func() {
+		name := filepath.Base(os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n", name)
+		for _, cmd := range []string{"runstats", "compare", "new-experiment"} {
+			fmt.Fprintf(flag.CommandLine.Output(), "       %s %s [flags] (see %s %s -h)\n", name, cmd, name, cmd)
+		}
+		fmt.Fprintln(flag.CommandLine.Output())
+		flag.PrintDefaults()
+	}
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "runstats":
+			sp.InitLogAudit()
+			runStatsCmd(os.Args[2:])
+			return
+		case "compare":
+			sp.InitLogAudit()
+			compareCmd(os.Args[2:])
+			return
+		case "new-experiment":
+			sp.InitLogAudit()
+			newExperimentCmd(os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
+	if *configFile != "" {
+		applyConfigFile(*configFile)
+	}
 	if *debug {
 		sp.InitLogDebug()
 	} else {
 		sp.InitLogAudit()
 	}
+	if *geneSetFile != "" {
+		*geneSet = readGeneSetFile(*geneSetFile)
+	}
+	if *statsPanel != "all" && len(geneSets[*statsPanel]) == 0 {
+		sp.Error.Fatalf("Incorrect gene set %s specified for -statspanel!\n", *statsPanel)
+	}
 	if len(geneSets[*geneSet]) == 0 {
 		names := []string{}
 		for n := range geneSets {
@@ -124,20 +213,91 @@ func main() {
 		}
 		sp.Error.Fatalf("Incorrect gene set %s specified! Only allowed values are: %s\n", *geneSet, str.Join(names, ", "))
 	}
+	if !strInSlice(*splitMode, splitModes) {
+		sp.Error.Fatalf("Incorrect split mode %s specified! Only allowed values are: %s\n", *splitMode, str.Join(splitModes, ", "))
+	}
+	if *splitMode == splitTime && *docYearsFile == "" {
+		sp.Error.Fatalf("The time split mode needs a document years file, specified with -docyears\n")
+	}
+	if *regression && *splitMode != splitDrugBank {
+		sp.Error.Fatalf("The conformal regression models can only be validated with the %s split\n", splitDrugBank)
+	}
+	regCosts := []string{}
+	for _, cost := range str.Split(*regCostsStr, ",") {
+		cost = str.TrimSpace(cost)
+		if _, err := strconv.ParseInt(cost, 10, 0); err != nil {
+			sp.Error.Fatalf("Incorrect regression cost %s specified! Only integer costs are allowed\n", cost)
+		}
+		regCosts = append(regCosts, cost)
+	}
+	selectedSpecies := parseSpecies(*speciesStr)
+	speciesWeights := parseSpeciesWeights(*speciesWeightsS)
+	if !strInSlice(*labelSource, labelSources) {
+		sp.Error.Fatalf("Incorrect label source %s specified! Only allowed values are: %s\n", *labelSource, str.Join(labelSources, ", "))
+	}
+	if *pxc50GreyZone < 0 {
+		sp.Error.Fatalf("The pXC50 grey zone can not be negative\n")
+	}
+	if *plotFormat != plotFormatPDF && *plotFormat != plotFormatSVG {
+		sp.Error.Fatalf("Incorrect plot format %s specified! Only allowed values are: %s, %s\n", *plotFormat, plotFormatPDF, plotFormatSVG)
+	}
+	if *graphFormat != graphFormatDOT && *graphFormat != graphFormatMermaid {
+		sp.Error.Fatalf("Incorrect graph format %s specified! Only allowed values are: %s, %s\n", *graphFormat, graphFormatDOT, graphFormatMermaid)
+	}
 	runtime.GOMAXPROCS(*threads)
+	taskResources := readTaskResources(*resourceConfig)
+
+	// Resolve the gene symbols of the panel to those in ExCAPE-DB
+	dbFileName := "pubchem.chembl.dataset4publication_inchi_smiles.tsv.xz"
+	excapeDBPath := "../../raw/" + str.TrimSuffix(dbFileName, ".xz")
+	excapeGenesPath := "../../raw/" + str.TrimSuffix(dbFileName, ".tsv.xz") + ".genes.tsv"
+	genes, geneResolutions, genesChecked := resolveGenePanelOrFail(geneSets[*geneSet], *geneAliases, *geneTaxID, excapeDBPath, excapeGenesPath, *skipUnresolved)
+	resolutionOf := map[string]*GeneResolution{}
+	for _, r := range geneResolutions {
+		resolutionOf[r.Symbol] = r
+	}
+	if *graphGene != "" && !strInSlice(str.ToUpper(*graphGene), genes) {
+		sp.Error.Fatalf("Gene %s to highlight is not in the %s gene set\n", *graphGene, *geneSet)
+	}
+	failurePolicy = NewFailurePolicy(readRetryPolicies(*retryConfig), *continueOnFail, genes)
+	for _, gene := range genes {
+		if _, ok := costsPerTarget[gene]; !ok {
+			sp.Audit.Printf("No cost selected for %s, so searching among the default costs: %s\n", gene, str.Join(defaultCosts, ", "))
+		}
+	}
 
 	// --------------------------------
 	// Show startup messages
 	// --------------------------------
 	sp.Audit.Printf("Using max %d OS threads to schedule max %d tasks\n", *threads, *maxTasks)
 	sp.Audit.Printf("Starting workflow for %s geneset\n", *geneSet)
+	sp.Audit.Printf("Using the %s split for validation\n", *splitMode)
+	sp.Audit.Printf("Training on the data of species: %s (orthologs: %t, weights: %s)\n", *speciesStr, *orthologs, speciesWeightsString(speciesWeights))
 
 	// --------------------------------
 	// Initialize processes and add to runner
 	// --------------------------------
 	wf := sp.NewWorkflow("train_models", *maxTasks)
 
-	dbFileName := "pubchem.chembl.dataset4publication_inchi_smiles.tsv.xz"
+	var slurm *SlurmExecutor
+	if *runSlurm {
+		slurm = NewSlurmExecutor(readSlurmConfig(*slurmConfig))
+		sp.Audit.Printf("Running heavy tasks as SLURM jobs with account %s\n", slurm.Config.Account)
+	}
+	var sched *ResourceScheduler
+	if *localResources {
+		sched = NewResourceScheduler(*localCores, *localMemMB, taskResources)
+		sp.Audit.Printf("Scheduling local tasks by their resources, within %d cores and %d MB\n", sched.Cores, sched.MemMB)
+	}
+	var k8s *KubernetesExecutor
+	if *runKubernetes {
+		if *runSlurm {
+			sp.Failf("The -slurm and -kubernetes flags can not be used together\n")
+		}
+		k8s = NewKubernetesExecutor(readKubernetesConfig(*k8sConfig))
+		sp.Audit.Printf("Running CPSign tasks as Kubernetes Jobs with image %s in namespace %s\n", k8s.Config.Image, k8s.Config.Namespace)
+	}
+
 	dlExcapeDB := wf.NewProc("dlDB", fmt.Sprintf("wget https://zenodo.org/record/173258/files/%s -O {o:excapexz}", dbFileName))
 	dlExcapeDB.SetPathStatic("excapexz", "../../raw/"+dbFileName)
 
@@ -146,6 +306,19 @@ func main() {
 	unPackDB.In("xzfile").Connect(dlExcapeDB.Out("excapexz"))
 
 	dataExcapeDB := unPackDB.Out("unxzed")
+
+	// Extract the genes in ExCAPE-DB (Gene_Symbol, Entrez_ID and Tax_ID), to
+	// resolve the gene symbols of the panels against
+	extractExcapeGenes := wf.NewProc("ext_excape_genes", `awk -F"\t" 'NR > 1 { print $9 "\t" $3 "\t" $8 }' {i:excapedb} | sort -u > {o:genes}`)
+	extractExcapeGenes.SetPathStatic("genes", excapeGenesPath)
+	extractExcapeGenes.In("excapedb").Connect(dataExcapeDB)
+
+	// Count actives, non-actives, unique and conflicting structures, source
+	// databases and pXC50 values per gene, and select the genes of the
+	// -statspanel with at least -minpercls structures per class
+	statsPanelGenes := geneSets[*statsPanel]
+	excapeDBStats := NewExcapeDBStats(wf, "excapedb_stats", "res/excapedb_stats.tsv", fmt.Sprintf("res/%smin%dpercls.txt", *statsPanel, *minPerClass), *minPerClass, statsPanelGenes)
+	excapeDBStats.InExcapeDB().Connect(dataExcapeDB)
 	//unPackDB.Prepend = "salloc -A snic2017-7-89 -n 2 -t 8:00:00 -J unpack_excapedb"
 
 	// Download chemical structures and "links" (references) for *approved* (small molecule) drugs
@@ -228,13 +401,64 @@ func main() {
 	drugBankIdsCsvToTsv.SetPathReplace("csv", "tsv", ".csv", ".tsv")
 	drugBankIdsCsvToTsv.In("csv").Connect(mergeApprWithdr.Out("out"))
 
+	// Select the data of the -species, and -orthologs, to train on, instead of
+	// all rows with the symbol of the target
+	selectedExcapeDB := dataExcapeDB
+	if len(selectedSpecies) > 0 || *orthologs || len(speciesWeights) > 0 {
+		selectSpecies := NewSelectSpecies(wf, "select_species", "res/species_selection_report.tsv", selectedSpecies, *orthologs, speciesWeights)
+		selectSpecies.InExcapeDB().Connect(dataExcapeDB)
+		if sched != nil {
+			sched.Annotate(selectSpecies.Process, "extract")
+		}
+		failurePolicy.Annotate(selectSpecies.Process, "extract")
+		selectedExcapeDB = selectSpecies.OutExcapeDB()
+	}
+
+	// Extract the species of each structure of each gene, to count what
+	// species the models are trained on
+	extractGeneSmilesTaxID := wf.NewProc("extract_gene_smiles_taxid", `awk -F "\t" 'NR > 1 { print $9 "\t" $12 "\t" $8 }' {i:excapedb} | sort -u > {o:gene_smiles_taxid}`)
+	extractGeneSmilesTaxID.SetPathReplace("excapedb", "gene_smiles_taxid", ".tsv", ".gene_smiles_taxid.tsv")
+	extractGeneSmilesTaxID.In("excapedb").Connect(selectedExcapeDB)
+
 	// extractGISA extracts a file with only Gene symbol, id (orig entry), SMILES,
 	// and the Activity flag into a .tsv file, for easier subsequent parsing.
 	// ATTENTION: The sorting order (Gene, SMILES, Activity) is super important,
 	// for the following component, `removeConflicting` to function properly!
-	extractGISA := wf.NewProc("extract_gene_id_smiles_activity", `awk -F "\t" '{ print $9 "\t" $2 "\t" $12 "\t" $4 }' {i:excapedb} | sort -uV -k 1,1 -k 3,3 -k 4,4 > {o:gene_id_smiles_activity}`)
+	// The ID is the last sort key, so that -u keeps every compound ID of a
+	// structure, for the removal of the DrugBank compounds (See below)
+	extractGISA := wf.NewProc("extract_gene_id_smiles_activity", `awk -F "\t" '{ print $9 "\t" $2 "\t" $12 "\t" $4 }' {i:excapedb} | sort -uV -k 1,1 -k 3,3 -k 4,4 -k 2,2 > {o:gene_id_smiles_activity}`)
 	extractGISA.SetPathReplace("excapedb", "gene_id_smiles_activity", ".tsv", ".gisa.tsv")
-	extractGISA.In("excapedb").Connect(dataExcapeDB)
+	extractGISA.In("excapedb").Connect(selectedExcapeDB)
+
+	gisa := extractGISA.Out("gene_id_smiles_activity")
+	if *labelSource == labelsPXC50 {
+		// Derive the activity labels from the pXC50 values instead, to study
+		// how the activity cut-off affects the models
+		thresholds := readActivityThresholds(*labelConfig, ActivityThreshold{Threshold: *pxc50Threshold, GreyZone: *pxc50GreyZone})
+		sp.Audit.Printf("Labelling activities by pXC50 thresholds (%s)\n", thresholdsString(thresholds))
+		relabelActivities := NewRelabelActivities(wf, "relabel_activities", "res/relabel_report.tsv", thresholds)
+		relabelActivities.InExcapeDB().Connect(selectedExcapeDB)
+
+		// The sorting order is again important for `removeConflicting` (See above)
+		sortRelabeled := wf.NewProc("sort_relabeled", `sort -uV -k 1,1 -k 3,3 -k 4,4 -k 2,2 {i:unsorted} > {o:sorted}`)
+		sortRelabeled.SetPathReplace("unsorted", "sorted", "_unsorted.tsv", ".tsv")
+		sortRelabeled.In("unsorted").Connect(relabelActivities.OutGISA())
+		gisa = sortRelabeled.Out("sorted")
+	}
+
+	gisaToDedup := gisa
+	if *standardize {
+		// Standardize structures, so that salt forms, charge states and stereo
+		// variants of a compound are merged before conflicts are removed
+		standardizeStructs := NewStandardizeStructures(wf, "standardize_structures", "res/standardization_report.tsv", NewStandardizer(*standardizerCmd))
+		standardizeStructs.InGISA().Connect(gisa)
+
+		// The sorting order is again important for `removeConflicting` (See above)
+		sortStandardized := wf.NewProc("sort_standardized", `sort -uV -k 1,1 -k 3,3 -k 4,4 -k 2,2 {i:std_unsorted} > {o:std}`)
+		sortStandardized.SetPathReplace("std_unsorted", "std", ".std_unsorted.tsv", ".std.tsv")
+		sortStandardized.In("std_unsorted").Connect(standardizeStructs.OutGISA())
+		gisaToDedup = sortStandardized.Out("std")
+	}
 
 	// removeConflicting prints the previous line, unless it has the same values on
 	removeConflicting := wf.NewProc("remove_conflicting", `awk -F "\t" '((( prev1 != $1 ) && ( prev1 != "")) || (( prev3 != $3 ) && ( prev3 != "" ))) && !isconflicting[prev1,prev3] { print prev1 "\t" prev2 "\t" prev3 "\t" prev4 }
@@ -243,44 +467,165 @@ func main() {
 																END { print }' \
 															{i:gene_id_smiles_activity} > {o:gene_id_smiles_activity}`)
 	removeConflicting.SetPathReplace("gene_id_smiles_activity", "gene_id_smiles_activity", ".tsv", ".dedup.tsv")
-	removeConflicting.In("gene_id_smiles_activity").Connect(extractGISA.Out("gene_id_smiles_activity"))
+	removeConflicting.In("gene_id_smiles_activity").Connect(gisaToDedup)
 
 	// Create process for subtracting the DrugBank compounds HERE
-	remDrugBankComps := wf.NewProc("remove_drugbank_compounds", `awk 'FNR==NR { db[$1]; next } !($2 in db)' {i:compids_to_remove} {i:gisa} | sort -uV > {o:gisa_wo_drugbank}`)
+	// As `removeConflicting` keeps only one compound ID per structure, and the
+	// standardization merges the salt forms etc. of compounds into one
+	// structure, the DrugBank compounds are removed by their structures (as
+	// found with all their IDs, before deduplication), and not only by ID, so
+	// that no other ID of a held-out structure is left in the training data
+	remDrugBankComps := wf.NewProc("remove_drugbank_compounds", removeDrugBankCompsCmd("gisa_all_ids", "gisa", "gisa_wo_drugbank"))
 	remDrugBankComps.SetPathStatic("gisa_wo_drugbank", "dat/excapedb.gisa_wo_drugbank.tsv")
 	remDrugBankComps.In("compids_to_remove").Connect(makeOneColumn.Out("onecol"))
+	remDrugBankComps.In("gisa_all_ids").Connect(gisaToDedup)
 	remDrugBankComps.In("gisa").Connect(removeConflicting.Out("gene_id_smiles_activity"))
 
+	// Build the indexed store to extract target data from, with -store
+	var gisaStore *BuildGISAStore
+	if *useStore {
+		gisaStore = NewBuildGISAStore(wf, "build_gisa_store")
+		gisaStore.InGISA().Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
+		if sched != nil {
+			sched.Annotate(gisaStore.Process, "extract")
+		}
+		failurePolicy.Annotate(gisaStore.Process, "extract")
+	}
+
 	// extractValidationRawdata prepares a data file for use in validation at the end of the workflow
-	extractValidationRawdata := wf.NewProc("extract_validation_rawdata", `awk -F"\t" 'FNR==NR { cid[$1]; cbl[$2]; next } (( $2 in cid ) || ($2 in cbl )) { print }' {i:removed_compids} {i:gisa} | sort -uV > {o:drugbank_removed}`)
+	// The structures of the DrugBank compounds are looked up by their IDs before
+	// deduplication, and taken from the deduplicated data with the DrugBank ID,
+	// as the ID kept by `removeConflicting` might be another one
+	extractValidationRawdata := wf.NewProc("extract_validation_rawdata", `awk -F"\t" 'FILENAME == ARGV[1] { cid[$1]; cbl[$2]; next } FILENAME == ARGV[2] { if (( $2 in cid ) || ( $2 in cbl )) { dbid[$1 FS $3] = $2 }; next } ( $1 FS $3 ) in dbid { print $1 "\t" dbid[$1 FS $3] "\t" $3 "\t" $4 }' {i:removed_compids} {i:gisa_all_ids} {i:gisa} | sort -uV > {o:drugbank_removed}`)
 	extractValidationRawdata.In("removed_compids").Connect(drugBankIdsCsvToTsv.Out("tsv"))
+	extractValidationRawdata.In("gisa_all_ids").Connect(gisaToDedup)
 	extractValidationRawdata.In("gisa").Connect(removeConflicting.Out("gene_id_smiles_activity"))
 	extractValidationRawdata.SetPathExtend("gisa", "drugbank_removed", ".drugbank_removed.tsv")
 
+	// Extract the pXC50 values, without and with only the DrugBank compounds,
+	// for the conformal regression models, with -regression. Structures are
+	// not deduplicated here, as the regression data extraction takes the
+	// median of their values.
+	var remDrugBankCompsPXC50, extractValidationRawdataPXC50 *sp.Process
+	if *regression {
+		extractGSPA := wf.NewProc("extract_gene_id_smiles_pxc50", `awk -F "\t" '( NR > 1 ) && ( $5 != "" ) { print $9 "\t" $2 "\t" $12 "\t" $5 }' {i:excapedb} | sort -uV > {o:gene_id_smiles_pxc50}`)
+		extractGSPA.SetPathReplace("excapedb", "gene_id_smiles_pxc50", ".tsv", ".gspa.tsv")
+		extractGSPA.In("excapedb").Connect(selectedExcapeDB)
+
+		// The pXC50 values have the structures as in ExCAPE-DB, so the
+		// structures of the DrugBank compounds are looked up before any
+		// standardization
+		remDrugBankCompsPXC50 = wf.NewProc("remove_drugbank_compounds_pxc50", removeDrugBankCompsCmd("gisa_all_ids", "gspa", "gspa_wo_drugbank"))
+		remDrugBankCompsPXC50.SetPathStatic("gspa_wo_drugbank", "dat/excapedb.gspa_wo_drugbank.tsv")
+		remDrugBankCompsPXC50.In("compids_to_remove").Connect(makeOneColumn.Out("onecol"))
+		remDrugBankCompsPXC50.In("gisa_all_ids").Connect(gisa)
+		remDrugBankCompsPXC50.In("gspa").Connect(extractGSPA.Out("gene_id_smiles_pxc50"))
+
+		extractValidationRawdataPXC50 = wf.NewProc("extract_validation_rawdata_pxc50", `awk -F"\t" 'FNR==NR { cid[$1]; cbl[$2]; next } (( $2 in cid ) || ($2 in cbl )) { print }' {i:removed_compids} {i:gspa} > {o:drugbank_removed}`)
+		extractValidationRawdataPXC50.In("removed_compids").Connect(drugBankIdsCsvToTsv.Out("tsv"))
+		extractValidationRawdataPXC50.In("gspa").Connect(extractGSPA.Out("gene_id_smiles_pxc50"))
+		extractValidationRawdataPXC50.SetPathExtend("gspa", "drugbank_removed", ".drugbank_removed.tsv")
+	}
+
+	var docYears *spc.FileSource
+	if *splitMode == splitTime {
+		docYears = spc.NewFileSource(wf, "doc_years", *docYearsFile)
+	}
+
 	finalModelsSummary := NewFinalModelSummarizer(wf, "finalmodels_summary_creator", "res/final_models_summary.tsv", '\t')
+	replicatesSummary := NewReplicateAggregator(wf, "aggregate_replicates", "res/final_models_summary.replicates.tsv", 0.8)
+	replicatesSummary.InSummary().Connect(finalModelsSummary.OutSummary())
+	targetDataCounts := NewTableGatherer(wf, "gather_target_data_counts", "res/target_data_counts.tsv", []string{"gene", "runset"}, "ActiveCnt", "NonactiveCnt")
+	speciesCounts := NewTableGatherer(wf, "gather_species_counts", "res/species_counts.tsv", []string{"gene"})
 
 	genRandomProcs := map[string]*sp.Process{}
 
+	var lcSummary *LearningCurveSummarizer
+	var lcRandSrc *sp.Process
+	lcFracs := []string{}
+	if *learningCurve {
+		lcSummary = NewLearningCurveSummarizer(wf, "learningcurve_summary_creator", "res/learningcurve_summary.tsv", 0.8)
+		for _, frac := range str.Split(*lcFracsStr, ",") {
+			lcFracs = append(lcFracs, str.TrimSpace(frac))
+		}
+	}
+
 	// We only do the fill run-set here (filling up for "small" datasets)
 	runSets := []string{"fill"} // []string{"orig", "fill"}
 
-	calibPlotPorts := []*sp.OutPort{}
+	calibPlotter := NewCalibrationPlotter(wf, "plot_calibration", *plotFormat, "res/calibration/calibration_grid."+*plotFormat)
+	valPlotter := NewValidationPlotter(wf, "plot_validation", *plotFormat, 0.8, "res/validation")
+	report := NewReportGenerator(wf, "create_report", "res/report", "PTP models without DrugBank compounds ("+*geneSet+", "+*splitMode+" split)")
+	report.InReplicates().Connect(replicatesSummary.OutAggregated())
+	report.InPlots().Connect(calibPlotter.OutPlots())
+	report.InPlots().Connect(calibPlotter.OutGrid())
+	report.InPlots().Connect(valPlotter.OutPlots())
+	report.InPlots().Connect(valPlotter.OutGrid())
+	calibAnalyzer := NewCalibrationAnalyzer(wf, "analyze_calibration", "res/calibration", "res/calibration_summary.tsv", 0.05)
+	report.InCalibSummary().Connect(calibAnalyzer.OutSummary())
+	report.InCalibCurves().Connect(calibAnalyzer.OutCurves())
+	report.InSpeciesCounts().Connect(speciesCounts.OutTable())
 
 	// --------------------------------
 	// Set up gene-specific workflow branches
 	// --------------------------------
-	for _, geneUppercase := range geneSets[*geneSet] {
+	for _, geneUppercase := range genes {
 		geneLowerCase := str.ToLower(geneUppercase)
 		uniqStrGene := geneLowerCase
 
 		// extractTargetData extract all data for the specific target, into a separate file
-		extractTargetData := wf.NewProc("extract_target_data_"+uniqStrGene, `awk 'END { print "smiles\tactivity" }' /dev/null > {o:target_data} && awk -F"\t" '$1 == "{p:gene}" { print $3"\t"$4 }' {i:raw_data} >> {o:target_data}`)
+		// The panel symbol and the Entrez ID are kept in the audit logs
+		var extractTargetData *sp.Process
+		if *useStore {
+			extractFromStore := NewExtractTargetDataFromStore(wf, "extract_target_data_"+uniqStrGene)
+			extractFromStore.InStore().Connect(gisaStore.OutStore())
+			extractTargetData = extractFromStore.Process
+		} else {
+			extractTargetData = wf.NewProc("extract_target_data_"+uniqStrGene, `awk 'END { print "smiles\tactivity" }' /dev/null > {o:target_data} && awk -F"\t" '$1 == "{p:gene}" { print $3"\t"$4 }' {i:raw_data} >> {o:target_data} # panel_symbol:{p:panel_symbol} entrez_id:{p:entrez_id}`)
+			extractTargetData.In("raw_data").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
+			if slurm != nil {
+				slurm.Apply(extractTargetData, "extract", "", 1)
+			}
+		}
 		extractTargetData.ParamInPort("gene").ConnectStr(geneUppercase)
+		extractTargetData.ParamInPort("panel_symbol").ConnectStr(resolutionOf[geneUppercase].PanelSymbol)
+		entrezID := resolutionOf[geneUppercase].EntrezID
+		if entrezID == "" {
+			entrezID = "NA"
+		}
+		extractTargetData.ParamInPort("entrez_id").ConnectStr(entrezID)
 		extractTargetData.SetPathStatic("target_data", fmt.Sprintf("dat/%s/%s.tsv", geneLowerCase, geneLowerCase))
-		extractTargetData.In("raw_data").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
-		if *runSlurm {
-			extractTargetData.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1:00:00 -J scipipe_extract_" + geneLowerCase // SLURM string
+		if sched != nil {
+			sched.Annotate(extractTargetData, "extract")
 		}
+		failurePolicy.Annotate(extractTargetData, "extract")
+
+		// In the scaffold and time split modes, models are trained on the
+		// training part of the target data, and validated on the test part,
+		// instead of on the removed DrugBank compounds
+		targetData := extractTargetData.Out("target_data")
+		var splitTestData *sp.OutPort
+		if *splitMode != splitDrugBank {
+			splitTgtData := NewSplitTargetData(wf, "split_target_data_"+uniqStrGene, *splitMode, *testFrac)
+			splitTgtData.InGISA().Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
+			splitTgtData.InGene().ConnectStr(geneUppercase)
+			if *splitMode == splitTime {
+				splitTgtData.InDocYears().Connect(docYears.Out())
+			}
+			targetData = splitTgtData.OutTrain()
+			splitTestData = splitTgtData.OutTest()
+		}
+
+		// Count the structures of the training data per species
+		countSpecies := NewCountSpecies(wf, "count_species_"+uniqStrGene)
+		countSpecies.InTargetData().Connect(targetData)
+		countSpecies.InGeneSmilesTaxID().Connect(extractGeneSmilesTaxID.Out("gene_smiles_taxid"))
+		countSpecies.InGene().ConnectStr(geneUppercase)
+		if sched != nil {
+			sched.Annotate(countSpecies.Process, "extract")
+		}
+		failurePolicy.Annotate(countSpecies.Process, "extract")
+		speciesCounts.InResults().Connect(countSpecies.OutCounts())
 
 		for _, runSet := range runSets {
 			uniqStrRunSet := uniqStrGene + "_" + runSet
@@ -309,18 +654,28 @@ func main() {
 					// to number of actives, by multiplying the number of actives
 					// times two, and subtracting the number of existing
 					// non-actices (See "A*2-N" in the AWK-script below).
-					extractAssumedNonBinding := wf.NewProc("extract_assumed_n_"+uniqStrRepl, `
+					// The counts are taken from the training data, while all the
+					// structures of the target, including those held out for
+					// testing, are excluded from the assumed non-actives.
+					var extractAssumedNonBinding *sp.Process
+					if *useStore {
+						sampleAssumedN := NewSampleAssumedNonActives(wf, "extract_assumed_n_"+uniqStrRepl)
+						sampleAssumedN.InStore().Connect(gisaStore.OutStore())
+						extractAssumedNonBinding = sampleAssumedN.Process
+					} else {
+						extractAssumedNonBinding = wf.NewProc("extract_assumed_n_"+uniqStrRepl, `
 					let "fillup_lines_cnt = "$(awk -F"\t" '$2 == "A" { A += 1 } $2 == "N" { N += 1 } END { print A*2-N }' {i:targetdata}) \
-					&& awk -F"\t" 'FNR==NR{target_smiles[$1]; next} ($1 != "{p:gene}") && !($3 in target_smiles) { print $3 "\tN" }' {i:targetdata} {i:rawdata} \
+					&& awk -F"\t" 'FNR==NR { if ($1 == "{p:gene}") target_smiles[$3]; next } ($1 != "{p:gene}") && !($3 in target_smiles) { print $3 "\tN" }' {i:rawdata} {i:rawdata} \
 					| sort -uV \
 					| shuf --random-source={i:randsrc} -n $fillup_lines_cnt > {o:assumed_n} # replicate:{p:replicate}`)
+						extractAssumedNonBinding.In("rawdata").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
+					}
 					extractAssumedNonBinding.SetPathCustom("assumed_n", func(t *sp.Task) string {
 						gene := str.ToLower(t.Param("gene"))
 						repl := t.Param("replicate")
 						return "dat/" + gene + "/" + repl + "/" + gene + "." + repl + ".assumed_n.tsv"
 					})
-					extractAssumedNonBinding.In("rawdata").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
-					extractAssumedNonBinding.In("targetdata").Connect(extractTargetData.Out("target_data"))
+					extractAssumedNonBinding.In("targetdata").Connect(targetData)
 					extractAssumedNonBinding.ParamInPort("gene").ConnectStr(geneUppercase)
 					extractAssumedNonBinding.ParamInPort("replicate").ConnectStr(replicate)
 					extractAssumedNonBinding.In("randsrc").Connect(genRandomProcs[genRandomID].Out("rand"))
@@ -339,7 +694,7 @@ func main() {
 						rset := t.Param("runset")
 						return "dat/" + gene + "/" + repl + "/" + rset + "/" + gene + "." + repl + "." + rset + ".cnt"
 					})
-					countProcs[uniqStrRunSet].In("targetdata").Connect(extractTargetData.Out("target_data"))
+					countProcs[uniqStrRunSet].In("targetdata").Connect(targetData)
 					if doFillUp {
 						countProcs[uniqStrRunSet].In("assumed_n").Connect(assumedNonActive)
 					}
@@ -351,7 +706,7 @@ func main() {
 				// --------------------------------------------------------------------------------
 				// Pre-compute step
 				// --------------------------------------------------------------------------------
-				cpSignPrecompCmd := `java -jar ` + cpSignPath + ` precompute \
+				cpSignPrecompCmd := sched.JavaCmd("precompute") + ` -jar ` + cpSignPath + ` precompute \
 									--license ` + cpSignLicensePath + `\
 									--model-type classification \
 									--train-data CSV delim:'\t' {i:traindata} \
@@ -366,7 +721,7 @@ func main() {
 				}
 				cpSignPrecompCmd += ` # {p:gene} {p:runset} {p:replicate}`
 				cpSignPrecomp := wf.NewProc("cpsign_precomp_"+uniqStrRepl, cpSignPrecompCmd)
-				cpSignPrecomp.In("traindata").Connect(extractTargetData.Out("target_data"))
+				cpSignPrecomp.In("traindata").Connect(targetData)
 				if doFillUp {
 					cpSignPrecomp.In("propertraindata").Connect(assumedNonActive)
 				}
@@ -383,8 +738,15 @@ func main() {
 				cpSignPrecomp.SetPathCustom("logfile", func(t *sp.Task) string {
 					return precompPathFunc(t) + ".cpsign.log"
 				})
-				if *runSlurm {
-					cpSignPrecomp.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J precmp_" + geneLowerCase // SLURM string
+				if slurm != nil {
+					slurm.Apply(cpSignPrecomp, "precompute", "", 1)
+				}
+				if sched != nil {
+					sched.Annotate(cpSignPrecomp, "precompute")
+				}
+				failurePolicy.Annotate(cpSignPrecomp, "precompute")
+				if k8s != nil {
+					k8s.Apply(cpSignPrecomp, "precompute")
 				}
 
 				// --------------------------------------------------------------------------------
@@ -396,29 +758,10 @@ func main() {
 					"dat/"+runSet+"/"+geneLowerCase+"/"+replicate+"/"+geneLowerCase+"_cost_gamma_perf_stats.tsv",
 					includeGamma)
 
-				for _, cost := range costsPerTarget[geneUppercase] {
+				for _, cost := range costsOf(geneUppercase) {
 					uniqStrCost := uniqStrRepl + "_" + cost
 					// If Liblinear
-					evalCostCmd := `java -jar ` + cpSignPath + ` crossvalidate \
-									--license ` + cpSignLicensePath + `\
-									--predictor-type ACP_Classification \
-									--seed {p:seed} \
-									--scorer LinearSVC:cost={p:cost} \
-									--train-data CSV header:smiles,activity delim:'\t' {i:traindata} \
-									--endpoint activity \
-									--labels A, N \
-									--sampling-strategy random:numSamples={p:nrmdl}:calibRatio=0.2 \
-									--cv-folds {p:cvfolds} \
-									--result-format json \
-									--result-output {o:stats} \
-									--logfile {o:logfile}`
-					if doFillUp {
-						evalCostCmd += ` \
-									--model-data CSV header:smiles,activity delim:'\t' {i:propertraindata}`
-					}
-					evalCostCmd += ` \
-									--calibration-points "{p:confidences}" # {p:gene} {p:runset} {p:replicate}`
-					evalCost := wf.NewProc("crossval_"+uniqStrCost, evalCostCmd)
+					evalCost := wf.NewProc("crossval_"+uniqStrCost, cpSignCrossValCmd(doFillUp, sched.JavaCmd("crossval")))
 					evalCostStatsPathFunc := func(t *sp.Task) string {
 						cost, err := strconv.ParseInt(t.Param("cost"), 10, 0)
 						sp.Check(err)
@@ -434,7 +777,7 @@ func main() {
 					if doFillUp {
 						evalCost.In("propertraindata").Connect(assumedNonActive)
 					}
-					evalCost.In("traindata").Connect(extractTargetData.Out("target_data"))
+					evalCost.In("traindata").Connect(targetData)
 					evalCost.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
 					evalCost.ParamInPort("nrmdl").ConnectStr("10")
 					evalCost.ParamInPort("cvfolds").ConnectStr("10")
@@ -443,12 +786,22 @@ func main() {
 					evalCost.ParamInPort("runset").ConnectStr(runSet)
 					evalCost.ParamInPort("replicate").ConnectStr(replicate)
 					evalCost.ParamInPort("cost").ConnectStr(cost)
-					if *runSlurm {
-						evalCost.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J evalcg_" + uniqStrCost // SLURM string
+					if slurm != nil {
+						slurm.Apply(evalCost, "crossval", "crossval_"+uniqStrRepl, len(costsOf(geneUppercase)))
+					}
+					if sched != nil {
+						sched.Annotate(evalCost, "crossval")
+					}
+					failurePolicy.Annotate(evalCost, "crossval")
+					if k8s != nil {
+						k8s.Apply(evalCost, "crossval")
 					}
 
 					extractCostGammaStats := spc.NewMapToKeys(wf, "extract_cgstats_"+uniqStrCost, func(ip *sp.FileIP) map[string]string {
 						newKeys := map[string]string{}
+						if failurePolicy.IsPlaceholder(ip.Path()) {
+							return newKeys
+						}
 						crossValStats := &cpSignCrossValOutput{}
 						ip.UnMarshalJSON(crossValStats)
 						newKeys["obsfuzz_overall"] = fmt.Sprintf("%.3f", crossValStats.ObservedFuzziness)
@@ -457,6 +810,8 @@ func main() {
 					extractCostGammaStats.In().Connect(evalCost.Out("stats"))
 
 					summarize.In().Connect(extractCostGammaStats.Out())
+					calibPlotter.InCrossValStats().Connect(evalCost.Out("stats"))
+					calibAnalyzer.InCrossValStats().Connect(evalCost.Out("stats"))
 				} // end for cost
 
 				selectBest := NewBestCostGamma(wf,
@@ -464,12 +819,91 @@ func main() {
 					'\t',
 					false, includeGamma)
 				selectBest.InCSVFile().Connect(summarize.OutStats())
+				report.InCostPerf().Connect(summarize.OutStats())
+
+				// --------------------------------------------------------------------------------
+				// Learning curve step
+				// --------------------------------------------------------------------------------
+				if *learningCurve {
+					if lcRandSrc == nil {
+						lcRandSrc = wf.NewProc("create_lc_random_bytes", "dd if=/dev/urandom of={o:rand} bs=1048576 count=1")
+						lcRandSrc.SetPathStatic("rand", "dat/lc_random_bytes.bin")
+					}
+					for _, frac := range lcFracs {
+						uniqStrFrac := uniqStrRepl + "_" + str.Replace(frac, ".", "p", 1)
+						lcPathFunc := func(t *sp.Task) string {
+							gene := str.ToLower(t.Param("gene"))
+							repl := t.Param("replicate")
+							rset := t.Param("runset")
+							return "dat/learningcurve/" + gene + "/" + repl + "/" + rset + "/" + gene + "." + repl + "." + rset + ".frac" + t.Param("frac")
+						}
+
+						subsampleTrain := NewSubsample(wf, "lc_subsample_"+uniqStrFrac, true, func(t *sp.Task) string {
+							return lcPathFunc(t) + ".tsv"
+						})
+						subsampleTrain.In("data").Connect(targetData)
+						subsampleTrain.In("randsrc").Connect(lcRandSrc.Out("rand"))
+						subsampleTrain.ParamInPort("frac").ConnectStr(frac)
+						subsampleTrain.ParamInPort("gene").ConnectStr(geneUppercase)
+						subsampleTrain.ParamInPort("runset").ConnectStr(runSet)
+						subsampleTrain.ParamInPort("replicate").ConnectStr(replicate)
+
+						// Number of target compounds (not counting assumed non-actives) in the subsample
+						countTrainSize := spc.NewMapToKeys(wf, "lc_count_trainsize_"+uniqStrFrac, func(ip *sp.FileIP) map[string]string {
+							return map[string]string{"trainsize": fmt.Sprintf("%d", str.Count(string(ip.Read()), "\n")-1)}
+						})
+						countTrainSize.In().Connect(subsampleTrain.Out("subsample"))
+
+						lcCrossVal := wf.NewProc("lc_crossval_"+uniqStrFrac, cpSignCrossValCmd(doFillUp, sched.JavaCmd("learningcurve"))+" {p:frac}")
+						lcCrossValStatsPathFunc := func(t *sp.Task) string {
+							return lcPathFunc(t) + ".liblin_c" + t.Param("cost") + ".cvstats.json"
+						}
+						lcCrossVal.SetPathCustom("stats", lcCrossValStatsPathFunc)
+						lcCrossVal.SetPathCustom("logfile", func(t *sp.Task) string {
+							return lcCrossValStatsPathFunc(t) + ".cpsign.log"
+						})
+						lcCrossVal.In("traindata").Connect(countTrainSize.Out())
+						if doFillUp {
+							subsampleAssumedN := NewSubsample(wf, "lc_subsample_assumed_n_"+uniqStrFrac, false, func(t *sp.Task) string {
+								return lcPathFunc(t) + ".assumed_n.tsv"
+							})
+							subsampleAssumedN.In("data").Connect(assumedNonActive)
+							subsampleAssumedN.In("randsrc").Connect(lcRandSrc.Out("rand"))
+							subsampleAssumedN.ParamInPort("frac").ConnectStr(frac)
+							subsampleAssumedN.ParamInPort("gene").ConnectStr(geneUppercase)
+							subsampleAssumedN.ParamInPort("runset").ConnectStr(runSet)
+							subsampleAssumedN.ParamInPort("replicate").ConnectStr(replicate)
+							lcCrossVal.In("propertraindata").Connect(subsampleAssumedN.Out("subsample"))
+						}
+						lcCrossVal.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
+						lcCrossVal.ParamInPort("nrmdl").ConnectStr("10")
+						lcCrossVal.ParamInPort("cvfolds").ConnectStr("10")
+						lcCrossVal.ParamInPort("confidences").ConnectStr("0.05, 0.1, 0.15, 0.2, 0.25, 0.3, 0.35, 0.4, 0.45, 0.5, 0.55, 0.6, 0.65, 0.7, 0.75, 0.8, 0.85, 0.9, 0.95")
+						lcCrossVal.ParamInPort("gene").ConnectStr(geneUppercase)
+						lcCrossVal.ParamInPort("runset").ConnectStr(runSet)
+						lcCrossVal.ParamInPort("replicate").ConnectStr(replicate)
+						lcCrossVal.ParamInPort("frac").ConnectStr(frac)
+						lcCrossVal.ParamInPort("cost").Connect(selectBest.OutBestCost())
+						if slurm != nil {
+							slurm.Apply(lcCrossVal, "learningcurve", "lc_crossval_"+uniqStrRepl, len(lcFracs))
+						}
+						if sched != nil {
+							sched.Annotate(lcCrossVal, "learningcurve")
+						}
+						failurePolicy.Annotate(lcCrossVal, "learningcurve")
+						if k8s != nil {
+							k8s.Apply(lcCrossVal, "learningcurve")
+						}
+
+						lcSummary.InCrossValStats().Connect(lcCrossVal.Out("stats"))
+					}
+				}
 
 				// --------------------------------------------------------------------------------
 				// Train step
 				// --------------------------------------------------------------------------------
 				cpSignTrain := wf.NewProc("cpsign_train_"+uniqStrRepl,
-					`java -jar `+cpSignPath+` train \
+					sched.JavaCmd("train")+` -jar `+cpSignPath+` train \
 									--license `+cpSignLicensePath+` \
 									--seed {p:seed} \
 									--ptype 1 \
@@ -483,7 +917,7 @@ func main() {
 									--logfile {o:logfile} \
 									--model-name "{p:gene}" # {p:runset} {p:replicate} Observed Fuzziness: {p:obsfuzz_overall}`)
 				cpSignTrain.In("model").Connect(cpSignPrecomp.Out("precomp"))
-				cpSignTrain.In("percentilesfile").Connect(extractTargetData.Out("target_data"))
+				cpSignTrain.In("percentilesfile").Connect(targetData)
 				cpSignTrain.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
 				cpSignTrain.ParamInPort("nrmdl").ConnectStr("10")
 				cpSignTrain.ParamInPort("gene").ConnectStr(geneUppercase)
@@ -508,45 +942,59 @@ func main() {
 				cpSignTrain.SetPathCustom("logfile", func(t *sp.Task) string {
 					return cpSignTrainModelPathFunc(t) + ".cpsign.log"
 				})
-				if *runSlurm {
-					cpSignTrain.Prepend = "salloc -A snic2017-7-89 -n 4 -c 4 -t 1-00:00:00 -J train_" + uniqStrRepl // SLURM string
+				if slurm != nil {
+					slurm.Apply(cpSignTrain, "train", "", 1)
+				}
+				if sched != nil {
+					sched.Annotate(cpSignTrain, "train")
+				}
+				failurePolicy.Annotate(cpSignTrain, "train")
+				if k8s != nil {
+					k8s.Apply(cpSignTrain, "train")
 				}
 
 				embedAuditLog := NewEmbedAuditLogInJar(wf, "embed_auditlog_"+uniqStrRepl)
 				embedAuditLog.InJarFile().Connect(cpSignTrain.Out("model"))
 
 				finalModelsSummary.InModel().Connect(cpSignTrain.Out("model"))
+				calibPlotter.InModel().Connect(cpSignTrain.Out("model"))
+				calibAnalyzer.InModel().Connect(cpSignTrain.Out("model"))
+				report.InModels().Connect(cpSignTrain.Out("model"))
 
 				// ------------------------------------------
 				// Validate excluded DrugBank compounds (compare predicted and actual values)
 				// ------------------------------------------
 				// gisa: gene, id, smiles, activity. sa: smiles, activity
 
-				// extractTargetValidationData -----------------------------------
-				extractTargetValidationData := wf.NewProc("extract_target_validation_data_"+uniqStrRepl, `awk '
-					( $1 == "`+geneUppercase+`" ) { print $2 "\t" $3 "\t" $4 }' \
-				{i:raw} > {o:tgt} # {p:gene} {p:replicate} {p:runset}`)
-				extractTargetValidationData.SetPathCustom("tgt", func(t *sp.Task) string {
-					uniqStrReplRunset := t.Param("gene") + "." + t.Param("replicate") + "." + t.Param("runset")
-					return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + ".validation_data.tsv"
-				})
-				extractTargetValidationData.In("raw").Connect(extractValidationRawdata.Out("drugbank_removed")) // HERE
-				extractTargetValidationData.ParamInPort("gene").ConnectStr(geneLowerCase)
-				extractTargetValidationData.ParamInPort("replicate").ConnectStr(replicate)
-				extractTargetValidationData.ParamInPort("runset").ConnectStr(runSet)
-
-				// dedupTargetValData --------------------------------------------
-				dedupTargetValData := wf.NewProc("dedup_target_validation_data_"+uniqStrRepl, `awk '
-					FNR == NR { ids[$1] = $2 "\t" $3; next }
-					( $1 in ids ) { print ids[$1] }
-					(!( $1 in ids ) && ( $2 in ids )) { print ids[$2] }' \
-				{i:target_val_data} {i:drugbank_compids} > {o:dedup}`)
-				dedupTargetValData.SetPathExtend("target_val_data", "dedup", ".dedup.tsv")
-				dedupTargetValData.In("target_val_data").Connect(extractTargetValidationData.Out("tgt"))
-				dedupTargetValData.In("drugbank_compids").Connect(drugBankIdsCsvToTsv.Out("tsv"))
+				validationData := splitTestData
+				if *splitMode == splitDrugBank {
+					// extractTargetValidationData -----------------------------------
+					extractTargetValidationData := wf.NewProc("extract_target_validation_data_"+uniqStrRepl, `awk '
+						( $1 == "`+geneUppercase+`" ) { print $2 "\t" $3 "\t" $4 }' \
+					{i:raw} > {o:tgt} # {p:gene} {p:replicate} {p:runset}`)
+					extractTargetValidationData.SetPathCustom("tgt", func(t *sp.Task) string {
+						uniqStrReplRunset := t.Param("gene") + "." + t.Param("replicate") + "." + t.Param("runset")
+						return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + ".validation_data.tsv"
+					})
+					extractTargetValidationData.In("raw").Connect(extractValidationRawdata.Out("drugbank_removed")) // HERE
+					extractTargetValidationData.ParamInPort("gene").ConnectStr(geneLowerCase)
+					extractTargetValidationData.ParamInPort("replicate").ConnectStr(replicate)
+					extractTargetValidationData.ParamInPort("runset").ConnectStr(runSet)
+
+					// dedupTargetValData --------------------------------------------
+					dedupTargetValData := wf.NewProc("dedup_target_validation_data_"+uniqStrRepl, `awk '
+						FNR == NR { ids[$1] = $2 "\t" $3; next }
+						( $1 in ids ) { print ids[$1] }
+						(!( $1 in ids ) && ( $2 in ids )) { print ids[$2] }' \
+					{i:target_val_data} {i:drugbank_compids} > {o:dedup}`)
+					dedupTargetValData.SetPathExtend("target_val_data", "dedup", ".dedup.tsv")
+					dedupTargetValData.In("target_val_data").Connect(extractTargetValidationData.Out("tgt"))
+					dedupTargetValData.In("drugbank_compids").Connect(drugBankIdsCsvToTsv.Out("tsv"))
+					validationData = dedupTargetValData.Out("dedup")
+				}
 
 				// validateDrugBank ----------------------------------------------
-				validateDrugBank := wf.NewProc("validate_drugbank_"+uniqStrRepl, `java -jar `+cpSignPath+` validate \
+				validateDrugBank := wf.NewProc("validate_"+*splitMode+"_"+uniqStrRepl, sched.JavaCmd("validate")+` -jar `+cpSignPath+` validate \
 									--license `+cpSignLicensePath+` \
 									--model-in {i:model} \
 									--predict-file CSV header:smiles,activity {i:smiles} \
@@ -557,6 +1005,9 @@ func main() {
 									--output {o:json} # {p:gene} {p:replicate} {p:runset}`)
 				validateDrugBankJSONPathFunc := func(t *sp.Task) string {
 					uniqStrReplRunset := t.Param("gene") + "." + t.Param("replicate") + "." + t.Param("runset")
+					if *splitMode != splitDrugBank {
+						return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + ".validate_" + *splitMode + "_split.json"
+					}
 					return "dat/validate/" + uniqStrReplRunset + "/" + uniqStrReplRunset + ".validate_drugbank_1000.json"
 				}
 				validateDrugBank.SetPathCustom("json", validateDrugBankJSONPathFunc)
@@ -564,44 +1015,288 @@ func main() {
 					return validateDrugBankJSONPathFunc(t) + ".cpsign.log"
 				})
 				validateDrugBank.In("model").Connect(cpSignTrain.Out("model"))
-				validateDrugBank.In("smiles").Connect(dedupTargetValData.Out("dedup")) // Create target specific data file
+				validateDrugBank.In("smiles").Connect(validationData) // Create target specific data file
 				validateDrugBank.ParamInPort("gene").ConnectStr(geneLowerCase)
 				validateDrugBank.ParamInPort("replicate").ConnectStr(replicate)
 				validateDrugBank.ParamInPort("runset").ConnectStr(runSet)
 				validateDrugBank.ParamInPort("confidences").ConnectStr("0.8, 0.9")
+				if k8s != nil {
+					k8s.Apply(validateDrugBank, "validate")
+				}
+				if sched != nil {
+					sched.Annotate(validateDrugBank, "validate")
+				}
+				failurePolicy.Annotate(validateDrugBank, "validate")
+
+				replicatesSummary.InValidation().Connect(validateDrugBank.Out("json"))
+				valPlotter.InValidation().Connect(validateDrugBank.Out("json"))
 			} // end: for replicate
 			finalModelsSummary.InTargetDataCount().Connect(countProcs[uniqStrRunSet].Out("count"))
+			targetDataCounts.InResults().Connect(countProcs[uniqStrRunSet].Out("count"))
 		} // end: runset
 	} // end: for gene
 
-	sts := spc.NewStreamToSubStream(wf, "merge_plots_stream_to_substream")
-	for _, calibPlotPort := range calibPlotPorts {
-		sts.In().Connect(calibPlotPort)
+	// --------------------------------
+	// Set up gene-specific conformal regression branches
+	// --------------------------------
+	if *regression {
+		regressionSummary := NewRegressionSummarizer(wf, "regression_summary_creator", "res/regression_summary.tsv", 0.8, 0.9)
+		finalModelsSummary.InRegression().Connect(regressionSummary.OutSummary())
+		report.InRegression().Connect(regressionSummary.OutSummary())
+
+		for _, geneUppercase := range genes {
+			geneLowerCase := str.ToLower(geneUppercase)
+			uniqStrGene := geneLowerCase
+
+			extractRegressionData := NewExtractRegressionData(wf, "extract_regression_data_"+uniqStrGene, func(t *sp.Task) string {
+				gene := str.ToLower(t.Param("gene"))
+				return "dat/" + gene + "/" + gene + ".pxc50.tsv"
+			})
+			extractRegressionData.InGSPA().Connect(remDrugBankCompsPXC50.Out("gspa_wo_drugbank"))
+			extractRegressionData.InGene().ConnectStr(geneUppercase)
+			if sched != nil {
+				sched.Annotate(extractRegressionData.Process, "extract")
+			}
+			failurePolicy.Annotate(extractRegressionData.Process, "extract")
+
+			extractRegressionValData := NewExtractRegressionData(wf, "extract_regression_validation_data_"+uniqStrGene, func(t *sp.Task) string {
+				gene := str.ToLower(t.Param("gene"))
+				return "dat/validate_regression/" + gene + "/" + gene + ".pxc50.validation_data.tsv"
+			})
+			extractRegressionValData.InGSPA().Connect(extractValidationRawdataPXC50.Out("drugbank_removed"))
+			extractRegressionValData.InGene().ConnectStr(geneUppercase)
+			if sched != nil {
+				sched.Annotate(extractRegressionValData.Process, "extract")
+			}
+			failurePolicy.Annotate(extractRegressionValData.Process, "extract")
+
+			for i, replicate := range replicates {
+				seed := i + 1
+				uniqStrRepl := uniqStrGene + "_" + replicate
+
+				// Pre-compute step ----------------------------------------------
+				regPrecomp := wf.NewProc("cpsign_precomp_regression_"+uniqStrRepl, sched.JavaCmd("precompute")+` -jar `+cpSignPath+` precompute \
+									--license `+cpSignLicensePath+`\
+									--model-type regression \
+									--train-data CSV delim:'\t' {i:traindata} \
+									--endpoint 'pxc50' \
+									--model-out {o:precomp} \
+									--model-name "`+geneUppercase+`" \
+									--logfile {o:logfile} # {p:gene} {p:replicate}`)
+				regPrecomp.In("traindata").Connect(extractRegressionData.OutData())
+				regPrecomp.ParamInPort("gene").ConnectStr(geneLowerCase)
+				regPrecomp.ParamInPort("replicate").ConnectStr(replicate)
+				regPrecompPathFunc := func(t *sp.Task) string {
+					gene := t.Param("gene")
+					repl := t.Param("replicate")
+					return "dat/regression/" + gene + "/" + repl + "/" + gene + "." + repl + ".pxc50.precomp"
+				}
+				regPrecomp.SetPathCustom("precomp", regPrecompPathFunc)
+				regPrecomp.SetPathCustom("logfile", func(t *sp.Task) string {
+					return regPrecompPathFunc(t) + ".cpsign.log"
+				})
+				if slurm != nil {
+					slurm.Apply(regPrecomp, "precompute", "", 1)
+				}
+				if sched != nil {
+					sched.Annotate(regPrecomp, "precompute")
+				}
+				failurePolicy.Annotate(regPrecomp, "precompute")
+				if k8s != nil {
+					k8s.Apply(regPrecomp, "precompute")
+				}
+
+				// Optimize cost step --------------------------------------------
+				selectRegCost := NewRegressionCostSelector(wf,
+					"select_regression_cost_"+uniqStrRepl,
+					"dat/regression/"+geneLowerCase+"/"+replicate+"/"+geneLowerCase+"_regression_cost_perf_stats.tsv",
+					0.8)
+				for _, cost := range regCosts {
+					uniqStrCost := uniqStrRepl + "_" + cost
+					regCrossVal := wf.NewProc("crossval_regression_"+uniqStrCost, cpSignRegressionCrossValCmd(sched.JavaCmd("crossval")))
+					regCrossValStatsPathFunc := func(t *sp.Task) string {
+						cost, err := strconv.ParseInt(t.Param("cost"), 10, 0)
+						sp.Check(err)
+						gene := str.ToLower(t.Param("gene"))
+						repl := t.Param("replicate")
+						return "dat/regression/" + gene + "/" + repl + "/" + fmt.Sprintf("%s.%s.linsvr_c%03d", gene, repl, cost) + ".cvstats.json"
+					}
+					regCrossVal.SetPathCustom("stats", regCrossValStatsPathFunc)
+					regCrossVal.SetPathCustom("logfile", func(t *sp.Task) string {
+						return regCrossValStatsPathFunc(t) + ".cpsign.log"
+					})
+					regCrossVal.In("traindata").Connect(extractRegressionData.OutData())
+					regCrossVal.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
+					regCrossVal.ParamInPort("nrmdl").ConnectStr("10")
+					regCrossVal.ParamInPort("cvfolds").ConnectStr("10")
+					regCrossVal.ParamInPort("confidences").ConnectStr("0.8, 0.9")
+					regCrossVal.ParamInPort("gene").ConnectStr(geneUppercase)
+					regCrossVal.ParamInPort("replicate").ConnectStr(replicate)
+					regCrossVal.ParamInPort("cost").ConnectStr(cost)
+					if slurm != nil {
+						slurm.Apply(regCrossVal, "crossval", "crossval_regression_"+uniqStrRepl, len(regCosts))
+					}
+					if sched != nil {
+						sched.Annotate(regCrossVal, "crossval")
+					}
+					failurePolicy.Annotate(regCrossVal, "crossval")
+					if k8s != nil {
+						k8s.Apply(regCrossVal, "crossval")
+					}
+					selectRegCost.InCrossValStats().Connect(regCrossVal.Out("stats"))
+				}
+
+				// Train step ----------------------------------------------------
+				regTrain := wf.NewProc("cpsign_train_regression_"+uniqStrRepl,
+					sched.JavaCmd("train")+` -jar `+cpSignPath+` train \
+									--license `+cpSignLicensePath+` \
+									--seed {p:seed} \
+									--ptype 2 \
+									--model-in {i:model} \
+									--impl LinearSVR:{p:cost} \
+									--sampling-strategy random:numSamples={p:nrmdl}:calibRatio=0.2 \
+									--model-out {o:model} \
+									--logfile {o:logfile} \
+									--model-name "{p:gene}" # {p:replicate} RMSE: {p:cv_rmse} Median width: {p:cv_width}`)
+				regTrain.In("model").Connect(regPrecomp.Out("precomp"))
+				regTrain.ParamInPort("seed").ConnectStr(fmt.Sprintf("%d", seed))
+				regTrain.ParamInPort("nrmdl").ConnectStr("10")
+				regTrain.ParamInPort("gene").ConnectStr(geneUppercase)
+				regTrain.ParamInPort("replicate").ConnectStr(replicate)
+				regTrain.ParamInPort("cost").Connect(selectRegCost.OutBestCost())
+				regTrain.ParamInPort("cv_rmse").Connect(selectRegCost.OutBestRMSE())
+				regTrain.ParamInPort("cv_width").Connect(selectRegCost.OutBestWidth())
+				regTrainModelPathFunc := func(t *sp.Task) string {
+					return fmt.Sprintf("dat/final_models_regression/%s/%s/%s.%s.%s_c%s_nrmdl%s.mdl.jar",
+						str.ToLower(t.Param("gene")),
+						t.Param("replicate"),
+						str.ToLower(t.Param("gene")),
+						t.Param("replicate"),
+						"linsvr",
+						t.Param("cost"),
+						t.Param("nrmdl"))
+				}
+				regTrain.SetPathCustom("model", regTrainModelPathFunc)
+				regTrain.SetPathCustom("logfile", func(t *sp.Task) string {
+					return regTrainModelPathFunc(t) + ".cpsign.log"
+				})
+				if slurm != nil {
+					slurm.Apply(regTrain, "train", "", 1)
+				}
+				if sched != nil {
+					sched.Annotate(regTrain, "train")
+				}
+				failurePolicy.Annotate(regTrain, "train")
+				if k8s != nil {
+					k8s.Apply(regTrain, "train")
+				}
+				regressionSummary.InModel().Connect(regTrain.Out("model"))
+				report.InModels().Connect(regTrain.Out("model"))
+
+				// Validate step -------------------------------------------------
+				regValidate := wf.NewProc("validate_regression_"+uniqStrRepl, sched.JavaCmd("validate")+` -jar `+cpSignPath+` validate \
+									--license `+cpSignLicensePath+` \
+									--model-in {i:model} \
+									--predict-file CSV delim:'\t' {i:data} \
+									--validation-endpoint pxc50 \
+									--calibration-points {p:confidences} \
+									--logfile {o:log} \
+									--print-predictions \
+									--output-format json \
+									--output {o:json} # {p:gene} {p:replicate}`)
+				regValidateJSONPathFunc := func(t *sp.Task) string {
+					uniqStrGeneRepl := str.ToLower(t.Param("gene")) + "." + t.Param("replicate")
+					return "dat/validate_regression/" + uniqStrGeneRepl + "/" + uniqStrGeneRepl + ".validate_regression_drugbank.json"
+				}
+				regValidate.SetPathCustom("json", regValidateJSONPathFunc)
+				regValidate.SetPathCustom("log", func(t *sp.Task) string {
+					return regValidateJSONPathFunc(t) + ".cpsign.log"
+				})
+				regValidate.In("model").Connect(regTrain.Out("model"))
+				regValidate.In("data").Connect(extractRegressionValData.OutData())
+				regValidate.ParamInPort("gene").ConnectStr(geneUppercase)
+				regValidate.ParamInPort("replicate").ConnectStr(replicate)
+				regValidate.ParamInPort("confidences").ConnectStr("0.8, 0.9")
+				if k8s != nil {
+					k8s.Apply(regValidate, "validate")
+				}
+				if sched != nil {
+					sched.Annotate(regValidate, "validate")
+				}
+				failurePolicy.Annotate(regValidate, "validate")
+				regressionSummary.InValidation().Connect(regValidate.Out("json"))
+			} // end: for replicate
+		} // end: for gene
 	}
-	mergeCalibPlots := wf.NewProc("merge_calibration_plots", "montage -tile 7x -geometry +2+2 {i:plots:r: } {o:merged}")
-	mergeCalibPlots.SetPathStatic("merged", "dat/calibration_plots.png")
-	mergeCalibPlots.In("plots").Connect(sts.OutSubStream())
 
 	sortSummaryOnDataSize := wf.NewProc("sort_summary", "head -n 1 {i:summary} > {o:sorted} && tail -n +2 {i:summary} | sort -k 17n,17 -k 2,2 -k 3r,3 >> {o:sorted}")
 	sortSummaryOnDataSize.SetPathReplace("summary", "sorted", ".tsv", ".sorted.tsv")
 	sortSummaryOnDataSize.In("summary").Connect(finalModelsSummary.OutSummary())
+	report.InSummary().Connect(sortSummaryOnDataSize.Out("sorted"))
 
 	for _, runSet := range runSets {
-		plotSummary := wf.NewProc("plot_summary_"+runSet, "Rscript bin/plot_summary.r -i {i:summary} -o {o:plot} -f pdf # gene:{i:gene_smiles_activity} runset:{p:runset}")
-		plotSummary.SetPathExtend("summary", "plot", "."+runSet+".pdf")
+		plotSummary := NewPlotSummary(wf, "plot_summary_"+runSet, *plotFormat)
+		plotSummary.SetPathExtend("summary", "plot", "."+runSet+"."+*plotFormat)
 		plotSummary.In("summary").Connect(sortSummaryOnDataSize.Out("sorted"))
-		plotSummary.In("gene_smiles_activity").Connect(remDrugBankComps.Out("gisa_wo_drugbank"))
 		plotSummary.ParamInPort("runset").ConnectStr(runSet)
+		report.InPlots().Connect(plotSummary.Out("plot"))
+	}
+
+	if *learningCurve {
+		plotLearningCurve := NewPlotLearningCurve(wf, "plot_learningcurve", *plotFormat)
+		plotLearningCurve.SetPathExtend("summary", "plot", "."+*plotFormat)
+		plotLearningCurve.In("summary").Connect(lcSummary.OutSummary())
+		report.InPlots().Connect(plotLearningCurve.Out("plot"))
 	}
 
 	// --------------------------------
 	// Run the pipeline!
 	// --------------------------------
-	//if *graph {
-	//	wf.PlotGraph("wo_drugbank_wf.dot", true, true)
-	//} else {
+	if !genesChecked {
+		// Only the processes making ExCAPE-DB can be run before the genes
+		// are resolved against it
+		excapeDBProcs := []string{dlExcapeDB.Name(), unPackDB.Name(), extractExcapeGenes.Name()}
+		procsPtn, err := regexp.Compile(*procsRegex)
+		sp.CheckWithMsg(err, "Regex pattern doesn't work: "+*procsRegex)
+		for procName := range wf.Procs() {
+			if procsPtn.MatchString(procName) && !strInSlice(procName, excapeDBProcs) {
+				sp.Failf("Neither the ExCAPE-DB gene list (%s), nor ExCAPE-DB (%s), exists yet, to resolve the genes of the panel against. Run with -procs %s first\n", excapeGenesPath, excapeDBPath, extractExcapeGenes.Name())
+			}
+		}
+	}
+	if *plan {
+		printPlan(os.Stdout, newWorkflowPlanner(wf, NewTaskCache(*explain, cpSignPath)).PlanToRegex(*procsRegex))
+		return
+	}
+	if *graph {
+		g := newWorkflowGraph(wf, *procsRegex, genes, *graphCollapse, *graphGene, readFailedTasks(*failureReport, failureLogDir))
+		graphFile, graphData := "wo_drugbank_wf.dot", g.DOT()
+		if *graphFormat == graphFormatMermaid {
+			graphFile, graphData = "wo_drugbank_wf.mmd", g.Mermaid()
+		}
+		sp.CheckWithMsg(ioutil.WriteFile(graphFile, graphData, 0644), "Could not write workflow graph: "+graphFile)
+		sp.Audit.Printf("Wrote workflow graph to %s\n", graphFile)
+		return
+	}
+	sp.CheckWithMsg(os.MkdirAll("res", 0755), "Could not create directory: res")
+	writeGeneResolutions("res/gene_resolution.tsv", geneResolutions)
+	if sched != nil {
+		sched.Apply(wf)
+	}
+	metricsLog = NewMetricsLog(*runLog)
+	metricsLog.Apply(wf)
+	failurePolicy.Apply(wf)
+	taskCache = NewTaskCache(*explain, cpSignPath)
+	taskCache.Apply(wf)
 	wf.RunToRegex(*procsRegex)
-	//}
+	taskCache.PrintSummary()
+	metricsLog.Close()
+	sp.Audit.Printf("Appended task metrics to %s\n", *runLog)
+	failurePolicy.RemovePlaceholders()
+	if failurePolicy.HasFailures() {
+		failurePolicy.WriteReport(*failureReport)
+		sp.Failf("Some targets failed, and were left out. See the failure report: %s\n", *failureReport)
+	}
 }
 
 // --------------------------------------------------------------------------------
@@ -625,6 +1320,41 @@ type cpSignCrossValOutput struct {
 	ObservedFuzziness float64 `json:"observedFuzziness"`
 }
 
+// cpSignCrossValCmd returns the command pattern for crossvalidating a model
+// with a given cost, optionally with (assumed non-active) data only used for
+// training the models (not for calibration or testing), run with javaCmd
+func cpSignCrossValCmd(includeModelData bool, javaCmd string) string {
+	cmd := javaCmd + ` -jar ` + cpSignPath + ` crossvalidate \
+									--license ` + cpSignLicensePath + `\
+									--predictor-type ACP_Classification \
+									--seed {p:seed} \
+									--scorer LinearSVC:cost={p:cost} \
+									--train-data CSV header:smiles,activity delim:'\t' {i:traindata} \
+									--endpoint activity \
+									--labels A, N \
+									--sampling-strategy random:numSamples={p:nrmdl}:calibRatio=0.2 \
+									--cv-folds {p:cvfolds} \
+									--result-format json \
+									--result-output {o:stats} \
+									--logfile {o:logfile}`
+	if includeModelData {
+		cmd += ` \
+									--model-data CSV header:smiles,activity delim:'\t' {i:propertraindata}`
+	}
+	cmd += ` \
+									--calibration-points "{p:confidences}" # {p:gene} {p:runset} {p:replicate}`
+	return cmd
+}
+
+// removeDrugBankCompsCmd returns the command pattern for removing the
+// DrugBank compounds from a table of gene, compound ID, SMILES and a value,
+// on the dataPort in-port. The compounds are removed by ID, and by the
+// structures of their IDs in the table of all IDs on the allIDsPort in-port,
+// so that no other ID of a held-out structure is left.
+func removeDrugBankCompsCmd(allIDsPort string, dataPort string, outPort string) string {
+	return fmt.Sprintf(`awk -F"\t" 'FILENAME == ARGV[1] { db[$1]; next } FILENAME == ARGV[2] { if ( $2 in db ) { dbsmiles[$3] }; next } !( $2 in db ) && !( $3 in dbsmiles )' {i:compids_to_remove} {i:%s} {i:%s} | sort -uV > {o:%s}`, allIDsPort, dataPort, outPort)
+}
+
 func strInSlice(searchStr string, strings []string) bool {
 	for _, str := range strings {
 		if searchStr == str {
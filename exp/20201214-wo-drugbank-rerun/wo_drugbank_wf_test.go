@@ -0,0 +1,22 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCostsOf(t *testing.T) {
+	tests := []struct {
+		gene string
+		want []string
+	}{
+		{"AVPR1A", []string{"100"}},
+		{"DRD1", []string{"1"}},
+		{"GRIN1", []string{"1", "10", "100"}}, // Not in costsPerTarget
+	}
+	for _, tt := range tests {
+		if got := costsOf(tt.gene); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("costsOf(%q) = %v, want %v", tt.gene, got, tt.want)
+		}
+	}
+}
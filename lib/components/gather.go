@@ -0,0 +1,218 @@
+// Package components holds SciPipe components shared by the experiments of
+// the project
+package components
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	str "strings"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// TableGatherer is a SciPipe component gathering the results of many upstream
+// tasks, such as one per gene, into one table, instead of having the tasks
+// append to a shared file. The table is written only when all results are
+// received, to a temp file that is then atomized, with the rows sorted by
+// their keys, so the table is the same regardless of the order the tasks
+// finish in.
+//
+// The keys of a row are the KeyParams of the task that made the result (such
+// as "gene" and "runset"). A result file either has one "NAME<tab>VALUE" line
+// per value, giving the columns of the table in the order they are first seen,
+// or, if ValueCols is set, the values of those columns on its first line, as
+// in the output of an awk count like `print a "\t" n`. Values missing for a
+// row are written as NA.
+//
+// Received results for which SkipIP, if set, returns true, such as the
+// placeholders of failed tasks, are left out of the table. If Cache is set,
+// it decides whether an existing table can be kept, and otherwise the table
+// is kept whenever it exists.
+type TableGatherer struct {
+	sp.BaseProcess
+	TableFileName string
+	KeyParams     []string
+	ValueCols     []string
+	Separator     rune
+	SkipIP        func(procName string, ip *sp.FileIP) bool
+	Cache         ComponentCache
+}
+
+// ComponentCache decides whether the output of a component, made from the
+// given parameters and inputs, is up to date, and stores what the output was
+// made from when it is written
+type ComponentCache interface {
+	ComponentUpToDate(procName string, path string, params map[string]string, inIPs []*sp.FileIP) bool
+	StoreComponent(procName string, path string, tempPath string, params map[string]string, inIPs []*sp.FileIP)
+}
+
+func NewTableGatherer(wf *sp.Workflow, procName string, fileName string, keyParams []string, valueCols ...string) *TableGatherer {
+	if len(keyParams) == 0 {
+		sp.Failf("| %-32s | A table gatherer needs at least one key parameter\n", procName)
+	}
+	p := &TableGatherer{
+		BaseProcess:   sp.NewBaseProcess(wf, procName),
+		TableFileName: fileName,
+		KeyParams:     keyParams,
+		ValueCols:     valueCols,
+		Separator:     '\t',
+	}
+	p.InitInPort(p, "results")
+	p.InitOutPort(p, "table")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *TableGatherer) InResults() *sp.InPort { return p.InPort("results") }
+func (p *TableGatherer) OutTable() *sp.OutPort { return p.OutPort("table") }
+
+// gatheredRow holds the keys and values of one result
+type gatheredRow struct {
+	keys   []string
+	values map[string]string
+	cols   []string
+}
+
+func (p *TableGatherer) Run() {
+	defer p.OutTable().Close()
+
+	iips := []*sp.FileIP{}
+	for iip := range p.InResults().Chan {
+		if p.SkipIP != nil && p.SkipIP(p.Name(), iip) {
+			continue
+		}
+		iips = append(iips, iip)
+	}
+
+	oip := sp.NewFileIP(p.TableFileName)
+	cacheParams := map[string]string{
+		"key_params": str.Join(p.KeyParams, ","),
+		"value_cols": str.Join(p.ValueCols, ","),
+		"separator":  string(p.Separator),
+	}
+	if p.upToDate(oip, cacheParams, iips) {
+		sp.Info.Printf("Process %s: Out-target %s is up to date, so skipping\n", p.Name(), oip.Path())
+	} else {
+		rows := []*gatheredRow{}
+		seen := map[string]string{}
+		for _, iip := range iips {
+			row := &gatheredRow{values: map[string]string{}}
+			for _, param := range p.KeyParams {
+				row.keys = append(row.keys, iip.Param(param))
+			}
+			key := str.Join(row.keys, "\t")
+			if prevPath, ok := seen[key]; ok {
+				sp.Failf("| %-32s | Results %s and %s have the same keys (%s)\n", p.Name(), prevPath, iip.Path(), str.Join(row.keys, ", "))
+			}
+			seen[key] = iip.Path()
+			p.readValues(iip, row)
+			rows = append(rows, row)
+		}
+		sort.Slice(rows, func(i, j int) bool {
+			return LessKeys(rows[i].keys, rows[j].keys)
+		})
+
+		// Columns in the order they are first seen, in the sorted rows
+		cols := append([]string{}, p.ValueCols...)
+		seenCol := map[string]bool{}
+		for _, col := range cols {
+			seenCol[col] = true
+		}
+		for _, row := range rows {
+			for _, col := range row.cols {
+				if !seenCol[col] {
+					seenCol[col] = true
+					cols = append(cols, col)
+				}
+			}
+		}
+
+		fh := oip.OpenWriteTemp()
+		tsvWriter := csv.NewWriter(fh)
+		tsvWriter.Comma = p.Separator
+		header := []string{}
+		for _, param := range p.KeyParams {
+			header = append(header, str.Title(param))
+		}
+		tsvWriter.Write(append(header, cols...))
+		for _, row := range rows {
+			out := append([]string{}, row.keys...)
+			for _, col := range cols {
+				val, ok := row.values[col]
+				if !ok {
+					val = "NA"
+				}
+				out = append(out, val)
+			}
+			tsvWriter.Write(out)
+		}
+		tsvWriter.Flush()
+		sp.CheckWithMsg(tsvWriter.Error(), "Could not write table: "+oip.TempPath())
+		fh.Close()
+		if p.Cache != nil {
+			p.Cache.StoreComponent(p.Name(), oip.Path(), oip.TempPath(), cacheParams, iips)
+		}
+		oip.Atomize()
+		sp.Audit.Printf("| %-32s | Gathered %d results into %s\n", p.Name(), len(rows), oip.Path())
+	}
+	p.OutTable().Send(oip)
+}
+
+// upToDate tells whether the table can be kept, as decided by the cache, or
+// without a cache, whether it exists
+func (p *TableGatherer) upToDate(oip *sp.FileIP, cacheParams map[string]string, iips []*sp.FileIP) bool {
+	if p.Cache != nil {
+		return p.Cache.ComponentUpToDate(p.Name(), oip.Path(), cacheParams, iips)
+	}
+	return oip.Exists()
+}
+
+// readValues reads the values of a result file into a row
+func (p *TableGatherer) readValues(iip *sp.FileIP, row *gatheredRow) {
+	scanner := bufio.NewScanner(bytes.NewReader(iip.Read()))
+	if len(p.ValueCols) > 0 {
+		line := ""
+		if scanner.Scan() {
+			line = str.TrimRight(scanner.Text(), "\r")
+		}
+		fields := str.Split(line, "\t")
+		if line == "" || len(fields) != len(p.ValueCols) {
+			sp.Failf("| %-32s | Expected %d values (%s) on the first line of %s, but got: %q\n", p.Name(), len(p.ValueCols), str.Join(p.ValueCols, ", "), iip.Path(), line)
+		}
+		for i, col := range p.ValueCols {
+			row.values[col] = fields[i]
+		}
+		row.cols = p.ValueCols
+		return
+	}
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := str.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		parts := str.SplitN(line, "\t", 2)
+		if len(parts) != 2 {
+			sp.Failf("| %-32s | Expected a NAME<tab>VALUE line on line %d of %s, but got: %q\n", p.Name(), lineNo, iip.Path(), line)
+		}
+		if _, ok := row.values[parts[0]]; ok {
+			sp.Failf("| %-32s | Value %s given twice in %s\n", p.Name(), parts[0], iip.Path())
+		}
+		row.values[parts[0]] = parts[1]
+		row.cols = append(row.cols, parts[0])
+	}
+	sp.CheckWithMsg(scanner.Err(), fmt.Sprintf("Could not read result file: %s", iip.Path()))
+}
+
+// LessKeys orders rows by their keys, one at a time, as used to sort the
+// gathered tables
+func LessKeys(a []string, b []string) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
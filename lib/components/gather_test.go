@@ -0,0 +1,102 @@
+package components
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	sp "github.com/scipipe/scipipe"
+)
+
+// inTempDir runs f in a new temp dir, for workflows writing relative paths
+func inTempDir(t *testing.T, f func()) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gather_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	f()
+}
+
+func TestTableGatherer(t *testing.T) {
+	sp.InitLogError()
+	tests := []struct {
+		name      string
+		results   map[string]string // Contents by gene
+		valueCols []string
+		skip      string // Gene to skip
+		want      string
+	}{
+		{
+			name:      "value columns",
+			results:   map[string]string{"DRD2": "10\t20\n", "ADRA1A": "1\t2\n", "CHRM1": "3\t4\n"},
+			valueCols: []string{"ActiveCnt", "NonactiveCnt"},
+			want:      "Gene\tActiveCnt\tNonactiveCnt\nADRA1A\t1\t2\nCHRM1\t3\t4\nDRD2\t10\t20\n",
+		},
+		{
+			name:    "name and value lines, with missing values",
+			results: map[string]string{"DRD2": "Human\t5\nRat\t2\n", "ADRA1A": "Human\t7\nMouse\t1\n"},
+			want:    "Gene\tHuman\tMouse\tRat\nADRA1A\t7\t1\tNA\nDRD2\t5\tNA\t2\n",
+		},
+		{
+			name:      "skipped results",
+			results:   map[string]string{"DRD2": "10\n", "ADRA1A": "1\n"},
+			valueCols: []string{"Count"},
+			skip:      "DRD2",
+			want:      "Gene\tCount\nADRA1A\t1\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inTempDir(t, func() {
+				wf := sp.NewWorkflow("gather_test", 4)
+				gatherer := NewTableGatherer(wf, "gather", "table.tsv", []string{"gene"}, tt.valueCols...)
+				gatherer.SkipIP = func(procName string, ip *sp.FileIP) bool {
+					return ip.Param("gene") == tt.skip
+				}
+				for gene, contents := range tt.results {
+					if err := ioutil.WriteFile(gene+".txt", []byte(contents), 0644); err != nil {
+						t.Fatal(err)
+					}
+					result := wf.NewProc("result_"+gene, "cat {p:gene}.txt > {o:result}")
+					result.SetPathStatic("result", gene+".result.txt")
+					result.ParamInPort("gene").ConnectStr(gene)
+					gatherer.InResults().Connect(result.Out("result"))
+				}
+				wf.Run()
+				table, err := ioutil.ReadFile("table.tsv")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(table) != tt.want {
+					t.Errorf("Gathered table = %q, want %q", table, tt.want)
+				}
+			})
+		})
+	}
+}
+
+func TestLessKeys(t *testing.T) {
+	tests := []struct {
+		a, b []string
+		want bool
+	}{
+		{[]string{"ADRA1A", "fill"}, []string{"DRD2", "assumed"}, true},
+		{[]string{"DRD2", "assumed"}, []string{"DRD2", "fill"}, true},
+		{[]string{"DRD2", "fill"}, []string{"DRD2", "fill"}, false},
+		{[]string{"DRD2", "fill"}, []string{"ADRA1A", "fill"}, false},
+	}
+	for _, tt := range tests {
+		if got := LessKeys(tt.a, tt.b); got != tt.want {
+			t.Errorf("LessKeys(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
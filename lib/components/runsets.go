@@ -0,0 +1,157 @@
+package components
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/pharmbio/ptp-project/lib/stats"
+	sp "github.com/scipipe/scipipe"
+)
+
+// RunsetComparison is a SciPipe component comparing two runsets (such as
+// "orig" and "fill") in a final models summary, with paired tests over genes.
+// Values are first averaged over replicates per gene and runset. For each
+// metric, a paired Wilcoxon signed-rank test and a paired t-test is done on
+// the differences (RunSetB - RunSetA), together with effect sizes, and all
+// p-values in the output are also corrected for multiple testing (Holm and
+// Benjamini-Hochberg).
+type RunsetComparison struct {
+	sp.BaseProcess
+	StatsFileName string
+	RunSetA       string
+	RunSetB       string
+	Alternative   string // One of two.sided, less or greater, for RunSetB compared to RunSetA
+	Metrics       []string
+}
+
+func NewRunsetComparison(wf *sp.Workflow, procName string, fileName string, runSetA string, runSetB string, alternative string, metrics ...string) *RunsetComparison {
+	if alternative != stats.AltTwoSided && alternative != stats.AltLess && alternative != stats.AltGreater {
+		sp.Failf("| %-32s | Unknown alternative hypothesis: %s\n", procName, alternative)
+	}
+	p := &RunsetComparison{
+		BaseProcess:   sp.NewBaseProcess(wf, procName),
+		StatsFileName: fileName,
+		RunSetA:       runSetA,
+		RunSetB:       runSetB,
+		Alternative:   alternative,
+		Metrics:       metrics,
+	}
+	p.InitInPort(p, "summary")
+	p.InitOutPort(p, "stats")
+	wf.AddProc(p)
+	return p
+}
+
+func (p *RunsetComparison) InSummary() *sp.InPort { return p.InPort("summary") }
+func (p *RunsetComparison) OutStats() *sp.OutPort { return p.OutPort("stats") }
+
+func (p *RunsetComparison) Run() {
+	defer p.OutStats().Close()
+
+	// metric -> runset -> gene -> values (one per replicate)
+	values := map[string]map[string]map[string][]float64{}
+	for sip := range p.InSummary().Chan {
+		tsvReader := csv.NewReader(bytes.NewReader(sip.Read()))
+		tsvReader.Comma = '\t'
+		rows, err := tsvReader.ReadAll()
+		sp.CheckWithMsg(err, "Could not read final models summary: "+sip.Path())
+		if len(rows) < 2 {
+			continue
+		}
+		col := map[string]int{}
+		for i, name := range rows[0] {
+			col[name] = i
+		}
+		for _, metric := range p.Metrics {
+			if _, ok := col[metric]; !ok {
+				sp.Audit.Printf("| %-32s | Column %s not found in summary, so skipping it\n", p.Name(), metric)
+				continue
+			}
+			if values[metric] == nil {
+				values[metric] = map[string]map[string][]float64{p.RunSetA: {}, p.RunSetB: {}}
+			}
+			for _, row := range rows[1:] {
+				perGene, ok := values[metric][row[col["Runset"]]]
+				if !ok {
+					continue
+				}
+				val, err := strconv.ParseFloat(row[col[metric]], 64)
+				if err != nil {
+					continue // NA values and similar
+				}
+				perGene[row[col["Gene"]]] = append(perGene[row[col["Gene"]]], val)
+			}
+		}
+	}
+
+	rows := [][]string{}
+	pValues := []float64{}
+	for _, metric := range p.Metrics {
+		if values[metric] == nil {
+			continue
+		}
+		a, b := pairedGeneMeans(values[metric][p.RunSetA], values[metric][p.RunSetB])
+		if len(a) < 2 {
+			sp.Audit.Printf("| %-32s | Too few genes in both runsets for %s, so skipping it\n", p.Name(), metric)
+			continue
+		}
+		diffs := make([]float64, len(a))
+		for i := range a {
+			diffs[i] = b[i] - a[i]
+		}
+		common := []string{metric, p.RunSetA, p.RunSetB, p.Alternative, fmt.Sprintf("%d", len(a)), FmtFloat(stats.Mean(a)), FmtFloat(stats.Mean(b)), FmtFloat(stats.Mean(diffs))}
+
+		v, wp, rbc := stats.WilcoxonSignedRank(diffs, p.Alternative)
+		rows = append(rows, append(append([]string{}, common...), "wilcoxon_signed_rank", "V", FmtFloat(v), FmtFloat(wp), "rank_biserial", FmtFloat(rbc)))
+		pValues = append(pValues, wp)
+
+		t, tp, dz := stats.PairedTTest(diffs, p.Alternative)
+		rows = append(rows, append(append([]string{}, common...), "paired_t", "t", FmtFloat(t), FmtFloat(tp), "cohens_dz", FmtFloat(dz)))
+		pValues = append(pValues, tp)
+	}
+	holm := stats.HolmAdjust(pValues)
+	bh := stats.BenjaminiHochbergAdjust(pValues)
+
+	oip := sp.NewFileIP(p.StatsFileName)
+	fh := oip.OpenWriteTemp()
+	tsvWriter := csv.NewWriter(fh)
+	tsvWriter.Comma = '\t'
+	tsvWriter.Write([]string{"Metric", "RunsetA", "RunsetB", "Alternative", "Genes", "MeanA", "MeanB", "MeanDiff", "Test", "StatisticName", "Statistic", "PValue", "EffectSizeName", "EffectSize", "PValueHolm", "PValueBH"})
+	for i, row := range rows {
+		tsvWriter.Write(append(row, FmtFloat(holm[i]), FmtFloat(bh[i])))
+	}
+	tsvWriter.Flush()
+	fh.Close()
+	oip.Atomize()
+	p.OutStats().Send(oip)
+}
+
+// pairedGeneMeans returns the per-gene means over replicates, for the genes
+// present in both a and b, sorted on gene name
+func pairedGeneMeans(a map[string][]float64, b map[string][]float64) ([]float64, []float64) {
+	genes := []string{}
+	for gene := range a {
+		if _, ok := b[gene]; ok {
+			genes = append(genes, gene)
+		}
+	}
+	sort.Strings(genes)
+	meansA, meansB := []float64{}, []float64{}
+	for _, gene := range genes {
+		meansA = append(meansA, stats.Mean(a[gene]))
+		meansB = append(meansB, stats.Mean(b[gene]))
+	}
+	return meansA, meansB
+}
+
+// FmtFloat formats v for the tables, with NaN as NA, as in R
+func FmtFloat(v float64) string {
+	if math.IsNaN(v) {
+		return "NA"
+	}
+	return strconv.FormatFloat(v, 'g', 6, 64)
+}
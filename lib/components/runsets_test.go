@@ -0,0 +1,23 @@
+package components
+
+import (
+	"math"
+	"testing"
+)
+
+func TestFmtFloat(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0.5, "0.5"},
+		{1.0 / 3, "0.333333"},
+		{1234567, "1.23457e+06"},
+		{math.NaN(), "NA"},
+	}
+	for _, tt := range tests {
+		if got := FmtFloat(tt.v); got != tt.want {
+			t.Errorf("FmtFloat(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/pharmbio/ptp-project/lib
+
+go 1.15
+
+require github.com/scipipe/scipipe v0.9.10
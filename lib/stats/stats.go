@@ -0,0 +1,311 @@
+// Package stats holds the statistical tests used to compare the models of
+// the experiments, following the corresponding functions in R
+package stats
+
+import (
+	"math"
+	"sort"
+)
+
+// Alternative hypotheses for the paired tests, named as in R
+const (
+	AltTwoSided = "two.sided"
+	AltLess     = "less"
+	AltGreater  = "greater"
+)
+
+// ================================================================================
+// Statistical tests
+// ================================================================================
+
+// Mean returns the arithmetic mean of vals
+func Mean(vals []float64) float64 {
+	sum := 0.0
+	for _, v := range vals {
+		sum += v
+	}
+	return sum / float64(len(vals))
+}
+
+// SampleSD returns the sample standard deviation of vals (with n - 1 in the
+// denominator, as sd in R)
+func SampleSD(vals []float64) float64 {
+	m := Mean(vals)
+	ssq := 0.0
+	for _, v := range vals {
+		ssq += (v - m) * (v - m)
+	}
+	return math.Sqrt(ssq / float64(len(vals)-1))
+}
+
+// Median returns the median of vals, as the mean of the two middle values for
+// an even number of values, and NaN for no values, as median in R
+func Median(vals []float64) float64 {
+	if len(vals) == 0 {
+		return math.NaN()
+	}
+	sorted := append([]float64{}, vals...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// WilcoxonSignedRank does a Wilcoxon signed-rank test on paired differences,
+// following R's wilcox.test(..., paired = TRUE): zero differences are
+// dropped, the exact distribution is used for fewer than 50 differences
+// without ties or zeros, and otherwise the normal approximation with tie and
+// continuity correction. Returns the statistic V (the sum of the ranks of
+// positive differences), the p-value, and the matched-pairs rank-biserial
+// correlation as effect size.
+func WilcoxonSignedRank(diffs []float64, alternative string) (v float64, p float64, rankBiserial float64) {
+	nonZero := []float64{}
+	for _, d := range diffs {
+		if d != 0 {
+			nonZero = append(nonZero, d)
+		}
+	}
+	n := len(nonZero)
+	if n == 0 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	abs := make([]float64, n)
+	for i, d := range nonZero {
+		abs[i] = math.Abs(d)
+	}
+	ranks, tieSizes := averageRanks(abs)
+	for i, d := range nonZero {
+		if d > 0 {
+			v += ranks[i]
+		}
+	}
+	total := float64(n*(n+1)) / 2
+	rankBiserial = (v - (total - v)) / total
+
+	if n < 50 && len(tieSizes) == 0 && n == len(diffs) {
+		// Exact distribution of V, by counting the subsets of 1..n with each rank sum
+		counts := make([]float64, int(total)+1)
+		counts[0] = 1
+		for r := 1; r <= n; r++ {
+			for s := int(total); s >= r; s-- {
+				counts[s] += counts[s-r]
+			}
+		}
+		norm := math.Pow(2, float64(n))
+		cdf := func(x int) float64 { // P(V <= x)
+			sum := 0.0
+			for s := 0; s <= x && s < len(counts); s++ {
+				sum += counts[s]
+			}
+			return sum / norm
+		}
+		vi := int(v)
+		switch alternative {
+		case AltLess:
+			p = cdf(vi)
+		case AltGreater:
+			p = 1 - cdf(vi-1)
+		default:
+			p = math.Min(1, 2*math.Min(cdf(vi), 1-cdf(vi-1)))
+		}
+		return v, p, rankBiserial
+	}
+
+	z := v - float64(n*(n+1))/4
+	tieCorr := 0.0
+	for _, t := range tieSizes {
+		tieCorr += float64(t*t*t - t)
+	}
+	sigma := math.Sqrt(float64(n*(n+1)*(2*n+1))/24 - tieCorr/48)
+	correction := 0.5
+	switch alternative {
+	case AltLess:
+		correction = -0.5
+	case AltTwoSided:
+		// As sign(z) * 0.5 in R
+		if z < 0 {
+			correction = -0.5
+		} else if z == 0 {
+			correction = 0
+		}
+	}
+	z = (z - correction) / sigma
+	switch alternative {
+	case AltLess:
+		p = NormalCDF(z)
+	case AltGreater:
+		p = 1 - NormalCDF(z)
+	default:
+		p = 2 * math.Min(NormalCDF(z), 1-NormalCDF(z))
+	}
+	return v, p, rankBiserial
+}
+
+// averageRanks returns the ranks (1-based, ties given their average rank) of
+// vals, and the sizes of all groups of tied values
+func averageRanks(vals []float64) ([]float64, []int) {
+	idx := make([]int, len(vals))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return vals[idx[i]] < vals[idx[j]] })
+	ranks := make([]float64, len(vals))
+	tieSizes := []int{}
+	for i := 0; i < len(idx); {
+		j := i
+		for j+1 < len(idx) && vals[idx[j+1]] == vals[idx[i]] {
+			j++
+		}
+		for k := i; k <= j; k++ {
+			ranks[idx[k]] = float64(i+j)/2 + 1
+		}
+		if j > i {
+			tieSizes = append(tieSizes, j-i+1)
+		}
+		i = j + 1
+	}
+	return ranks, tieSizes
+}
+
+// PairedTTest does a paired t-test on the differences, and returns the t
+// statistic, the p-value and Cohen's d_z (mean difference divided by the
+// standard deviation of the differences) as effect size
+func PairedTTest(diffs []float64, alternative string) (t float64, p float64, dz float64) {
+	n := len(diffs)
+	sd := SampleSD(diffs)
+	if n < 2 || sd == 0 {
+		return math.NaN(), math.NaN(), math.NaN()
+	}
+	dz = Mean(diffs) / sd
+	t = dz * math.Sqrt(float64(n))
+	df := float64(n - 1)
+	switch alternative {
+	case AltLess:
+		p = StudentTCDF(t, df)
+	case AltGreater:
+		p = 1 - StudentTCDF(t, df)
+	default:
+		p = 2 * StudentTCDF(-math.Abs(t), df)
+	}
+	return t, p, dz
+}
+
+// NormalCDF returns P(Z <= z) for the standard normal distribution
+func NormalCDF(z float64) float64 {
+	return 0.5 * math.Erfc(-z/math.Sqrt2)
+}
+
+// StudentTCDF returns P(T <= t) for Student's t-distribution with df degrees
+// of freedom
+func StudentTCDF(t float64, df float64) float64 {
+	tail := 0.5 * regIncBeta(df/(df+t*t), df/2, 0.5)
+	if t > 0 {
+		return 1 - tail
+	}
+	return tail
+}
+
+// regIncBeta returns the regularized incomplete beta function I_x(a, b),
+// evaluated with a continued fraction (as in Numerical Recipes)
+func regIncBeta(x float64, a float64, b float64) float64 {
+	if x <= 0 {
+		return 0
+	}
+	if x >= 1 {
+		return 1
+	}
+	lga, _ := math.Lgamma(a)
+	lgb, _ := math.Lgamma(b)
+	lgab, _ := math.Lgamma(a + b)
+	front := math.Exp(lgab - lga - lgb + a*math.Log(x) + b*math.Log(1-x))
+	if x < (a+1)/(a+b+2) {
+		return front * betaContFrac(x, a, b) / a
+	}
+	return 1 - front*betaContFrac(1-x, b, a)/b
+}
+
+func betaContFrac(x float64, a float64, b float64) float64 {
+	const tiny = 1e-300
+	c, d := 1.0, 1-(a+b)*x/(a+1)
+	if math.Abs(d) < tiny {
+		d = tiny
+	}
+	d = 1 / d
+	h := d
+	for m := 1; m <= 300; m++ {
+		fm := float64(m)
+		for _, num := range []float64{
+			fm * (b - fm) * x / ((a + 2*fm - 1) * (a + 2*fm)),
+			-(a + fm) * (a + b + fm) * x / ((a + 2*fm) * (a + 2*fm + 1)),
+		} {
+			d = 1 + num*d
+			if math.Abs(d) < tiny {
+				d = tiny
+			}
+			c = 1 + num/c
+			if math.Abs(c) < tiny {
+				c = tiny
+			}
+			d = 1 / d
+			h *= d * c
+		}
+		if math.Abs(d*c-1) < 1e-14 {
+			break
+		}
+	}
+	return h
+}
+
+// ================================================================================
+// Multiple testing correction
+// ================================================================================
+
+// HolmAdjust returns Holm-Bonferroni adjusted p-values. NaN values are kept,
+// and not counted as tests.
+func HolmAdjust(pValues []float64) []float64 {
+	idx := sortedPValueIdx(pValues)
+	adjusted := make([]float64, len(pValues))
+	for i := range adjusted {
+		adjusted[i] = math.NaN()
+	}
+	m := len(idx)
+	runningMax := 0.0
+	for k, i := range idx {
+		runningMax = math.Max(runningMax, math.Min(1, float64(m-k)*pValues[i]))
+		adjusted[i] = runningMax
+	}
+	return adjusted
+}
+
+// BenjaminiHochbergAdjust returns Benjamini-Hochberg (false discovery rate)
+// adjusted p-values. NaN values are kept, and not counted as tests.
+func BenjaminiHochbergAdjust(pValues []float64) []float64 {
+	idx := sortedPValueIdx(pValues)
+	adjusted := make([]float64, len(pValues))
+	for i := range adjusted {
+		adjusted[i] = math.NaN()
+	}
+	m := len(idx)
+	runningMin := 1.0
+	for k := m - 1; k >= 0; k-- {
+		i := idx[k]
+		runningMin = math.Min(runningMin, float64(m)/float64(k+1)*pValues[i])
+		adjusted[i] = runningMin
+	}
+	return adjusted
+}
+
+// sortedPValueIdx returns the indices of the non-NaN p-values, in increasing
+// order of p-value
+func sortedPValueIdx(pValues []float64) []int {
+	idx := []int{}
+	for i, p := range pValues {
+		if !math.IsNaN(p) {
+			idx = append(idx, i)
+		}
+	}
+	sort.SliceStable(idx, func(i, j int) bool { return pValues[idx[i]] < pValues[idx[j]] })
+	return idx
+}
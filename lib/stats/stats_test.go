@@ -0,0 +1,175 @@
+package stats
+
+import (
+	"math"
+	"testing"
+)
+
+// The expected values are those of R (wilcox.test, t.test and p.adjust, with
+// the t-test p-values as printed by R). The depression data is from the
+// examples of wilcox.test, and the sleep data is the sleep dataset in R.
+var (
+	depressionX = []float64{1.83, 0.50, 1.62, 2.48, 1.68, 1.88, 1.55, 3.06, 1.30}
+	depressionY = []float64{0.878, 0.647, 0.598, 2.05, 1.06, 1.29, 1.06, 3.14, 1.29}
+	sleepGroup1 = []float64{0.7, -1.6, -0.2, -1.2, -0.1, 3.4, 3.7, 0.8, 0.0, 2.0}
+	sleepGroup2 = []float64{1.9, 0.8, 1.1, 0.1, -0.1, 4.4, 5.5, 1.6, 4.6, 3.4}
+)
+
+func diffs(x []float64, y []float64) []float64 {
+	d := make([]float64, len(x))
+	for i := range x {
+		d[i] = x[i] - y[i]
+	}
+	return d
+}
+
+func approxEqual(a float64, b float64, tol float64) bool {
+	if math.IsNaN(a) || math.IsNaN(b) {
+		return math.IsNaN(a) && math.IsNaN(b)
+	}
+	return math.Abs(a-b) <= tol
+}
+
+func TestMedian(t *testing.T) {
+	tests := []struct {
+		vals []float64
+		want float64
+	}{
+		{[]float64{3, 1, 2}, 2},
+		{[]float64{4, 1, 3, 2}, 2.5},
+		{[]float64{5}, 5},
+		{[]float64{}, math.NaN()},
+	}
+	for _, tt := range tests {
+		if got := Median(tt.vals); !approxEqual(got, tt.want, 0) {
+			t.Errorf("Median(%v) = %v, want %v", tt.vals, got, tt.want)
+		}
+	}
+}
+
+func TestWilcoxonSignedRank(t *testing.T) {
+	tests := []struct {
+		name        string
+		diffs       []float64
+		alternative string
+		wantV       float64
+		wantP       float64
+	}{
+		// Exact distribution
+		{"exact, greater", diffs(depressionX, depressionY), AltGreater, 40, 0.01953125},
+		{"exact, two-sided", diffs(depressionX, depressionY), AltTwoSided, 40, 0.0390625},
+		{"exact, less", diffs(depressionX, depressionY), AltLess, 40, 0.986328125},
+		{"exact, small", []float64{1, -2, 3, 4, 5}, AltTwoSided, 13, 0.1875},
+		{"exact, at the center", []float64{1, -2, -3, 4}, AltTwoSided, 5, 1},
+		// Normal approximation, with ties
+		{"ties, two-sided", []float64{1, 2, 2, 3, -1, 4, 5, 5, 6, -2}, AltTwoSided, 49.5, 0.02780183},
+		{"ties, less", []float64{1, 2, 2, 3, -1, 4, 5, 5, 6, -2}, AltLess, 49.5, 0.9893437},
+		{"ties, greater", []float64{1, 2, 2, 3, -1, 4, 5, 5, 6, -2}, AltGreater, 49.5, 0.01390092},
+		// Normal approximation, with zeros (but no ties)
+		{"zeros, two-sided", []float64{0, 1.5, -0.5, 2.5, 3.5, 0, 4.5, -1, 6, 7}, AltTwoSided, 33, 0.04231527},
+		{"zeros, less", []float64{0, 1.5, -0.5, 2.5, 3.5, 0, 4.5, -1, 6, 7}, AltLess, 33, 0.985013},
+		{"zeros, greater", []float64{0, 1.5, -0.5, 2.5, 3.5, 0, 4.5, -1, 6, 7}, AltGreater, 33, 0.02115764},
+		// Normal approximation, with ties and zeros
+		{"sleep", diffs(sleepGroup1, sleepGroup2), AltTwoSided, 0, 0.009090698},
+		{"ties and zeros", []float64{0, 1, 1, -2, 3, 3, 3, 4, 0, -5, 6, 7}, AltGreater, 44, 0.05089971},
+		// Nothing to test
+		{"only zeros", []float64{0, 0, 0}, AltTwoSided, math.NaN(), math.NaN()},
+	}
+	for _, tt := range tests {
+		v, p, _ := WilcoxonSignedRank(tt.diffs, tt.alternative)
+		if !approxEqual(v, tt.wantV, 1e-9) || !approxEqual(p, tt.wantP, 1e-6) {
+			t.Errorf("%s: WilcoxonSignedRank() = V %v, p %v, want V %v, p %v", tt.name, v, p, tt.wantV, tt.wantP)
+		}
+	}
+}
+
+func TestWilcoxonRankBiserial(t *testing.T) {
+	tests := []struct {
+		diffs []float64
+		want  float64
+	}{
+		{[]float64{1, 2, 3}, 1},
+		{[]float64{-1, -2, -3}, -1},
+		{[]float64{1, -2, 3, 4, 5}, 11.0 / 15},
+		{[]float64{1, -1}, 0},
+	}
+	for _, tt := range tests {
+		if _, _, r := WilcoxonSignedRank(tt.diffs, AltTwoSided); !approxEqual(r, tt.want, 1e-12) {
+			t.Errorf("Rank-biserial correlation of %v = %v, want %v", tt.diffs, r, tt.want)
+		}
+	}
+}
+
+func TestPairedTTest(t *testing.T) {
+	tests := []struct {
+		name        string
+		diffs       []float64
+		alternative string
+		wantT       float64
+		wantP       float64
+	}{
+		{"depression, two-sided", diffs(depressionX, depressionY), AltTwoSided, 3.035375, 0.01618},
+		{"sleep, two-sided", diffs(sleepGroup1, sleepGroup2), AltTwoSided, -4.062128, 0.002833},
+		{"sleep, less", diffs(sleepGroup1, sleepGroup2), AltLess, -4.062128, 0.001416},
+		{"sleep, greater", diffs(sleepGroup1, sleepGroup2), AltGreater, -4.062128, 0.9986},
+		{"no variance", []float64{1, 1, 1}, AltTwoSided, math.NaN(), math.NaN()},
+	}
+	for _, tt := range tests {
+		tStat, p, _ := PairedTTest(tt.diffs, tt.alternative)
+		if !approxEqual(tStat, tt.wantT, 1e-6) || !approxEqual(p, tt.wantP, 1e-3*tt.wantP) {
+			t.Errorf("%s: PairedTTest() = t %v, p %v, want t %v, p %v", tt.name, tStat, p, tt.wantT, tt.wantP)
+		}
+	}
+}
+
+func TestPAdjust(t *testing.T) {
+	nan := math.NaN()
+	tests := []struct {
+		name     string
+		pValues  []float64
+		wantHolm []float64
+		wantBH   []float64
+	}{
+		{
+			"sorted",
+			[]float64{0.01, 0.02, 0.03, 0.04, 0.05},
+			[]float64{0.05, 0.08, 0.09, 0.09, 0.09},
+			[]float64{0.05, 0.05, 0.05, 0.05, 0.05},
+		},
+		{
+			"unsorted",
+			[]float64{0.04, 0.001, 0.5, 0.01, 0.03, 0.2},
+			[]float64{0.12, 0.006, 0.5, 0.05, 0.12, 0.4},
+			[]float64{0.06, 0.006, 0.5, 0.03, 0.06, 0.24},
+		},
+		{
+			"capped at one",
+			[]float64{0.5, 0.6},
+			[]float64{1, 1},
+			[]float64{0.6, 0.6},
+		},
+		{
+			// As p.adjust with the default n = length(p[!is.na(p)])
+			"NA values",
+			[]float64{0.01, nan, 0.04},
+			[]float64{0.02, nan, 0.04},
+			[]float64{0.02, nan, 0.04},
+		},
+	}
+	for _, tt := range tests {
+		holm := HolmAdjust(tt.pValues)
+		bh := BenjaminiHochbergAdjust(tt.pValues)
+		for i := range tt.pValues {
+			if !approxEqual(holm[i], tt.wantHolm[i], 1e-12) {
+				t.Errorf("%s: HolmAdjust() = %v, want %v", tt.name, holm, tt.wantHolm)
+				break
+			}
+		}
+		for i := range tt.pValues {
+			if !approxEqual(bh[i], tt.wantBH[i], 1e-12) {
+				t.Errorf("%s: BenjaminiHochbergAdjust() = %v, want %v", tt.name, bh, tt.wantBH)
+				break
+			}
+		}
+	}
+}